@@ -0,0 +1,293 @@
+package nebula
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/cert"
+)
+
+// AdminServiceName is the name every admin socket method is registered under, ie `Nebula.ListHostmap`
+const AdminServiceName = "Nebula"
+
+// AdminArgs are the arguments of every admin socket method, fields a method does not use are ignored
+type AdminArgs struct {
+	// Network selects a network configured under `networks`, the base network is used if empty
+	Network            string `json:"network"`
+	VpnIP              string `json:"vpnIp"`
+	Remote             string `json:"remote"`
+	Pending            bool   `json:"pending"`
+	LocalOnly          bool   `json:"localOnly"`
+	ExcludeLighthouses bool   `json:"excludeLighthouses"`
+}
+
+// AdminService exposes Control over the admin socket as json-rpc 1.0 methods
+type AdminService struct {
+	c      *Control
+	config *Config
+}
+
+func (a *AdminService) control(args *AdminArgs) (*Control, error) {
+	if args.Network == "" {
+		return a.c, nil
+	}
+
+	c := a.c.Network(args.Network)
+	if c == nil {
+		return nil, fmt.Errorf("unknown network: %s", args.Network)
+	}
+	return c, nil
+}
+
+func (a *AdminService) vpnIp(args *AdminArgs) (*Control, uint32, error) {
+	c, err := a.control(args)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	ip := net.ParseIP(args.VpnIP).To4()
+	if ip == nil {
+		return nil, 0, fmt.Errorf("the provided vpn ip could not be parsed: %s", args.VpnIP)
+	}
+	return c, ip2int(ip), nil
+}
+
+// ListHostmap returns every tunnel in the hostmap, or the pending hostmap if args.Pending is set
+func (a *AdminService) ListHostmap(args *AdminArgs, reply *[]ControlHostInfo) error {
+	c, err := a.control(args)
+	if err != nil {
+		return err
+	}
+
+	*reply = c.ListHostmap(args.Pending)
+	return nil
+}
+
+// GetHostInfoByVpnIP returns the tunnel to args.VpnIP
+func (a *AdminService) GetHostInfoByVpnIP(args *AdminArgs, reply *ControlHostInfo) error {
+	c, vpnIp, err := a.vpnIp(args)
+	if err != nil {
+		return err
+	}
+
+	h := c.GetHostInfoByVpnIP(vpnIp, args.Pending)
+	if h == nil {
+		return fmt.Errorf("could not find tunnel for vpn ip: %s", args.VpnIP)
+	}
+
+	*reply = *h
+	return nil
+}
+
+// SetRemoteForTunnel forces the tunnel to args.VpnIP to use args.Remote
+func (a *AdminService) SetRemoteForTunnel(args *AdminArgs, reply *ControlHostInfo) error {
+	c, vpnIp, err := a.vpnIp(args)
+	if err != nil {
+		return err
+	}
+
+	ip, port, err := parseIPAndPort(args.Remote)
+	if err != nil {
+		return fmt.Errorf("the provided remote could not be parsed: %s", args.Remote)
+	}
+
+	h := c.SetRemoteForTunnel(vpnIp, *NewUDPAddr(ip, port))
+	if h == nil {
+		return fmt.Errorf("could not find tunnel for vpn ip: %s", args.VpnIP)
+	}
+
+	*reply = *h
+	return nil
+}
+
+// CloseTunnel closes the tunnel to args.VpnIP, the remote side is told unless args.LocalOnly is set
+func (a *AdminService) CloseTunnel(args *AdminArgs, reply *bool) error {
+	c, vpnIp, err := a.vpnIp(args)
+	if err != nil {
+		return err
+	}
+
+	*reply = c.CloseTunnel(vpnIp, args.LocalOnly)
+	return nil
+}
+
+// CloseAllTunnels closes every tunnel and replies with how many were closed
+func (a *AdminService) CloseAllTunnels(args *AdminArgs, reply *int) error {
+	c, err := a.control(args)
+	if err != nil {
+		return err
+	}
+
+	*reply = c.CloseAllTunnels(args.ExcludeLighthouses)
+	return nil
+}
+
+// Reload reloads the config from disk, like a SIGHUP does. Every network is reloaded, args.Network is ignored
+func (a *AdminService) Reload(args *AdminArgs, reply *bool) error {
+	a.c.l.Info("Caught reload request on the admin socket, reloading config")
+	if err := a.config.reload(); err != nil {
+		return fmt.Errorf("failed to reload config: %s", err)
+	}
+
+	*reply = true
+	return nil
+}
+
+// QueryLighthouse asks the lighthouses where args.VpnIP is and replies with the addresses that are already known
+func (a *AdminService) QueryLighthouse(args *AdminArgs, reply *[]string) error {
+	c, vpnIp, err := a.vpnIp(args)
+	if err != nil {
+		return err
+	}
+
+	ips, _ := c.f.lightHouse.Query(vpnIp, c.f)
+	*reply = make([]string, len(ips))
+	for i, ip := range ips {
+		(*reply)[i] = ip.String()
+	}
+	return nil
+}
+
+// PrintCert returns our certificate, or the certificate of the tunnel to args.VpnIP if it is set
+func (a *AdminService) PrintCert(args *AdminArgs, reply *cert.NebulaCertificate) error {
+	if args.VpnIP == "" {
+		c, err := a.control(args)
+		if err != nil {
+			return err
+		}
+
+		*reply = *c.f.certState.certificate
+		return nil
+	}
+
+	c, vpnIp, err := a.vpnIp(args)
+	if err != nil {
+		return err
+	}
+
+	h, err := c.f.hostMap.QueryVpnIP(vpnIp)
+	if err != nil {
+		return fmt.Errorf("could not find tunnel for vpn ip: %s", args.VpnIP)
+	}
+
+	crt := h.GetCert()
+	if crt == nil {
+		return fmt.Errorf("no certificate is known for vpn ip: %s", args.VpnIP)
+	}
+
+	*reply = *crt
+	return nil
+}
+
+// Stats returns the current value of every metric, they are shared by all networks so args.Network is ignored
+func (a *AdminService) Stats(args *AdminArgs, reply *map[string]map[string]interface{}) error {
+	*reply = metrics.DefaultRegistry.GetAll()
+	return nil
+}
+
+// adminServer serves the AdminService on a unix socket, access is controlled by the permissions of the socket file
+type adminServer struct {
+	l        *logrus.Logger
+	path     string
+	listener *net.UnixListener
+	server   *rpc.Server
+}
+
+// newAdminServerFromConfig listens on `admin.listen` if it is set, nil is returned if it is not
+func newAdminServerFromConfig(l *logrus.Logger, c *Config, ctrl *Control) (*adminServer, error) {
+	path := c.GetString("admin.listen", "")
+	if path == "" {
+		return nil, nil
+	}
+
+	mode, err := strconv.ParseUint(c.GetString("admin.mode", "0600"), 8, 32)
+	if err != nil || mode > 0777 {
+		return nil, fmt.Errorf("admin.mode must be an octal file mode: %s", c.GetString("admin.mode", ""))
+	}
+
+	server := rpc.NewServer()
+	err = server.RegisterName(AdminServiceName, &AdminService{c: ctrl, config: c})
+	if err != nil {
+		return nil, err
+	}
+
+	listener, err := listenAdmin(path, os.FileMode(mode))
+	if err != nil {
+		return nil, err
+	}
+
+	return &adminServer{l: l, path: path, listener: listener, server: server}, nil
+}
+
+// listenAdmin binds a unix socket at path with the given mode. The socket is bound in a new directory that only we
+// can enter and renamed into place once its permissions are set, so nobody else can connect before then.
+func listenAdmin(path string, mode os.FileMode) (*net.UnixListener, error) {
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("admin.listen exists and is not a socket: %s", path)
+		}
+
+		// Refuse to steal the socket from a nebula that is still running
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("admin.listen is in use by another process: %s", path)
+		}
+	}
+
+	// TempDir creates the directory with a random name and 0700, whatever the umask is
+	dir, err := ioutil.TempDir(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	tmp := filepath.Join(dir, "admin.sock")
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: tmp, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	// The socket is renamed below so we remove it ourselves on close
+	listener.SetUnlinkOnClose(false)
+
+	if err = os.Chmod(tmp, mode); err == nil {
+		err = os.Rename(tmp, path)
+	}
+
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	return listener, nil
+}
+
+// Run accepts admin connections until the server is stopped
+func (a *adminServer) Run() {
+	a.l.WithField("socket", a.path).Info("Admin socket listening")
+	for {
+		conn, err := a.listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				a.l.WithError(err).Error("Admin socket stopped accepting connections")
+			}
+			return
+		}
+
+		go a.server.ServeCodec(jsonrpc.NewServerCodec(conn))
+	}
+}
+
+// Stop closes the listener and removes the socket, connections that are already open are left to finish
+func (a *adminServer) Stop() {
+	a.listener.Close()
+	os.Remove(a.path)
+}
@@ -0,0 +1,154 @@
+package nebula
+
+import (
+	"io/ioutil"
+	"net"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/cert"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestAdminServer(t *testing.T, c *Config, ctrl *Control) (*adminServer, *rpc.Client) {
+	a, err := newAdminServerFromConfig(NewTestLogger(), c, ctrl)
+	assert.Nil(t, err)
+	go a.Run()
+
+	conn, err := net.Dial("unix", a.path)
+	assert.Nil(t, err)
+	return a, jsonrpc.NewClient(conn)
+}
+
+func TestAdminServer(t *testing.T) {
+	l := NewTestLogger()
+	dir, err := ioutil.TempDir("", "admin-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	hm := NewHostMap(l, "test", &net.IPNet{}, make([]*net.IPNet, 0))
+	vpnIp := net.IPv4(10, 1, 0, 2).To4()
+	peerCert := &cert.NebulaCertificate{Details: cert.NebulaCertificateDetails{Names: []string{"peer"}}}
+	hm.Add(ip2int(vpnIp), &HostInfo{
+		remote:          NewUDPAddr(net.IPv4(1, 1, 1, 1), 4242),
+		ConnectionState: &ConnectionState{peerCert: peerCert},
+		hostId:          ip2int(vpnIp),
+	})
+
+	ctrl := &Control{
+		f: &Interface{
+			hostMap:   hm,
+			certState: &CertState{certificate: &cert.NebulaCertificate{Details: cert.NebulaCertificateDetails{Names: []string{"me"}}}},
+		},
+		l: logrus.New(),
+	}
+
+	path := filepath.Join(dir, "nebula.sock")
+	c := NewConfig(l)
+	c.Settings["admin"] = map[interface{}]interface{}{"listen": path, "mode": "0660"}
+
+	a, client := newTestAdminServer(t, c, ctrl)
+	defer client.Close()
+
+	// The socket only has the permissions we asked for and nothing is left over from creating it
+	fi, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0660), fi.Mode().Perm())
+	files, _ := ioutil.ReadDir(dir)
+	assert.Len(t, files, 1)
+
+	var hosts []ControlHostInfo
+	assert.Nil(t, client.Call("Nebula.ListHostmap", &AdminArgs{}, &hosts))
+	assert.Len(t, hosts, 1)
+
+	var hostInfo ControlHostInfo
+	assert.Nil(t, client.Call("Nebula.GetHostInfoByVpnIP", &AdminArgs{VpnIP: "10.1.0.2"}, &hostInfo))
+	assert.Equal(t, "10.1.0.2", hostInfo.VpnIP.String())
+	assert.EqualError(t, client.Call("Nebula.GetHostInfoByVpnIP", &AdminArgs{VpnIP: "10.1.0.3"}, &hostInfo), "could not find tunnel for vpn ip: 10.1.0.3")
+	assert.EqualError(t, client.Call("Nebula.GetHostInfoByVpnIP", &AdminArgs{VpnIP: "nope"}, &hostInfo), "the provided vpn ip could not be parsed: nope")
+	assert.EqualError(t, client.Call("Nebula.ListHostmap", &AdminArgs{Network: "nope"}, &hosts), "unknown network: nope")
+
+	assert.Nil(t, client.Call("Nebula.SetRemoteForTunnel", &AdminArgs{VpnIP: "10.1.0.2", Remote: "2.2.2.2:4243"}, &hostInfo))
+	h, _ := hm.QueryVpnIP(ip2int(vpnIp))
+	assert.Equal(t, "2.2.2.2:4243", h.remote.String())
+
+	var crt map[string]interface{}
+	assert.Nil(t, client.Call("Nebula.PrintCert", &AdminArgs{}, &crt))
+	assert.Equal(t, []interface{}{"me"}, crt["details"].(map[string]interface{})["names"])
+	assert.Nil(t, client.Call("Nebula.PrintCert", &AdminArgs{VpnIP: "10.1.0.2"}, &crt))
+	assert.Equal(t, []interface{}{"peer"}, crt["details"].(map[string]interface{})["names"])
+
+	var stats map[string]map[string]interface{}
+	assert.Nil(t, client.Call("Nebula.Stats", &AdminArgs{}, &stats))
+
+	// A failed reload is reported to the caller
+	var ok bool
+	c.path = filepath.Join(dir, "missing")
+	assert.Error(t, client.Call("Nebula.Reload", &AdminArgs{}, &ok))
+
+	a.Stop()
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestAdminServer_existingSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "admin-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "nebula.sock")
+	c := NewConfig(NewTestLogger())
+	c.Settings["admin"] = map[interface{}]interface{}{"listen": path}
+
+	// A stale socket from a previous run is replaced
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	assert.Nil(t, err)
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+
+	a, client := newTestAdminServer(t, c, &Control{})
+	client.Close()
+
+	// But one that is still in use is not
+	_, err = newAdminServerFromConfig(NewTestLogger(), c, &Control{})
+	assert.EqualError(t, err, "admin.listen is in use by another process: "+path)
+	a.Stop()
+
+	// Nor is anything else
+	assert.Nil(t, ioutil.WriteFile(path, []byte{}, 0600))
+	_, err = newAdminServerFromConfig(NewTestLogger(), c, &Control{})
+	assert.EqualError(t, err, "admin.listen exists and is not a socket: "+path)
+
+	c.Settings["admin"] = map[interface{}]interface{}{"listen": path, "mode": "rw"}
+	_, err = newAdminServerFromConfig(NewTestLogger(), c, &Control{})
+	assert.EqualError(t, err, "admin.mode must be an octal file mode: rw")
+}
+
+func TestListenAdmin(t *testing.T) {
+	dir, err := ioutil.TempDir("", "admin-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "nebula.sock")
+	listener, err := listenAdmin(path, 0640)
+	assert.Nil(t, err)
+	defer listener.Close()
+
+	fi, err := os.Lstat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0640), fi.Mode().Perm())
+
+	// The private directory the socket was bound in is gone
+	entries, err := ioutil.ReadDir(dir)
+	assert.Nil(t, err)
+	assert.Len(t, entries, 1)
+	assert.Equal(t, "nebula.sock", entries[0].Name())
+
+	conn, err := net.Dial("unix", path)
+	assert.Nil(t, err)
+	conn.Close()
+}
@@ -15,14 +15,14 @@ type Bits struct {
 	outOfWindowCounter metrics.Counter
 }
 
-func NewBits(bits uint64) *Bits {
+func NewBits(bits uint64, r metrics.Registry) *Bits {
 	return &Bits{
 		length:             bits,
 		bits:               make([]bool, bits, bits),
 		current:            0,
-		lostCounter:        metrics.GetOrRegisterCounter("network.packets.lost", nil),
-		dupeCounter:        metrics.GetOrRegisterCounter("network.packets.duplicate", nil),
-		outOfWindowCounter: metrics.GetOrRegisterCounter("network.packets.out_of_window", nil),
+		lostCounter:        metrics.GetOrRegisterCounter("network.packets.lost", r),
+		dupeCounter:        metrics.GetOrRegisterCounter("network.packets.duplicate", r),
+		outOfWindowCounter: metrics.GetOrRegisterCounter("network.packets.out_of_window", r),
 	}
 }
 
@@ -8,7 +8,7 @@ import (
 
 func TestBits(t *testing.T) {
 	l := NewTestLogger()
-	b := NewBits(10)
+	b := NewBits(10, nil)
 
 	// make sure it is the right size
 	assert.Len(t, b.bits, 10)
@@ -61,13 +61,13 @@ func TestBits(t *testing.T) {
 	assert.Equal(t, g, b.bits)
 
 	// make sure we handle wrapping around once to the current position
-	b = NewBits(10)
+	b = NewBits(10, nil)
 	assert.True(t, b.Update(l, 1))
 	assert.True(t, b.Update(l, 11))
 	assert.Equal(t, []bool{false, true, false, false, false, false, false, false, false, false}, b.bits)
 
 	// Walk through a few windows in order
-	b = NewBits(10)
+	b = NewBits(10, nil)
 	for i := uint64(0); i <= 100; i++ {
 		assert.True(t, b.Check(l, i), "Error while checking %v", i)
 		assert.True(t, b.Update(l, i), "Error while updating %v", i)
@@ -76,7 +76,7 @@ func TestBits(t *testing.T) {
 
 func TestBitsDupeCounter(t *testing.T) {
 	l := NewTestLogger()
-	b := NewBits(10)
+	b := NewBits(10, nil)
 	b.lostCounter.Clear()
 	b.dupeCounter.Clear()
 	b.outOfWindowCounter.Clear()
@@ -101,7 +101,7 @@ func TestBitsDupeCounter(t *testing.T) {
 
 func TestBitsOutOfWindowCounter(t *testing.T) {
 	l := NewTestLogger()
-	b := NewBits(10)
+	b := NewBits(10, nil)
 	b.lostCounter.Clear()
 	b.dupeCounter.Clear()
 	b.outOfWindowCounter.Clear()
@@ -131,7 +131,7 @@ func TestBitsOutOfWindowCounter(t *testing.T) {
 
 func TestBitsLostCounter(t *testing.T) {
 	l := NewTestLogger()
-	b := NewBits(10)
+	b := NewBits(10, nil)
 	b.lostCounter.Clear()
 	b.dupeCounter.Clear()
 	b.outOfWindowCounter.Clear()
@@ -152,7 +152,7 @@ func TestBitsLostCounter(t *testing.T) {
 	assert.Equal(t, int64(0), b.dupeCounter.Count())
 	assert.Equal(t, int64(0), b.outOfWindowCounter.Count())
 
-	b = NewBits(10)
+	b = NewBits(10, nil)
 	b.lostCounter.Clear()
 	b.dupeCounter.Clear()
 	b.outOfWindowCounter.Clear()
@@ -214,7 +214,7 @@ func TestBitsLostCounter(t *testing.T) {
 }
 
 func BenchmarkBits(b *testing.B) {
-	z := NewBits(10)
+	z := NewBits(10, nil)
 	for n := 0; n < b.N; n++ {
 		for i := range z.bits {
 			z.bits[i] = true
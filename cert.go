@@ -153,6 +153,10 @@ func loadCAFromConfig(l *logrus.Logger, c *Config) (*cert.NebulaCAPool, error) {
 		CAs.BlocklistFingerprint(fp)
 	}
 
+	for fp, t := range CAs.GetDeprecations() {
+		l.WithField("fingerprint", fp).WithField("deprecatedAfter", t).Info("Trusted CA is deprecated")
+	}
+
 	// Support deprecated config for at leaast one minor release to allow for migrations
 	for _, fp := range c.GetStringSlice("pki.blacklist", []string{}) {
 		l.WithField("fingerprint", fp).Infof("Blocklisting cert")
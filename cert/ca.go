@@ -1,14 +1,19 @@
 package cert
 
 import (
+	"encoding/pem"
 	"fmt"
 	"strings"
 	"time"
 )
 
+// DeprecatedAfterHeader is the PEM header used to mark a CA in a bundle as deprecated after an RFC3339 date
+const DeprecatedAfterHeader = "Deprecated-After"
+
 type NebulaCAPool struct {
 	CAs           map[string]*NebulaCertificate
 	certBlocklist map[string]struct{}
+	deprecations  map[string]time.Time
 }
 
 // NewCAPool creates a CAPool
@@ -16,6 +21,7 @@ func NewCAPool() *NebulaCAPool {
 	ca := NebulaCAPool{
 		CAs:           make(map[string]*NebulaCertificate),
 		certBlocklist: make(map[string]struct{}),
+		deprecations:  make(map[string]time.Time),
 	}
 
 	return &ca
@@ -39,9 +45,17 @@ func NewCAPoolFromBytes(caPEMs []byte) (*NebulaCAPool, error) {
 
 // AddCACertificate verifies a Nebula CA certificate and adds it to the pool
 // Only the first pem encoded object will be consumed, any remaining bytes are returned.
-// Parsed certificates will be verified and must be a CA
+// Parsed certificates will be verified and must be a CA. A Deprecated-After PEM header will mark the CA as deprecated
 func (ncp *NebulaCAPool) AddCACertificate(pemBytes []byte) ([]byte, error) {
-	c, pemBytes, err := UnmarshalNebulaCertificateFromPEM(pemBytes)
+	p, pemBytes := pem.Decode(pemBytes)
+	if p == nil {
+		return pemBytes, fmt.Errorf("input did not contain a valid PEM encoded block")
+	}
+	if p.Type != CertBanner {
+		return pemBytes, fmt.Errorf("bytes did not contain a proper nebula certificate banner")
+	}
+
+	c, err := UnmarshalNebulaCertificate(p.Bytes)
 	if err != nil {
 		return pemBytes, err
 	}
@@ -63,10 +77,43 @@ func (ncp *NebulaCAPool) AddCACertificate(pemBytes []byte) ([]byte, error) {
 		return pemBytes, fmt.Errorf("could not calculate shasum for provided CA; error: %s; %v", err, c.Details.Names)
 	}
 
+	if v, ok := p.Headers[DeprecatedAfterHeader]; ok {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return pemBytes, fmt.Errorf("could not parse %s header for provided CA; error: %s; %v", DeprecatedAfterHeader, err, c.Details.Names)
+		}
+		ncp.deprecations[sum] = t
+	}
+
 	ncp.CAs[sum] = c
 	return pemBytes, nil
 }
 
+// DeprecateCA marks the CA with the provided fingerprint as deprecated after t
+func (ncp *NebulaCAPool) DeprecateCA(f string, t time.Time) {
+	ncp.deprecations[f] = t
+}
+
+// GetDeprecations returns the deprecation time of every deprecated CA keyed by fingerprint
+func (ncp *NebulaCAPool) GetDeprecations() map[string]time.Time {
+	d := make(map[string]time.Time, len(ncp.deprecations))
+	for k, v := range ncp.deprecations {
+		d[k] = v
+	}
+	return d
+}
+
+// IsDeprecated returns true if the certificate was issued by a CA that is deprecated at the provided time.
+// No signature validation is performed
+func (ncp *NebulaCAPool) IsDeprecated(c *NebulaCertificate, t time.Time) bool {
+	d, ok := ncp.deprecations[c.Details.Issuer]
+	if !ok {
+		return false
+	}
+
+	return t.After(d)
+}
+
 // BlocklistFingerprint adds a cert fingerprint to the blocklist
 func (ncp *NebulaCAPool) BlocklistFingerprint(f string) {
 	ncp.certBlocklist[f] = struct{}{}
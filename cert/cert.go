@@ -11,6 +11,7 @@ import (
 	"encoding/pem"
 	"fmt"
 	"net"
+	"sort"
 	"time"
 
 	"github.com/golang/protobuf/proto"
@@ -44,6 +45,9 @@ type NebulaCertificateDetails struct {
 	IsCA      bool
 	Issuer    string
 
+	// Extensions are arbitrary key/value pairs covered by the signature
+	Extensions map[string]string
+
 	// Map of groups for faster lookup
 	InvertedGroups map[string]struct{}
 }
@@ -83,6 +87,7 @@ func UnmarshalNebulaCertificate(b []byte) (*NebulaCertificate, error) {
 			NotAfter:       time.Unix(rc.Details.NotAfter, 0),
 			PublicKey:      make([]byte, len(rc.Details.PublicKey)),
 			IsCA:           rc.Details.IsCA,
+			Extensions:     make(map[string]string, len(rc.Details.Extensions)),
 			InvertedGroups: make(map[string]struct{}),
 		},
 		Signature: make([]byte, len(rc.Signature)),
@@ -118,6 +123,13 @@ func UnmarshalNebulaCertificate(b []byte) (*NebulaCertificate, error) {
 		nc.Details.InvertedGroups[g] = struct{}{}
 	}
 
+	for _, e := range rc.Details.Extensions {
+		if _, ok := nc.Details.Extensions[e.Key]; ok {
+			return nil, fmt.Errorf("encoded Extensions contained a duplicate key: %s", e.Key)
+		}
+		nc.Details.Extensions[e.Key] = e.Value
+	}
+
 	return &nc, nil
 }
 
@@ -321,6 +333,21 @@ func (nc *NebulaCertificate) CheckRootConstrains(signer *NebulaCertificate) erro
 		}
 	}
 
+	// If the signer has a limited set of extensions make sure the cert only contains a subset.
+	// An empty value on the signer allows any value for that key, otherwise the values must match
+	if len(signer.Details.Extensions) > 0 {
+		for k, v := range nc.Details.Extensions {
+			sv, ok := signer.Details.Extensions[k]
+			if !ok {
+				return fmt.Errorf("certificate contained an extension not present on the signing ca: %s", k)
+			}
+
+			if sv != "" && sv != v {
+				return fmt.Errorf("certificate contained an extension value not allowed by the signing ca: %s=%s", k, v)
+			}
+		}
+	}
+
 	return nil
 }
 
@@ -375,6 +402,16 @@ func (nc *NebulaCertificate) String() string {
 		s += "\t\tGroups: []\n"
 	}
 
+	if len(nc.Details.Extensions) > 0 {
+		s += "\t\tExtensions: [\n"
+		for _, k := range nc.extensionKeys() {
+			s += fmt.Sprintf("\t\t\t\"%v\": \"%v\"\n", k, nc.Details.Extensions[k])
+		}
+		s += "\t\t]\n"
+	} else {
+		s += "\t\tExtensions: []\n"
+	}
+
 	s += fmt.Sprintf("\t\tNot before: %v\n", nc.Details.NotBefore)
 	s += fmt.Sprintf("\t\tNot After: %v\n", nc.Details.NotAfter)
 	s += fmt.Sprintf("\t\tIs CA: %v\n", nc.Details.IsCA)
@@ -410,6 +447,11 @@ func (nc *NebulaCertificate) getRawDetails() *RawNebulaCertificateDetails {
 		rd.Subnets = append(rd.Subnets, ip2int(ipNet.IP), ip2int(ipNet.Mask))
 	}
 
+	// Extensions are sorted by key so the signed bytes are stable
+	for _, k := range nc.extensionKeys() {
+		rd.Extensions = append(rd.Extensions, &RawNebulaCertificateExtension{Key: k, Value: nc.Details.Extensions[k]})
+	}
+
 	copy(rd.PublicKey, nc.Details.PublicKey[:])
 
 	// I know, this is terrible
@@ -418,6 +460,16 @@ func (nc *NebulaCertificate) getRawDetails() *RawNebulaCertificateDetails {
 	return rd
 }
 
+// extensionKeys returns the extension keys in sorted order
+func (nc *NebulaCertificate) extensionKeys() []string {
+	keys := make([]string, 0, len(nc.Details.Extensions))
+	for k := range nc.Details.Extensions {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
 // Marshal will marshal a nebula cert into a protobuf byte array
 func (nc *NebulaCertificate) Marshal() ([]byte, error) {
 	rc := RawNebulaCertificate{
@@ -457,18 +509,24 @@ func (nc *NebulaCertificate) MarshalJSON() ([]byte, error) {
 		return s
 	}
 
+	extensions := map[string]string{}
+	for k, v := range nc.Details.Extensions {
+		extensions[k] = v
+	}
+
 	fp, _ := nc.Sha256Sum()
 	jc := m{
 		"details": m{
-			"names":     nc.Details.Names,
-			"ips":       toString(nc.Details.Ips),
-			"subnets":   toString(nc.Details.Subnets),
-			"groups":    nc.Details.Groups,
-			"notBefore": nc.Details.NotBefore,
-			"notAfter":  nc.Details.NotAfter,
-			"publicKey": fmt.Sprintf("%x", nc.Details.PublicKey),
-			"isCa":      nc.Details.IsCA,
-			"issuer":    nc.Details.Issuer,
+			"names":      nc.Details.Names,
+			"ips":        toString(nc.Details.Ips),
+			"subnets":    toString(nc.Details.Subnets),
+			"groups":     nc.Details.Groups,
+			"notBefore":  nc.Details.NotBefore,
+			"notAfter":   nc.Details.NotAfter,
+			"publicKey":  fmt.Sprintf("%x", nc.Details.PublicKey),
+			"isCa":       nc.Details.IsCA,
+			"issuer":     nc.Details.Issuer,
+			"extensions": extensions,
 		},
 		"fingerprint": fp,
 		"signature":   fmt.Sprintf("%x", nc.Signature),
@@ -531,6 +589,13 @@ func (nc *NebulaCertificate) Copy() *NebulaCertificate {
 		c.Details.InvertedGroups[g] = struct{}{}
 	}
 
+	if nc.Details.Extensions != nil {
+		c.Details.Extensions = make(map[string]string, len(nc.Details.Extensions))
+		for k, v := range nc.Details.Extensions {
+			c.Details.Extensions[k] = v
+		}
+	}
+
 	return c
 }
 
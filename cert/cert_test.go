@@ -2,6 +2,7 @@ package cert
 
 import (
 	"crypto/rand"
+	"encoding/pem"
 	"fmt"
 	"io"
 	"net"
@@ -39,6 +40,10 @@ func TestMarshalingNebulaCertificate(t *testing.T) {
 			PublicKey: pubKey,
 			IsCA:      false,
 			Issuer:    "1234567890abcedfghij1234567890ab",
+			Extensions: map[string]string{
+				"team": "ops",
+				"env":  "prod",
+			},
 		},
 		Signature: []byte("1234567890abcedfghij1234567890ab"),
 	}
@@ -69,6 +74,12 @@ func TestMarshalingNebulaCertificate(t *testing.T) {
 	}
 
 	assert.EqualValues(t, nc.Details.Groups, nc2.Details.Groups)
+	assert.Equal(t, nc.Details.Extensions, nc2.Details.Extensions)
+
+	// Extensions must be marshalled in a stable order
+	b2, err := nc2.Marshal()
+	assert.Nil(t, err)
+	assert.Equal(t, b, b2)
 }
 
 func TestNebulaCertificate_Sign(t *testing.T) {
@@ -153,7 +164,7 @@ func TestNebulaCertificate_MarshalJSON(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(
 		t,
-		"{\"details\":{\"groups\":[\"test-group1\",\"test-group2\",\"test-group3\"],\"ips\":[\"10.1.1.1/24\",\"10.1.1.2/16\",\"10.1.1.3/ff00ff00\"],\"isCa\":false,\"issuer\":\"1234567890abcedfghij1234567890ab\",\"names\":[\"testing\"],\"notAfter\":\"0000-11-30T02:00:00Z\",\"notBefore\":\"0000-11-30T01:00:00Z\",\"publicKey\":\"313233343536373839306162636564666768696a313233343536373839306162\",\"subnets\":[\"9.1.1.1/ff00ff00\",\"9.1.1.2/24\",\"9.1.1.3/16\"]},\"fingerprint\":\"26cb1c30ad7872c804c166b5150fa372f437aa3856b04edb4334b4470ec728e4\",\"signature\":\"313233343536373839306162636564666768696a313233343536373839306162\"}",
+		"{\"details\":{\"extensions\":{},\"groups\":[\"test-group1\",\"test-group2\",\"test-group3\"],\"ips\":[\"10.1.1.1/24\",\"10.1.1.2/16\",\"10.1.1.3/ff00ff00\"],\"isCa\":false,\"issuer\":\"1234567890abcedfghij1234567890ab\",\"names\":[\"testing\"],\"notAfter\":\"0000-11-30T02:00:00Z\",\"notBefore\":\"0000-11-30T01:00:00Z\",\"publicKey\":\"313233343536373839306162636564666768696a313233343536373839306162\",\"subnets\":[\"9.1.1.1/ff00ff00\",\"9.1.1.2/24\",\"9.1.1.3/16\"]},\"fingerprint\":\"26cb1c30ad7872c804c166b5150fa372f437aa3856b04edb4334b4470ec728e4\",\"signature\":\"313233343536373839306162636564666768696a313233343536373839306162\"}",
 		string(b),
 	)
 }
@@ -375,6 +386,62 @@ func TestNebulaCertificate_Verify_Subnets(t *testing.T) {
 	assert.Nil(t, err)
 }
 
+func TestNebulaCertificate_Verify_Extensions(t *testing.T) {
+	ca, _, caKey, err := newTestCaCert(time.Now(), time.Now().Add(10*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
+	assert.Nil(t, err)
+	ca.Details.Extensions = map[string]string{"env": "prod", "team": ""}
+	assert.Nil(t, ca.Sign(caKey))
+
+	caPem, err := ca.MarshalToPEM()
+	assert.Nil(t, err)
+
+	caPool := NewCAPool()
+	caPool.AddCACertificate(caPem)
+
+	newCert := func(ext map[string]string) *NebulaCertificate {
+		c, _, _, err := newTestCert(ca, caKey, time.Now(), time.Now().Add(5*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
+		assert.Nil(t, err)
+		c.Details.Extensions = ext
+		assert.Nil(t, c.Sign(caKey))
+		return c
+	}
+
+	// no extensions is always fine
+	v, err := newCert(nil).Verify(time.Now(), caPool)
+	assert.True(t, v)
+	assert.Nil(t, err)
+
+	// key not present on the ca
+	v, err = newCert(map[string]string{"owner": "bob"}).Verify(time.Now(), caPool)
+	assert.False(t, v)
+	assert.EqualError(t, err, "certificate contained an extension not present on the signing ca: owner")
+
+	// value pinned by the ca
+	v, err = newCert(map[string]string{"env": "staging"}).Verify(time.Now(), caPool)
+	assert.False(t, v)
+	assert.EqualError(t, err, "certificate contained an extension value not allowed by the signing ca: env=staging")
+
+	// pinned value and a free value
+	v, err = newCert(map[string]string{"env": "prod", "team": "ops"}).Verify(time.Now(), caPool)
+	assert.True(t, v)
+	assert.Nil(t, err)
+
+	// a ca without extensions does not constrain
+	ca2, _, caKey2, err := newTestCaCert(time.Now(), time.Now().Add(10*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
+	assert.Nil(t, err)
+	caPem, err = ca2.MarshalToPEM()
+	assert.Nil(t, err)
+	caPool.AddCACertificate(caPem)
+
+	c, _, _, err := newTestCert(ca2, caKey2, time.Now(), time.Now().Add(5*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
+	assert.Nil(t, err)
+	c.Details.Extensions = map[string]string{"anything": "goes"}
+	assert.Nil(t, c.Sign(caKey2))
+	v, err = c.Verify(time.Now(), caPool)
+	assert.True(t, v)
+	assert.Nil(t, err)
+}
+
 func TestNebulaVerifyPrivateKey(t *testing.T) {
 	ca, _, caKey, err := newTestCaCert(time.Time{}, time.Time{}, []*net.IPNet{}, []*net.IPNet{}, []string{})
 	assert.Nil(t, err)
@@ -447,6 +514,43 @@ BVG+oJpAoqokUBbI4U0N8CSfpUABEkB/Pm5A2xyH/nc8mg/wvGUWG3pZ7nHzaDMf
 	assert.Equal(t, pp.CAs[string("5c9c3f23e7ee7fe97637cbd3a0a5b854154d1d9aaaf7b566a51f4a88f76b64cd")].Details.Names, rootCA01.Details.Names)
 }
 
+func TestNebulaCAPool_Deprecated(t *testing.T) {
+	ca, _, caKey, err := newTestCaCert(time.Now(), time.Now().Add(10*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
+	assert.Nil(t, err)
+	ca2, _, _, err := newTestCaCert(time.Now(), time.Now().Add(10*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
+	assert.Nil(t, err)
+
+	b, err := ca.Marshal()
+	assert.Nil(t, err)
+	b2, err := ca2.MarshalToPEM()
+	assert.Nil(t, err)
+
+	deprecatedAfter := time.Date(2021, time.March, 1, 0, 0, 0, 0, time.UTC)
+	caPem := pem.EncodeToMemory(&pem.Block{Type: CertBanner, Headers: map[string]string{DeprecatedAfterHeader: deprecatedAfter.Format(time.RFC3339)}, Bytes: b})
+
+	p, err := NewCAPoolFromBytes(appendByteSlices(caPem, b2))
+	assert.Nil(t, err)
+	assert.Len(t, p.CAs, 2)
+
+	fp, _ := ca.Sha256Sum()
+	assert.Equal(t, map[string]time.Time{fp: deprecatedAfter}, p.GetDeprecations())
+
+	c, _, _, err := newTestCert(ca, caKey, time.Now(), time.Now().Add(5*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
+	assert.Nil(t, err)
+	assert.False(t, p.IsDeprecated(c, deprecatedAfter.Add(-time.Second)))
+	assert.True(t, p.IsDeprecated(c, deprecatedAfter.Add(time.Second)))
+
+	// deprecated certs still verify
+	v, err := c.Verify(time.Now(), p)
+	assert.True(t, v)
+	assert.Nil(t, err)
+
+	// bad header
+	caPem = pem.EncodeToMemory(&pem.Block{Type: CertBanner, Headers: map[string]string{DeprecatedAfterHeader: "soon"}, Bytes: b})
+	_, err = NewCAPoolFromBytes(caPem)
+	assert.EqualError(t, err, "could not parse Deprecated-After header for provided CA; error: parsing time \"soon\" as \"2006-01-02T15:04:05Z07:00\": cannot parse \"soon\" as \"2006\"; [test ca]")
+}
+
 func appendByteSlices(b ...[]byte) []byte {
 	retSlice := []byte{}
 	for _, v := range b {
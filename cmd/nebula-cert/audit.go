@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/slackhq/nebula/cert"
+)
+
+type auditFlags struct {
+	set          *flag.FlagSet
+	caPath       *string
+	path         *string
+	ext          *string
+	blocklist    *string
+	expireWithin *time.Duration
+	json         *bool
+}
+
+func newAuditFlags() *auditFlags {
+	af := auditFlags{set: flag.NewFlagSet("audit", flag.ContinueOnError)}
+	af.set.Usage = func() {}
+	af.caPath = af.set.String("ca", "", "Required: path to a file containing one or more ca certificates")
+	af.path = af.set.String("path", "", "Required: path to a directory of certificates, searched recursively")
+	af.ext = af.set.String("ext", ".crt", "Optional: only consider files with this extension, empty to consider all files")
+	af.blocklist = af.set.String("blocklist", "", "Optional: path to a file containing blocklisted certificate fingerprints, one per line")
+	af.expireWithin = af.set.Duration("expire-within", time.Hour*24*30, "Optional: report certificates that expire within this amount of time. Valid time units are seconds: \"s\", minutes: \"m\", hours: \"h\"")
+	af.json = af.set.Bool("json", false, "Optional: outputs the report in json format")
+	return &af
+}
+
+type auditIssue struct {
+	Path        string `json:"path"`
+	Names       string `json:"names"`
+	Fingerprint string `json:"fingerprint"`
+	Issue       string `json:"issue"`
+	Details     string `json:"details"`
+}
+
+type auditCert struct {
+	path string
+	fp   string
+	c    *cert.NebulaCertificate
+}
+
+func audit(args []string, out io.Writer, errOut io.Writer) error {
+	af := newAuditFlags()
+	err := af.set.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if err := mustFlagString("ca", af.caPath); err != nil {
+		return err
+	}
+	if err := mustFlagString("path", af.path); err != nil {
+		return err
+	}
+
+	rawCACert, err := ioutil.ReadFile(*af.caPath)
+	if err != nil {
+		return fmt.Errorf("error while reading ca: %s", err)
+	}
+
+	caPool, err := cert.NewCAPoolFromBytes(rawCACert)
+	if err != nil {
+		return fmt.Errorf("error while adding ca cert to pool: %s", err)
+	}
+
+	if *af.blocklist != "" {
+		f, err := os.Open(*af.blocklist)
+		if err != nil {
+			return fmt.Errorf("error while reading blocklist: %s", err)
+		}
+
+		s := bufio.NewScanner(f)
+		for s.Scan() {
+			fp := strings.TrimSpace(s.Text())
+			if fp != "" && !strings.HasPrefix(fp, "#") {
+				caPool.BlocklistFingerprint(fp)
+			}
+		}
+		f.Close()
+
+		if err := s.Err(); err != nil {
+			return fmt.Errorf("error while reading blocklist: %s", err)
+		}
+	}
+
+	var issues []auditIssue
+	var certs []auditCert
+
+	addIssue := func(ac auditCert, issue string, details string) {
+		i := auditIssue{Path: ac.path, Fingerprint: ac.fp, Issue: issue, Details: details}
+		if ac.c != nil {
+			i.Names = strings.Join(ac.c.Details.Names, ",")
+		}
+		issues = append(issues, i)
+	}
+
+	err = filepath.Walk(*af.path, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() || (*af.ext != "" && filepath.Ext(path) != *af.ext) {
+			return nil
+		}
+
+		rawCert, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		for {
+			var c *cert.NebulaCertificate
+			c, rawCert, err = cert.UnmarshalNebulaCertificateFromPEM(rawCert)
+			if err != nil {
+				addIssue(auditCert{path: path}, "invalid", err.Error())
+				return nil
+			}
+
+			fp, _ := c.Sha256Sum()
+			certs = append(certs, auditCert{path: path, fp: fp, c: c})
+
+			if rawCert == nil || len(rawCert) == 0 || strings.TrimSpace(string(rawCert)) == "" {
+				return nil
+			}
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("error while reading certificates: %s", err)
+	}
+
+	now := time.Now()
+	ips := map[string]auditCert{}
+	var subnets []*net.IPNet
+	var subnetOwners []auditCert
+
+	for _, ac := range certs {
+		if caPool.IsBlocklisted(ac.c) {
+			addIssue(ac, "blocklisted", "fingerprint is blocklisted")
+		}
+
+		if ac.c.Expired(now) {
+			addIssue(ac, "expired", fmt.Sprintf("valid from %s until %s", ac.c.Details.NotBefore, ac.c.Details.NotAfter))
+		} else if ac.c.Expired(now.Add(*af.expireWithin)) {
+			addIssue(ac, "expiring", fmt.Sprintf("expires at %s", ac.c.Details.NotAfter))
+		}
+
+		// CA certificates only need their expiration checked
+		if ac.c.Details.IsCA {
+			continue
+		}
+
+		if _, err := caPool.GetCAForCert(ac.c); err != nil {
+			addIssue(ac, "unknown ca", fmt.Sprintf("issuer %s is not in the ca bundle", ac.c.Details.Issuer))
+
+		} else if ok, err := ac.c.Verify(now, caPool); !ok && !ac.c.Expired(now) && !caPool.IsBlocklisted(ac.c) {
+			// Expired and blocklisted certs were already reported above
+			addIssue(ac, "unverified", err.Error())
+		}
+
+		for _, ip := range ac.c.Details.Ips {
+			if other, ok := ips[ip.IP.String()]; ok {
+				addIssue(ac, "duplicate ip", fmt.Sprintf("%s is also assigned in %s", ip.IP, other.path))
+				continue
+			}
+			ips[ip.IP.String()] = ac
+		}
+
+		for _, subnet := range ac.c.Details.Subnets {
+			for i, other := range subnets {
+				if other.Contains(subnet.IP) || subnet.Contains(other.IP) {
+					addIssue(ac, "overlapping subnet", fmt.Sprintf("%s overlaps %s in %s", subnet, other, subnetOwners[i].path))
+				}
+			}
+			subnets = append(subnets, subnet)
+			subnetOwners = append(subnetOwners, ac)
+		}
+	}
+
+	if *af.json {
+		if issues == nil {
+			issues = []auditIssue{}
+		}
+		b, _ := json.Marshal(issues)
+		out.Write(b)
+		out.Write([]byte("\n"))
+
+	} else if len(issues) > 0 {
+		tw := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "PATH\tNAMES\tFINGERPRINT\tISSUE\tDETAILS")
+		for _, i := range issues {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", i.Path, i.Names, i.Fingerprint, i.Issue, i.Details)
+		}
+		tw.Flush()
+	}
+
+	if len(issues) > 0 {
+		return fmt.Errorf("found %v issues in %v certificates", len(issues), len(certs))
+	}
+
+	return nil
+}
+
+func auditSummary() string {
+	return "audit <flags>: checks a directory of certificates for expiry, verification failures, and duplicate assignments"
+}
+
+func auditHelp(out io.Writer) {
+	af := newAuditFlags()
+	out.Write([]byte("Usage of " + os.Args[0] + " " + auditSummary() + "\n"))
+	af.set.SetOutput(out)
+	af.set.PrintDefaults()
+}
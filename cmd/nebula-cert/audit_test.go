@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ed25519"
+)
+
+func Test_auditSummary(t *testing.T) {
+	assert.Equal(t, "audit <flags>: checks a directory of certificates for expiry, verification failures, and duplicate assignments", auditSummary())
+}
+
+func Test_auditHelp(t *testing.T) {
+	ob := &bytes.Buffer{}
+	auditHelp(ob)
+	assert.Equal(
+		t,
+		"Usage of "+os.Args[0]+" audit <flags>: checks a directory of certificates for expiry, verification failures, and duplicate assignments\n"+
+			"  -blocklist string\n"+
+			"    \tOptional: path to a file containing blocklisted certificate fingerprints, one per line\n"+
+			"  -ca string\n"+
+			"    \tRequired: path to a file containing one or more ca certificates\n"+
+			"  -expire-within duration\n"+
+			"    \tOptional: report certificates that expire within this amount of time. Valid time units are seconds: \"s\", minutes: \"m\", hours: \"h\" (default 720h0m0s)\n"+
+			"  -ext string\n"+
+			"    \tOptional: only consider files with this extension, empty to consider all files (default \".crt\")\n"+
+			"  -json\n"+
+			"    \tOptional: outputs the report in json format\n"+
+			"  -path string\n"+
+			"    \tRequired: path to a directory of certificates, searched recursively\n",
+		ob.String(),
+	)
+}
+
+func Test_audit(t *testing.T) {
+	ob := &bytes.Buffer{}
+	eb := &bytes.Buffer{}
+
+	// required args
+	assertHelpError(t, audit([]string{"-ca", "derp"}, ob, eb), "-path is required")
+	assert.Equal(t, "", ob.String())
+	assert.Equal(t, "", eb.String())
+
+	assertHelpError(t, audit([]string{"-path", "derp"}, ob, eb), "-ca is required")
+	assert.Equal(t, "", ob.String())
+	assert.Equal(t, "", eb.String())
+
+	// no ca at path
+	err := audit([]string{"-ca", "does_not_exist", "-path", "does_not_exist"}, ob, eb)
+	assert.EqualError(t, err, "error while reading ca: open does_not_exist: "+NoSuchFileError)
+
+	dir, err := ioutil.TempDir("", "audit")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	caCert, caPriv := newAuditCA(t, "test-ca")
+	caPem, _ := caCert.MarshalToPEM()
+	caPath := filepath.Join(dir, "ca.pem")
+	assert.Nil(t, ioutil.WriteFile(caPath, caPem, 0600))
+
+	otherCA, otherPriv := newAuditCA(t, "other-ca")
+
+	certs := filepath.Join(dir, "certs")
+	assert.Nil(t, os.Mkdir(certs, 0700))
+
+	// no certs is no issues
+	ob.Reset()
+	assert.Nil(t, audit([]string{"-ca", caPath, "-path", certs}, ob, eb))
+	assert.Equal(t, "", ob.String())
+
+	ob.Reset()
+	assert.Nil(t, audit([]string{"-ca", caPath, "-path", certs, "-json"}, ob, eb))
+	assert.Equal(t, "[]\n", ob.String())
+
+	_, sn1, _ := net.ParseCIDR("192.168.0.0/24")
+	_, sn2, _ := net.ParseCIDR("192.168.0.128/25")
+	writeAuditCert(t, filepath.Join(certs, "a-good.crt"), caCert, caPriv, "good", "10.1.0.1/16", []*net.IPNet{sn1}, time.Hour*800)
+	writeAuditCert(t, filepath.Join(certs, "b-soon.crt"), caCert, caPriv, "soon", "10.1.0.2/16", []*net.IPNet{sn2}, time.Hour)
+	writeAuditCert(t, filepath.Join(certs, "c-dupe.crt"), caCert, caPriv, "dupe", "10.1.0.1/16", nil, time.Hour*800)
+	writeAuditCert(t, filepath.Join(certs, "d-unknown.crt"), otherCA, otherPriv, "unknown", "10.1.0.4/16", nil, time.Hour*800)
+	blocked := writeAuditCert(t, filepath.Join(certs, "e-blocked.crt"), caCert, caPriv, "blocked", "10.1.0.5/16", nil, time.Hour*800)
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(certs, "f-bad.crt"), []byte("-----BEGIN NOPE-----"), 0600))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(certs, "notes.txt"), []byte("ignored"), 0600))
+
+	blocklistPath := filepath.Join(dir, "blocklist")
+	assert.Nil(t, ioutil.WriteFile(blocklistPath, []byte("# blocked hosts\n"+blocked+"\n"), 0600))
+
+	ob.Reset()
+	err = audit([]string{"-ca", caPath, "-path", certs, "-blocklist", blocklistPath, "-json"}, ob, eb)
+	assert.EqualError(t, err, "found 6 issues in 5 certificates")
+
+	var issues []auditIssue
+	assert.Nil(t, json.Unmarshal(ob.Bytes(), &issues))
+
+	found := map[string]string{}
+	for _, i := range issues {
+		found[i.Issue] = filepath.Base(i.Path)
+	}
+
+	assert.Equal(t, map[string]string{
+		"expiring":           "b-soon.crt",
+		"overlapping subnet": "b-soon.crt",
+		"duplicate ip":       "c-dupe.crt",
+		"unknown ca":         "d-unknown.crt",
+		"blocklisted":        "e-blocked.crt",
+		"invalid":            "f-bad.crt",
+	}, found)
+
+	// table output
+	ob.Reset()
+	err = audit([]string{"-ca", caPath, "-path", certs, "-blocklist", blocklistPath}, ob, eb)
+	assert.Error(t, err)
+	assert.Contains(t, ob.String(), "PATH")
+	assert.Contains(t, ob.String(), "duplicate ip")
+	assert.Equal(t, "", eb.String())
+}
+
+func newAuditCA(t *testing.T, name string) (*cert.NebulaCertificate, ed25519.PrivateKey) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+
+	ca := &cert.NebulaCertificate{
+		Details: cert.NebulaCertificateDetails{
+			Names:     []string{name},
+			NotBefore: time.Now().Add(time.Hour * -1),
+			NotAfter:  time.Now().Add(time.Hour * 1000),
+			PublicKey: pub,
+			IsCA:      true,
+		},
+	}
+	assert.Nil(t, ca.Sign(priv))
+	return ca, priv
+}
+
+func writeAuditCert(t *testing.T, path string, ca *cert.NebulaCertificate, caKey ed25519.PrivateKey, name, ip string, subnets []*net.IPNet, d time.Duration) string {
+	issuer, err := ca.Sha256Sum()
+	assert.Nil(t, err)
+
+	i, ipNet, err := net.ParseCIDR(ip)
+	assert.Nil(t, err)
+	ipNet.IP = i
+
+	pub, _ := x25519Keypair()
+	c := cert.NebulaCertificate{
+		Details: cert.NebulaCertificateDetails{
+			Names:     []string{name},
+			Ips:       []*net.IPNet{ipNet},
+			Subnets:   subnets,
+			NotBefore: time.Now().Add(time.Minute * -1),
+			NotAfter:  time.Now().Add(d),
+			PublicKey: pub,
+			Issuer:    issuer,
+		},
+	}
+	assert.Nil(t, c.Sign(caKey))
+
+	b, err := c.MarshalToPEM()
+	assert.Nil(t, err)
+	assert.Nil(t, ioutil.WriteFile(path, b, 0600))
+
+	fp, err := c.Sha256Sum()
+	assert.Nil(t, err)
+	return fp
+}
@@ -26,6 +26,7 @@ type caFlags struct {
 	groups      *string
 	ips         *string
 	subnets     *string
+	extensions  *string
 }
 
 func newCaFlags() *caFlags {
@@ -39,6 +40,7 @@ func newCaFlags() *caFlags {
 	cf.groups = cf.set.String("groups", "", "Optional: comma separated list of groups. This will limit which groups subordinate certs can use")
 	cf.ips = cf.set.String("ips", "", "Optional: comma separated list of ip and network in CIDR notation. This will limit which ip addresses and networks subordinate certs can use")
 	cf.subnets = cf.set.String("subnets", "", "Optional: comma separated list of ip and network in CIDR notation. This will limit which subnet addresses and networks subordinate certs can use")
+	cf.extensions = cf.set.String("extensions", "", "Optional: comma separated list of key=value extensions. This will limit which extension keys subordinate certs can use, an empty value allows any value")
 	return &cf
 }
 
@@ -103,6 +105,11 @@ func ca(args []string, out io.Writer, errOut io.Writer) error {
 		}
 	}
 
+	extensions, err := parseExtensions(*cf.extensions)
+	if err != nil {
+		return err
+	}
+
 	pub, rawPriv, err := ed25519.GenerateKey(rand.Reader)
 	if err != nil {
 		return fmt.Errorf("error while generating ed25519 keys: %s", err)
@@ -110,14 +117,15 @@ func ca(args []string, out io.Writer, errOut io.Writer) error {
 
 	nc := cert.NebulaCertificate{
 		Details: cert.NebulaCertificateDetails{
-			Names:     strings.Split(*cf.name, ","),
-			Groups:    groups,
-			Ips:       ips,
-			Subnets:   subnets,
-			NotBefore: time.Now(),
-			NotAfter:  time.Now().Add(*cf.duration),
-			PublicKey: pub,
-			IsCA:      true,
+			Names:      strings.Split(*cf.name, ","),
+			Groups:     groups,
+			Ips:        ips,
+			Subnets:    subnets,
+			NotBefore:  time.Now(),
+			NotAfter:   time.Now().Add(*cf.duration),
+			PublicKey:  pub,
+			IsCA:       true,
+			Extensions: extensions,
 		},
 	}
 
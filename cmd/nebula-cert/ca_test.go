@@ -27,6 +27,8 @@ func Test_caHelp(t *testing.T) {
 		"Usage of "+os.Args[0]+" ca <flags>: create a self signed certificate authority\n"+
 			"  -duration duration\n"+
 			"    \tOptional: amount of time the certificate should be valid for. Valid time units are seconds: \"s\", minutes: \"m\", hours: \"h\" (default 8760h0m0s)\n"+
+			"  -extensions string\n"+
+			"    \tOptional: comma separated list of key=value extensions. This will limit which extension keys subordinate certs can use, an empty value allows any value\n"+
 			"  -groups string\n"+
 			"    \tOptional: comma separated list of groups. This will limit which groups subordinate certs can use\n"+
 			"  -ips string\n"+
@@ -84,7 +86,7 @@ func Test_ca(t *testing.T) {
 	// test proper cert with removed empty groups and subnets
 	ob.Reset()
 	eb.Reset()
-	args = []string{"-name", "test", "-duration", "100m", "-groups", "1,,   2    ,        ,,,3,4,5", "-out-crt", crtF.Name(), "-out-key", keyF.Name()}
+	args = []string{"-name", "test", "-duration", "100m", "-groups", "1,,   2    ,        ,,,3,4,5", "-extensions", "env=prod,, team", "-out-crt", crtF.Name(), "-out-key", keyF.Name()}
 	assert.Nil(t, ca(args, ob, eb))
 	assert.Equal(t, "", ob.String())
 	assert.Equal(t, "", eb.String())
@@ -101,10 +103,11 @@ func Test_ca(t *testing.T) {
 	assert.Len(t, b, 0)
 	assert.Nil(t, err)
 
-	assert.Equal(t, "test", lCrt.Details.Name)
+	assert.Equal(t, []string{"test"}, lCrt.Details.Names)
 	assert.Len(t, lCrt.Details.Ips, 0)
 	assert.True(t, lCrt.Details.IsCA)
 	assert.Equal(t, []string{"1", "2", "3", "4", "5"}, lCrt.Details.Groups)
+	assert.Equal(t, map[string]string{"env": "prod", "team": ""}, lCrt.Details.Extensions)
 	assert.Len(t, lCrt.Details.Subnets, 0)
 	assert.Len(t, lCrt.Details.PublicKey, 32)
 	assert.Equal(t, time.Duration(time.Minute*100), lCrt.Details.NotAfter.Sub(lCrt.Details.NotBefore))
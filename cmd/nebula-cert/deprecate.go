@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/slackhq/nebula/cert"
+)
+
+type deprecateFlags struct {
+	set         *flag.FlagSet
+	caPath      *string
+	fingerprint *string
+	after       *string
+	outPath     *string
+}
+
+func newDeprecateFlags() *deprecateFlags {
+	df := deprecateFlags{set: flag.NewFlagSet("deprecate", flag.ContinueOnError)}
+	df.set.Usage = func() {}
+	df.caPath = df.set.String("ca", "", "Required: path to a file containing one or more ca certificates")
+	df.fingerprint = df.set.String("fingerprint", "", "Required: fingerprint of the ca certificate to deprecate")
+	df.after = df.set.String("after", "", "Required: RFC3339 date after which the ca certificate is deprecated, ie 2021-03-01T00:00:00Z")
+	df.outPath = df.set.String("out", "", "Optional: path to write the updated ca bundle to, defaults to rewriting -ca")
+	return &df
+}
+
+func deprecate(args []string, out io.Writer, errOut io.Writer) error {
+	df := newDeprecateFlags()
+	err := df.set.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if err := mustFlagString("ca", df.caPath); err != nil {
+		return err
+	}
+	if err := mustFlagString("fingerprint", df.fingerprint); err != nil {
+		return err
+	}
+	if err := mustFlagString("after", df.after); err != nil {
+		return err
+	}
+
+	after, err := time.Parse(time.RFC3339, *df.after)
+	if err != nil {
+		return newHelpErrorf("invalid after definition: %s", err)
+	}
+
+	if *df.outPath == "" {
+		*df.outPath = *df.caPath
+	}
+
+	rest, err := ioutil.ReadFile(*df.caPath)
+	if err != nil {
+		return fmt.Errorf("error while reading ca: %s", err)
+	}
+
+	// Walk the bundle block by block so that comments and ordering are preserved
+	found := false
+	bundle := &bytes.Buffer{}
+	for {
+		i := bytes.Index(rest, []byte("-----BEGIN"))
+		if i < 0 {
+			bundle.Write(rest)
+			break
+		}
+		bundle.Write(rest[:i])
+
+		var p *pem.Block
+		p, rest = pem.Decode(rest[i:])
+		if p == nil || p.Type != cert.CertBanner {
+			return fmt.Errorf("error while parsing ca: bundle did not contain a proper nebula certificate")
+		}
+
+		c, err := cert.UnmarshalNebulaCertificate(p.Bytes)
+		if err != nil {
+			return fmt.Errorf("error while parsing ca: %s", err)
+		}
+
+		fp, err := c.Sha256Sum()
+		if err != nil {
+			return fmt.Errorf("error while getting ca fingerprint: %s", err)
+		}
+
+		if fp == *df.fingerprint {
+			if p.Headers == nil {
+				p.Headers = map[string]string{}
+			}
+			p.Headers[cert.DeprecatedAfterHeader] = after.Format(time.RFC3339)
+			found = true
+		}
+
+		bundle.Write(pem.EncodeToMemory(p))
+	}
+
+	if !found {
+		return fmt.Errorf("could not find a ca with fingerprint %s", *df.fingerprint)
+	}
+
+	// Make sure the result still loads
+	if _, err := cert.NewCAPoolFromBytes(bundle.Bytes()); err != nil {
+		return fmt.Errorf("error while verifying updated ca: %s", err)
+	}
+
+	err = ioutil.WriteFile(*df.outPath, bundle.Bytes(), 0600)
+	if err != nil {
+		return fmt.Errorf("error while writing out: %s", err)
+	}
+
+	return nil
+}
+
+func deprecateSummary() string {
+	return "deprecate <flags>: marks a certificate authority in a bundle as deprecated after a date"
+}
+
+func deprecateHelp(out io.Writer) {
+	df := newDeprecateFlags()
+	out.Write([]byte("Usage of " + os.Args[0] + " " + deprecateSummary() + "\n"))
+	df.set.SetOutput(out)
+	df.set.PrintDefaults()
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_deprecateSummary(t *testing.T) {
+	assert.Equal(t, "deprecate <flags>: marks a certificate authority in a bundle as deprecated after a date", deprecateSummary())
+}
+
+func Test_deprecateHelp(t *testing.T) {
+	ob := &bytes.Buffer{}
+	deprecateHelp(ob)
+	assert.Equal(
+		t,
+		"Usage of "+os.Args[0]+" deprecate <flags>: marks a certificate authority in a bundle as deprecated after a date\n"+
+			"  -after string\n"+
+			"    \tRequired: RFC3339 date after which the ca certificate is deprecated, ie 2021-03-01T00:00:00Z\n"+
+			"  -ca string\n"+
+			"    \tRequired: path to a file containing one or more ca certificates\n"+
+			"  -fingerprint string\n"+
+			"    \tRequired: fingerprint of the ca certificate to deprecate\n"+
+			"  -out string\n"+
+			"    \tOptional: path to write the updated ca bundle to, defaults to rewriting -ca\n",
+		ob.String(),
+	)
+}
+
+func Test_deprecate(t *testing.T) {
+	ob := &bytes.Buffer{}
+	eb := &bytes.Buffer{}
+
+	// required args
+	assertHelpError(t, deprecate([]string{"-fingerprint", "a", "-after", "b"}, ob, eb), "-ca is required")
+	assertHelpError(t, deprecate([]string{"-ca", "a", "-after", "b"}, ob, eb), "-fingerprint is required")
+	assertHelpError(t, deprecate([]string{"-ca", "a", "-fingerprint", "b"}, ob, eb), "-after is required")
+	assertHelpError(t, deprecate([]string{"-ca", "a", "-fingerprint", "b", "-after", "soon"}, ob, eb), "invalid after definition: parsing time \"soon\" as \"2006-01-02T15:04:05Z07:00\": cannot parse \"soon\" as \"2006\"")
+
+	dir, err := ioutil.TempDir("", "deprecate")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	oldCA, _ := newAuditCA(t, "old-ca")
+	newCA, _ := newAuditCA(t, "new-ca")
+	oldPem, _ := oldCA.MarshalToPEM()
+	newPem, _ := newCA.MarshalToPEM()
+
+	bundle := filepath.Join(dir, "ca.crt")
+	assert.Nil(t, ioutil.WriteFile(bundle, []byte("# old\n"+string(oldPem)+"# new\n"+string(newPem)), 0600))
+
+	// unknown fingerprint
+	err = deprecate([]string{"-ca", bundle, "-fingerprint", "nope", "-after", "2021-03-01T00:00:00Z"}, ob, eb)
+	assert.EqualError(t, err, "could not find a ca with fingerprint nope")
+
+	fp, _ := oldCA.Sha256Sum()
+	assert.Nil(t, deprecate([]string{"-ca", bundle, "-fingerprint", fp, "-after", "2021-03-01T00:00:00Z"}, ob, eb))
+	assert.Empty(t, ob.String())
+	assert.Empty(t, eb.String())
+
+	rb, err := ioutil.ReadFile(bundle)
+	assert.Nil(t, err)
+	assert.Contains(t, string(rb), "# old\n-----BEGIN NEBULA CERTIFICATE-----\nDeprecated-After: 2021-03-01T00:00:00Z\n")
+	assert.Contains(t, string(rb), "# new\n"+string(newPem))
+
+	caPool, err := cert.NewCAPoolFromBytes(rb)
+	assert.Nil(t, err)
+	assert.Len(t, caPool.CAs, 2)
+	assert.Equal(t, map[string]time.Time{fp: time.Date(2021, time.March, 1, 0, 0, 0, 0, time.UTC)}, caPool.GetDeprecations())
+}
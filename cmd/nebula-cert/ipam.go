@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/slackhq/nebula/cert"
+)
+
+// ipamEntry records a single certificate issuance
+type ipamEntry struct {
+	Fingerprint string    `json:"fingerprint"`
+	Names       []string  `json:"names"`
+	Ip          string    `json:"ip"`
+	Issued      time.Time `json:"issued"`
+	NotAfter    time.Time `json:"notAfter"`
+}
+
+// ipamState is the on disk issuance history used to hand out addresses
+type ipamState struct {
+	Issued []ipamEntry `json:"issued"`
+}
+
+// ipamUsage tracks which ips and names are currently assigned and to what
+type ipamUsage struct {
+	ips   map[uint32]string
+	names map[string]string
+}
+
+func newIpamUsage() *ipamUsage {
+	return &ipamUsage{
+		ips:   make(map[uint32]string),
+		names: make(map[string]string),
+	}
+}
+
+// loadIpamState reads an ipam state file, a missing file is treated as empty
+func loadIpamState(path string) (*ipamState, error) {
+	s := &ipamState{}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s, nil
+		}
+		return nil, err
+	}
+
+	err = json.Unmarshal(b, s)
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *ipamState) save(path string) error {
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, append(b, '\n'), 0600)
+}
+
+// record adds a newly issued certificate to the history
+func (s *ipamState) record(nc *cert.NebulaCertificate) error {
+	fp, err := nc.Sha256Sum()
+	if err != nil {
+		return err
+	}
+
+	s.Issued = append(s.Issued, ipamEntry{
+		Fingerprint: fp,
+		Names:       nc.Details.Names,
+		Ip:          nc.Details.Ips[0].String(),
+		Issued:      nc.Details.NotBefore,
+		NotAfter:    nc.Details.NotAfter,
+	})
+
+	return nil
+}
+
+// addState marks every unexpired issuance in the history as in use
+func (u *ipamUsage) addState(s *ipamState, now time.Time) error {
+	for _, e := range s.Issued {
+		if e.NotAfter.Before(now) {
+			continue
+		}
+
+		ip, _, err := net.ParseCIDR(e.Ip)
+		if err != nil {
+			return fmt.Errorf("invalid ip %s for %s: %s", e.Ip, e.Fingerprint, err)
+		}
+
+		u.add(e.Fingerprint, ip, e.Names)
+	}
+
+	return nil
+}
+
+// addDir marks every unexpired certificate found in dir as in use
+func (u *ipamUsage) addDir(dir string, now time.Time) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() || filepath.Ext(path) != ".crt" {
+			return nil
+		}
+
+		rawCert, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		for {
+			var c *cert.NebulaCertificate
+			c, rawCert, err = cert.UnmarshalNebulaCertificateFromPEM(rawCert)
+			if err != nil {
+				return fmt.Errorf("%s: %s", path, err)
+			}
+
+			if !c.Details.IsCA && !c.Expired(now) {
+				for _, ip := range c.Details.Ips {
+					u.add(path, ip.IP, c.Details.Names)
+				}
+			}
+
+			if rawCert == nil || len(rawCert) == 0 || strings.TrimSpace(string(rawCert)) == "" {
+				return nil
+			}
+		}
+	})
+}
+
+func (u *ipamUsage) add(owner string, ip net.IP, names []string) {
+	u.ips[ip2int(ip)] = owner
+	for _, n := range names {
+		u.names[n] = owner
+	}
+}
+
+// check returns an error if the ip or any of the names are already assigned
+func (u *ipamUsage) check(ip net.IP, names []string) error {
+	if owner, ok := u.ips[ip2int(ip)]; ok {
+		return fmt.Errorf("ip %s is already assigned to %s", ip, owner)
+	}
+
+	for _, n := range names {
+		if owner, ok := u.names[n]; ok {
+			return fmt.Errorf("name %s is already assigned to %s", n, owner)
+		}
+	}
+
+	return nil
+}
+
+// next returns the first unassigned address in the provided networks, skipping network and broadcast addresses
+func (u *ipamUsage) next(networks []*net.IPNet) (*net.IPNet, error) {
+	for _, n := range networks {
+		ip4 := n.IP.To4()
+		if ip4 == nil {
+			continue
+		}
+
+		mask := ip2int(n.Mask)
+		start := ip2int(ip4) & mask
+		end := start | ^mask
+
+		for i := start + 1; i < end; i++ {
+			if _, ok := u.ips[i]; !ok {
+				return &net.IPNet{IP: int2ip(i), Mask: n.Mask}, nil
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("no free ip addresses")
+}
+
+func ip2int(ip []byte) uint32 {
+	if len(ip) == 16 {
+		return binary.BigEndian.Uint32(ip[12:16])
+	}
+	return binary.BigEndian.Uint32(ip)
+}
+
+func int2ip(nn uint32) net.IP {
+	ip := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(ip, nn)
+	return ip
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"strings"
 )
 
 var Build string
@@ -71,6 +72,12 @@ func main() {
 		err = printCert(args[1:], os.Stdout, os.Stderr)
 	case "verify":
 		err = verify(args[1:], os.Stdout, os.Stderr)
+	case "audit":
+		err = audit(args[1:], os.Stdout, os.Stderr)
+	case "resign":
+		err = resign(args[1:], os.Stdout, os.Stderr)
+	case "deprecate":
+		err = deprecate(args[1:], os.Stdout, os.Stderr)
 	default:
 		err = fmt.Errorf("unknown mode: %s", args[0])
 	}
@@ -104,6 +111,12 @@ func handleError(mode string, e error, out io.Writer) int {
 			printHelp(out)
 		case "verify":
 			verifyHelp(out)
+		case "audit":
+			auditHelp(out)
+		case "resign":
+			resignHelp(out)
+		case "deprecate":
+			deprecateHelp(out)
 		}
 	}
 
@@ -127,6 +140,9 @@ func help(err string, out io.Writer) {
 	fmt.Fprintln(out, "    "+signSummary())
 	fmt.Fprintln(out, "    "+printSummary())
 	fmt.Fprintln(out, "    "+verifySummary())
+	fmt.Fprintln(out, "    "+auditSummary())
+	fmt.Fprintln(out, "    "+resignSummary())
+	fmt.Fprintln(out, "    "+deprecateSummary())
 }
 
 func mustFlagString(name string, val *string) error {
@@ -135,3 +151,36 @@ func mustFlagString(name string, val *string) error {
 	}
 	return nil
 }
+
+// parseExtensions parses a comma separated list of key=value pairs, a missing value is treated as empty
+func parseExtensions(s string) (map[string]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	ext := make(map[string]string)
+	for _, re := range strings.Split(s, ",") {
+		re = strings.TrimSpace(re)
+		if re == "" {
+			continue
+		}
+
+		kv := strings.SplitN(re, "=", 2)
+		k := strings.TrimSpace(kv[0])
+		if k == "" {
+			return nil, newHelpErrorf("invalid extension definition, missing key: %s", re)
+		}
+
+		if _, ok := ext[k]; ok {
+			return nil, newHelpErrorf("invalid extension definition, duplicate key: %s", k)
+		}
+
+		if len(kv) == 2 {
+			ext[k] = strings.TrimSpace(kv[1])
+		} else {
+			ext[k] = ""
+		}
+	}
+
+	return ext, nil
+}
@@ -22,7 +22,10 @@ func Test_help(t *testing.T) {
 		"    " + keygenSummary() + "\n" +
 		"    " + signSummary() + "\n" +
 		"    " + printSummary() + "\n" +
-		"    " + verifySummary() + "\n"
+		"    " + verifySummary() + "\n" +
+		"    " + auditSummary() + "\n" +
+		"    " + resignSummary() + "\n" +
+		"    " + deprecateSummary() + "\n"
 
 	ob := &bytes.Buffer{}
 
@@ -57,7 +60,7 @@ func Test_handleError(t *testing.T) {
 	assert.Equal(t, "Error: test error\n", ob.String())
 
 	// test all modes with help error
-	modes := map[string]func(io.Writer){"ca": caHelp, "print": printHelp, "sign": signHelp, "verify": verifyHelp}
+	modes := map[string]func(io.Writer){"ca": caHelp, "print": printHelp, "sign": signHelp, "verify": verifyHelp, "audit": auditHelp, "resign": resignHelp, "deprecate": deprecateHelp}
 	eb := &bytes.Buffer{}
 	for mode, fn := range modes {
 		ob.Reset()
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/slackhq/nebula/cert"
+)
+
+type resignFlags struct {
+	set         *flag.FlagSet
+	caKeyPath   *string
+	caCertPath  *string
+	certPath    *string
+	duration    *time.Duration
+	inPubPath   *string
+	outKeyPath  *string
+	outCertPath *string
+}
+
+func newResignFlags() *resignFlags {
+	rf := resignFlags{set: flag.NewFlagSet("resign", flag.ContinueOnError)}
+	rf.set.Usage = func() {}
+	rf.caKeyPath = rf.set.String("ca-key", "ca.key", "Optional: path to the new signing CA key")
+	rf.caCertPath = rf.set.String("ca-crt", "ca.crt", "Optional: path to the new signing CA cert")
+	rf.certPath = rf.set.String("crt", "", "Required: path to the existing certificate to re-issue")
+	rf.duration = rf.set.Duration("duration", 0, "Optional: how long the cert should be valid for. The default is 1 second before the signing cert expires. Valid time units are seconds: \"s\", minutes: \"m\", hours: \"h\"")
+	rf.inPubPath = rf.set.String("in-pub", "", "Optional (if out-key not set): path to read a previously generated public key")
+	rf.outKeyPath = rf.set.String("out-key", "", "Required (if in-pub not set): path to write the new private key to")
+	rf.outCertPath = rf.set.String("out-crt", "", "Required: path to write the new certificate to")
+	return &rf
+}
+
+func resign(args []string, out io.Writer, errOut io.Writer) error {
+	rf := newResignFlags()
+	err := rf.set.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if err := mustFlagString("ca-key", rf.caKeyPath); err != nil {
+		return err
+	}
+	if err := mustFlagString("ca-crt", rf.caCertPath); err != nil {
+		return err
+	}
+	if err := mustFlagString("crt", rf.certPath); err != nil {
+		return err
+	}
+	if err := mustFlagString("out-crt", rf.outCertPath); err != nil {
+		return err
+	}
+	if *rf.inPubPath != "" && *rf.outKeyPath != "" {
+		return newHelpErrorf("cannot set both -in-pub and -out-key")
+	}
+	if *rf.inPubPath == "" {
+		if err := mustFlagString("out-key", rf.outKeyPath); err != nil {
+			return err
+		}
+	}
+
+	rawCAKey, err := ioutil.ReadFile(*rf.caKeyPath)
+	if err != nil {
+		return fmt.Errorf("error while reading ca-key: %s", err)
+	}
+
+	caKey, _, err := cert.UnmarshalEd25519PrivateKey(rawCAKey)
+	if err != nil {
+		return fmt.Errorf("error while parsing ca-key: %s", err)
+	}
+
+	rawCACert, err := ioutil.ReadFile(*rf.caCertPath)
+	if err != nil {
+		return fmt.Errorf("error while reading ca-crt: %s", err)
+	}
+
+	caCert, _, err := cert.UnmarshalNebulaCertificateFromPEM(rawCACert)
+	if err != nil {
+		return fmt.Errorf("error while parsing ca-crt: %s", err)
+	}
+
+	issuer, err := caCert.Sha256Sum()
+	if err != nil {
+		return fmt.Errorf("error while getting -ca-crt fingerprint: %s", err)
+	}
+
+	if caCert.Expired(time.Now()) {
+		return fmt.Errorf("ca certificate is expired")
+	}
+
+	rawCert, err := ioutil.ReadFile(*rf.certPath)
+	if err != nil {
+		return fmt.Errorf("error while reading crt: %s", err)
+	}
+
+	oldCert, _, err := cert.UnmarshalNebulaCertificateFromPEM(rawCert)
+	if err != nil {
+		return fmt.Errorf("error while parsing crt: %s", err)
+	}
+
+	if oldCert.Details.IsCA {
+		return fmt.Errorf("refusing to re-issue a ca certificate")
+	}
+
+	// if no duration is given, expire one second before the root expires
+	if *rf.duration <= 0 {
+		*rf.duration = time.Until(caCert.Details.NotAfter) - time.Second*1
+	}
+
+	var pub, rawPriv []byte
+	if *rf.inPubPath != "" {
+		rawPub, err := ioutil.ReadFile(*rf.inPubPath)
+		if err != nil {
+			return fmt.Errorf("error while reading in-pub: %s", err)
+		}
+		pub, _, err = cert.UnmarshalX25519PublicKey(rawPub)
+		if err != nil {
+			return fmt.Errorf("error while parsing in-pub: %s", err)
+		}
+	} else {
+		pub, rawPriv = x25519Keypair()
+	}
+
+	// Carry over everything that describes the host, the key, validity and issuer are new
+	nc := oldCert.Copy()
+	nc.Signature = nil
+	nc.Details.NotBefore = time.Now()
+	nc.Details.NotAfter = time.Now().Add(*rf.duration)
+	nc.Details.PublicKey = pub
+	nc.Details.Issuer = issuer
+
+	if err := nc.CheckRootConstrains(caCert); err != nil {
+		return fmt.Errorf("refusing to sign, root certificate constraints violated: %s", err)
+	}
+
+	if _, err := os.Stat(*rf.outCertPath); err == nil {
+		return fmt.Errorf("refusing to overwrite existing cert: %s", *rf.outCertPath)
+	}
+
+	err = nc.Sign(caKey)
+	if err != nil {
+		return fmt.Errorf("error while signing: %s", err)
+	}
+
+	if *rf.inPubPath == "" {
+		if _, err := os.Stat(*rf.outKeyPath); err == nil {
+			return fmt.Errorf("refusing to overwrite existing key: %s", *rf.outKeyPath)
+		}
+
+		err = ioutil.WriteFile(*rf.outKeyPath, cert.MarshalX25519PrivateKey(rawPriv), 0600)
+		if err != nil {
+			return fmt.Errorf("error while writing out-key: %s", err)
+		}
+	}
+
+	b, err := nc.MarshalToPEM()
+	if err != nil {
+		return fmt.Errorf("error while marshalling certificate: %s", err)
+	}
+
+	err = ioutil.WriteFile(*rf.outCertPath, b, 0600)
+	if err != nil {
+		return fmt.Errorf("error while writing out-crt: %s", err)
+	}
+
+	return nil
+}
+
+func resignSummary() string {
+	return "resign <flags>: re-issue an existing certificate under a new certificate authority with a new key"
+}
+
+func resignHelp(out io.Writer) {
+	rf := newResignFlags()
+	out.Write([]byte("Usage of " + os.Args[0] + " " + resignSummary() + "\n"))
+	rf.set.SetOutput(out)
+	rf.set.PrintDefaults()
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_resignSummary(t *testing.T) {
+	assert.Equal(t, "resign <flags>: re-issue an existing certificate under a new certificate authority with a new key", resignSummary())
+}
+
+func Test_resignHelp(t *testing.T) {
+	ob := &bytes.Buffer{}
+	resignHelp(ob)
+	assert.Equal(
+		t,
+		"Usage of "+os.Args[0]+" resign <flags>: re-issue an existing certificate under a new certificate authority with a new key\n"+
+			"  -ca-crt string\n"+
+			"    \tOptional: path to the new signing CA cert (default \"ca.crt\")\n"+
+			"  -ca-key string\n"+
+			"    \tOptional: path to the new signing CA key (default \"ca.key\")\n"+
+			"  -crt string\n"+
+			"    \tRequired: path to the existing certificate to re-issue\n"+
+			"  -duration duration\n"+
+			"    \tOptional: how long the cert should be valid for. The default is 1 second before the signing cert expires. Valid time units are seconds: \"s\", minutes: \"m\", hours: \"h\"\n"+
+			"  -in-pub string\n"+
+			"    \tOptional (if out-key not set): path to read a previously generated public key\n"+
+			"  -out-crt string\n"+
+			"    \tRequired: path to write the new certificate to\n"+
+			"  -out-key string\n"+
+			"    \tRequired (if in-pub not set): path to write the new private key to\n",
+		ob.String(),
+	)
+}
+
+func Test_resign(t *testing.T) {
+	ob := &bytes.Buffer{}
+	eb := &bytes.Buffer{}
+
+	// required args
+	assertHelpError(t, resign([]string{"-out-crt", "nope", "-out-key", "nope"}, ob, eb), "-crt is required")
+	assertHelpError(t, resign([]string{"-crt", "nope", "-out-key", "nope"}, ob, eb), "-out-crt is required")
+	assertHelpError(t, resign([]string{"-crt", "nope", "-out-crt", "nope"}, ob, eb), "-out-key is required")
+	assertHelpError(t, resign([]string{"-crt", "nope", "-out-crt", "nope", "-out-key", "nope", "-in-pub", "nope"}, ob, eb), "cannot set both -in-pub and -out-key")
+	assert.Empty(t, ob.String())
+	assert.Empty(t, eb.String())
+
+	dir, err := ioutil.TempDir("", "resign")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	oldCA, oldKey := newAuditCA(t, "old-ca")
+	newCA, newKey := newAuditCA(t, "new-ca")
+
+	caCrt := filepath.Join(dir, "ca.crt")
+	caKey := filepath.Join(dir, "ca.key")
+	b, _ := newCA.MarshalToPEM()
+	assert.Nil(t, ioutil.WriteFile(caCrt, b, 0600))
+	assert.Nil(t, ioutil.WriteFile(caKey, cert.MarshalEd25519PrivateKey(newKey), 0600))
+
+	_, sn, _ := net.ParseCIDR("192.168.0.0/24")
+	oldCrt := filepath.Join(dir, "host.crt")
+	writeAuditCert(t, oldCrt, oldCA, oldKey, "host", "10.1.0.1/16", []*net.IPNet{sn}, time.Hour)
+
+	// missing crt
+	err = resign([]string{"-ca-crt", caCrt, "-ca-key", caKey, "-crt", "does_not_exist", "-out-crt", "nope", "-out-key", "nope"}, ob, eb)
+	assert.EqualError(t, err, "error while reading crt: open does_not_exist: "+NoSuchFileError)
+
+	// refuse to resign a ca
+	err = resign([]string{"-ca-crt", caCrt, "-ca-key", caKey, "-crt", caCrt, "-out-crt", "nope", "-out-key", "nope"}, ob, eb)
+	assert.EqualError(t, err, "refusing to re-issue a ca certificate")
+
+	newCrt := filepath.Join(dir, "host-new.crt")
+	newCrtKey := filepath.Join(dir, "host-new.key")
+	args := []string{"-ca-crt", caCrt, "-ca-key", caKey, "-crt", oldCrt, "-out-crt", newCrt, "-out-key", newCrtKey, "-duration", "100m"}
+	assert.Nil(t, resign(args, ob, eb))
+	assert.Empty(t, ob.String())
+	assert.Empty(t, eb.String())
+
+	rb, _ := ioutil.ReadFile(oldCrt)
+	old, _, err := cert.UnmarshalNebulaCertificateFromPEM(rb)
+	assert.Nil(t, err)
+
+	rb, _ = ioutil.ReadFile(newCrt)
+	nc, _, err := cert.UnmarshalNebulaCertificateFromPEM(rb)
+	assert.Nil(t, err)
+
+	rb, _ = ioutil.ReadFile(newCrtKey)
+	priv, _, err := cert.UnmarshalX25519PrivateKey(rb)
+	assert.Nil(t, err)
+
+	assert.Equal(t, old.Details.Names, nc.Details.Names)
+	assert.Equal(t, old.Details.Ips[0].String(), nc.Details.Ips[0].String())
+	assert.Equal(t, old.Details.Subnets[0].String(), nc.Details.Subnets[0].String())
+	assert.NotEqual(t, old.Details.PublicKey, nc.Details.PublicKey)
+	assert.Nil(t, nc.VerifyPrivateKey(priv))
+	assert.Equal(t, time.Duration(time.Minute*100), nc.Details.NotAfter.Sub(nc.Details.NotBefore))
+
+	caPool := cert.NewCAPool()
+	b, _ = newCA.MarshalToPEM()
+	_, err = caPool.AddCACertificate(b)
+	assert.Nil(t, err)
+	v, err := nc.Verify(time.Now(), caPool)
+	assert.True(t, v)
+	assert.Nil(t, err)
+
+	// refuse to overwrite
+	assert.EqualError(t, resign(args, ob, eb), "refusing to overwrite existing cert: "+newCrt)
+}
@@ -29,6 +29,10 @@ type signFlags struct {
 	outQRPath   *string
 	groups      *string
 	subnets     *string
+	extensions  *string
+	ipamPath    *string
+	ipamDir     *string
+	force       *bool
 }
 
 func newSignFlags() *signFlags {
@@ -37,7 +41,7 @@ func newSignFlags() *signFlags {
 	sf.caKeyPath = sf.set.String("ca-key", "ca.key", "Optional: path to the signing CA key")
 	sf.caCertPath = sf.set.String("ca-crt", "ca.crt", "Optional: path to the signing CA cert")
 	sf.name = sf.set.String("name", "", "Required: name of the cert, usually a hostname")
-	sf.ip = sf.set.String("ip", "", "Required: ip and network in CIDR notation to assign the cert")
+	sf.ip = sf.set.String("ip", "", "Required (if ipam and ipam-dir not set): ip and network in CIDR notation to assign the cert")
 	sf.duration = sf.set.Duration("duration", 0, "Optional: how long the cert should be valid for. The default is 1 second before the signing cert expires. Valid time units are seconds: \"s\", minutes: \"m\", hours: \"h\"")
 	sf.inPubPath = sf.set.String("in-pub", "", "Optional (if out-key not set): path to read a previously generated public key")
 	sf.outKeyPath = sf.set.String("out-key", "", "Optional (if in-pub not set): path to write the private key to")
@@ -45,6 +49,10 @@ func newSignFlags() *signFlags {
 	sf.outQRPath = sf.set.String("out-qr", "", "Optional: output a qr code image (png) of the certificate")
 	sf.groups = sf.set.String("groups", "", "Optional: comma separated list of groups")
 	sf.subnets = sf.set.String("subnets", "", "Optional: comma separated list of subnet this cert can serve for")
+	sf.extensions = sf.set.String("extensions", "", "Optional: comma separated list of key=value extensions")
+	sf.ipamPath = sf.set.String("ipam", "", "Optional: path to an ipam state file used to pick the next free ip and to record issuance history")
+	sf.ipamDir = sf.set.String("ipam-dir", "", "Optional: path to a directory of issued certificates used to pick the next free ip")
+	sf.force = sf.set.Bool("force", false, "Optional: sign even if the ip or name is already assigned")
 	return &sf
 
 }
@@ -65,8 +73,10 @@ func signCert(args []string, out io.Writer, errOut io.Writer) error {
 	if err := mustFlagString("name", sf.name); err != nil {
 		return err
 	}
-	if err := mustFlagString("ip", sf.ip); err != nil {
-		return err
+	if *sf.ipamPath == "" && *sf.ipamDir == "" {
+		if err := mustFlagString("ip", sf.ip); err != nil {
+			return err
+		}
 	}
 	if *sf.inPubPath != "" && *sf.outKeyPath != "" {
 		return newHelpErrorf("cannot set both -in-pub and -out-key")
@@ -106,11 +116,52 @@ func signCert(args []string, out io.Writer, errOut io.Writer) error {
 		*sf.duration = time.Until(caCert.Details.NotAfter) - time.Second*1
 	}
 
-	ip, ipNet, err := net.ParseCIDR(*sf.ip)
-	if err != nil {
-		return newHelpErrorf("invalid ip definition: %s", err)
+	var ipam *ipamState
+	usage := newIpamUsage()
+	if *sf.ipamPath != "" {
+		ipam, err = loadIpamState(*sf.ipamPath)
+		if err != nil {
+			return fmt.Errorf("error while reading ipam: %s", err)
+		}
+
+		if err := usage.addState(ipam, time.Now()); err != nil {
+			return fmt.Errorf("error while reading ipam: %s", err)
+		}
+	}
+
+	if *sf.ipamDir != "" {
+		if err := usage.addDir(*sf.ipamDir, time.Now()); err != nil {
+			return fmt.Errorf("error while reading ipam-dir: %s", err)
+		}
+	}
+
+	var ipNet *net.IPNet
+	if *sf.ip != "" {
+		var ip net.IP
+		ip, ipNet, err = net.ParseCIDR(*sf.ip)
+		if err != nil {
+			return newHelpErrorf("invalid ip definition: %s", err)
+		}
+		ipNet.IP = ip
+
+	} else {
+		if len(caCert.Details.Ips) == 0 {
+			return newHelpErrorf("-ip is required, the ca certificate does not limit ip networks")
+		}
+
+		ipNet, err = usage.next(caCert.Details.Ips)
+		if err != nil {
+			return fmt.Errorf("error while picking an ip: %s", err)
+		}
+
+		fmt.Fprintf(out, "Assigned ip %s\n", ipNet)
+	}
+
+	if !*sf.force {
+		if err := usage.check(ipNet.IP, strings.Split(*sf.name, ",")); err != nil {
+			return fmt.Errorf("refusing to sign, %s", err)
+		}
 	}
-	ipNet.IP = ip
 
 	groups := []string{}
 	if *sf.groups != "" {
@@ -136,6 +187,11 @@ func signCert(args []string, out io.Writer, errOut io.Writer) error {
 		}
 	}
 
+	extensions, err := parseExtensions(*sf.extensions)
+	if err != nil {
+		return err
+	}
+
 	var pub, rawPriv []byte
 	if *sf.inPubPath != "" {
 		rawPub, err := ioutil.ReadFile(*sf.inPubPath)
@@ -152,15 +208,16 @@ func signCert(args []string, out io.Writer, errOut io.Writer) error {
 
 	nc := cert.NebulaCertificate{
 		Details: cert.NebulaCertificateDetails{
-			Names:     strings.Split(*sf.name, ","),
-			Ips:       []*net.IPNet{ipNet},
-			Groups:    groups,
-			Subnets:   subnets,
-			NotBefore: time.Now(),
-			NotAfter:  time.Now().Add(*sf.duration),
-			PublicKey: pub,
-			IsCA:      false,
-			Issuer:    issuer,
+			Names:      strings.Split(*sf.name, ","),
+			Ips:        []*net.IPNet{ipNet},
+			Groups:     groups,
+			Subnets:    subnets,
+			NotBefore:  time.Now(),
+			NotAfter:   time.Now().Add(*sf.duration),
+			PublicKey:  pub,
+			IsCA:       false,
+			Issuer:     issuer,
+			Extensions: extensions,
 		},
 	}
 
@@ -206,6 +263,17 @@ func signCert(args []string, out io.Writer, errOut io.Writer) error {
 		return fmt.Errorf("error while writing out-crt: %s", err)
 	}
 
+	if ipam != nil {
+		if err := ipam.record(&nc); err != nil {
+			return fmt.Errorf("error while recording issuance: %s", err)
+		}
+
+		err = ipam.save(*sf.ipamPath)
+		if err != nil {
+			return fmt.Errorf("error while writing ipam: %s", err)
+		}
+	}
+
 	if *sf.outQRPath != "" {
 		b, err = qrcode.Encode(string(b), qrcode.Medium, -5)
 		if err != nil {
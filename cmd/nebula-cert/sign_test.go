@@ -6,7 +6,9 @@ import (
 	"bytes"
 	"crypto/rand"
 	"io/ioutil"
+	"net"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -33,12 +35,20 @@ func Test_signHelp(t *testing.T) {
 			"    \tOptional: path to the signing CA key (default \"ca.key\")\n"+
 			"  -duration duration\n"+
 			"    \tOptional: how long the cert should be valid for. The default is 1 second before the signing cert expires. Valid time units are seconds: \"s\", minutes: \"m\", hours: \"h\"\n"+
+			"  -extensions string\n"+
+			"    \tOptional: comma separated list of key=value extensions\n"+
+			"  -force\n"+
+			"    \tOptional: sign even if the ip or name is already assigned\n"+
 			"  -groups string\n"+
 			"    \tOptional: comma separated list of groups\n"+
 			"  -in-pub string\n"+
 			"    \tOptional (if out-key not set): path to read a previously generated public key\n"+
 			"  -ip string\n"+
-			"    \tRequired: ip and network in CIDR notation to assign the cert\n"+
+			"    \tRequired (if ipam and ipam-dir not set): ip and network in CIDR notation to assign the cert\n"+
+			"  -ipam string\n"+
+			"    \tOptional: path to an ipam state file used to pick the next free ip and to record issuance history\n"+
+			"  -ipam-dir string\n"+
+			"    \tOptional: path to a directory of issued certificates used to pick the next free ip\n"+
 			"  -name string\n"+
 			"    \tRequired: name of the cert, usually a hostname\n"+
 			"  -out-crt string\n"+
@@ -117,7 +127,7 @@ func Test_signCert(t *testing.T) {
 	// write a proper ca cert for later
 	ca := cert.NebulaCertificate{
 		Details: cert.NebulaCertificateDetails{
-			Name:      "ca",
+			Names:     []string{"ca"},
 			NotBefore: time.Now(),
 			NotAfter:  time.Now().Add(time.Minute * 200),
 			PublicKey: caPub,
@@ -197,7 +207,7 @@ func Test_signCert(t *testing.T) {
 	// test proper cert with removed empty groups and subnets
 	ob.Reset()
 	eb.Reset()
-	args = []string{"-ca-crt", caCrtF.Name(), "-ca-key", caKeyF.Name(), "-name", "test", "-ip", "1.1.1.1/24", "-out-crt", crtF.Name(), "-out-key", keyF.Name(), "-duration", "100m", "-subnets", "10.1.1.1/32, ,   10.2.2.2/32   ,   ,  ,, 10.5.5.5/32", "-groups", "1,,   2    ,        ,,,3,4,5"}
+	args = []string{"-ca-crt", caCrtF.Name(), "-ca-key", caKeyF.Name(), "-name", "test", "-ip", "1.1.1.1/24", "-out-crt", crtF.Name(), "-out-key", keyF.Name(), "-duration", "100m", "-subnets", "10.1.1.1/32, ,   10.2.2.2/32   ,   ,  ,, 10.5.5.5/32", "-groups", "1,,   2    ,        ,,,3,4,5", "-extensions", "env=prod, team=ops"}
 	assert.Nil(t, signCert(args, ob, eb))
 	assert.Empty(t, ob.String())
 	assert.Empty(t, eb.String())
@@ -214,11 +224,12 @@ func Test_signCert(t *testing.T) {
 	assert.Len(t, b, 0)
 	assert.Nil(t, err)
 
-	assert.Equal(t, "test", lCrt.Details.Name)
+	assert.Equal(t, []string{"test"}, lCrt.Details.Names)
 	assert.Equal(t, "1.1.1.1/24", lCrt.Details.Ips[0].String())
 	assert.Len(t, lCrt.Details.Ips, 1)
 	assert.False(t, lCrt.Details.IsCA)
 	assert.Equal(t, []string{"1", "2", "3", "4", "5"}, lCrt.Details.Groups)
+	assert.Equal(t, map[string]string{"env": "prod", "team": "ops"}, lCrt.Details.Extensions)
 	assert.Len(t, lCrt.Details.Subnets, 3)
 	assert.Len(t, lCrt.Details.PublicKey, 32)
 	assert.Equal(t, time.Duration(time.Minute*100), lCrt.Details.NotAfter.Sub(lCrt.Details.NotBefore))
@@ -289,3 +300,80 @@ func Test_signCert(t *testing.T) {
 	assert.Empty(t, ob.String())
 	assert.Empty(t, eb.String())
 }
+
+func Test_signCert_ipam(t *testing.T) {
+	ob := &bytes.Buffer{}
+	eb := &bytes.Buffer{}
+
+	dir, err := ioutil.TempDir("", "sign-ipam")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	_, caNet, _ := net.ParseCIDR("10.1.0.0/29")
+	caPub, caPriv, _ := ed25519.GenerateKey(rand.Reader)
+	ca := cert.NebulaCertificate{
+		Details: cert.NebulaCertificateDetails{
+			Names:     []string{"ca"},
+			Ips:       []*net.IPNet{caNet},
+			NotBefore: time.Now(),
+			NotAfter:  time.Now().Add(time.Minute * 200),
+			PublicKey: caPub,
+			IsCA:      true,
+		},
+	}
+	assert.Nil(t, ca.Sign(caPriv))
+	b, _ := ca.MarshalToPEM()
+
+	caCrt := filepath.Join(dir, "ca.crt")
+	caKey := filepath.Join(dir, "ca.key")
+	assert.Nil(t, ioutil.WriteFile(caCrt, b, 0600))
+	assert.Nil(t, ioutil.WriteFile(caKey, cert.MarshalEd25519PrivateKey(caPriv), 0600))
+
+	certs := filepath.Join(dir, "certs")
+	assert.Nil(t, os.Mkdir(certs, 0700))
+	state := filepath.Join(dir, "ipam.json")
+
+	sign := func(name string, extra ...string) error {
+		ob.Reset()
+		eb.Reset()
+		args := []string{"-ca-crt", caCrt, "-ca-key", caKey, "-name", name, "-duration", "100m", "-out-crt", filepath.Join(certs, name+".crt"), "-out-key", filepath.Join(dir, name+".key")}
+		return signCert(append(args, extra...), ob, eb)
+	}
+
+	// first free addresses are handed out in order
+	assert.Nil(t, sign("a", "-ipam", state))
+	assert.Equal(t, "Assigned ip 10.1.0.1/29\n", ob.String())
+	assert.Empty(t, eb.String())
+
+	assert.Nil(t, sign("b", "-ipam", state))
+	assert.Equal(t, "Assigned ip 10.1.0.2/29\n", ob.String())
+
+	is, err := loadIpamState(state)
+	assert.Nil(t, err)
+	assert.Len(t, is.Issued, 2)
+	assert.Equal(t, []string{"a"}, is.Issued[0].Names)
+	assert.Equal(t, "10.1.0.1/29", is.Issued[0].Ip)
+	assert.Len(t, is.Issued[0].Fingerprint, 64)
+
+	// duplicates are refused
+	assert.EqualError(t, sign("a", "-ipam", state), "refusing to sign, name a is already assigned to "+is.Issued[0].Fingerprint)
+	assert.EqualError(t, sign("c", "-ipam", state, "-ip", "10.1.0.2/29"), "refusing to sign, ip 10.1.0.2 is already assigned to "+is.Issued[1].Fingerprint)
+
+	// unless forced
+	assert.Nil(t, sign("c", "-ipam", state, "-ip", "10.1.0.2/29", "-force"))
+	assert.Empty(t, ob.String())
+	is, err = loadIpamState(state)
+	assert.Nil(t, err)
+	assert.Len(t, is.Issued, 3)
+
+	// a directory of issued certs works the same way
+	assert.Nil(t, sign("d", "-ipam-dir", certs))
+	assert.Equal(t, "Assigned ip 10.1.0.3/29\n", ob.String())
+	assert.EqualError(t, sign("b", "-ipam-dir", certs), "refusing to sign, name b is already assigned to "+filepath.Join(certs, "b.crt"))
+
+	// running out of addresses
+	for _, n := range []string{"e", "f", "g"} {
+		assert.Nil(t, sign(n, "-ipam-dir", certs))
+	}
+	assert.EqualError(t, sign("h", "-ipam-dir", certs), "error while picking an ip: no free ip addresses")
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/slackhq/nebula"
+)
+
+var Build string
+
+type command struct {
+	name    string
+	usage   string
+	summary string
+	method  string
+	// minArgs and maxArgs bound the positional arguments, the vpn ip followed by the remote
+	minArgs int
+	maxArgs int
+	// flags adds the flags of the command, if any
+	flags func(fs *flag.FlagSet, args *nebula.AdminArgs)
+}
+
+func pendingFlag(fs *flag.FlagSet, args *nebula.AdminArgs) {
+	fs.BoolVar(&args.Pending, "pending", false, "Use the pending (handshaking) hostmap")
+}
+
+var commands = []command{
+	{
+		name:    "hostmap",
+		usage:   "[-pending]",
+		summary: "List the tunnels in the hostmap",
+		method:  "ListHostmap",
+		flags:   pendingFlag,
+	},
+	{
+		name:    "hostinfo",
+		usage:   "[-pending] <vpn ip>",
+		summary: "Show the tunnel to a vpn ip",
+		method:  "GetHostInfoByVpnIP",
+		minArgs: 1,
+		maxArgs: 1,
+		flags:   pendingFlag,
+	},
+	{
+		name:    "set-remote",
+		usage:   "<vpn ip> <ip:port>",
+		summary: "Force the tunnel to a vpn ip to use a remote",
+		method:  "SetRemoteForTunnel",
+		minArgs: 2,
+		maxArgs: 2,
+	},
+	{
+		name:    "close-tunnel",
+		usage:   "[-local-only] <vpn ip>",
+		summary: "Close the tunnel to a vpn ip",
+		method:  "CloseTunnel",
+		minArgs: 1,
+		maxArgs: 1,
+		flags: func(fs *flag.FlagSet, args *nebula.AdminArgs) {
+			fs.BoolVar(&args.LocalOnly, "local-only", false, "Do not tell the remote host that the tunnel is being closed")
+		},
+	},
+	{
+		name:    "close-all-tunnels",
+		usage:   "[-exclude-lighthouses]",
+		summary: "Close every tunnel and print how many were closed",
+		method:  "CloseAllTunnels",
+		flags: func(fs *flag.FlagSet, args *nebula.AdminArgs) {
+			fs.BoolVar(&args.ExcludeLighthouses, "exclude-lighthouses", false, "Leave the tunnels to lighthouses open")
+		},
+	},
+	{
+		name:    "reload",
+		summary: "Reload the config from disk",
+		method:  "Reload",
+	},
+	{
+		name:    "query-lighthouse",
+		usage:   "<vpn ip>",
+		summary: "Query the lighthouses for the remotes of a vpn ip",
+		method:  "QueryLighthouse",
+		minArgs: 1,
+		maxArgs: 1,
+	},
+	{
+		name:    "print-cert",
+		usage:   "[vpn ip]",
+		summary: "Print our certificate, or the certificate of the tunnel to a vpn ip",
+		method:  "PrintCert",
+		maxArgs: 1,
+	},
+	{
+		name:    "stats",
+		summary: "Print the current value of every metric",
+		method:  "Stats",
+	},
+}
+
+// parse fills args from the flags and arguments of the command
+func (c *command) parse(fs *flag.FlagSet, a []string, args *nebula.AdminArgs) error {
+	if c.flags != nil {
+		c.flags(fs, args)
+	}
+
+	if err := fs.Parse(a); err != nil {
+		return err
+	}
+
+	rest := fs.Args()
+	if len(rest) < c.minArgs || len(rest) > c.maxArgs {
+		fs.Usage()
+		return fmt.Errorf("%s takes between %d and %d arguments, got %d", c.name, c.minArgs, c.maxArgs, len(rest))
+	}
+
+	if len(rest) > 0 {
+		args.VpnIP = rest[0]
+	}
+	if len(rest) > 1 {
+		args.Remote = rest[1]
+	}
+	return nil
+}
+
+func findCommand(name string) *command {
+	for i := range commands {
+		if commands[i].name == name {
+			return &commands[i]
+		}
+	}
+	return nil
+}
+
+func main() {
+	flag.Usage = func() {
+		help("", os.Stderr)
+	}
+
+	socket := flag.String("socket", "/var/run/nebula.sock", "Path to the admin socket, `admin.listen` in the nebula config")
+	network := flag.String("network", "", "Name of the network under `networks` to manage, the base network if empty")
+	timeout := flag.Duration("timeout", time.Second*10, "How long to wait for nebula to respond")
+	printVersion := flag.Bool("version", false, "Print version")
+	flag.Parse()
+
+	if *printVersion {
+		fmt.Printf("Version: %v\n", Build)
+		os.Exit(0)
+	}
+
+	args := flag.Args()
+	if len(args) < 1 {
+		help("No command was provided", os.Stderr)
+		os.Exit(1)
+	}
+
+	dial := func() (*rpc.Client, error) {
+		conn, err := net.DialTimeout("unix", *socket, *timeout)
+		if err != nil {
+			return nil, err
+		}
+		_ = conn.SetDeadline(time.Now().Add(*timeout))
+		return jsonrpc.NewClient(conn), nil
+	}
+
+	err := run(args, *network, dial, os.Stdout, os.Stderr)
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(1)
+	}
+}
+
+// run parses the command in a, calls it over the client returned by dial and prints the reply as json to out
+func run(a []string, network string, dial func() (*rpc.Client, error), out io.Writer, errOut io.Writer) error {
+	cmd := findCommand(a[0])
+	if cmd == nil {
+		help("", errOut)
+		return fmt.Errorf("unknown command: %s", a[0])
+	}
+
+	fs := flag.NewFlagSet(cmd.name, flag.ContinueOnError)
+	fs.SetOutput(errOut)
+	fs.Usage = func() {
+		fmt.Fprintf(errOut, "Usage: %s %s\n  %s\n", os.Args[0], strings.TrimSpace(cmd.name+" "+cmd.usage), cmd.summary)
+		fs.PrintDefaults()
+	}
+
+	args := nebula.AdminArgs{Network: network}
+	if err := cmd.parse(fs, a[1:], &args); err != nil {
+		return err
+	}
+
+	client, err := dial()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	var reply json.RawMessage
+	err = client.Call(nebula.AdminServiceName+"."+cmd.method, &args, &reply)
+	if err != nil {
+		return err
+	}
+
+	b := &bytes.Buffer{}
+	if err := json.Indent(b, reply, "", "    "); err != nil {
+		return err
+	}
+	b.WriteByte('\n')
+	_, err = b.WriteTo(out)
+	return err
+}
+
+func help(err string, out io.Writer) {
+	if err != "" {
+		fmt.Fprintln(out, "Error:", err)
+		fmt.Fprintln(out, "")
+	}
+
+	fmt.Fprintf(out, "Usage of %s <global flags> <command>:\n", os.Args[0])
+	fmt.Fprintln(out, "  Global flags:")
+	flag.CommandLine.SetOutput(out)
+	flag.PrintDefaults()
+	fmt.Fprintln(out, "")
+	fmt.Fprintln(out, "  Commands:")
+	for _, c := range commands {
+		fmt.Fprintf(out, "    %s: %s\n", strings.TrimSpace(c.name+" "+c.usage), c.summary)
+	}
+}
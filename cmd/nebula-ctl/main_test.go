@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"testing"
+
+	"github.com/slackhq/nebula"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeAdmin stands in for nebula.AdminService and remembers the last call it got
+type fakeAdmin struct {
+	method string
+	args   nebula.AdminArgs
+}
+
+func (f *fakeAdmin) record(method string, args *nebula.AdminArgs) {
+	f.method = method
+	f.args = *args
+}
+
+func (f *fakeAdmin) ListHostmap(args *nebula.AdminArgs, reply *[]string) error {
+	f.record("ListHostmap", args)
+	*reply = []string{"a", "b"}
+	return nil
+}
+
+func (f *fakeAdmin) CloseTunnel(args *nebula.AdminArgs, reply *bool) error {
+	f.record("CloseTunnel", args)
+	*reply = true
+	return nil
+}
+
+func (f *fakeAdmin) SetRemoteForTunnel(args *nebula.AdminArgs, reply *bool) error {
+	f.record("SetRemoteForTunnel", args)
+	return errors.New("could not find tunnel for vpn ip: " + args.VpnIP)
+}
+
+func newFakeDial(t *testing.T, f *fakeAdmin) func() (*rpc.Client, error) {
+	server := rpc.NewServer()
+	assert.Nil(t, server.RegisterName(nebula.AdminServiceName, f))
+
+	return func() (*rpc.Client, error) {
+		c, s := net.Pipe()
+		go server.ServeCodec(jsonrpc.NewServerCodec(s))
+		return jsonrpc.NewClient(c), nil
+	}
+}
+
+func Test_run(t *testing.T) {
+	f := &fakeAdmin{}
+	dial := newFakeDial(t, f)
+	ob := &bytes.Buffer{}
+	eb := &bytes.Buffer{}
+
+	assert.Nil(t, run([]string{"hostmap", "-pending"}, "", dial, ob, eb))
+	assert.Equal(t, "ListHostmap", f.method)
+	assert.Equal(t, nebula.AdminArgs{Pending: true}, f.args)
+	assert.Equal(t, "[\n    \"a\",\n    \"b\"\n]\n", ob.String())
+
+	ob.Reset()
+	assert.Nil(t, run([]string{"close-tunnel", "-local-only", "10.1.0.2"}, "other", dial, ob, eb))
+	assert.Equal(t, "CloseTunnel", f.method)
+	assert.Equal(t, nebula.AdminArgs{Network: "other", VpnIP: "10.1.0.2", LocalOnly: true}, f.args)
+	assert.Equal(t, "true\n", ob.String())
+
+	// Errors from nebula are returned as is
+	ob.Reset()
+	err := run([]string{"set-remote", "10.1.0.2", "1.1.1.1:4242"}, "", dial, ob, eb)
+	assert.EqualError(t, err, "could not find tunnel for vpn ip: 10.1.0.2")
+	assert.Equal(t, nebula.AdminArgs{VpnIP: "10.1.0.2", Remote: "1.1.1.1:4242"}, f.args)
+	assert.Empty(t, ob.String())
+
+	// Bad arguments never make it to nebula
+	f.method = ""
+	assert.EqualError(t, run([]string{"set-remote", "10.1.0.2"}, "", dial, ob, eb), "set-remote takes between 2 and 2 arguments, got 1")
+	assert.EqualError(t, run([]string{"hostmap", "-nope"}, "", dial, ob, eb), "flag provided but not defined: -nope")
+	assert.EqualError(t, run([]string{"nope"}, "", dial, ob, eb), "unknown command: nope")
+	assert.Empty(t, f.method)
+}
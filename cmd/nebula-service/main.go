@@ -20,6 +20,7 @@ func main() {
 	serviceFlag := flag.String("service", "", "Control the system service.")
 	configPath := flag.String("config", "", "Path to either a file or directory to load configuration from")
 	configTest := flag.Bool("test", false, "Test the config and print the end result. Non zero exit indicates a faulty config")
+	configValidate := flag.Bool("validate", false, "Report unknown keys, values of the wrong type and deprecated keys in the config. Non zero exit indicates a faulty config, combine with -test to also test the config")
 	printVersion := flag.Bool("version", false, "Print version")
 	printUsage := flag.Bool("help", false, "Print command line usage")
 
@@ -56,6 +57,29 @@ func main() {
 		os.Exit(1)
 	}
 
+	if *configValidate {
+		issues, err := config.Validate()
+		if err != nil {
+			fmt.Printf("failed to validate config: %s\n", err)
+			os.Exit(1)
+		}
+
+		failed := false
+		for _, issue := range issues {
+			fmt.Println(issue)
+			if !issue.Warning {
+				failed = true
+			}
+		}
+
+		if failed {
+			os.Exit(1)
+		}
+		if !*configTest {
+			os.Exit(0)
+		}
+	}
+
 	c, err := nebula.Main(config, *configTest, Build, l, nil)
 
 	switch v := err.(type) {
@@ -12,6 +12,7 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -26,7 +27,9 @@ type Config struct {
 	Settings    map[interface{}]interface{}
 	oldSettings map[interface{}]interface{}
 	callbacks   []func(*Config)
-	l           *logrus.Logger
+	// reloadLock keeps a SIGHUP and an admin socket reload from replacing the settings and running callbacks at once
+	reloadLock sync.Mutex
+	l          *logrus.Logger
 }
 
 func NewConfig(l *logrus.Logger) *Config {
@@ -127,6 +130,17 @@ func (c *Config) CatchHUP() {
 }
 
 func (c *Config) ReloadConfig() {
+	err := c.reload()
+	if err != nil {
+		c.l.WithField("config_path", c.path).WithError(err).Error("Error occurred while reloading config")
+	}
+}
+
+// reload loads the config from disk again and runs the reload callbacks, the callbacks are not run if loading fails
+func (c *Config) reload() error {
+	c.reloadLock.Lock()
+	defer c.reloadLock.Unlock()
+
 	c.oldSettings = make(map[interface{}]interface{})
 	for k, v := range c.Settings {
 		c.oldSettings[k] = v
@@ -134,13 +148,13 @@ func (c *Config) ReloadConfig() {
 
 	err := c.Load(c.path)
 	if err != nil {
-		c.l.WithField("config_path", c.path).WithError(err).Error("Error occurred while reloading config")
-		return
+		return err
 	}
 
 	for _, v := range c.callbacks {
 		v(c)
 	}
+	return nil
 }
 
 // GetString will get the string for k or return the default d if not found or invalid
@@ -396,6 +410,105 @@ func (c *Config) get(k string, v interface{}) interface{} {
 	return v
 }
 
+// processConfigKeys are shared by every network in the process and can only be set in the base config
+var processConfigKeys = map[string]bool{
+	"networks": true,
+	"logging":  true,
+	"sshd":     true,
+	"stats":    true,
+	"cipher":   true,
+	"ciphers":  true,
+}
+
+// Networks returns a config for every entry in `networks`. Each network starts from the base config and any top level
+// key it sets replaces that key from the base config entirely. The returned configs are updated when this config is
+// reloaded, networks can not be added or removed without a restart.
+func (c *Config) Networks() (map[string]*Config, error) {
+	raw := c.GetMap("networks", map[interface{}]interface{}{})
+	networks := make(map[string]*Config, len(raw))
+	for k := range raw {
+		name := fmt.Sprintf("%v", k)
+		s, err := c.networkSettings(name)
+		if err != nil {
+			return nil, err
+		}
+
+		nc := NewConfig(c.l)
+		nc.Settings = s
+		networks[name] = nc
+	}
+
+	if len(networks) == 0 {
+		return networks, nil
+	}
+
+	c.RegisterReloadCallback(func(c *Config) {
+		for name, nc := range networks {
+			s, err := c.networkSettings(name)
+			if err != nil {
+				c.l.WithField("networkName", name).WithError(err).Error("Failed to reload network config")
+				continue
+			}
+
+			nc.reloadSettings(s)
+		}
+	})
+
+	return networks, nil
+}
+
+// networkSettings builds the settings for the named entry in `networks`
+func (c *Config) networkSettings(name string) (map[interface{}]interface{}, error) {
+	raw := c.GetMap("networks", map[interface{}]interface{}{})
+
+	var overlay map[interface{}]interface{}
+	for k, v := range raw {
+		if fmt.Sprintf("%v", k) != name {
+			continue
+		}
+
+		var ok bool
+		overlay, ok = v.(map[interface{}]interface{})
+		if !ok {
+			return nil, fmt.Errorf("networks.%s must be a map", name)
+		}
+	}
+
+	if overlay == nil {
+		return nil, fmt.Errorf("network %s was not found", name)
+	}
+
+	s := make(map[interface{}]interface{}, len(c.Settings))
+	for k, v := range c.Settings {
+		if k != "networks" {
+			s[k] = v
+		}
+	}
+
+	for k, v := range overlay {
+		key := fmt.Sprintf("%v", k)
+		if processConfigKeys[key] {
+			return nil, fmt.Errorf("networks.%s.%s can only be set in the base config", name, key)
+		}
+		s[key] = v
+	}
+
+	return s, nil
+}
+
+// reloadSettings replaces the settings of a config that was not loaded from disk and runs the reload callbacks
+func (c *Config) reloadSettings(s map[interface{}]interface{}) {
+	c.reloadLock.Lock()
+	defer c.reloadLock.Unlock()
+
+	c.oldSettings = c.Settings
+	c.Settings = s
+
+	for _, v := range c.callbacks {
+		v(c)
+	}
+}
+
 // direct signifies if this is the config path directly specified by the user,
 // versus a file/dir found by recursing into that path
 func (c *Config) resolve(path string, direct bool) error {
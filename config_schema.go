@@ -0,0 +1,499 @@
+package nebula
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ConfigType is the kind of value a config key holds
+type ConfigType int
+
+const (
+	// ConfigString accepts any scalar, it is read with fmt.Sprint
+	ConfigString ConfigType = iota
+	ConfigInt
+	ConfigBool
+	ConfigDuration
+	ConfigList
+	// ConfigMap is a map whose keys are not known ahead of time, like static_host_map
+	ConfigMap
+)
+
+func (t ConfigType) String() string {
+	switch t {
+	case ConfigString:
+		return "a string"
+	case ConfigInt:
+		return "an int"
+	case ConfigBool:
+		return "a bool"
+	case ConfigDuration:
+		return "a duration"
+	case ConfigList:
+		return "a list"
+	case ConfigMap:
+		return "a map"
+	default:
+		return "unknown"
+	}
+}
+
+// ConfigKey describes a key nebula reads from its config
+type ConfigKey struct {
+	Name string
+	Type ConfigType
+	// Default is used when the key is not set, it is nil when there is no default or it depends on other keys
+	Default interface{}
+	// Reload is true if a change is applied by a config reload without a restart
+	Reload bool
+	// Deprecated names the key to use instead, deprecated keys still work
+	Deprecated string
+}
+
+// ConfigSchema is every key nebula reads from its config. Keys inside lists, like firewall rules and hooks, are checked
+// when they are loaded instead.
+var ConfigSchema = []ConfigKey{
+	{Name: "pki.ca", Type: ConfigString, Reload: true},
+	{Name: "pki.cert", Type: ConfigString, Reload: true},
+	{Name: "pki.key", Type: ConfigString, Reload: true},
+	{Name: "pki.blocklist", Type: ConfigList, Reload: true},
+	{Name: "pki.blacklist", Type: ConfigList, Reload: true, Deprecated: "pki.blocklist"},
+	{Name: "x509.ca", Type: ConfigString, Reload: true, Deprecated: "pki.ca"},
+	{Name: "x509.cert", Type: ConfigString, Reload: true, Deprecated: "pki.cert"},
+	{Name: "x509.key", Type: ConfigString, Reload: true, Deprecated: "pki.key"},
+
+	{Name: "static_host_map", Type: ConfigMap},
+
+	{Name: "lighthouse.am_lighthouse", Type: ConfigBool, Default: false},
+	{Name: "lighthouse.serve_dns", Type: ConfigBool, Default: false},
+	{Name: "lighthouse.dns.host", Type: ConfigString, Default: "", Reload: true},
+	{Name: "lighthouse.dns.port", Type: ConfigInt, Default: 53, Reload: true},
+	{Name: "lighthouse.interval", Type: ConfigInt, Default: 10},
+	{Name: "lighthouse.hosts", Type: ConfigList},
+	{Name: "lighthouse.remote_allow_list", Type: ConfigMap},
+	{Name: "lighthouse.local_allow_list", Type: ConfigMap},
+
+	{Name: "listen.host", Type: ConfigString, Default: "0.0.0.0"},
+	{Name: "listen.port", Type: ConfigInt, Default: 0},
+	{Name: "listen.batch", Type: ConfigInt, Default: 64},
+	{Name: "listen.gso", Type: ConfigBool, Default: true, Reload: true},
+	{Name: "listen.gro", Type: ConfigBool, Default: true},
+	{Name: "listen.read_buffer", Type: ConfigInt, Default: 0, Reload: true},
+	{Name: "listen.write_buffer", Type: ConfigInt, Default: 0, Reload: true},
+	{Name: "listen.routines", Type: ConfigInt, Default: 1, Deprecated: "routines"},
+
+	{Name: "routines", Type: ConfigInt, Default: 1},
+
+	{Name: "punchy", Type: ConfigBool, Default: false, Deprecated: "punchy.punch"},
+	{Name: "punchy.punch", Type: ConfigBool, Default: false},
+	{Name: "punchy.respond", Type: ConfigBool, Default: false},
+	{Name: "punchy.delay", Type: ConfigDuration, Default: "1s"},
+	{Name: "punch_back", Type: ConfigBool, Default: false, Deprecated: "punchy.respond"},
+
+	{Name: "pmtud.enabled", Type: ConfigBool, Default: false},
+	{Name: "pmtud.interval", Type: ConfigDuration, Default: "10m"},
+	{Name: "pmtud.timeout", Type: ConfigDuration, Default: "1s"},
+	{Name: "pmtud.min", Type: ConfigInt, Default: 1200},
+	{Name: "pmtud.max", Type: ConfigInt},
+
+	{Name: "multipath.enabled", Type: ConfigBool, Default: false},
+	{Name: "multipath.mode", Type: ConfigString, Default: "spread"},
+	{Name: "multipath.probe_interval", Type: ConfigDuration, Default: "500ms"},
+	{Name: "multipath.max_paths", Type: ConfigInt, Default: 4},
+
+	{Name: "cipher", Type: ConfigString, Default: "aes"},
+	{Name: "ciphers", Type: ConfigList},
+	{Name: "local_range", Type: ConfigString},
+	{Name: "preferred_ranges", Type: ConfigList},
+	{Name: "default_route", Type: ConfigString, Default: "0.0.0.0"},
+	{Name: "promoter.interval", Type: ConfigInt, Default: 10},
+
+	{Name: "sshd.enabled", Type: ConfigBool, Default: false, Reload: true},
+	{Name: "sshd.listen", Type: ConfigString, Reload: true},
+	{Name: "sshd.host_key", Type: ConfigString, Reload: true},
+	{Name: "sshd.roles", Type: ConfigMap, Reload: true},
+	{Name: "sshd.authorized_users", Type: ConfigList, Reload: true},
+	{Name: "sshd.nebula_auth", Type: ConfigList, Reload: true},
+	{Name: "sshd.overlay_only", Type: ConfigBool, Default: false, Reload: true},
+
+	{Name: "admin.listen", Type: ConfigString},
+	{Name: "admin.mode", Type: ConfigString, Default: "0600"},
+
+	{Name: "hooks", Type: ConfigList, Reload: true},
+
+	{Name: "tun.disabled", Type: ConfigBool, Default: false},
+	{Name: "tun.dev", Type: ConfigString},
+	{Name: "tun.drop_local_broadcast", Type: ConfigBool, Default: false},
+	{Name: "tun.drop_multicast", Type: ConfigBool, Default: false},
+	{Name: "tun.tx_queue", Type: ConfigInt, Default: 500},
+	{Name: "tun.batch", Type: ConfigInt, Default: 64},
+	{Name: "tun.offload", Type: ConfigBool, Default: false},
+	{Name: "tun.mtu", Type: ConfigInt, Default: DEFAULT_MTU},
+	{Name: "tun.routes", Type: ConfigList},
+	{Name: "tun.unsafe_routes", Type: ConfigList},
+	{Name: "tun.routines", Type: ConfigInt, Default: 1, Deprecated: "routines"},
+
+	{Name: "logging.level", Type: ConfigString, Default: "info", Reload: true},
+	{Name: "logging.format", Type: ConfigString, Default: "text", Reload: true},
+	{Name: "logging.disable_timestamp", Type: ConfigBool, Default: false, Reload: true},
+	{Name: "logging.timestamp_format", Type: ConfigString, Reload: true},
+
+	{Name: "stats.type", Type: ConfigString, Default: "none"},
+	{Name: "stats.interval", Type: ConfigDuration},
+	{Name: "stats.prefix", Type: ConfigString, Default: "nebula"},
+	{Name: "stats.protocol", Type: ConfigString},
+	{Name: "stats.host", Type: ConfigString},
+	{Name: "stats.listen", Type: ConfigString},
+	{Name: "stats.path", Type: ConfigString},
+	{Name: "stats.namespace", Type: ConfigString},
+	{Name: "stats.subsystem", Type: ConfigString},
+	{Name: "stats.tls.cert", Type: ConfigString},
+	{Name: "stats.tls.key", Type: ConfigString},
+	{Name: "stats.auth.username", Type: ConfigString},
+	{Name: "stats.auth.password", Type: ConfigString},
+	{Name: "stats.auth.token", Type: ConfigString},
+	{Name: "stats.tunnels.enabled", Type: ConfigBool, Default: false},
+	{Name: "stats.tunnels.max", Type: ConfigInt, Default: 100},
+	{Name: "stats.endpoint", Type: ConfigString},
+	{Name: "stats.headers", Type: ConfigMap},
+	{Name: "stats.traces", Type: ConfigBool, Default: false},
+	{Name: "stats.message_metrics", Type: ConfigBool, Default: false},
+	{Name: "stats.lighthouse_metrics", Type: ConfigBool, Default: false},
+
+	{Name: "handshakes.try_interval", Type: ConfigDuration, Default: DefaultHandshakeTryInterval.String()},
+	{Name: "handshakes.retries", Type: ConfigInt, Default: DefaultHandshakeRetries},
+	{Name: "handshakes.wait_rotation", Type: ConfigInt, Default: DefaultHandshakeWaitRotation},
+	{Name: "handshakes.trigger_buffer", Type: ConfigInt, Default: DefaultHandshakeTriggerBuffer},
+	{Name: "handshakes.hybrid", Type: ConfigString, Default: "off"},
+	{Name: "handshakes.psk.keys", Type: ConfigList, Reload: true},
+	{Name: "handshakes.rate_limit.per_source", Type: ConfigInt, Default: 0, Reload: true},
+	{Name: "handshakes.rate_limit.burst", Type: ConfigInt, Reload: true},
+	{Name: "handshakes.rate_limit.cookie_threshold", Type: ConfigInt, Default: 0, Reload: true},
+
+	{Name: "timers.connection_alive_interval", Type: ConfigInt, Default: 5},
+	{Name: "timers.pending_deletion_interval", Type: ConfigInt, Default: 10},
+
+	{Name: "firewall.conntrack.tcp_timeout", Type: ConfigDuration, Default: "12m", Reload: true},
+	{Name: "firewall.conntrack.udp_timeout", Type: ConfigDuration, Default: "3m", Reload: true},
+	{Name: "firewall.conntrack.default_timeout", Type: ConfigDuration, Default: "10m", Reload: true},
+	{Name: "firewall.conntrack.routine_cache_timeout", Type: ConfigDuration},
+	{Name: "firewall.conntrack.max_connections", Type: ConfigInt, Default: 100000},
+	{Name: "firewall.outbound", Type: ConfigList, Reload: true},
+	{Name: "firewall.inbound", Type: ConfigList, Reload: true},
+
+	{Name: "networks", Type: ConfigMap},
+}
+
+// configSchemaKeys indexes ConfigSchema by name, configSchemaParents holds every name that has keys under it
+var configSchemaKeys, configSchemaParents = indexConfigSchema(ConfigSchema)
+
+func indexConfigSchema(schema []ConfigKey) (map[string]ConfigKey, map[string]bool) {
+	keys := make(map[string]ConfigKey, len(schema))
+	parents := map[string]bool{"": true}
+	for _, k := range schema {
+		keys[k.Name] = k
+		parts := strings.Split(k.Name, ".")
+		for i := 1; i < len(parts); i++ {
+			parents[strings.Join(parts[:i], ".")] = true
+		}
+	}
+
+	return keys, parents
+}
+
+// ConfigIssue is a problem with a single key, found by Config.Validate
+type ConfigIssue struct {
+	Key string `json:"key"`
+	// File and Line are where the key was last set, they are empty for configs that were not loaded from files
+	File    string `json:"file,omitempty"`
+	Line    int    `json:"line,omitempty"`
+	Message string `json:"message"`
+	// Warning is set for issues that do not stop nebula from starting, like deprecated keys
+	Warning bool `json:"warning"`
+}
+
+func (i ConfigIssue) String() string {
+	level := "error"
+	if i.Warning {
+		level = "warning"
+	}
+
+	if i.File == "" {
+		return fmt.Sprintf("%s: %s: %s", level, i.Key, i.Message)
+	}
+	return fmt.Sprintf("%s:%d: %s: %s: %s", i.File, i.Line, level, i.Key, i.Message)
+}
+
+// Validate checks every key in the config against ConfigSchema and reports unknown keys, values of the wrong type and
+// deprecated keys, ordered by where they were set. An error is only returned if the config files could not be read.
+func (c *Config) Validate() ([]ConfigIssue, error) {
+	lines, err := c.keyLines()
+	if err != nil {
+		return nil, err
+	}
+
+	v := &configValidator{lines: lines}
+	v.walk("", "", c.Settings, false)
+
+	sort.SliceStable(v.issues, func(a, b int) bool {
+		ia, ib := v.issues[a], v.issues[b]
+		if ia.File != ib.File {
+			return ia.File < ib.File
+		}
+		if ia.Line != ib.Line {
+			return ia.Line < ib.Line
+		}
+		return ia.Key < ib.Key
+	})
+	return v.issues, nil
+}
+
+// configLine is where a key was set
+type configLine struct {
+	file string
+	line int
+}
+
+// keyLines finds the file and line of every key in the config files. Files later in the load order win, like they do
+// when the files are merged.
+func (c *Config) keyLines() (map[string]configLine, error) {
+	lines := make(map[string]configLine)
+	for _, path := range c.files {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		var doc yaml.Node
+		err = yaml.Unmarshal(b, &doc)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+
+		if len(doc.Content) > 0 {
+			addKeyLines(lines, path, "", doc.Content[0])
+		}
+	}
+
+	return lines, nil
+}
+
+func addKeyLines(lines map[string]configLine, file, prefix string, n *yaml.Node) {
+	if n.Kind != yaml.MappingNode {
+		return
+	}
+
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		key := joinConfigKey(prefix, n.Content[i].Value)
+		lines[key] = configLine{file: file, line: n.Content[i].Line}
+		addKeyLines(lines, file, key, n.Content[i+1])
+	}
+}
+
+type configValidator struct {
+	lines  map[string]configLine
+	issues []ConfigIssue
+}
+
+func (v *configValidator) add(key, message string, warning bool) {
+	l := v.lines[key]
+	v.issues = append(v.issues, ConfigIssue{Key: key, File: l.file, Line: l.line, Message: message, Warning: warning})
+}
+
+// walk checks every key in m. path is where m is in the config and name is where it is in the schema, they differ for
+// keys under networks.
+func (v *configValidator) walk(path, name string, m map[interface{}]interface{}, inNetwork bool) {
+	keys := make([]string, 0, len(m))
+	values := make(map[string]interface{}, len(m))
+	for k, val := range m {
+		key := fmt.Sprintf("%v", k)
+		keys = append(keys, key)
+		values[key] = val
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		val := values[k]
+		keyPath, keyName := joinConfigKey(path, k), joinConfigKey(name, k)
+
+		if keyName == "networks" {
+			if inNetwork {
+				v.add(keyPath, "can only be set in the base config", false)
+			} else {
+				v.walkNetworks(keyPath, val)
+			}
+			continue
+		}
+
+		if inNetwork && name == "" && processConfigKeys[k] {
+			v.add(keyPath, "can only be set in the base config", false)
+			continue
+		}
+
+		sub, isMap := val.(map[interface{}]interface{})
+		if isMap && configSchemaParents[keyName] {
+			v.walk(keyPath, keyName, sub, inNetwork)
+			continue
+		}
+
+		key, ok := configSchemaKeys[keyName]
+		switch {
+		case ok:
+			v.check(keyPath, key, val)
+		case configSchemaParents[keyName]:
+			v.add(keyPath, fmt.Sprintf("expected a map but got %s", describeConfigValue(val)), false)
+		default:
+			msg := "unknown key"
+			if s := suggestConfigKey(name, k); s != "" {
+				msg += ", did you mean " + joinConfigKey(path, s) + "?"
+			}
+			v.add(keyPath, msg, false)
+		}
+	}
+}
+
+func (v *configValidator) walkNetworks(path string, val interface{}) {
+	if val == nil {
+		return
+	}
+
+	networks, ok := val.(map[interface{}]interface{})
+	if !ok {
+		v.add(path, fmt.Sprintf("expected a map but got %s", describeConfigValue(val)), false)
+		return
+	}
+
+	for name, nv := range networks {
+		key := joinConfigKey(path, fmt.Sprintf("%v", name))
+		network, ok := nv.(map[interface{}]interface{})
+		if !ok {
+			v.add(key, fmt.Sprintf("expected a map but got %s", describeConfigValue(nv)), false)
+			continue
+		}
+		v.walk(key, "", network, true)
+	}
+}
+
+// check reports val if it would not be understood as key.Type by the Config getters, or if key is deprecated
+func (v *configValidator) check(path string, key ConfigKey, val interface{}) {
+	if !configValueIs(key.Type, val) {
+		v.add(path, fmt.Sprintf("expected %s but got %s", key.Type, describeConfigValue(val)), false)
+		return
+	}
+
+	if key.Deprecated != "" {
+		v.add(path, fmt.Sprintf("is deprecated, use %s instead", key.Deprecated), true)
+	}
+}
+
+// configValueIs mirrors the parsing of the Config getters, an empty value is the same as not setting the key
+func configValueIs(t ConfigType, val interface{}) bool {
+	if val == nil {
+		return true
+	}
+
+	_, isMap := val.(map[interface{}]interface{})
+	_, isList := val.([]interface{})
+	scalar := !isMap && !isList
+	s := fmt.Sprintf("%v", val)
+
+	switch t {
+	case ConfigString:
+		return scalar
+	case ConfigInt:
+		_, err := strconv.Atoi(s)
+		return scalar && err == nil
+	case ConfigBool:
+		_, err := strconv.ParseBool(s)
+		switch strings.ToLower(s) {
+		case "y", "yes", "n", "no":
+			err = nil
+		}
+		return scalar && err == nil
+	case ConfigDuration:
+		_, err := time.ParseDuration(s)
+		return scalar && err == nil
+	case ConfigList:
+		return isList
+	case ConfigMap:
+		return isMap
+	}
+
+	return false
+}
+
+func describeConfigValue(val interface{}) string {
+	switch val.(type) {
+	case map[interface{}]interface{}:
+		return "a map"
+	case []interface{}:
+		return "a list"
+	default:
+		return fmt.Sprintf("`%v`", val)
+	}
+}
+
+// suggestConfigKey returns the known key under parent that is closest to a misspelled key, or nothing if none is close
+func suggestConfigKey(parent, key string) string {
+	best, bestDistance := "", len(key)/3+1
+	for name := range configSchemaKeys {
+		if parent != "" {
+			if !strings.HasPrefix(name, parent+".") {
+				continue
+			}
+			name = name[len(parent)+1:]
+		}
+		if i := strings.IndexByte(name, '.'); i >= 0 {
+			name = name[:i]
+		}
+
+		d := levenshtein(key, name)
+		if d < bestDistance || (d == bestDistance && best != "" && name < best) {
+			best, bestDistance = name, d
+		}
+	}
+
+	return best
+}
+
+func levenshtein(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = minInt(minInt(prev[j]+1, cur[j-1]+1), prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+
+	return prev[len(b)]
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func joinConfigKey(prefix, key string) string {
+	if prefix == "" {
+		return key
+	}
+	return prefix + "." + key
+}
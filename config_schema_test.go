@@ -0,0 +1,107 @@
+package nebula
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfig_Validate(t *testing.T) {
+	l := NewTestLogger()
+	dir, err := ioutil.TempDir("", "config-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	first := filepath.Join(dir, "01.yml")
+	second := filepath.Join(dir, "02.yml")
+	assert.Nil(t, ioutil.WriteFile(first, []byte(`pki:
+  ca: /etc/nebula/ca.crt
+lighthouse:
+  am_lighthose: true
+  interval: 60
+tun:
+  routines: 2
+  mtu: big
+`), 0644))
+	assert.Nil(t, ioutil.WriteFile(second, []byte(`lighthouse:
+  interval: soon
+listen: 4242
+punchy: true
+handshakes:
+  try_interval: 10
+  retries: "5"
+firewall:
+  conntrack:
+    tcp_timeout: 12m
+  outbound: any
+networks:
+  corp:
+    pki:
+      cert: /etc/nebula/corp.crt
+    stats:
+      type: none
+    lighthouse:
+      hostz: []
+`), 0644))
+
+	c := NewConfig(l)
+	assert.Nil(t, c.Load(dir))
+	issues, err := c.Validate()
+	assert.Nil(t, err)
+
+	var got []string
+	for _, i := range issues {
+		got = append(got, i.String())
+	}
+	assert.Equal(t, []string{
+		first + ":4: error: lighthouse.am_lighthose: unknown key, did you mean lighthouse.am_lighthouse?",
+		first + ":7: warning: tun.routines: is deprecated, use routines instead",
+		first + ":8: error: tun.mtu: expected an int but got `big`",
+		second + ":2: error: lighthouse.interval: expected an int but got `soon`",
+		second + ":3: error: listen: expected a map but got `4242`",
+		second + ":4: warning: punchy: is deprecated, use punchy.punch instead",
+		second + ":6: error: handshakes.try_interval: expected a duration but got `10`",
+		second + ":11: error: firewall.outbound: expected a list but got `any`",
+		second + ":16: error: networks.corp.stats: can only be set in the base config",
+		second + ":19: error: networks.corp.lighthouse.hostz: unknown key, did you mean networks.corp.lighthouse.hosts?",
+	}, got)
+
+	// Configs that were not loaded from files have no line numbers
+	c = NewConfig(l)
+	assert.Nil(t, c.LoadString("punchy:\n  punch: yes\n  respond: maybe\nnope: true\n"))
+	issues, err = c.Validate()
+	assert.Nil(t, err)
+	assert.Equal(t, []ConfigIssue{
+		{Key: "nope", Message: "unknown key"},
+		{Key: "punchy.respond", Message: "expected a bool but got `maybe`"},
+	}, issues)
+	assert.Equal(t, "error: nope: unknown key", issues[0].String())
+}
+
+func TestConfig_ValidateExample(t *testing.T) {
+	c := NewConfig(NewTestLogger())
+	assert.Nil(t, c.Load("examples/config.yml"))
+	issues, err := c.Validate()
+	assert.Nil(t, err)
+	assert.Empty(t, issues)
+}
+
+func TestConfigSchema(t *testing.T) {
+	seen := make(map[string]bool)
+	for _, k := range ConfigSchema {
+		assert.False(t, seen[k.Name], "%s is in the schema twice", k.Name)
+		seen[k.Name] = true
+
+		if k.Deprecated != "" {
+			_, ok := configSchemaKeys[k.Deprecated]
+			assert.True(t, ok, "%s is deprecated for %s which is not in the schema", k.Name, k.Deprecated)
+		}
+
+		if k.Default != nil {
+			assert.True(t, configValueIs(k.Type, k.Default), "the default of %s is not %s", k.Name, k.Type)
+		}
+	}
+}
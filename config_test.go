@@ -4,6 +4,8 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -240,3 +242,92 @@ func TestConfig_ReloadConfig(t *testing.T) {
 	}
 
 }
+
+func TestConfig_ReloadConfigConcurrent(t *testing.T) {
+	l := NewTestLogger()
+	dir, err := ioutil.TempDir("", "config-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "01.yaml"), []byte("outer:\n  inner: hi"), 0644)
+
+	c := NewConfig(l)
+	assert.Nil(t, c.Load(dir))
+
+	// A SIGHUP and the admin socket can reload at the same time, the callbacks of one must finish before the next starts
+	var running, overlapped int32
+	c.RegisterReloadCallback(func(c *Config) {
+		if atomic.AddInt32(&running, 1) > 1 {
+			atomic.StoreInt32(&overlapped, 1)
+		}
+		time.Sleep(time.Millisecond)
+		atomic.AddInt32(&running, -1)
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.Nil(t, c.reload())
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, int32(0), atomic.LoadInt32(&overlapped))
+}
+
+func TestConfig_Networks(t *testing.T) {
+	l := NewTestLogger()
+	dir, err := ioutil.TempDir("", "config-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	base := "pki:\n  cert: base.crt\ntun:\n  dev: nebula1\nlisten:\n  port: 4242\nlogging:\n  level: info\n"
+	ioutil.WriteFile(filepath.Join(dir, "01.yaml"), []byte(base+"networks:\n  corp:\n    pki:\n      cert: corp.crt\n    tun:\n      dev: nebula2\n"), 0644)
+
+	c := NewConfig(l)
+	assert.Nil(t, c.Load(dir))
+
+	networks, err := c.Networks()
+	assert.Nil(t, err)
+	assert.Len(t, networks, 1)
+
+	corp := networks["corp"]
+	assert.NotNil(t, corp)
+	assert.Equal(t, "corp.crt", corp.GetString("pki.cert", ""))
+	assert.Equal(t, "nebula2", corp.GetString("tun.dev", ""))
+	// Keys not set by the network come from the base config
+	assert.Equal(t, 4242, corp.GetInt("listen.port", 0))
+	assert.Equal(t, "info", corp.GetString("logging.level", ""))
+	assert.False(t, corp.IsSet("networks"))
+
+	// A reload of the base config is passed along to the network
+	done := make(chan bool, 1)
+	corp.RegisterReloadCallback(func(c *Config) {
+		done <- true
+	})
+
+	ioutil.WriteFile(filepath.Join(dir, "01.yaml"), []byte(base+"networks:\n  corp:\n    pki:\n      cert: corp2.crt\n"), 0644)
+	c.ReloadConfig()
+
+	select {
+	case <-done:
+	case <-time.After(1 * time.Second):
+		panic("timeout")
+	}
+
+	assert.Equal(t, "corp2.crt", corp.GetString("pki.cert", ""))
+	assert.Equal(t, "nebula1", corp.GetString("tun.dev", ""))
+	assert.True(t, corp.HasChanged("pki.cert"))
+	assert.False(t, corp.HasChanged("listen"))
+
+	// Process wide settings can not be changed per network
+	c = NewConfig(l)
+	assert.Nil(t, c.LoadString(base+"networks:\n  corp:\n    sshd:\n      enabled: true\n"))
+	_, err = c.Networks()
+	assert.EqualError(t, err, "networks.corp.sshd can only be set in the base config")
+
+	assert.Nil(t, c.LoadString(base+"networks:\n  corp: true\n"))
+	_, err = c.Networks()
+	assert.EqualError(t, err, "networks.corp must be a map")
+}
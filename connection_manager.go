@@ -143,7 +143,7 @@ func (n *connectionManager) Start() {
 
 func (n *connectionManager) Run() {
 	clockSource := time.Tick(500 * time.Millisecond)
-	p := []byte("")
+	p := make([]byte, 0, testTimestampLen)
 	nb := make([]byte, 12, 12)
 	out := make([]byte, mtu)
 
@@ -193,6 +193,8 @@ func (n *connectionManager) HandleMonitorTick(now time.Time, p, nb, out []byte)
 
 		if hostinfo != nil && hostinfo.ConnectionState != nil {
 			// Send a test packet to trigger an authenticated tunnel test, this should suss out any lingering tunnel issues
+			// The peer echoes the time back so we can measure the round trip
+			p = appendTestTimestamp(p[:0], time.Now())
 			n.intf.SendMessageToVpnIp(test, testRequest, vpnIP, p, nb, out)
 
 		} else {
@@ -250,6 +252,10 @@ func (n *connectionManager) HandleDeletionTick(now time.Time) {
 				n.intf.lightHouse.DeleteVpnIP(vpnIP)
 			}
 			n.hostMap.DeleteHostInfo(hostinfo)
+
+			e := newHostEvent(EventTunnelDown, hostinfo)
+			e.Reason = TunnelDownDead
+			n.intf.events.publish(e)
 		} else {
 			n.ClearIP(vpnIP)
 			n.ClearPendingDeletion(vpnIP)
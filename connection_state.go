@@ -25,18 +25,24 @@ type ConnectionState struct {
 	queueLock            sync.Mutex
 	writeLock            sync.Mutex
 	ready                bool
+
+	// kem is the initiator's ML-KEM key while a hybrid handshake is in flight
+	kem *hybridKEM
+	// hybrid is true if the tunnel keys include an ML-KEM shared secret
+	hybrid bool
+	// handshakeCipher is the cipher the noise handshake was done with
+	handshakeCipher string
+	// cipher is the cipher the tunnel keys are used with, it is negotiated during the handshake
+	cipher string
 }
 
-func (f *Interface) newConnectionState(l *logrus.Logger, initiator bool, pattern noise.HandshakePattern, psk []byte, pskStage int) *ConnectionState {
-	cs := noise.NewCipherSuite(noise.DH25519, noise.CipherAESGCM, noise.HashSHA256)
-	if f.cipher == "chachapoly" {
-		cs = noise.NewCipherSuite(noise.DH25519, noise.CipherChaChaPoly, noise.HashSHA256)
-	}
+func (f *Interface) newConnectionState(l *logrus.Logger, initiator bool, pattern noise.HandshakePattern, cipher string, psk []byte, pskStage int) *ConnectionState {
+	cs := newCipherSuite(cipher)
 
 	curCertState := f.certState
 	static := noise.DHKey{Private: curCertState.privateKey, Public: curCertState.publicKey}
 
-	b := NewBits(ReplayWindow)
+	b := NewBits(ReplayWindow, f.metrics)
 	// Clear out bit 0, we never transmit it and we don't want it showing as packet loss
 	b.Update(l, 0)
 
@@ -56,11 +62,13 @@ func (f *Interface) newConnectionState(l *logrus.Logger, initiator bool, pattern
 	// The queue and ready params prevent a counter race that would happen when
 	// sending stored packets and simultaneously accepting new traffic.
 	ci := &ConnectionState{
-		H:         hs,
-		initiator: initiator,
-		window:    b,
-		ready:     false,
-		certState: curCertState,
+		H:               hs,
+		handshakeCipher: cipher,
+		cipher:          cipher,
+		initiator:       initiator,
+		window:          b,
+		ready:           false,
+		certState:       curCertState,
 	}
 
 	return ci
@@ -72,5 +80,15 @@ func (cs *ConnectionState) MarshalJSON() ([]byte, error) {
 		"initiator":       cs.initiator,
 		"message_counter": atomic.LoadUint64(&cs.atomicMessageCounter),
 		"ready":           cs.ready,
+		"key_exchange":    cs.KeyExchange(),
+		"cipher":          cs.cipher,
 	})
 }
+
+// KeyExchange describes the key exchange the tunnel keys were derived from
+func (cs *ConnectionState) KeyExchange() string {
+	if cs.hybrid {
+		return "X25519+" + hybridKEMName
+	}
+	return "X25519"
+}
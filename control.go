@@ -1,9 +1,12 @@
 package nebula
 
 import (
+	"errors"
+	"fmt"
 	"net"
 	"os"
 	"os/signal"
+	"sort"
 	"sync/atomic"
 	"syscall"
 
@@ -15,8 +18,12 @@ import (
 // core. This means copying IP objects, slices, de-referencing pointers and taking the actual value, etc
 
 type Control struct {
-	f *Interface
-	l *logrus.Logger
+	f        *Interface
+	l        *logrus.Logger
+	networks map[string]*Control
+	admin    *adminServer
+	stats    *statsServer
+	logTail  *logTailHook
 }
 
 type ControlHostInfo struct {
@@ -28,23 +35,74 @@ type ControlHostInfo struct {
 	Cert           *cert.NebulaCertificate `json:"cert"`
 	MessageCounter uint64                  `json:"messageCounter"`
 	CurrentRemote  *udpAddr                `json:"currentRemote"`
+	PathMTU        int                     `json:"pathMtu"`
+	KeyExchange    string                  `json:"keyExchange"`
+	Cipher         string                  `json:"cipher"`
+	Stats          TunnelStats             `json:"stats"`
 }
 
 // Start actually runs nebula, this is a nonblocking call. To block use Control.ShutdownBlock()
 func (c *Control) Start() {
 	c.f.run()
+	for _, n := range c.networks {
+		n.Start()
+	}
+
+	if c.admin != nil {
+		go c.admin.Run()
+	}
+
+	if c.stats != nil {
+		go c.stats.Run()
+	}
 }
 
 // Stop signals nebula to shutdown, returns after the shutdown is complete
 func (c *Control) Stop() {
 	//TODO: stop tun and udp routines, the lock on hostMap effectively does that though
+	if c.admin != nil {
+		c.admin.Stop()
+	}
+
+	if c.stats != nil {
+		c.stats.Stop()
+	}
+
 	c.CloseAllTunnels(false)
+	c.f.hooks.stop()
+	for _, n := range c.networks {
+		n.CloseAllTunnels(false)
+		n.f.hooks.stop()
+	}
 	c.l.Info("Goodbye")
 }
 
+// Ready returns nil once the tun is up, the udp listener is bound and a tunnel to at least one lighthouse is established
+// in every network, otherwise it describes what is missing. Lighthouses and networks without lighthouses do not wait
+// for a lighthouse tunnel.
+func (c *Control) Ready() error {
+	if err := c.f.ready(); err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(c.networks))
+	for name := range c.networks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if err := c.networks[name].f.ready(); err != nil {
+			return fmt.Errorf("network %s: %s", name, err)
+		}
+	}
+
+	return nil
+}
+
 // ShutdownBlock will listen for and block on term and interrupt signals, calling Control.Stop() once signalled
 func (c *Control) ShutdownBlock() {
-	sigChan := make(chan os.Signal)
+	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGTERM)
 	signal.Notify(sigChan, syscall.SIGINT)
 
@@ -63,6 +121,42 @@ func (c *Control) RebindUDPServer() {
 
 	// Let the main interface know that we rebound so that underlying tunnels know to trigger punches from their remotes
 	c.f.rebindCount++
+
+	for _, n := range c.networks {
+		n.RebindUDPServer()
+	}
+}
+
+// Network returns the control for a network configured under `networks`, or nil if there is no such network.
+// The Control returned by Main manages the base network.
+func (c *Control) Network(name string) *Control {
+	return c.networks[name]
+}
+
+// Networks returns the sorted names of every network configured under `networks`
+func (c *Control) Networks() []string {
+	names := make([]string, 0, len(c.networks))
+	for name := range c.networks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// TailLog sends every log entry matching opts to the returned LogTail, which must be closed when you are done with it.
+// Entries are dropped instead of slowing down nebula if the LogTail is not read from quickly enough.
+func (c *Control) TailLog(opts LogTailOptions) (*LogTail, error) {
+	if c.logTail == nil {
+		return nil, errors.New("log tailing is not available")
+	}
+	return c.logTail.subscribe(opts)
+}
+
+// SubscribeEvents sends the events of this network to the returned EventSubscription, only events of types are sent
+// if any are given. The subscription must be closed when you are done with it, events are dropped instead of slowing
+// down nebula if it is not read from quickly enough.
+func (c *Control) SubscribeEvents(types ...EventType) *EventSubscription {
+	return c.f.events.subscribe(types...)
 }
 
 // ListHostmap returns details about the actual or pending (handshaking) hostmap
@@ -136,7 +230,7 @@ func (c *Control) CloseTunnel(vpnIP uint32, localOnly bool) bool {
 		)
 	}
 
-	c.f.closeTunnel(hostInfo)
+	c.f.closeTunnel(hostInfo, TunnelDownClosed)
 	return true
 }
 
@@ -171,6 +265,10 @@ func copyHostInfo(h *HostInfo) ControlHostInfo {
 		RemoteAddrs:    h.CopyRemotes(),
 		CachedPackets:  len(h.packetStore),
 		MessageCounter: atomic.LoadUint64(&h.ConnectionState.atomicMessageCounter),
+		PathMTU:        h.PathMTU(),
+		KeyExchange:    h.ConnectionState.KeyExchange(),
+		Cipher:         h.ConnectionState.cipher,
+		Stats:          h.stats.Copy(),
 	}
 
 	if c := h.GetCert(); c != nil {
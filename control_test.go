@@ -51,10 +51,13 @@ func TestControl_GetHostInfoByVpnIP(t *testing.T) {
 		Remotes: remotes,
 		ConnectionState: &ConnectionState{
 			peerCert: crt,
+			cipher:   "chachapoly",
 		},
 		remoteIndexId: 200,
 		localIndexId:  201,
 		hostId:        ip2int(ipNet.IP),
+		pmtu:          pmtuState{atomicMTU: 1400},
+		stats:         tunnelStats{atomicTxBytes: 300, atomicTxPackets: 2, atomicRxBytes: 100, atomicRxPackets: 1, atomicReplayed: 3, atomicRTT: int64(time.Millisecond)},
 	})
 
 	hm.Add(ip2int(ipNet2.IP), &HostInfo{
@@ -86,10 +89,14 @@ func TestControl_GetHostInfoByVpnIP(t *testing.T) {
 		Cert:           crt.Copy(),
 		MessageCounter: 0,
 		CurrentRemote:  NewUDPAddr(int2ip(100), 4444),
+		PathMTU:        1400,
+		KeyExchange:    "X25519",
+		Cipher:         "chachapoly",
+		Stats:          TunnelStats{TxBytes: 300, TxPackets: 2, RxBytes: 100, RxPackets: 1, Replayed: 3, RTT: time.Millisecond},
 	}
 
 	// Make sure we don't have any unexpected fields
-	assertFields(t, []string{"VpnIP", "LocalIndex", "RemoteIndex", "RemoteAddrs", "CachedPackets", "Cert", "MessageCounter", "CurrentRemote"}, thi)
+	assertFields(t, []string{"VpnIP", "LocalIndex", "RemoteIndex", "RemoteAddrs", "CachedPackets", "Cert", "MessageCounter", "CurrentRemote", "PathMTU", "KeyExchange", "Cipher", "Stats"}, thi)
 	util.AssertDeepCopyEqual(t, &expectedInfo, thi)
 
 	// Make sure we don't panic if the host info doesn't have a cert yet
@@ -9,6 +9,7 @@ import (
 
 	"github.com/slackhq/nebula"
 	"github.com/slackhq/nebula/e2e/router"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestGoodHandshake(t *testing.T) {
@@ -54,6 +55,15 @@ func TestGoodHandshake(t *testing.T) {
 	// Do a bidirectional tunnel test
 	assertTunnel(t, myVpnIp, theirVpnIp, myControl, theirControl, router.NewR(myControl, theirControl))
 
+	// Both sides counted the cached packet and the tunnel test
+	myStats := myControl.GetHostInfoByVpnIP(ip2int(theirVpnIp), false).Stats
+	theirStats := theirControl.GetHostInfoByVpnIP(ip2int(myVpnIp), false).Stats
+	assert.Equal(t, uint64(2), myStats.TxPackets)
+	assert.Equal(t, uint64(1), myStats.RxPackets)
+	assert.Equal(t, myStats.TxPackets, theirStats.RxPackets)
+	assert.Equal(t, myStats.TxBytes, theirStats.RxBytes)
+	assert.Equal(t, theirStats.TxBytes, myStats.RxBytes)
+
 	myControl.Stop()
 	theirControl.Stop()
 	//TODO: assert hostmaps
@@ -214,3 +224,254 @@ func TestWrongResponderHandshake(t *testing.T) {
 //
 //	//TODO: assert hostmaps for everyone
 //}
+
+func TestHybridHandshake(t *testing.T) {
+	tests := []struct {
+		me       string
+		them     string
+		expected string
+	}{
+		{me: "prefer", them: "prefer", expected: "X25519+ML-KEM-768"},
+		{me: "require", them: "prefer", expected: "X25519+ML-KEM-768"},
+		{me: "prefer", them: "require", expected: "X25519+ML-KEM-768"},
+		{me: "prefer", them: "off", expected: "X25519"},
+		{me: "off", them: "prefer", expected: "X25519"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.me+"-"+tt.them, func(t *testing.T) {
+			ca, _, caKey, _ := newTestCaCert(time.Now(), time.Now().Add(10*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
+			myControl, myVpnIp, myUdpAddr := newSimpleServer(ca, caKey, "me", net.IP{10, 0, 0, 1}, m{"handshakes": m{"hybrid": tt.me}})
+			theirControl, theirVpnIp, theirUdpAddr := newSimpleServer(ca, caKey, "them", net.IP{10, 0, 0, 2}, m{"handshakes": m{"hybrid": tt.them}})
+			myControl.InjectLightHouseAddr(theirVpnIp, theirUdpAddr)
+
+			myControl.Start()
+			theirControl.Start()
+
+			myControl.InjectTunUDPPacket(theirVpnIp, 80, 80, []byte("Hi from me"))
+			theirControl.InjectUDPPacket(myControl.GetFromUDP(true))
+			myControl.InjectUDPPacket(theirControl.GetFromUDP(true))
+			myControl.WaitForType(1, 0, theirControl)
+
+			assertHostInfoPair(t, myUdpAddr, theirUdpAddr, myVpnIp, theirVpnIp, myControl, theirControl)
+			assert.Equal(t, tt.expected, myControl.GetHostInfoByVpnIP(ip2int(theirVpnIp), false).KeyExchange)
+			assert.Equal(t, tt.expected, theirControl.GetHostInfoByVpnIP(ip2int(myVpnIp), false).KeyExchange)
+
+			myCachedPacket := theirControl.GetFromTun(true)
+			assertUdpPacket(t, []byte("Hi from me"), myCachedPacket, myVpnIp, theirVpnIp, 80, 80)
+			assertTunnel(t, myVpnIp, theirVpnIp, myControl, theirControl, router.NewR(myControl, theirControl))
+
+			myControl.Stop()
+			theirControl.Stop()
+		})
+	}
+}
+
+func TestHybridHandshakeWithPathMTUDiscovery(t *testing.T) {
+	// pmtud probes are sent with the DF bit, the hybrid handshake messages do not fit in a 1280 byte path and must be
+	// sent without it
+	conf := m{"handshakes": m{"hybrid": "require"}, "pmtud": m{"enabled": true, "timeout": "1h"}}
+
+	ca, _, caKey, _ := newTestCaCert(time.Now(), time.Now().Add(10*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
+	myControl, myVpnIp, myUdpAddr := newSimpleServer(ca, caKey, "me", net.IP{10, 0, 0, 1}, conf)
+	theirControl, theirVpnIp, theirUdpAddr := newSimpleServer(ca, caKey, "them", net.IP{10, 0, 0, 2}, conf)
+	myControl.InjectLightHouseAddr(theirVpnIp, theirUdpAddr)
+
+	myControl.Start()
+	theirControl.Start()
+
+	myControl.InjectTunUDPPacket(theirVpnIp, 80, 80, []byte("Hi from me"))
+	stage0 := myControl.GetFromUDP(true)
+	assert.True(t, len(stage0.Data) > 1280, "the stage 0 packet should not fit in a 1280 byte mtu")
+	theirControl.InjectUDPPacket(stage0)
+	myControl.InjectUDPPacket(theirControl.GetFromUDP(true))
+	myControl.WaitForType(1, 0, theirControl)
+
+	assertHostInfoPair(t, myUdpAddr, theirUdpAddr, myVpnIp, theirVpnIp, myControl, theirControl)
+	assert.Equal(t, "X25519+ML-KEM-768", myControl.GetHostInfoByVpnIP(ip2int(theirVpnIp), false).KeyExchange)
+
+	myCachedPacket := theirControl.GetFromTun(true)
+	assertUdpPacket(t, []byte("Hi from me"), myCachedPacket, myVpnIp, theirVpnIp, 80, 80)
+	assertTunnel(t, myVpnIp, theirVpnIp, myControl, theirControl, router.NewR(myControl, theirControl))
+
+	myControl.Stop()
+	theirControl.Stop()
+}
+
+func TestCipherNegotiation(t *testing.T) {
+	tests := []struct {
+		name     string
+		me       m
+		them     m
+		expected string
+	}{
+		{name: "legacy both", me: m{"cipher": "chachapoly"}, them: m{"cipher": "chachapoly"}, expected: "chachapoly"},
+		{name: "legacy initiator", me: m{"cipher": "chachapoly"}, them: m{"ciphers": []string{"aes", "chachapoly"}}, expected: "chachapoly"},
+		{name: "legacy responder", me: m{"ciphers": []string{"aes", "chachapoly"}}, them: m{"cipher": "aes"}, expected: "aes"},
+		{name: "responder preference", me: m{"ciphers": []string{"chachapoly", "aes"}}, them: m{"ciphers": []string{"aes", "chachapoly"}}, expected: "aes"},
+		{name: "initiator only", me: m{"ciphers": []string{"aes"}}, them: m{"ciphers": []string{"chachapoly", "aes"}}, expected: "aes"},
+		{
+			name:     "psk",
+			me:       m{"cipher": "chachapoly", "handshakes": m{"psk": m{"keys": []string{"secret"}}}},
+			them:     m{"ciphers": []string{"aes", "chachapoly"}, "handshakes": m{"psk": m{"keys": []string{"secret"}}}},
+			expected: "chachapoly",
+		},
+		{
+			name:     "hybrid",
+			me:       m{"ciphers": []string{"aes", "chachapoly"}, "handshakes": m{"hybrid": "prefer"}},
+			them:     m{"ciphers": []string{"chachapoly", "aes"}, "handshakes": m{"hybrid": "prefer"}},
+			expected: "chachapoly",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ca, _, caKey, _ := newTestCaCert(time.Now(), time.Now().Add(10*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
+			myControl, myVpnIp, myUdpAddr := newSimpleServer(ca, caKey, "me", net.IP{10, 0, 0, 1}, tt.me)
+			theirControl, theirVpnIp, theirUdpAddr := newSimpleServer(ca, caKey, "them", net.IP{10, 0, 0, 2}, tt.them)
+			myControl.InjectLightHouseAddr(theirVpnIp, theirUdpAddr)
+
+			myControl.Start()
+			theirControl.Start()
+
+			myControl.InjectTunUDPPacket(theirVpnIp, 80, 80, []byte("Hi from me"))
+			theirControl.InjectUDPPacket(myControl.GetFromUDP(true))
+			myControl.InjectUDPPacket(theirControl.GetFromUDP(true))
+			myControl.WaitForType(1, 0, theirControl)
+
+			assertHostInfoPair(t, myUdpAddr, theirUdpAddr, myVpnIp, theirVpnIp, myControl, theirControl)
+			assert.Equal(t, tt.expected, myControl.GetHostInfoByVpnIP(ip2int(theirVpnIp), false).Cipher)
+			assert.Equal(t, tt.expected, theirControl.GetHostInfoByVpnIP(ip2int(myVpnIp), false).Cipher)
+
+			myCachedPacket := theirControl.GetFromTun(true)
+			assertUdpPacket(t, []byte("Hi from me"), myCachedPacket, myVpnIp, theirVpnIp, 80, 80)
+			assertTunnel(t, myVpnIp, theirVpnIp, myControl, theirControl, router.NewR(myControl, theirControl))
+
+			myControl.Stop()
+			theirControl.Stop()
+		})
+	}
+}
+
+func TestPskHandshake(t *testing.T) {
+	tests := []struct {
+		name string
+		me   []string
+		them []string
+	}{
+		{name: "same key", me: []string{"secret"}, them: []string{"secret"}},
+		{name: "rotating", me: []string{"new", "old"}, them: []string{"old", "new"}},
+		{name: "rolling out", me: []string{""}, them: []string{"secret", ""}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ca, _, caKey, _ := newTestCaCert(time.Now(), time.Now().Add(10*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
+			myControl, myVpnIp, myUdpAddr := newSimpleServer(ca, caKey, "me", net.IP{10, 0, 0, 1}, m{"handshakes": m{"psk": m{"keys": tt.me}}})
+			theirControl, theirVpnIp, theirUdpAddr := newSimpleServer(ca, caKey, "them", net.IP{10, 0, 0, 2}, m{"handshakes": m{"psk": m{"keys": tt.them}}})
+			myControl.InjectLightHouseAddr(theirVpnIp, theirUdpAddr)
+
+			myControl.Start()
+			theirControl.Start()
+
+			myControl.InjectTunUDPPacket(theirVpnIp, 80, 80, []byte("Hi from me"))
+			theirControl.InjectUDPPacket(myControl.GetFromUDP(true))
+			myControl.InjectUDPPacket(theirControl.GetFromUDP(true))
+			myControl.WaitForType(1, 0, theirControl)
+
+			assertHostInfoPair(t, myUdpAddr, theirUdpAddr, myVpnIp, theirVpnIp, myControl, theirControl)
+			myCachedPacket := theirControl.GetFromTun(true)
+			assertUdpPacket(t, []byte("Hi from me"), myCachedPacket, myVpnIp, theirVpnIp, 80, 80)
+			assertTunnel(t, myVpnIp, theirVpnIp, myControl, theirControl, router.NewR(myControl, theirControl))
+
+			myControl.Stop()
+			theirControl.Stop()
+		})
+	}
+}
+
+func TestHandshakeCookie(t *testing.T) {
+	ca, _, caKey, _ := newTestCaCert(time.Now(), time.Now().Add(10*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
+	myControl, myVpnIp, myUdpAddr := newSimpleServer(ca, caKey, "me", net.IP{10, 0, 0, 1})
+	otherControl, otherVpnIp, _ := newSimpleServer(ca, caKey, "other", net.IP{10, 0, 0, 3})
+	theirControl, theirVpnIp, theirUdpAddr := newSimpleServer(ca, caKey, "them", net.IP{10, 0, 0, 2}, m{"handshakes": m{"rate_limit": m{"cookie_threshold": 1}}})
+	myControl.InjectLightHouseAddr(theirVpnIp, theirUdpAddr)
+	otherControl.InjectLightHouseAddr(theirVpnIp, theirUdpAddr)
+
+	myControl.Start()
+	otherControl.Start()
+	theirControl.Start()
+
+	t.Log("The first handshake uses up what they are willing to do without a cookie")
+	otherControl.InjectTunUDPPacket(theirVpnIp, 80, 80, []byte("Hi from other"))
+	theirControl.InjectUDPPacket(otherControl.GetFromUDP(true))
+	otherControl.InjectUDPPacket(theirControl.GetFromUDP(true))
+	otherControl.WaitForType(1, 0, theirControl)
+	assertUdpPacket(t, []byte("Hi from other"), theirControl.GetFromTun(true), otherVpnIp, theirVpnIp, 80, 80)
+
+	// Let them know other is gone so they only have a single tunnel to close when stopping
+	otherControl.Stop()
+	theirControl.InjectUDPPacket(otherControl.GetFromUDP(true))
+
+	t.Log("Now they are busy and challenge us")
+	myControl.InjectTunUDPPacket(theirVpnIp, 80, 80, []byte("Hi from me"))
+	theirControl.InjectUDPPacket(myControl.GetFromUDP(true))
+	cookieReply := theirControl.GetFromUDP(true)
+	assert.Equal(t, byte(0), cookieReply.Data[0]&0x0f, "expected a handshake packet")
+	assert.Equal(t, byte(3), cookieReply.Data[1], "expected a cookie reply")
+
+	t.Log("Echo the cookie and finish the handshake")
+	myControl.InjectUDPPacket(cookieReply)
+	theirControl.InjectUDPPacket(myControl.GetFromUDP(true))
+	myControl.InjectUDPPacket(theirControl.GetFromUDP(true))
+	myControl.WaitForType(1, 0, theirControl)
+
+	assertHostInfoPair(t, myUdpAddr, theirUdpAddr, myVpnIp, theirVpnIp, myControl, theirControl)
+	assertUdpPacket(t, []byte("Hi from me"), theirControl.GetFromTun(true), myVpnIp, theirVpnIp, 80, 80)
+
+	myControl.Stop()
+	theirControl.Stop()
+}
+
+func BenchmarkTunnel(b *testing.B) {
+	ca, _, caKey, _ := newTestCaCert(time.Now(), time.Now().Add(10*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
+	myControl, _, _ := newSimpleServer(ca, caKey, "me", net.IP{10, 0, 0, 1})
+	theirControl, theirVpnIp, theirUdpAddr := newSimpleServer(ca, caKey, "them", net.IP{10, 0, 0, 2})
+	myControl.InjectLightHouseAddr(theirVpnIp, theirUdpAddr)
+
+	myControl.Start()
+	theirControl.Start()
+
+	// Stand up the tunnel before we start measuring
+	myControl.InjectTunUDPPacket(theirVpnIp, 80, 80, []byte("Hi from me"))
+	theirControl.InjectUDPPacket(myControl.GetFromUDP(true))
+	myControl.InjectUDPPacket(theirControl.GetFromUDP(true))
+	myControl.WaitForType(1, 0, theirControl)
+	theirControl.GetFromTun(true)
+
+	// Every iteration sends a burst so the tun reader gets several packets per read and sends them as one batch
+	const burst = 32
+	payload := make([]byte, 1200)
+	b.SetBytes(int64(len(payload) * burst))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		go func() {
+			for j := 0; j < burst; j++ {
+				myControl.InjectTunUDPPacket(theirVpnIp, 80, 80, payload)
+			}
+		}()
+		go func() {
+			for j := 0; j < burst; j++ {
+				theirControl.InjectUDPPacket(myControl.GetFromUDP(true))
+			}
+		}()
+		for j := 0; j < burst; j++ {
+			theirControl.GetFromTun(true)
+		}
+	}
+
+	b.StopTimer()
+	myControl.Stop()
+	theirControl.Stop()
+}
@@ -27,8 +27,8 @@ import (
 
 type m map[string]interface{}
 
-// newSimpleServer creates a nebula instance with many assumptions
-func newSimpleServer(caCrt *cert.NebulaCertificate, caKey []byte, name string, udpIp net.IP) (*nebula.Control, net.IP, *net.UDPAddr) {
+// newSimpleServer creates a nebula instance with many assumptions, any top level keys in overrides replace the defaults
+func newSimpleServer(caCrt *cert.NebulaCertificate, caKey []byte, name string, udpIp net.IP, overrides ...m) (*nebula.Control, net.IP, *net.UDPAddr) {
 	l := NewTestLogger()
 
 	vpnIpNet := &net.IPNet{IP: make([]byte, len(udpIp)), Mask: net.IPMask{255, 255, 255, 0}}
@@ -73,6 +73,13 @@ func newSimpleServer(caCrt *cert.NebulaCertificate, caKey []byte, name string, u
 			"level":            l.Level.String(),
 		},
 	}
+
+	for _, o := range overrides {
+		for k, v := range o {
+			mc[k] = v
+		}
+	}
+
 	cb, err := yaml.Marshal(mc)
 	if err != nil {
 		panic(err)
@@ -102,7 +109,7 @@ func newTestCaCert(before, after time.Time, ips, subnets []*net.IPNet, groups []
 
 	nc := &cert.NebulaCertificate{
 		Details: cert.NebulaCertificateDetails{
-			Name:           "test ca",
+			Names:          []string{"test ca"},
 			NotBefore:      time.Unix(before.Unix(), 0),
 			NotAfter:       time.Unix(after.Unix(), 0),
 			PublicKey:      pub,
@@ -156,7 +163,7 @@ func newTestCert(ca *cert.NebulaCertificate, key []byte, name string, before, af
 
 	nc := &cert.NebulaCertificate{
 		Details: cert.NebulaCertificateDetails{
-			Name:           name,
+			Names:          []string{name},
 			Ips:            []*net.IPNet{ip},
 			Subnets:        subnets,
 			Groups:         groups,
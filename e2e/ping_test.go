@@ -0,0 +1,98 @@
+// +build e2e_testing
+
+package e2e
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula"
+	"github.com/stretchr/testify/assert"
+)
+
+// pump delivers every udp packet sent by from to to until stop is closed
+func pump(from, to *nebula.Control, stop chan struct{}) {
+	for {
+		select {
+		case p := <-from.GetUDPTxChan():
+			to.InjectUDPPacket(p)
+		case <-stop:
+			return
+		}
+	}
+}
+
+func TestPing(t *testing.T) {
+	ca, _, caKey, _ := newTestCaCert(time.Now(), time.Now().Add(10*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
+	myControl, _, _ := newSimpleServer(ca, caKey, "me", net.IP{10, 0, 0, 1})
+	theirControl, theirVpnIp, theirUdpAddr := newSimpleServer(ca, caKey, "them", net.IP{10, 0, 0, 2})
+	myControl.InjectLightHouseAddr(theirVpnIp, theirUdpAddr)
+
+	myControl.Start()
+	theirControl.Start()
+
+	stop := make(chan struct{})
+	go pump(myControl, theirControl, stop)
+	go pump(theirControl, myControl, stop)
+
+	t.Log("Ping sets up the tunnel and gets a reply for every probe")
+	var replies []nebula.PingReply
+	stats, err := myControl.Ping(ip2int(theirVpnIp), nebula.PingOptions{Count: 3, Interval: time.Millisecond * 10, Timeout: time.Second * 5}, func(r nebula.PingReply) {
+		replies = append(replies, r)
+	})
+	assert.Nil(t, err)
+	assert.Len(t, replies, 3)
+	for i, r := range replies {
+		assert.Equal(t, i, r.Seq)
+		assert.False(t, r.Lost)
+		assert.Equal(t, theirUdpAddr.String(), r.Remote.String())
+	}
+
+	assert.Len(t, stats, 1)
+	assert.Equal(t, theirUdpAddr.String(), stats[0].Remote.String())
+	assert.Equal(t, 3, stats[0].Transmitted)
+	assert.Equal(t, 3, stats[0].Received)
+	assert.True(t, stats[0].Min <= stats[0].Avg && stats[0].Avg <= stats[0].Max)
+
+	myControl.Stop()
+	theirControl.Stop()
+	close(stop)
+}
+
+func TestPingFailures(t *testing.T) {
+	ca, _, caKey, _ := newTestCaCert(time.Now(), time.Now().Add(10*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
+	myControl, _, _ := newSimpleServer(ca, caKey, "me", net.IP{10, 0, 0, 1}, m{
+		"handshakes": m{"try_interval": "20ms", "retries": 3},
+		"firewall": m{
+			"outbound": []m{{"proto": "tcp", "port": "any", "host": "any"}},
+			"inbound":  []m{{"proto": "any", "port": "any", "host": "any"}},
+		},
+	})
+	theirControl, theirVpnIp, theirUdpAddr := newSimpleServer(ca, caKey, "them", net.IP{10, 0, 0, 2})
+	myControl.InjectLightHouseAddr(theirVpnIp, theirUdpAddr)
+
+	myControl.Start()
+	theirControl.Start()
+
+	stop := make(chan struct{})
+	go pump(myControl, theirControl, stop)
+	go pump(theirControl, myControl, stop)
+
+	opts := nebula.PingOptions{Count: 1, Timeout: time.Second}
+
+	t.Log("Nobody knows where an unknown host is")
+	_, err := myControl.Ping(ip2int(net.IP{10, 128, 0, 99}), opts, nil)
+	assert.IsType(t, &nebula.PingError{}, err)
+	assert.Equal(t, nebula.PingStepLighthouse, err.(*nebula.PingError).Step)
+
+	t.Log("The tunnel comes up but our firewall does not allow icmp to them")
+	_, err = myControl.Ping(ip2int(theirVpnIp), opts, nil)
+	assert.IsType(t, &nebula.PingError{}, err)
+	assert.Equal(t, nebula.PingStepFirewall, err.(*nebula.PingError).Step)
+	assert.EqualError(t, err, "firewall failed: no matching rule in firewall table")
+
+	myControl.Stop()
+	theirControl.Stop()
+	close(stop)
+}
@@ -0,0 +1,168 @@
+package nebula
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/slackhq/nebula/cert"
+)
+
+// EventType is what happened in an Event
+type EventType string
+
+const (
+	// EventTunnelUp is sent when a handshake completes and the tunnel is added to the hostmap
+	EventTunnelUp EventType = "tunnel_up"
+	// EventTunnelDown is sent when a tunnel is removed, Reason says why
+	EventTunnelDown EventType = "tunnel_down"
+	// EventHandshakeFailed is sent when a handshake we started gave up
+	EventHandshakeFailed EventType = "handshake_failed"
+	// EventRoam is sent when a host starts talking to us from a new remote
+	EventRoam EventType = "roam"
+	// EventLighthouseUpdate is sent when a lighthouse tells us the remotes of a host, or a host tells us its remotes
+	// when we are a lighthouse
+	EventLighthouseUpdate EventType = "lighthouse_update"
+)
+
+// The reasons a tunnel goes down
+const (
+	// TunnelDownClosed is a tunnel closed by us, with Control.CloseTunnel or the sshd
+	TunnelDownClosed = "closed"
+	// TunnelDownCloseReceived is a tunnel the other side closed
+	TunnelDownCloseReceived = "close_received"
+	// TunnelDownDead is a tunnel that stopped getting traffic
+	TunnelDownDead = "dead"
+)
+
+// The reasons a handshake fails
+const (
+	// HandshakeFailedTimeout is a handshake that got no answer after every retry
+	HandshakeFailedTimeout = "timeout"
+	// HandshakeFailedInvalidCert is a handshake answered with a certificate we do not trust
+	HandshakeFailedInvalidCert = "invalid_certificate"
+)
+
+// eventBufferSize is how many events a subscriber can fall behind before events are dropped
+const eventBufferSize = 256
+
+// Event is something that happened to a tunnel. Fields that do not apply to the type of event are empty.
+type Event struct {
+	Type  EventType `json:"type"`
+	Time  time.Time `json:"time"`
+	VpnIP net.IP    `json:"vpnIp"`
+	// Name and Groups are from the certificate of the host, if it is known
+	Name   string   `json:"name,omitempty"`
+	Groups []string `json:"groups,omitempty"`
+	// Remote is the current remote of the tunnel, or the new remote of a roam
+	Remote *udpAddr `json:"remote,omitempty"`
+	// OldRemote is the remote a host roamed away from
+	OldRemote *udpAddr `json:"oldRemote,omitempty"`
+	// Remotes is every remote a lighthouse knows for the host
+	Remotes []*udpAddr `json:"remotes,omitempty"`
+	// Reason is why a tunnel went down or a handshake failed
+	Reason string `json:"reason,omitempty"`
+}
+
+// newHostEvent builds an event about a host, filling in what is known about its certificate and remote
+func newHostEvent(t EventType, hostinfo *HostInfo) Event {
+	e := Event{Type: t, Time: time.Now(), VpnIP: int2ip(hostinfo.hostId)}
+	if hostinfo.remote != nil {
+		e.Remote = hostinfo.remote.Copy()
+	}
+
+	var c *cert.NebulaCertificate
+	if hostinfo.ConnectionState != nil {
+		c = hostinfo.ConnectionState.peerCert
+	}
+	if c != nil {
+		if len(c.Details.Names) > 0 {
+			e.Name = c.Details.Names[0]
+		}
+		e.Groups = append([]string{}, c.Details.Groups...)
+	}
+
+	return e
+}
+
+// EventSubscription receives the events of one network until it is closed
+type EventSubscription struct {
+	// dropped is first to keep it 64 bit aligned for atomic access on 32 bit platforms
+	dropped uint64
+
+	// C receives the events, it is closed by Close
+	C <-chan Event
+
+	c     chan Event
+	types map[EventType]bool
+	bus   *eventBus
+}
+
+// Close stops the subscription and closes C
+func (s *EventSubscription) Close() {
+	s.bus.unsubscribe(s)
+}
+
+// Dropped returns how many events were not delivered because C was full
+func (s *EventSubscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// eventBus hands out events to subscribers without ever blocking the sender. A nil eventBus drops everything so code
+// under test does not need one.
+type eventBus struct {
+	sync.RWMutex
+	subs map[*EventSubscription]struct{}
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{subs: make(map[*EventSubscription]struct{})}
+}
+
+// subscribe returns a subscription to events of types, or every event if there are none
+func (b *eventBus) subscribe(types ...EventType) *EventSubscription {
+	c := make(chan Event, eventBufferSize)
+	s := &EventSubscription{C: c, c: c, bus: b}
+	if len(types) > 0 {
+		s.types = make(map[EventType]bool, len(types))
+		for _, t := range types {
+			s.types[t] = true
+		}
+	}
+
+	b.Lock()
+	b.subs[s] = struct{}{}
+	b.Unlock()
+	return s
+}
+
+func (b *eventBus) unsubscribe(s *EventSubscription) {
+	b.Lock()
+	defer b.Unlock()
+	if _, ok := b.subs[s]; ok {
+		delete(b.subs, s)
+		close(s.c)
+	}
+}
+
+// publish sends e to every interested subscriber, subscribers that are behind miss it
+func (b *eventBus) publish(e Event) {
+	if b == nil {
+		return
+	}
+
+	b.RLock()
+	defer b.RUnlock()
+	for s := range b.subs {
+		if s.types != nil && !s.types[e.Type] {
+			continue
+		}
+
+		select {
+		case s.c <- e:
+		default:
+			atomic.AddUint64(&s.dropped, 1)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package nebula
+
+import (
+	"net"
+	"testing"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEventBus(t *testing.T) {
+	// A nil bus is a no-op so tests and mocks do not need one
+	var nilBus *eventBus
+	nilBus.publish(Event{Type: EventRoam})
+
+	b := newEventBus()
+	all := b.subscribe()
+	roams := b.subscribe(EventRoam)
+
+	b.publish(Event{Type: EventTunnelUp})
+	b.publish(Event{Type: EventRoam})
+
+	assert.Len(t, all.C, 2)
+	assert.Len(t, roams.C, 1)
+	assert.Equal(t, EventRoam, (<-roams.C).Type)
+
+	roams.Close()
+	roams.Close()
+	_, ok := <-roams.C
+	assert.False(t, ok)
+	b.publish(Event{Type: EventRoam})
+	assert.Len(t, b.subs, 1)
+
+	// Slow subscribers miss events instead of blocking nebula
+	for i := 0; i < eventBufferSize; i++ {
+		b.publish(Event{Type: EventTunnelDown})
+	}
+	assert.Equal(t, uint64(3), all.Dropped())
+}
+
+func TestInterface_events(t *testing.T) {
+	l := NewTestLogger()
+	_, vpncidr, _ := net.ParseCIDR("172.1.1.1/24")
+	hostMap := NewHostMap(l, "test", vpncidr, []*net.IPNet{})
+	lh := NewLightHouse(l, false, &net.IPNet{IP: net.IP{0, 0, 0, 0}, Mask: net.IPMask{0, 0, 0, 0}}, []uint32{}, 1000, 0, &udpConn{}, false, 1, false, nil)
+	ifce := &Interface{
+		hostMap:    hostMap,
+		lightHouse: lh,
+		events:     newEventBus(),
+		l:          l,
+	}
+	ifce.connectionManager = newConnectionManager(l, ifce, 5, 10)
+
+	c := &Control{f: ifce, l: l}
+	events := c.SubscribeEvents(EventRoam, EventTunnelDown)
+	defer events.Close()
+
+	vpnIp := ip2int(net.ParseIP("172.1.1.2"))
+	hostinfo := hostMap.AddVpnIP(vpnIp)
+	hostinfo.ConnectionState = &ConnectionState{peerCert: &cert.NebulaCertificate{Details: cert.NebulaCertificateDetails{
+		Names:  []string{"host-2"},
+		Groups: []string{"ops", "web"},
+	}}}
+	hostinfo.SetRemote(NewUDPAddrFromString("1.1.1.1:4242"))
+
+	ifce.handleHostRoaming(hostinfo, NewUDPAddrFromString("2.2.2.2:4242"))
+	e := <-events.C
+	assert.Equal(t, EventRoam, e.Type)
+	assert.Equal(t, "172.1.1.2", e.VpnIP.String())
+	assert.Equal(t, "host-2", e.Name)
+	assert.Equal(t, []string{"ops", "web"}, e.Groups)
+	assert.Equal(t, "2.2.2.2:4242", e.Remote.String())
+	assert.Equal(t, "1.1.1.1:4242", e.OldRemote.String())
+
+	ifce.closeTunnel(hostinfo, TunnelDownCloseReceived)
+	e = <-events.C
+	assert.Equal(t, EventTunnelDown, e.Type)
+	assert.Equal(t, TunnelDownCloseReceived, e.Reason)
+	assert.Equal(t, "2.2.2.2:4242", e.Remote.String())
+	assert.NotContains(t, hostMap.Hosts, vpnIp)
+}
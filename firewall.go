@@ -34,7 +34,7 @@ const tcpACK = 0x10
 const tcpFIN = 0x01
 
 type FirewallInterface interface {
-	AddRule(incoming bool, proto uint8, startPort int32, endPort int32, groups []string, host string, ip *net.IPNet, caName string, caSha string) error
+	AddRule(incoming bool, proto uint8, startPort int32, endPort int32, groups []string, host string, ip *net.IPNet, certAttrs map[string]string, caName string, caSha string) error
 }
 
 type conn struct {
@@ -103,11 +103,12 @@ type FirewallCA struct {
 }
 
 type FirewallRule struct {
-	// Any makes Hosts, Groups, and CIDR irrelevant
-	Any    bool
-	Hosts  map[string]struct{}
-	Groups [][]string
-	CIDR   *CIDRTree
+	// Any makes Hosts, Groups, CIDR, and CertAttrs irrelevant
+	Any       bool
+	Hosts     map[string]struct{}
+	Groups    [][]string
+	CIDR      *CIDRTree
+	CertAttrs []map[string]string
 }
 
 // Even though ports are uint16, int32 maps are faster for lookup
@@ -156,8 +157,9 @@ func (fp FirewallPacket) MarshalJSON() ([]byte, error) {
 	})
 }
 
-// NewFirewall creates a new Firewall object. A TimerWheel is created for you from the provided timeouts.
-func NewFirewall(l *logrus.Logger, tcpTimeout, UDPTimeout, defaultTimeout time.Duration, c *cert.NebulaCertificate) *Firewall {
+// NewFirewall creates a new Firewall object. A TimerWheel is created for you from the provided timeouts. Metrics are
+// registered in r, nil uses the default registry.
+func NewFirewall(l *logrus.Logger, tcpTimeout, UDPTimeout, defaultTimeout time.Duration, c *cert.NebulaCertificate, r metrics.Registry) *Firewall {
 	//TODO: error on 0 duration
 	var min, max time.Duration
 
@@ -195,18 +197,19 @@ func NewFirewall(l *logrus.Logger, tcpTimeout, UDPTimeout, defaultTimeout time.D
 		UDPTimeout:     UDPTimeout,
 		DefaultTimeout: defaultTimeout,
 		localIps:       localIps,
-		metricTCPRTT:   metrics.GetOrRegisterHistogram("network.tcp.rtt", nil, metrics.NewExpDecaySample(1028, 0.015)),
+		metricTCPRTT:   metrics.GetOrRegisterHistogram("network.tcp.rtt", r, metrics.NewExpDecaySample(1028, 0.015)),
 		l:              l,
 	}
 }
 
-func NewFirewallFromConfig(l *logrus.Logger, nc *cert.NebulaCertificate, c *Config) (*Firewall, error) {
+func NewFirewallFromConfig(l *logrus.Logger, nc *cert.NebulaCertificate, c *Config, r metrics.Registry) (*Firewall, error) {
 	fw := NewFirewall(
 		l,
 		c.GetDuration("firewall.conntrack.tcp_timeout", time.Minute*12),
 		c.GetDuration("firewall.conntrack.udp_timeout", time.Minute*3),
 		c.GetDuration("firewall.conntrack.default_timeout", time.Minute*10),
 		nc,
+		r,
 		//TODO: max_connections
 	)
 
@@ -224,7 +227,7 @@ func NewFirewallFromConfig(l *logrus.Logger, nc *cert.NebulaCertificate, c *Conf
 }
 
 // AddRule properly creates the in memory rule structure for a firewall table.
-func (f *Firewall) AddRule(incoming bool, proto uint8, startPort int32, endPort int32, groups []string, host string, ip *net.IPNet, caName string, caSha string) error {
+func (f *Firewall) AddRule(incoming bool, proto uint8, startPort int32, endPort int32, groups []string, host string, ip *net.IPNet, certAttrs map[string]string, caName string, caSha string) error {
 	// Under gomobile, stringing a nil pointer with fmt causes an abort in debug mode for iOS
 	// https://github.com/golang/go/issues/14131
 	sIp := ""
@@ -234,8 +237,8 @@ func (f *Firewall) AddRule(incoming bool, proto uint8, startPort int32, endPort
 
 	// We need this rule string because we generate a hash. Removing this will break firewall reload.
 	ruleString := fmt.Sprintf(
-		"incoming: %v, proto: %v, startPort: %v, endPort: %v, groups: %v, host: %v, ip: %v, caName: %v, caSha: %s",
-		incoming, proto, startPort, endPort, groups, host, sIp, caName, caSha,
+		"incoming: %v, proto: %v, startPort: %v, endPort: %v, groups: %v, host: %v, ip: %v, certAttrs: %v, caName: %v, caSha: %s",
+		incoming, proto, startPort, endPort, groups, host, sIp, certAttrs, caName, caSha,
 	)
 	f.rules += ruleString + "\n"
 
@@ -243,7 +246,7 @@ func (f *Firewall) AddRule(incoming bool, proto uint8, startPort int32, endPort
 	if !incoming {
 		direction = "outgoing"
 	}
-	f.l.WithField("firewallRule", m{"direction": direction, "proto": proto, "startPort": startPort, "endPort": endPort, "groups": groups, "host": host, "ip": sIp, "caName": caName, "caSha": caSha}).
+	f.l.WithField("firewallRule", m{"direction": direction, "proto": proto, "startPort": startPort, "endPort": endPort, "groups": groups, "host": host, "ip": sIp, "certAttrs": certAttrs, "caName": caName, "caSha": caSha}).
 		Info("Firewall rule added")
 
 	var (
@@ -270,7 +273,7 @@ func (f *Firewall) AddRule(incoming bool, proto uint8, startPort int32, endPort
 		return fmt.Errorf("unknown protocol %v", proto)
 	}
 
-	return fp.addRule(startPort, endPort, groups, host, ip, caName, caSha)
+	return fp.addRule(startPort, endPort, groups, host, ip, certAttrs, caName, caSha)
 }
 
 // GetRuleHash returns a hash representation of all inbound and outbound rules
@@ -308,8 +311,8 @@ func AddFirewallRulesFromConfig(l *logrus.Logger, inbound bool, config *Config,
 			return fmt.Errorf("%s rule #%v; only one of port or code should be provided", table, i)
 		}
 
-		if r.Host == "" && len(r.Groups) == 0 && r.Group == "" && r.Cidr == "" && r.CAName == "" && r.CASha == "" {
-			return fmt.Errorf("%s rule #%v; at least one of host, group, cidr, ca_name, or ca_sha must be provided", table, i)
+		if r.Host == "" && len(r.Groups) == 0 && r.Group == "" && r.Cidr == "" && len(r.CertAttr) == 0 && r.CAName == "" && r.CASha == "" {
+			return fmt.Errorf("%s rule #%v; at least one of host, group, cidr, cert_attr, ca_name, or ca_sha must be provided", table, i)
 		}
 
 		if len(r.Groups) > 0 {
@@ -361,7 +364,19 @@ func AddFirewallRulesFromConfig(l *logrus.Logger, inbound bool, config *Config,
 			}
 		}
 
-		err = fw.AddRule(inbound, proto, startPort, endPort, groups, r.Host, cidr, r.CAName, r.CASha)
+		var certAttrs map[string]string
+		if len(r.CertAttr) > 0 {
+			certAttrs = make(map[string]string, len(r.CertAttr))
+			for _, a := range r.CertAttr {
+				kv := strings.SplitN(a, "=", 2)
+				if len(kv) != 2 || kv[0] == "" {
+					return fmt.Errorf("%s rule #%v; cert_attr should be in the form key=value; `%s`", table, i, a)
+				}
+				certAttrs[kv[0]] = kv[1]
+			}
+		}
+
+		err = fw.AddRule(inbound, proto, startPort, endPort, groups, r.Host, cidr, certAttrs, r.CAName, r.CASha)
 		if err != nil {
 			return fmt.Errorf("%s rule #%v; `%s`", table, i, err)
 		}
@@ -382,6 +397,19 @@ func (f *Firewall) Drop(packet []byte, fp FirewallPacket, incoming bool, h *Host
 		return nil
 	}
 
+	if err := f.allowNew(fp, incoming, h, caPool); err != nil {
+		return err
+	}
+
+	// We always want to conntrack since it is a faster operation
+	f.addConn(packet, fp, incoming)
+
+	return nil
+}
+
+// allowNew returns an error if a new flow starting with fp would be dropped, explaining why. Conntrack is not
+// consulted or updated.
+func (f *Firewall) allowNew(fp FirewallPacket, incoming bool, h *HostInfo, caPool *cert.NebulaCAPool) error {
 	// Make sure remote address matches nebula certificate
 	if remoteCidr := h.remoteCidr; remoteCidr != nil {
 		if remoteCidr.Contains(fp.RemoteIP) == nil {
@@ -409,9 +437,6 @@ func (f *Firewall) Drop(packet []byte, fp FirewallPacket, incoming bool, h *Host
 		return ErrNoMatchingRule
 	}
 
-	// We always want to conntrack since it is a faster operation
-	f.addConn(packet, fp, incoming)
-
 	return nil
 }
 
@@ -421,13 +446,13 @@ func (f *Firewall) Destroy() {
 	//TODO: clean references if/when needed
 }
 
-func (f *Firewall) EmitStats() {
+func (f *Firewall) EmitStats(r metrics.Registry) {
 	conntrack := f.Conntrack
 	conntrack.Lock()
 	conntrackCount := len(conntrack.Conns)
 	conntrack.Unlock()
-	metrics.GetOrRegisterGauge("firewall.conntrack.count", nil).Update(int64(conntrackCount))
-	metrics.GetOrRegisterGauge("firewall.rules.version", nil).Update(int64(f.rulesVersion))
+	metrics.GetOrRegisterGauge("firewall.conntrack.count", r).Update(int64(conntrackCount))
+	metrics.GetOrRegisterGauge("firewall.rules.version", r).Update(int64(f.rulesVersion))
 }
 
 func (f *Firewall) inConns(packet []byte, fp FirewallPacket, incoming bool, h *HostInfo, caPool *cert.NebulaCAPool, localCache ConntrackCache) bool {
@@ -587,7 +612,7 @@ func (ft *FirewallTable) match(p FirewallPacket, incoming bool, c *cert.NebulaCe
 	return false
 }
 
-func (fp firewallPort) addRule(startPort int32, endPort int32, groups []string, host string, ip *net.IPNet, caName string, caSha string) error {
+func (fp firewallPort) addRule(startPort int32, endPort int32, groups []string, host string, ip *net.IPNet, certAttrs map[string]string, caName string, caSha string) error {
 	if startPort > endPort {
 		return fmt.Errorf("start port was lower than end port")
 	}
@@ -600,7 +625,7 @@ func (fp firewallPort) addRule(startPort int32, endPort int32, groups []string,
 			}
 		}
 
-		if err := fp[i].addRule(groups, host, ip, caName, caSha); err != nil {
+		if err := fp[i].addRule(groups, host, ip, certAttrs, caName, caSha); err != nil {
 			return err
 		}
 	}
@@ -631,12 +656,13 @@ func (fp firewallPort) match(p FirewallPacket, incoming bool, c *cert.NebulaCert
 	return fp[fwPortAny].match(p, c, caPool)
 }
 
-func (fc *FirewallCA) addRule(groups []string, host string, ip *net.IPNet, caName, caSha string) error {
+func (fc *FirewallCA) addRule(groups []string, host string, ip *net.IPNet, certAttrs map[string]string, caName, caSha string) error {
 	fr := func() *FirewallRule {
 		return &FirewallRule{
-			Hosts:  make(map[string]struct{}),
-			Groups: make([][]string, 0),
-			CIDR:   NewCIDRTree(),
+			Hosts:     make(map[string]struct{}),
+			Groups:    make([][]string, 0),
+			CIDR:      NewCIDRTree(),
+			CertAttrs: make([]map[string]string, 0),
 		}
 	}
 
@@ -645,14 +671,14 @@ func (fc *FirewallCA) addRule(groups []string, host string, ip *net.IPNet, caNam
 			fc.Any = fr()
 		}
 
-		return fc.Any.addRule(groups, host, ip)
+		return fc.Any.addRule(groups, host, ip, certAttrs)
 	}
 
 	if caSha != "" {
 		if _, ok := fc.CAShas[caSha]; !ok {
 			fc.CAShas[caSha] = fr()
 		}
-		err := fc.CAShas[caSha].addRule(groups, host, ip)
+		err := fc.CAShas[caSha].addRule(groups, host, ip, certAttrs)
 		if err != nil {
 			return err
 		}
@@ -662,7 +688,7 @@ func (fc *FirewallCA) addRule(groups []string, host string, ip *net.IPNet, caNam
 		if _, ok := fc.CANames[caName]; !ok {
 			fc.CANames[caName] = fr()
 		}
-		err := fc.CANames[caName].addRule(groups, host, ip)
+		err := fc.CANames[caName].addRule(groups, host, ip, certAttrs)
 		if err != nil {
 			return err
 		}
@@ -700,17 +726,18 @@ func (fc *FirewallCA) match(p FirewallPacket, c *cert.NebulaCertificate, caPool
 	return false
 }
 
-func (fr *FirewallRule) addRule(groups []string, host string, ip *net.IPNet) error {
+func (fr *FirewallRule) addRule(groups []string, host string, ip *net.IPNet, certAttrs map[string]string) error {
 	if fr.Any {
 		return nil
 	}
 
-	if fr.isAny(groups, host, ip) {
+	if fr.isAny(groups, host, ip, certAttrs) {
 		fr.Any = true
 		// If it's any we need to wipe out any pre-existing rules to save on memory
 		fr.Groups = make([][]string, 0)
 		fr.Hosts = make(map[string]struct{})
 		fr.CIDR = NewCIDRTree()
+		fr.CertAttrs = make([]map[string]string, 0)
 	} else {
 		if len(groups) > 0 {
 			fr.Groups = append(fr.Groups, groups)
@@ -723,13 +750,17 @@ func (fr *FirewallRule) addRule(groups []string, host string, ip *net.IPNet) err
 		if ip != nil {
 			fr.CIDR.AddCIDR(ip, struct{}{})
 		}
+
+		if len(certAttrs) > 0 {
+			fr.CertAttrs = append(fr.CertAttrs, certAttrs)
+		}
 	}
 
 	return nil
 }
 
-func (fr *FirewallRule) isAny(groups []string, host string, ip *net.IPNet) bool {
-	if len(groups) == 0 && host == "" && ip == nil {
+func (fr *FirewallRule) isAny(groups []string, host string, ip *net.IPNet, certAttrs map[string]string) bool {
+	if len(groups) == 0 && host == "" && ip == nil && len(certAttrs) == 0 {
 		return true
 	}
 
@@ -760,7 +791,7 @@ func (fr *FirewallRule) match(p FirewallPacket, c *cert.NebulaCertificate) bool
 		return true
 	}
 
-	// Need any of group, host, or cidr to match
+	// Need any of group, host, cidr, or cert attribute to match
 	for _, sg := range fr.Groups {
 		found := false
 
@@ -790,20 +821,37 @@ func (fr *FirewallRule) match(p FirewallPacket, c *cert.NebulaCertificate) bool
 		return true
 	}
 
-	// No host, group, or cidr matched, bye bye
+	// All attributes in a set must be present on the certificate extensions
+	for _, attrs := range fr.CertAttrs {
+		found := true
+
+		for k, v := range attrs {
+			if cv, ok := c.Details.Extensions[k]; !ok || cv != v {
+				found = false
+				break
+			}
+		}
+
+		if found {
+			return true
+		}
+	}
+
+	// No host, group, cidr, or cert attribute matched, bye bye
 	return false
 }
 
 type rule struct {
-	Port   string
-	Code   string
-	Proto  string
-	Host   string
-	Group  string
-	Groups []string
-	Cidr   string
-	CAName string
-	CASha  string
+	Port     string
+	Code     string
+	Proto    string
+	Host     string
+	Group    string
+	Groups   []string
+	Cidr     string
+	CertAttr []string
+	CAName   string
+	CASha    string
 }
 
 func convertRule(l *logrus.Logger, p interface{}, table string, i int) (rule, error) {
@@ -856,6 +904,18 @@ func convertRule(l *logrus.Logger, p interface{}, table string, i int) (rule, er
 		}
 	}
 
+	if ra, ok := m["cert_attr"]; ok {
+		switch v := ra.(type) {
+		case []interface{}:
+			r.CertAttr = make([]string, len(v))
+			for i := range v {
+				r.CertAttr[i] = fmt.Sprintf("%v", v[i])
+			}
+		default:
+			r.CertAttr = []string{fmt.Sprintf("%v", v)}
+		}
+	}
+
 	return r, nil
 }
 
@@ -1,8 +1,22 @@
 package nebula
 
+import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
 const (
 	handshakeIXPSK0 = 0
 	handshakeXXPSK0 = 1
+
+	// handshakeIXPSK0Hybrid is ix_psk0 with an ML-KEM key exchange mixed into the tunnel keys. Responders use it to
+	// signal that they accepted the hybrid handshake, initiators only use it when they require a hybrid handshake.
+	handshakeIXPSK0Hybrid = 2
+
+	// handshakeCookieReply is sent by a busy responder instead of the second handshake message, the initiator has to
+	// start over and echo the cookie in the payload
+	handshakeCookieReply = 3
 )
 
 func HandleIncomingHandshake(f *Interface, addr *udpAddr, packet []byte, h *Header, hostinfo *HostInfo) {
@@ -12,9 +26,16 @@ func HandleIncomingHandshake(f *Interface, addr *udpAddr, packet []byte, h *Head
 	}
 
 	switch h.Subtype {
-	case handshakeIXPSK0:
+	case handshakeIXPSK0, handshakeIXPSK0Hybrid:
 		switch h.MessageCounter {
 		case 1:
+			if !f.handshakeLimiter.allow(addr, time.Now()) {
+				if f.l.Level >= logrus.DebugLevel {
+					f.l.WithField("udpAddr", addr).WithField("handshake", m{"stage": 1, "style": "ix_psk0"}).
+						Debug("Dropping handshake, handshakes.rate_limit.per_source exceeded")
+				}
+				return
+			}
 			ixHandshakeStage1(f, addr, packet, h)
 		case 2:
 			newHostinfo, _ := f.handshakeManager.QueryIndex(h.RemoteIndex)
@@ -23,6 +44,8 @@ func HandleIncomingHandshake(f *Interface, addr *udpAddr, packet []byte, h *Head
 				f.handshakeManager.DeleteHostInfo(newHostinfo)
 			}
 		}
+	case handshakeCookieReply:
+		ixHandshakeCookieReply(f, addr, packet, h)
 	}
 
 }
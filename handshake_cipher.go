@@ -0,0 +1,132 @@
+package nebula
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+
+	"github.com/flynn/noise"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	hybridInitiatorInfo = "nebula hybrid initiator"
+	hybridResponderInfo = "nebula hybrid responder"
+	cipherInitiatorInfo = "nebula cipher initiator"
+	cipherResponderInfo = "nebula cipher responder"
+)
+
+var cipherFuncs = map[string]noise.CipherFunc{
+	"aes":        noise.CipherAESGCM,
+	"chachapoly": noise.CipherChaChaPoly,
+}
+
+func newCipherSuite(cipher string) noise.CipherSuite {
+	cf, ok := cipherFuncs[cipher]
+	if !ok {
+		cf = noise.CipherAESGCM
+	}
+
+	return noise.NewCipherSuite(noise.DH25519, cf, noise.HashSHA256)
+}
+
+// newCiphersFromConfig returns the ciphers we accept in order of preference, the first one is used to initiate
+// handshakes. Without a ciphers list only the cipher setting is used, like older versions of nebula did.
+func newCiphersFromConfig(c *Config) ([]string, error) {
+	list := c.GetStringSlice("ciphers", []string{})
+	if len(list) == 0 {
+		cipher := c.GetString("cipher", "aes")
+		if _, ok := cipherFuncs[cipher]; !ok {
+			return nil, fmt.Errorf("unknown cipher: %v", cipher)
+		}
+		return []string{cipher}, nil
+	}
+
+	ciphers := make([]string, 0, len(list))
+	for _, v := range list {
+		v = strings.ToLower(v)
+		if _, ok := cipherFuncs[v]; !ok {
+			return nil, fmt.Errorf("unknown cipher in ciphers: %s, expected aes or chachapoly", v)
+		}
+
+		if hasCipher(ciphers, v) {
+			return nil, fmt.Errorf("cipher %s is listed more than once in ciphers", v)
+		}
+
+		ciphers = append(ciphers, v)
+	}
+
+	return ciphers, nil
+}
+
+func hasCipher(ciphers []string, cipher string) bool {
+	for _, v := range ciphers {
+		if v == cipher {
+			return true
+		}
+	}
+	return false
+}
+
+// chooseCipher picks the cipher for a tunnel, the first of ours the initiator also supports. Initiators that do not
+// advertise their ciphers get the cipher they did the handshake with.
+func chooseCipher(ours, theirs []string, handshakeCipher string) string {
+	for _, v := range ours {
+		if hasCipher(theirs, v) {
+			return v
+		}
+	}
+
+	return handshakeCipher
+}
+
+// deriveCipherState derives the transport key for one direction of a tunnel from the noise key for that direction,
+// the ML-KEM shared secret if any and the noise handshake hash. It is used when the tunnel keys can not come straight
+// out of noise, an attacker has to break both X25519 and ML-KEM to recover the key of a hybrid tunnel.
+func deriveCipherState(cipher string, k *noise.CipherState, ss, h []byte, info string) (*NebulaCipherState, error) {
+	// This is the noise REKEY function, it gives us key material bound to the noise key without exposing the key
+	var zeros [32]byte
+	exported := k.Cipher().Encrypt(nil, math.MaxUint64, []byte{}, zeros[:])
+
+	ikm := make([]byte, 0, 32+len(ss))
+	ikm = append(ikm, exported[:32]...)
+	ikm = append(ikm, ss...)
+
+	var key [32]byte
+	_, err := io.ReadFull(hkdf.New(sha256.New, ikm, h, []byte(info)), key[:])
+	if err != nil {
+		return nil, err
+	}
+
+	return &NebulaCipherState{c: newCipherSuite(cipher).Cipher(key), endianness: cipherEndianness(cipher)}, nil
+}
+
+// tunnelKeys returns both transport keys of a tunnel from the noise cipher states, i2r carries traffic from the
+// initiator to the responder. The noise keys are used as is unless a ML-KEM secret has to be mixed in or the tunnel
+// uses a different cipher than the handshake did.
+func tunnelKeys(ci *ConnectionState, i2r, r2i *noise.CipherState, ss []byte) (*NebulaCipherState, *NebulaCipherState, error) {
+	if ss == nil && ci.cipher == ci.handshakeCipher {
+		return NewNebulaCipherState(i2r, ci.cipher), NewNebulaCipherState(r2i, ci.cipher), nil
+	}
+
+	iInfo, rInfo := cipherInitiatorInfo, cipherResponderInfo
+	if ss != nil {
+		iInfo, rInfo = hybridInitiatorInfo, hybridResponderInfo
+	}
+
+	h := ci.H.ChannelBinding()
+
+	ik, err := deriveCipherState(ci.cipher, i2r, ss, h, iInfo)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rk, err := deriveCipherState(ci.cipher, r2i, ss, h, rInfo)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return ik, rk, nil
+}
@@ -0,0 +1,51 @@
+package nebula
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_newCiphersFromConfig(t *testing.T) {
+	l := NewTestLogger()
+	c := NewConfig(l)
+
+	ciphers, err := newCiphersFromConfig(c)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"aes"}, ciphers)
+
+	c.Settings["cipher"] = "chachapoly"
+	ciphers, err = newCiphersFromConfig(c)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"chachapoly"}, ciphers)
+
+	c.Settings["cipher"] = "nope"
+	_, err = newCiphersFromConfig(c)
+	assert.EqualError(t, err, "unknown cipher: nope")
+
+	// ciphers wins over cipher
+	c.Settings["ciphers"] = []interface{}{"AES", "chachapoly"}
+	ciphers, err = newCiphersFromConfig(c)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"aes", "chachapoly"}, ciphers)
+
+	c.Settings["ciphers"] = []interface{}{"aes", "nope"}
+	_, err = newCiphersFromConfig(c)
+	assert.EqualError(t, err, "unknown cipher in ciphers: nope, expected aes or chachapoly")
+
+	c.Settings["ciphers"] = []interface{}{"aes", "aes"}
+	_, err = newCiphersFromConfig(c)
+	assert.EqualError(t, err, "cipher aes is listed more than once in ciphers")
+}
+
+func Test_chooseCipher(t *testing.T) {
+	// Our preference wins
+	assert.Equal(t, "aes", chooseCipher([]string{"aes", "chachapoly"}, []string{"chachapoly", "aes"}, "chachapoly"))
+	assert.Equal(t, "chachapoly", chooseCipher([]string{"chachapoly", "aes"}, []string{"aes", "chachapoly"}, "aes"))
+
+	// Only what they support
+	assert.Equal(t, "chachapoly", chooseCipher([]string{"aes", "chachapoly"}, []string{"chachapoly"}, "chachapoly"))
+
+	// Older hosts do not tell us, use what they did the handshake with
+	assert.Equal(t, "chachapoly", chooseCipher([]string{"aes", "chachapoly"}, nil, "chachapoly"))
+}
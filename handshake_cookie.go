@@ -0,0 +1,294 @@
+package nebula
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/flynn/noise"
+	"github.com/rcrowley/go-metrics"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// cookieRotation is how often the secret used to create cookies is replaced, cookies made with the previous secret
+	// are still accepted
+	cookieRotation = time.Minute * 2
+
+	// cookieLen is the length of the payload of a cookie reply
+	cookieLen = 8
+
+	// limiterSweepInterval is how often idle sources are forgotten
+	limiterSweepInterval = time.Minute
+)
+
+// handshakeLimiter protects responders from being flooded with handshakes. Every source address gets a token bucket and
+// handshakes beyond it are dropped. Once the rate of handshakes from all sources goes over the cookie threshold
+// initiators must first prove they own their address by echoing a cookie, like wireguard does, before any certificate
+// is verified or key exchange is done.
+type handshakeLimiter struct {
+	sync.Mutex
+
+	perSource       float64
+	burst           float64
+	cookieThreshold float64
+
+	sources   map[string]*tokenBucket
+	load      tokenBucket
+	lastSweep time.Time
+
+	secret     [32]byte
+	prevSecret [32]byte
+	rotated    time.Time
+
+	metricDropped    metrics.Counter
+	metricChallenged metrics.Counter
+}
+
+// tokenBucket holds up to burst tokens and refills at rate tokens per second
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newHandshakeLimiterFromConfig(c *Config, r metrics.Registry) *handshakeLimiter {
+	hl := &handshakeLimiter{
+		sources:          make(map[string]*tokenBucket),
+		metricDropped:    metrics.GetOrRegisterCounter("handshakes.rate_limit.dropped", r),
+		metricChallenged: metrics.GetOrRegisterCounter("handshakes.rate_limit.challenged", r),
+	}
+
+	hl.reload(c)
+	return hl
+}
+
+// reload applies handshakes.rate_limit, the state of every source is reset
+func (hl *handshakeLimiter) reload(c *Config) {
+	perSource := float64(c.GetInt("handshakes.rate_limit.per_source", 0))
+	burst := float64(c.GetInt("handshakes.rate_limit.burst", int(perSource)*2))
+	cookieThreshold := float64(c.GetInt("handshakes.rate_limit.cookie_threshold", 0))
+
+	if perSource < 0 {
+		perSource = 0
+	}
+
+	if burst < 1 {
+		burst = 1
+	}
+
+	if cookieThreshold < 0 {
+		cookieThreshold = 0
+	}
+
+	hl.Lock()
+	defer hl.Unlock()
+
+	hl.perSource = perSource
+	hl.burst = burst
+	hl.cookieThreshold = cookieThreshold
+	hl.sources = make(map[string]*tokenBucket)
+	hl.load = tokenBucket{}
+}
+
+// Enabled is true if any limits are configured
+func (hl *handshakeLimiter) Enabled() bool {
+	hl.Lock()
+	defer hl.Unlock()
+	return hl.perSource > 0 || hl.cookieThreshold > 0
+}
+
+// allow returns false if addr has sent more handshakes than it is allowed to
+func (hl *handshakeLimiter) allow(addr *udpAddr, now time.Time) bool {
+	hl.Lock()
+	defer hl.Unlock()
+
+	if hl.perSource == 0 {
+		return true
+	}
+
+	if now.Sub(hl.lastSweep) >= limiterSweepInterval {
+		hl.sweep(now)
+	}
+
+	key := string(addr.IP.To16())
+	b, ok := hl.sources[key]
+	if !ok {
+		b = &tokenBucket{tokens: hl.burst, last: now}
+		hl.sources[key] = b
+	}
+
+	if !b.take(now, hl.perSource, hl.burst) {
+		hl.metricDropped.Inc(1)
+		return false
+	}
+
+	return true
+}
+
+// sweep forgets every source that has refilled its bucket, they would be recreated in the same state. hl must be locked
+func (hl *handshakeLimiter) sweep(now time.Time) {
+	hl.lastSweep = now
+	for k, b := range hl.sources {
+		if b.tokens+now.Sub(b.last).Seconds()*hl.perSource >= hl.burst {
+			delete(hl.sources, k)
+		}
+	}
+}
+
+// challenge returns 0 if the handshake from addr may continue, otherwise it returns the cookie the initiator must echo
+// in its next attempt. cookie is the one the initiator sent, if any.
+func (hl *handshakeLimiter) challenge(addr *udpAddr, index uint32, cookie uint64, now time.Time) uint64 {
+	hl.Lock()
+	defer hl.Unlock()
+
+	if hl.cookieThreshold == 0 {
+		return 0
+	}
+
+	if now.Sub(hl.rotated) >= cookieRotation {
+		hl.prevSecret = hl.secret
+		if _, err := rand.Read(hl.secret[:]); err != nil {
+			// Without a fresh secret there is nothing to challenge with, fall back to the rate limit alone
+			return 0
+		}
+
+		if hl.rotated.IsZero() {
+			hl.prevSecret = hl.secret
+		}
+		hl.rotated = now
+	}
+
+	if cookie != 0 {
+		if cookie == makeCookie(hl.secret[:], addr, index) || cookie == makeCookie(hl.prevSecret[:], addr, index) {
+			return 0
+		}
+	}
+
+	// Allow a handshake per second per threshold before we consider ourselves under load
+	if hl.load.last.IsZero() {
+		hl.load = tokenBucket{tokens: hl.cookieThreshold, last: now}
+	}
+
+	if hl.load.take(now, hl.cookieThreshold, hl.cookieThreshold) {
+		return 0
+	}
+
+	hl.metricChallenged.Inc(1)
+	return makeCookie(hl.secret[:], addr, index)
+}
+
+// take refills the bucket for the time since it was last used and takes a token if there is one
+func (b *tokenBucket) take(now time.Time, rate, burst float64) bool {
+	if now.After(b.last) {
+		b.tokens += now.Sub(b.last).Seconds() * rate
+		if b.tokens > burst {
+			b.tokens = burst
+		}
+		b.last = now
+	}
+
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens--
+	return true
+}
+
+// makeCookie binds a cookie to the initiator address and the index of the handshake, it is never 0
+func makeCookie(secret []byte, addr *udpAddr, index uint32) uint64 {
+	mac := hmac.New(sha256.New, secret)
+
+	b := make([]byte, net.IPv6len+6)
+	copy(b, addr.IP.To16())
+	binary.BigEndian.PutUint16(b[net.IPv6len:], addr.Port)
+	binary.BigEndian.PutUint32(b[net.IPv6len+2:], index)
+	mac.Write(b)
+
+	cookie := binary.BigEndian.Uint64(mac.Sum(nil))
+	if cookie == 0 {
+		cookie = 1
+	}
+
+	return cookie
+}
+
+// sendHandshakeCookie replies to a first handshake message with a cookie instead of continuing the handshake
+func (f *Interface) sendHandshakeCookie(addr *udpAddr, index uint32, cookie uint64) {
+	b := HeaderEncode(make([]byte, HeaderLen+cookieLen), Version, uint8(handshake), handshakeCookieReply, index, 2)
+	b = b[:HeaderLen+cookieLen]
+	binary.BigEndian.PutUint64(b[HeaderLen:], cookie)
+
+	f.messageMetrics.Tx(handshake, handshakeCookieReply, 1)
+	err := f.outside.WriteTo(b, addr)
+	if err != nil {
+		f.l.WithError(err).WithField("udpAddr", addr).WithField("initiatorIndex", index).
+			WithField("handshake", m{"stage": 1, "style": "ix_psk0"}).Error("Failed to send handshake cookie")
+	} else if f.l.Level >= logrus.DebugLevel {
+		f.l.WithField("udpAddr", addr).WithField("initiatorIndex", index).
+			WithField("handshake", m{"stage": 1, "style": "ix_psk0"}).Debug("Handshake cookie sent")
+	}
+}
+
+// ixHandshakeCookieReply restarts a pending handshake with the cookie a busy responder asked us to echo
+func ixHandshakeCookieReply(f *Interface, addr *udpAddr, packet []byte, h *Header) {
+	if len(packet) < HeaderLen+cookieLen {
+		return
+	}
+
+	hostinfo, err := f.handshakeManager.QueryIndex(h.RemoteIndex)
+	if err != nil {
+		return
+	}
+
+	hostinfo.Lock()
+	defer hostinfo.Unlock()
+
+	ci := hostinfo.ConnectionState
+	if ci == nil || !ci.initiator || ci.ready || !hostinfo.HandshakeReady {
+		return
+	}
+
+	// Only accept a cookie from an address we sent our handshake to
+	known := false
+	for _, r := range hostinfo.Remotes {
+		if r.Equals(addr) {
+			known = true
+			break
+		}
+	}
+
+	if !known {
+		f.l.WithField("vpnIp", IntIp(hostinfo.hostId)).WithField("udpAddr", addr).
+			WithField("handshake", m{"stage": 1, "style": "ix_psk0"}).Info("Ignoring handshake cookie from an unknown remote")
+		return
+	}
+
+	cookie := binary.BigEndian.Uint64(packet[HeaderLen : HeaderLen+cookieLen])
+	if cookie == 0 {
+		return
+	}
+
+	// Our first message has already been written by noise, start over with one that carries the cookie
+	hostinfo.ConnectionState = f.newConnectionState(f.l, true, noise.HandshakeIX, f.ciphers[0], f.psk.primary, 0)
+	if !ixHandshakeStage0Message(f, hostinfo, cookie) {
+		return
+	}
+
+	msg := hostinfo.HandshakePacket[0]
+	f.messageMetrics.Tx(handshake, NebulaMessageSubType(msg[1]), 1)
+	err = f.outside.WriteTo(msg, addr)
+	if err != nil {
+		f.l.WithError(err).WithField("vpnIp", IntIp(hostinfo.hostId)).WithField("udpAddr", addr).
+			WithField("initiatorIndex", hostinfo.localIndexId).WithField("cookie", true).
+			WithField("handshake", m{"stage": 1, "style": "ix_psk0"}).Error("Failed to send handshake message")
+	} else {
+		f.l.WithField("vpnIp", IntIp(hostinfo.hostId)).WithField("udpAddr", addr).
+			WithField("initiatorIndex", hostinfo.localIndexId).WithField("cookie", true).
+			WithField("handshake", m{"stage": 1, "style": "ix_psk0"}).Info("Handshake message sent")
+	}
+}
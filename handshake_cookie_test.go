@@ -0,0 +1,77 @@
+package nebula
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestHandshakeLimiter(rateLimit map[interface{}]interface{}) *handshakeLimiter {
+	c := NewConfig(NewTestLogger())
+	c.Settings["handshakes"] = map[interface{}]interface{}{"rate_limit": rateLimit}
+	return newHandshakeLimiterFromConfig(c, nil)
+}
+
+func TestHandshakeLimiter_allow(t *testing.T) {
+	now := time.Now()
+	a := NewUDPAddr(net.ParseIP("1.1.1.1"), 4242)
+	b := NewUDPAddr(net.ParseIP("1.1.1.2"), 4242)
+
+	// Disabled by default
+	hl := newTestHandshakeLimiter(map[interface{}]interface{}{})
+	assert.False(t, hl.Enabled())
+	for i := 0; i < 100; i++ {
+		assert.True(t, hl.allow(a, now))
+	}
+
+	hl = newTestHandshakeLimiter(map[interface{}]interface{}{"per_source": 2, "burst": 3})
+	assert.True(t, hl.Enabled())
+	assert.True(t, hl.allow(a, now))
+	assert.True(t, hl.allow(a, now))
+	assert.True(t, hl.allow(a, now))
+	assert.False(t, hl.allow(a, now))
+
+	// Other sources have their own bucket
+	assert.True(t, hl.allow(b, now))
+
+	// The bucket refills over time, regardless of the port
+	assert.True(t, hl.allow(NewUDPAddr(net.ParseIP("1.1.1.1"), 1), now.Add(time.Millisecond*500)))
+	assert.False(t, hl.allow(a, now.Add(time.Millisecond*500)))
+
+	// Idle sources are forgotten
+	hl.sweep(now.Add(time.Minute))
+	assert.Empty(t, hl.sources)
+}
+
+func TestHandshakeLimiter_challenge(t *testing.T) {
+	now := time.Now()
+	a := NewUDPAddr(net.ParseIP("1.1.1.1"), 4242)
+
+	hl := newTestHandshakeLimiter(map[interface{}]interface{}{})
+	assert.Equal(t, uint64(0), hl.challenge(a, 1, 0, now))
+
+	hl = newTestHandshakeLimiter(map[interface{}]interface{}{"cookie_threshold": 2})
+	assert.Equal(t, uint64(0), hl.challenge(a, 1, 0, now))
+	assert.Equal(t, uint64(0), hl.challenge(a, 1, 0, now))
+
+	// We are busy now
+	cookie := hl.challenge(a, 1, 0, now)
+	assert.NotEqual(t, uint64(0), cookie)
+
+	// A bad cookie is challenged again
+	assert.Equal(t, cookie, hl.challenge(a, 1, cookie+1, now))
+
+	// The cookie only works for the same address and handshake
+	assert.Equal(t, uint64(0), hl.challenge(a, 1, cookie, now))
+	assert.NotEqual(t, uint64(0), hl.challenge(a, 2, cookie, now))
+	assert.NotEqual(t, uint64(0), hl.challenge(NewUDPAddr(net.ParseIP("1.1.1.1"), 1), 1, cookie, now))
+
+	// Cookies outlive a single rotation but not two
+	assert.Equal(t, uint64(0), hl.challenge(a, 1, cookie, now.Add(cookieRotation)))
+	later := now.Add(cookieRotation * 2)
+	hl.challenge(a, 1, 0, later)
+	hl.challenge(a, 1, 0, later)
+	assert.NotEqual(t, uint64(0), hl.challenge(a, 1, cookie, later))
+}
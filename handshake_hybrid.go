@@ -0,0 +1,58 @@
+package nebula
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// hybridMode controls whether handshakes mix an ML-KEM key exchange into the tunnel keys alongside X25519
+type hybridMode int
+
+const (
+	// hybridOff never offers or accepts a hybrid handshake
+	hybridOff hybridMode = iota
+	// hybridPrefer offers a hybrid handshake and falls back to X25519 only with hosts that do not support it
+	hybridPrefer
+	// hybridRequire refuses any tunnel that did not complete a hybrid handshake
+	hybridRequire
+)
+
+var errHybridUnsupported = errors.New("hybrid handshakes require nebula to be built with go1.24 or newer")
+
+func (m hybridMode) String() string {
+	switch m {
+	case hybridPrefer:
+		return "prefer"
+	case hybridRequire:
+		return "require"
+	default:
+		return "off"
+	}
+}
+
+func parseHybridMode(s string) (hybridMode, error) {
+	switch strings.ToLower(s) {
+	case "", "off":
+		return hybridOff, nil
+	case "prefer":
+		return hybridPrefer, nil
+	case "require":
+		return hybridRequire, nil
+	default:
+		return hybridOff, fmt.Errorf("unknown handshakes.hybrid value: %s, expected off, prefer or require", s)
+	}
+}
+
+func newHybridModeFromConfig(c *Config) (hybridMode, error) {
+	mode, err := parseHybridMode(c.GetString("handshakes.hybrid", "off"))
+	if err != nil {
+		return hybridOff, err
+	}
+
+	if mode != hybridOff && !hybridKEMSupported {
+		return hybridOff, errHybridUnsupported
+	}
+
+	return mode, nil
+}
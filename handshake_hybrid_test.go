@@ -0,0 +1,49 @@
+package nebula
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_parseHybridMode(t *testing.T) {
+	for s, expected := range map[string]hybridMode{
+		"":        hybridOff,
+		"off":     hybridOff,
+		"prefer":  hybridPrefer,
+		"Require": hybridRequire,
+	} {
+		mode, err := parseHybridMode(s)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, mode)
+	}
+
+	_, err := parseHybridMode("sometimes")
+	assert.EqualError(t, err, "unknown handshakes.hybrid value: sometimes, expected off, prefer or require")
+}
+
+func Test_newHybridModeFromConfig(t *testing.T) {
+	l := NewTestLogger()
+	c := NewConfig(l)
+
+	mode, err := newHybridModeFromConfig(c)
+	assert.Nil(t, err)
+	assert.Equal(t, hybridOff, mode)
+
+	c.Settings["handshakes"] = map[interface{}]interface{}{"hybrid": "prefer"}
+	mode, err = newHybridModeFromConfig(c)
+	if hybridKEMSupported {
+		assert.Nil(t, err)
+		assert.Equal(t, hybridPrefer, mode)
+	} else {
+		assert.Equal(t, errHybridUnsupported, err)
+	}
+}
+
+func TestConnectionState_KeyExchange(t *testing.T) {
+	cs := &ConnectionState{}
+	assert.Equal(t, "X25519", cs.KeyExchange())
+
+	cs.hybrid = true
+	assert.Equal(t, "X25519+ML-KEM-768", cs.KeyExchange())
+}
@@ -6,6 +6,7 @@ import (
 
 	"github.com/flynn/noise"
 	"github.com/golang/protobuf/proto"
+	"github.com/sirupsen/logrus"
 )
 
 // NOISE IX Handshakes
@@ -31,12 +32,44 @@ func ixHandshakeStage0(f *Interface, vpnIp uint32, hostinfo *HostInfo) {
 		return
 	}
 
+	if !ixHandshakeStage0Message(f, hostinfo, 0) {
+		return
+	}
+
+	hostinfo.handshakeStart = time.Now()
+}
+
+// ixHandshakeStage0Message writes the first handshake message into hostinfo.HandshakePacket[0] using the connection
+// state of hostinfo. cookie is 0 unless the responder asked us to echo one. hostinfo must be locked
+func ixHandshakeStage0Message(f *Interface, hostinfo *HostInfo, cookie uint64) bool {
+	vpnIp := hostinfo.hostId
 	ci := hostinfo.ConnectionState
 
 	hsProto := &NebulaHandshakeDetails{
 		InitiatorIndex: hostinfo.localIndexId,
 		Time:           uint64(time.Now().Unix()),
 		Cert:           ci.certState.rawCertificateNoKey,
+		Cookie:         cookie,
+		Ciphers:        f.ciphers,
+	}
+
+	var err error
+
+	subtype := uint8(handshakeIXPSK0)
+	if f.handshakeHybrid != hybridOff {
+		ci.kem, err = newHybridKEM()
+		if err != nil {
+			f.l.WithError(err).WithField("vpnIp", IntIp(vpnIp)).
+				WithField("handshake", m{"stage": 0, "style": "ix_psk0"}).Error("Failed to generate hybrid handshake key")
+			return false
+		}
+
+		// Hosts that do not support hybrid handshakes ignore the key and respond with a regular handshake, unless we
+		// require it there is no reason to stop them from responding
+		hsProto.KemPublicKey = ci.kem.PublicKey()
+		if f.handshakeHybrid == hybridRequire {
+			subtype = handshakeIXPSK0Hybrid
+		}
 	}
 
 	hsBytes := []byte{}
@@ -49,17 +82,17 @@ func ixHandshakeStage0(f *Interface, vpnIp uint32, hostinfo *HostInfo) {
 	if err != nil {
 		f.l.WithError(err).WithField("vpnIp", IntIp(vpnIp)).
 			WithField("handshake", m{"stage": 0, "style": "ix_psk0"}).Error("Failed to marshal handshake message")
-		return
+		return false
 	}
 
-	header := HeaderEncode(make([]byte, HeaderLen), Version, uint8(handshake), handshakeIXPSK0, 0, 1)
+	header := HeaderEncode(make([]byte, HeaderLen), Version, uint8(handshake), subtype, 0, 1)
 	atomic.AddUint64(&ci.atomicMessageCounter, 1)
 
 	msg, _, _, err := ci.H.WriteMessage(header, hsBytes)
 	if err != nil {
 		f.l.WithError(err).WithField("vpnIp", IntIp(vpnIp)).
 			WithField("handshake", m{"stage": 0, "style": "ix_psk0"}).Error("Failed to call noise.WriteMessage")
-		return
+		return false
 	}
 
 	// We are sending handshake packet 1, so we don't expect to receive
@@ -68,17 +101,44 @@ func ixHandshakeStage0(f *Interface, vpnIp uint32, hostinfo *HostInfo) {
 
 	hostinfo.HandshakePacket[0] = msg
 	hostinfo.HandshakeReady = true
-	hostinfo.handshakeStart = time.Now()
+	return true
+}
+
+// ixReadStage1 reads the first handshake message with every combination of cipher and psk until one works. It returns
+// the connection state that read the message along with the psk it used.
+func ixReadStage1(f *Interface, packet []byte, ciphers []string, keys [][]byte) (*ConnectionState, []byte, []byte, error) {
+	var err error
+	for _, cipher := range ciphers {
+		for _, key := range keys {
+			ci := f.newConnectionState(f.l, false, noise.HandshakeIX, cipher, key, 0)
+			var msg []byte
+			msg, _, _, err = ci.H.ReadMessage(nil, packet[HeaderLen:])
+			if err == nil {
+				return ci, msg, key, nil
+			}
+		}
+	}
 
+	return nil, nil, nil, err
 }
 
 func ixHandshakeStage1(f *Interface, addr *udpAddr, packet []byte, h *Header) {
-	ci := f.newConnectionState(f.l, false, noise.HandshakeIX, []byte{}, 0)
-	// Mark packet 1 as seen so it doesn't show up as missed
-	ci.window.Update(f.l, 1)
-
-	msg, _, _, err := ci.H.ReadMessage(nil, packet[HeaderLen:])
+	// Without the right psk the first message fails to decrypt, before any asymmetric crypto or cert parsing happens.
+	// The initiator may have done the handshake with any of the ciphers we accept, try them all.
+	psk := f.psk
+	ci, msg, key, err := ixReadStage1(f, packet, f.ciphers, psk.keys)
 	if err != nil {
+		if psk.Required() {
+			// This is expected from anyone that does not have our psk, it is not worth more than a debug log
+			psk.metricRejected.Inc(1)
+			if f.l.Level >= logrus.DebugLevel {
+				f.l.WithError(err).WithField("udpAddr", addr).
+					WithField("handshake", m{"stage": 1, "style": "ix_psk0"}).
+					Debug("Failed to call noise.ReadMessage, the initiator may not have a valid psk")
+			}
+			return
+		}
+
 		f.l.WithError(err).WithField("udpAddr", addr).
 			WithField("handshake", m{"stage": 1, "style": "ix_psk0"}).Error("Failed to call noise.ReadMessage")
 		return
@@ -95,6 +155,33 @@ func ixHandshakeStage1(f *Interface, addr *udpAddr, packet []byte, h *Header) {
 		return
 	}
 
+	// Without a psk the first message is not encrypted and any cipher can read it, initiators that negotiate ciphers
+	// list the one they did the handshake with first
+	if len(hs.Details.Ciphers) > 0 && hs.Details.Ciphers[0] != ci.handshakeCipher {
+		if !hasCipher(f.ciphers, hs.Details.Ciphers[0]) {
+			f.l.WithField("udpAddr", addr).WithField("cipher", hs.Details.Ciphers[0]).
+				WithField("handshake", m{"stage": 1, "style": "ix_psk0"}).
+				Info("Refusing handshake, the initiator uses a cipher we do not accept")
+			return
+		}
+
+		ci, _, _, err = ixReadStage1(f, packet, hs.Details.Ciphers[:1], [][]byte{key})
+		if err != nil {
+			f.l.WithError(err).WithField("udpAddr", addr).WithField("cipher", hs.Details.Ciphers[0]).
+				WithField("handshake", m{"stage": 1, "style": "ix_psk0"}).Error("Failed to call noise.ReadMessage")
+			return
+		}
+	}
+
+	// Mark packet 1 as seen so it doesn't show up as missed
+	ci.window.Update(f.l, 1)
+
+	// A busy responder makes the initiator prove it owns its address before doing any real work
+	if cookie := f.handshakeLimiter.challenge(addr, hs.Details.InitiatorIndex, hs.Details.Cookie, time.Now()); cookie != 0 {
+		f.sendHandshakeCookie(addr, hs.Details.InitiatorIndex, cookie)
+		return
+	}
+
 	remoteCert, err := RecombineCertAndValidate(ci.H, hs.Details.Cert, f.caPool)
 	if err != nil {
 		f.l.WithError(err).WithField("udpAddr", addr).
@@ -106,6 +193,14 @@ func ixHandshakeStage1(f *Interface, addr *udpAddr, packet []byte, h *Header) {
 	certName := remoteCert.Details.Names
 	fingerprint, _ := remoteCert.Sha256Sum()
 
+	if f.caPool.IsDeprecated(remoteCert, time.Now()) {
+		f.l.WithField("vpnIp", IntIp(vpnIP)).WithField("udpAddr", addr).
+			WithField("certName", certName).
+			WithField("fingerprint", fingerprint).
+			WithField("issuer", remoteCert.Details.Issuer).
+			WithField("handshake", m{"stage": 1, "style": "ix_psk0"}).Warn("Peer certificate was issued by a deprecated CA")
+	}
+
 	if vpnIP == ip2int(f.certState.certificate.Details.Ips[0].IP) {
 		f.l.WithField("vpnIp", IntIp(vpnIP)).WithField("udpAddr", addr).
 			WithField("certName", certName).
@@ -139,8 +234,48 @@ func ixHandshakeStage1(f *Interface, addr *udpAddr, packet []byte, h *Header) {
 		WithField("remoteIndex", h.RemoteIndex).WithField("handshake", m{"stage": 1, "style": "ix_psk0"}).
 		Info("Handshake message received")
 
+	var ss []byte
+	subtype := uint8(handshakeIXPSK0)
+	if h.Subtype == handshakeIXPSK0Hybrid || (len(hs.Details.KemPublicKey) > 0 && f.handshakeHybrid != hybridOff) {
+		if f.handshakeHybrid == hybridOff {
+			f.l.WithField("vpnIp", IntIp(vpnIP)).WithField("udpAddr", addr).
+				WithField("certName", certName).
+				WithField("fingerprint", fingerprint).
+				WithField("handshake", m{"stage": 1, "style": "ix_psk0"}).
+				Info("Refusing hybrid handshake, handshakes.hybrid is off")
+			return
+		}
+
+		var ct []byte
+		ss, ct, err = hybridEncapsulate(hs.Details.KemPublicKey)
+		if err != nil {
+			f.l.WithError(err).WithField("vpnIp", IntIp(vpnIP)).WithField("udpAddr", addr).
+				WithField("certName", certName).
+				WithField("fingerprint", fingerprint).
+				WithField("handshake", m{"stage": 1, "style": "ix_psk0"}).Error("Failed to encapsulate hybrid handshake key")
+			return
+		}
+
+		hs.Details.KemCiphertext = ct
+		subtype = handshakeIXPSK0Hybrid
+
+	} else if f.handshakeHybrid == hybridRequire {
+		f.l.WithField("vpnIp", IntIp(vpnIP)).WithField("udpAddr", addr).
+			WithField("certName", certName).
+			WithField("fingerprint", fingerprint).
+			WithField("handshake", m{"stage": 1, "style": "ix_psk0"}).
+			Info("Refusing handshake without a hybrid key, handshakes.hybrid is require")
+		return
+	}
+
+	ci.cipher = chooseCipher(f.ciphers, hs.Details.Ciphers, ci.handshakeCipher)
+
 	hs.Details.ResponderIndex = myIndex
 	hs.Details.Cert = ci.certState.rawCertificateNoKey
+	// The initiator already has its key, there is no reason to send it back
+	hs.Details.KemPublicKey = nil
+	hs.Details.Ciphers = nil
+	hs.Details.Cipher = ci.cipher
 
 	hsBytes, err := proto.Marshal(hs)
 	if err != nil {
@@ -151,7 +286,7 @@ func ixHandshakeStage1(f *Interface, addr *udpAddr, packet []byte, h *Header) {
 		return
 	}
 
-	header := HeaderEncode(make([]byte, HeaderLen), Version, uint8(handshake), handshakeIXPSK0, hs.Details.InitiatorIndex, 2)
+	header := HeaderEncode(make([]byte, HeaderLen), Version, uint8(handshake), subtype, hs.Details.InitiatorIndex, 2)
 	msg, dKey, eKey, err := ci.H.WriteMessage(header, hsBytes)
 	if err != nil {
 		f.l.WithError(err).WithField("vpnIp", IntIp(hostinfo.hostId)).WithField("udpAddr", addr).
@@ -180,8 +315,15 @@ func ixHandshakeStage1(f *Interface, addr *udpAddr, packet []byte, h *Header) {
 	ci.window.Update(f.l, 2)
 
 	ci.peerCert = remoteCert
-	ci.dKey = NewNebulaCipherState(dKey)
-	ci.eKey = NewNebulaCipherState(eKey)
+	ci.dKey, ci.eKey, err = tunnelKeys(ci, dKey, eKey, ss)
+	if err != nil {
+		f.l.WithError(err).WithField("vpnIp", IntIp(hostinfo.hostId)).WithField("udpAddr", addr).
+			WithField("certName", certName).
+			WithField("fingerprint", fingerprint).
+			WithField("handshake", m{"stage": 1, "style": "ix_psk0"}).Error("Failed to derive tunnel keys")
+		return
+	}
+	ci.hybrid = ss != nil
 	//l.Debugln("got symmetric pairs")
 
 	//hostinfo.ClearRemotes()
@@ -326,6 +468,10 @@ func ixHandshakeStage2(f *Interface, addr *udpAddr, hostinfo *HostInfo, packet [
 			WithField("cert", remoteCert).WithField("handshake", m{"stage": 2, "style": "ix_psk0"}).
 			Error("Invalid certificate from host")
 
+		e := newHostEvent(EventHandshakeFailed, hostinfo)
+		e.Reason = HandshakeFailedInvalidCert
+		f.events.publish(e)
+
 		// The handshake state machine is complete, if things break now there is no chance to recover. Tear down and start again
 		return true
 	}
@@ -334,6 +480,59 @@ func ixHandshakeStage2(f *Interface, addr *udpAddr, hostinfo *HostInfo, packet [
 	certName := remoteCert.Details.Names
 	fingerprint, _ := remoteCert.Sha256Sum()
 
+	if f.caPool.IsDeprecated(remoteCert, time.Now()) {
+		f.l.WithField("vpnIp", IntIp(vpnIP)).WithField("udpAddr", addr).
+			WithField("certName", certName).
+			WithField("fingerprint", fingerprint).
+			WithField("issuer", remoteCert.Details.Issuer).
+			WithField("handshake", m{"stage": 2, "style": "ix_psk0"}).Warn("Peer certificate was issued by a deprecated CA")
+	}
+
+	var ss []byte
+	if h.Subtype == handshakeIXPSK0Hybrid || len(hs.Details.KemCiphertext) > 0 {
+		if ci.kem == nil {
+			f.l.WithField("vpnIp", IntIp(vpnIP)).WithField("udpAddr", addr).
+				WithField("certName", certName).
+				WithField("fingerprint", fingerprint).
+				WithField("handshake", m{"stage": 2, "style": "ix_psk0"}).
+				Error("Received a hybrid handshake response we did not ask for")
+			return true
+		}
+
+		ss, err = ci.kem.Decapsulate(hs.Details.KemCiphertext)
+		if err != nil {
+			f.l.WithError(err).WithField("vpnIp", IntIp(vpnIP)).WithField("udpAddr", addr).
+				WithField("certName", certName).
+				WithField("fingerprint", fingerprint).
+				WithField("handshake", m{"stage": 2, "style": "ix_psk0"}).
+				Error("Failed to decapsulate hybrid handshake key")
+			return true
+		}
+
+	} else if f.handshakeHybrid == hybridRequire {
+		f.l.WithField("vpnIp", IntIp(vpnIP)).WithField("udpAddr", addr).
+			WithField("certName", certName).
+			WithField("fingerprint", fingerprint).
+			WithField("handshake", m{"stage": 2, "style": "ix_psk0"}).
+			Error("Peer did not complete a hybrid handshake, handshakes.hybrid is require")
+		return true
+	}
+	ci.kem = nil
+
+	// Responders that do not negotiate ciphers use the one we did the handshake with
+	if hs.Details.Cipher != "" && hs.Details.Cipher != ci.handshakeCipher {
+		if !hasCipher(f.ciphers, hs.Details.Cipher) {
+			f.l.WithField("vpnIp", IntIp(vpnIP)).WithField("udpAddr", addr).
+				WithField("certName", certName).
+				WithField("fingerprint", fingerprint).
+				WithField("cipher", hs.Details.Cipher).
+				WithField("handshake", m{"stage": 2, "style": "ix_psk0"}).
+				Error("Peer chose a cipher we do not support")
+			return true
+		}
+		ci.cipher = hs.Details.Cipher
+	}
+
 	if vpnIP != hostinfo.hostId {
 		f.l.WithField("intendedVpnIp", IntIp(hostinfo.hostId)).WithField("haveVpnIp", IntIp(vpnIP)).
 			WithField("udpAddr", addr).WithField("certName", certName).
@@ -393,8 +592,15 @@ func ixHandshakeStage2(f *Interface, addr *udpAddr, hostinfo *HostInfo, packet [
 
 	// Store their cert and our symmetric keys
 	ci.peerCert = remoteCert
-	ci.dKey = NewNebulaCipherState(dKey)
-	ci.eKey = NewNebulaCipherState(eKey)
+	ci.eKey, ci.dKey, err = tunnelKeys(ci, eKey, dKey, ss)
+	if err != nil {
+		f.l.WithError(err).WithField("vpnIp", IntIp(vpnIP)).WithField("udpAddr", addr).
+			WithField("certName", certName).
+			WithField("fingerprint", fingerprint).
+			WithField("handshake", m{"stage": 2, "style": "ix_psk0"}).Error("Failed to derive tunnel keys")
+		return true
+	}
+	ci.hybrid = ss != nil
 
 	// Make sure the current udpAddr being used is set for responding
 	hostinfo.SetRemote(addr)
@@ -8,6 +8,7 @@ import (
 	"net"
 	"time"
 
+	"github.com/rcrowley/go-metrics"
 	"github.com/sirupsen/logrus"
 )
 
@@ -53,6 +54,8 @@ type HandshakeManager struct {
 	InboundHandshakeTimer  *SystemTimerWheel
 
 	messageMetrics *MessageMetrics
+	events         *eventBus
+	tracer         *handshakeTracer
 	l              *logrus.Logger
 }
 
@@ -109,9 +112,14 @@ func (c *HandshakeManager) handleOutbound(vpnIP uint32, f EncWriter, lighthouseT
 	hostinfo.Lock()
 	defer hostinfo.Unlock()
 
+	if lighthouseTriggered {
+		c.tracer.lighthouseReply(vpnIP)
+	}
+
 	// If we haven't finished the handshake and we haven't hit max retries, query
 	// lighthouse and then send the handshake packet again.
 	if hostinfo.HandshakeCounter < c.config.retries && !hostinfo.HandshakeComplete {
+		c.tracer.start(vpnIP)
 		if hostinfo.remote == nil {
 			// We continue to query the lighthouse because hosts may
 			// come online during handshake retries. If the query
@@ -121,6 +129,7 @@ func (c *HandshakeManager) handleOutbound(vpnIP uint32, f EncWriter, lighthouseT
 			// finished reporting its own IPs yet), then send another query to
 			// the LH.
 			if len(ips) <= 1 {
+				c.tracer.lighthouseQuery(vpnIP)
 				ips, err = c.lightHouse.Query(vpnIP, f)
 			}
 			if err == nil {
@@ -174,6 +183,12 @@ func (c *HandshakeManager) handleOutbound(vpnIP uint32, f EncWriter, lighthouseT
 		}
 	} else {
 		c.pendingHostMap.DeleteHostInfo(hostinfo)
+		if !hostinfo.HandshakeComplete {
+			e := newHostEvent(EventHandshakeFailed, hostinfo)
+			e.Reason = HandshakeFailedTimeout
+			c.events.publish(e)
+			c.tracer.finish(hostinfo, "handshake timed out")
+		}
 	}
 }
 
@@ -288,6 +303,7 @@ func (c *HandshakeManager) Complete(hostinfo *HostInfo, f *Interface) {
 	}
 
 	c.mainHostMap.addHostInfo(hostinfo, f)
+	c.tracer.finish(hostinfo, "")
 }
 
 // AddIndexHostInfo generates a unique localIndexId for this HostInfo
@@ -331,9 +347,9 @@ func (c *HandshakeManager) QueryIndex(index uint32) (*HostInfo, error) {
 	return c.pendingHostMap.QueryIndex(index)
 }
 
-func (c *HandshakeManager) EmitStats() {
-	c.pendingHostMap.EmitStats("pending")
-	c.mainHostMap.EmitStats("main")
+func (c *HandshakeManager) EmitStats(r metrics.Registry) {
+	c.pendingHostMap.EmitStats(r, "pending")
+	c.mainHostMap.EmitStats(r, "main")
 }
 
 // Utility functions below
@@ -0,0 +1,205 @@
+package nebula
+
+import (
+	"crypto/rand"
+	"sync"
+	"time"
+)
+
+// traceBufferSize is how many finished spans are held until the exporter collects them, older spans are dropped first
+const traceBufferSize = 4096
+
+// handshakeTraceTimeout is how long a trace may go without finishing before it is discarded
+const handshakeTraceTimeout = 5 * time.Minute
+
+// traceSpan is a finished or in flight span, attrs are encoded KeyValues
+type traceSpan struct {
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID []byte
+	name     string
+	start    time.Time
+	end      time.Time
+	attrs    [][]byte
+	err      string
+}
+
+func newTraceSpan(name string, traceID [16]byte, parent *traceSpan) *traceSpan {
+	s := &traceSpan{traceID: traceID, name: name, start: time.Now()}
+	_, _ = rand.Read(s.spanID[:])
+	if parent != nil {
+		s.parentID = parent.spanID[:]
+	}
+	return s
+}
+
+// traceBuffer holds finished spans from every network until they are exported
+type traceBuffer struct {
+	sync.Mutex
+	spans []*traceSpan
+}
+
+// newTraceBufferFromConfig returns nil unless handshake traces are enabled with `stats.traces`
+func newTraceBufferFromConfig(c *Config) *traceBuffer {
+	if c.GetString("stats.type", "") != "otlp" || !c.GetBool("stats.traces", false) {
+		return nil
+	}
+
+	return &traceBuffer{}
+}
+
+func (b *traceBuffer) add(spans ...*traceSpan) {
+	b.Lock()
+	defer b.Unlock()
+	b.spans = append(b.spans, spans...)
+	if over := len(b.spans) - traceBufferSize; over > 0 {
+		b.spans = b.spans[over:]
+	}
+}
+
+// drain returns and forgets every finished span, it is safe to call on a nil traceBuffer
+func (b *traceBuffer) drain() []*traceSpan {
+	if b == nil {
+		return nil
+	}
+
+	b.Lock()
+	defer b.Unlock()
+	spans := b.spans
+	b.spans = nil
+	return spans
+}
+
+// handshakeTrace is the root span of one outbound handshake and its lighthouse query, if one is in flight
+type handshakeTrace struct {
+	root       *traceSpan
+	lighthouse *traceSpan
+	queries    int64
+}
+
+// handshakeTracer records a span for every outbound handshake of a network, from the first attempt until the tunnel
+// is complete or the handshake gives up. Time spent waiting on the lighthouse is a child span.
+// All methods are safe to call on a nil handshakeTracer, which records nothing.
+type handshakeTracer struct {
+	sync.Mutex
+	network string
+	buffer  *traceBuffer
+	active  map[uint32]*handshakeTrace
+}
+
+// newHandshakeTracer returns nil if buffer is nil
+func newHandshakeTracer(network string, buffer *traceBuffer) *handshakeTracer {
+	if buffer == nil {
+		return nil
+	}
+
+	return &handshakeTracer{network: network, buffer: buffer, active: make(map[uint32]*handshakeTrace)}
+}
+
+// start begins a trace for vpnIp, it does nothing if one is already running
+func (t *handshakeTracer) start(vpnIp uint32) {
+	if t == nil {
+		return
+	}
+
+	t.Lock()
+	defer t.Unlock()
+	if _, ok := t.active[vpnIp]; ok {
+		return
+	}
+
+	// Handshakes that were abandoned without us hearing about it would otherwise stay forever
+	now := time.Now()
+	for ip, tr := range t.active {
+		if now.Sub(tr.root.start) > handshakeTraceTimeout {
+			delete(t.active, ip)
+		}
+	}
+
+	var traceID [16]byte
+	_, _ = rand.Read(traceID[:])
+	t.active[vpnIp] = &handshakeTrace{root: newTraceSpan("nebula.handshake", traceID, nil)}
+}
+
+// lighthouseQuery starts a lighthouse span for vpnIp unless one is already waiting on a reply
+func (t *handshakeTracer) lighthouseQuery(vpnIp uint32) {
+	if t == nil {
+		return
+	}
+
+	t.Lock()
+	defer t.Unlock()
+	tr, ok := t.active[vpnIp]
+	if !ok {
+		return
+	}
+
+	tr.queries++
+	if tr.lighthouse == nil {
+		tr.lighthouse = newTraceSpan("nebula.lighthouse.query", tr.root.traceID, tr.root)
+	}
+}
+
+// lighthouseReply ends the lighthouse span for vpnIp
+func (t *handshakeTracer) lighthouseReply(vpnIp uint32) {
+	if t == nil {
+		return
+	}
+
+	t.Lock()
+	defer t.Unlock()
+	tr, ok := t.active[vpnIp]
+	if !ok || tr.lighthouse == nil {
+		return
+	}
+
+	t.endLighthouse(tr, "")
+}
+
+// finish ends the trace for hostinfo, errMsg marks the handshake as failed when it is not empty
+func (t *handshakeTracer) finish(hostinfo *HostInfo, errMsg string) {
+	if t == nil {
+		return
+	}
+
+	t.Lock()
+	defer t.Unlock()
+	tr, ok := t.active[hostinfo.hostId]
+	if !ok {
+		return
+	}
+	delete(t.active, hostinfo.hostId)
+
+	if tr.lighthouse != nil {
+		t.endLighthouse(tr, errMsg)
+	}
+
+	e := newHostEvent(EventTunnelUp, hostinfo)
+	root := tr.root
+	root.end = time.Now()
+	root.err = errMsg
+	root.attrs = append(root.attrs,
+		pbAttr("nebula.network", t.network),
+		pbAttr("nebula.vpn_ip", e.VpnIP.String()),
+		pbAttr("nebula.handshake.attempts", int64(hostinfo.HandshakeCounter)),
+		pbAttr("nebula.lighthouse.queries", tr.queries),
+	)
+	if e.Remote != nil {
+		root.attrs = append(root.attrs, pbAttr("nebula.remote", e.Remote.String()))
+	}
+	if e.Name != "" {
+		root.attrs = append(root.attrs, pbAttr("nebula.cert_name", e.Name))
+	}
+
+	t.buffer.add(root)
+}
+
+// endLighthouse must be called with the lock held
+func (t *handshakeTracer) endLighthouse(tr *handshakeTrace, errMsg string) {
+	s := tr.lighthouse
+	tr.lighthouse = nil
+	s.end = time.Now()
+	s.err = errMsg
+	s.attrs = append(s.attrs, pbAttr("nebula.network", t.network))
+	t.buffer.add(s)
+}
@@ -0,0 +1,73 @@
+package nebula
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandshakeTracer(t *testing.T) {
+	// Tracing is off unless the otlp exporter asks for it
+	c := NewConfig(NewTestLogger())
+	c.Settings["stats"] = map[interface{}]interface{}{"type": "prometheus", "traces": true}
+	assert.Nil(t, newTraceBufferFromConfig(c))
+	c.Settings["stats"] = map[interface{}]interface{}{"type": "otlp"}
+	assert.Nil(t, newTraceBufferFromConfig(c))
+	c.Settings["stats"] = map[interface{}]interface{}{"type": "otlp", "traces": true}
+	traces := newTraceBufferFromConfig(c)
+	assert.NotNil(t, traces)
+
+	hostinfo := &HostInfo{hostId: ip2int(net.ParseIP("10.1.0.2"))}
+
+	// A nil tracer records nothing
+	var nilTracer *handshakeTracer
+	assert.Nil(t, newHandshakeTracer("", nil))
+	nilTracer.start(hostinfo.hostId)
+	nilTracer.lighthouseQuery(hostinfo.hostId)
+	nilTracer.lighthouseReply(hostinfo.hostId)
+	nilTracer.finish(hostinfo, "")
+	assert.Nil(t, (*traceBuffer)(nil).drain())
+
+	tracer := newHandshakeTracer("", traces)
+
+	// Nothing is recorded for handshakes we did not start, like those we respond to
+	tracer.finish(hostinfo, "")
+	assert.Empty(t, traces.drain())
+
+	// Retries keep the first trace and lighthouse span going
+	tracer.start(hostinfo.hostId)
+	tracer.lighthouseQuery(hostinfo.hostId)
+	root := tracer.active[hostinfo.hostId].root
+	lh := tracer.active[hostinfo.hostId].lighthouse
+	tracer.start(hostinfo.hostId)
+	tracer.lighthouseQuery(hostinfo.hostId)
+	assert.Equal(t, root, tracer.active[hostinfo.hostId].root)
+	assert.Equal(t, lh, tracer.active[hostinfo.hostId].lighthouse)
+	assert.Equal(t, int64(2), tracer.active[hostinfo.hostId].queries)
+
+	tracer.lighthouseReply(hostinfo.hostId)
+	assert.Equal(t, []*traceSpan{lh}, traces.drain())
+	assert.False(t, lh.end.IsZero())
+
+	tracer.finish(hostinfo, "")
+	assert.Equal(t, []*traceSpan{root}, traces.drain())
+	assert.Empty(t, tracer.active)
+
+	// Stale traces are pruned when a new one starts
+	tracer.start(hostinfo.hostId)
+	tracer.active[hostinfo.hostId].root.start = time.Now().Add(-handshakeTraceTimeout - time.Second)
+	tracer.start(hostinfo.hostId + 1)
+	assert.Len(t, tracer.active, 1)
+	assert.Contains(t, tracer.active, hostinfo.hostId+1)
+
+	// The buffer keeps the newest spans
+	for i := 0; i < traceBufferSize+10; i++ {
+		traces.add(&traceSpan{name: "span"})
+	}
+	traces.add(&traceSpan{name: "last"})
+	spans := traces.drain()
+	assert.Len(t, spans, traceBufferSize)
+	assert.Equal(t, "last", spans[len(spans)-1].name)
+}
@@ -74,7 +74,9 @@ var subTypeMap = map[NebulaMessageType]*map[NebulaMessageSubType]string{
 	test:        &subTypeTestMap,
 	closeTunnel: &subTypeNoneMap,
 	handshake: {
-		handshakeIXPSK0: "ix_psk0",
+		handshakeIXPSK0:       "ix_psk0",
+		handshakeIXPSK0Hybrid: "ix_psk0_hybrid",
+		handshakeCookieReply:  "cookie_reply",
 	},
 	//TODO: these are deprecated
 	testRemote:      &subTypeNoneMap,
@@ -93,7 +93,9 @@ func TestTypeMap(t *testing.T) {
 		test:        &subTypeTestMap,
 		closeTunnel: &subTypeNoneMap,
 		handshake: {
-			handshakeIXPSK0: "ix_psk0",
+			handshakeIXPSK0:       "ix_psk0",
+			handshakeIXPSK0Hybrid: "ix_psk0_hybrid",
+			handshakeCookieReply:  "cookie_reply",
 		},
 		testRemote:      &subTypeNoneMap,
 		testRemoteReply: &subTypeNoneMap,
@@ -0,0 +1,293 @@
+package nebula
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultHookTimeout is how long a hook may run before it is killed
+const DefaultHookTimeout = 10 * time.Second
+
+// hookEvents are the events a hook can run on
+var hookEvents = []EventType{EventTunnelUp, EventTunnelDown, EventHandshakeFailed, EventRoam, EventLighthouseUpdate}
+
+// tunnelHook runs a command or posts to a url for every event it is interested in
+type tunnelHook struct {
+	index   int
+	on      []EventType
+	command []string
+	url     string
+	timeout time.Duration
+}
+
+// env describes e in environment variables for a command
+func (h *tunnelHook) env(e Event) []string {
+	env := []string{
+		"NEBULA_EVENT=" + string(e.Type),
+		"NEBULA_VPN_IP=" + e.VpnIP.String(),
+		"NEBULA_CERT_NAME=" + e.Name,
+		"NEBULA_GROUPS=" + strings.Join(e.Groups, ","),
+		"NEBULA_REASON=" + e.Reason,
+	}
+
+	remote := ""
+	if e.Remote != nil {
+		remote = e.Remote.String()
+	}
+	env = append(env, "NEBULA_REMOTE="+remote)
+
+	oldRemote := ""
+	if e.OldRemote != nil {
+		oldRemote = e.OldRemote.String()
+	}
+	return append(env, "NEBULA_OLD_REMOTE="+oldRemote)
+}
+
+// fire runs the hook for e and waits for it to finish, the hook is killed if ctx is canceled
+func (h *tunnelHook) fire(ctx context.Context, e Event) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, h.timeout)
+	defer cancel()
+
+	if h.url != "" {
+		req, err := http.NewRequest(http.MethodPost, h.url, bytes.NewReader(b))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return fmt.Errorf("%s returned %s", h.url, resp.Status)
+		}
+		return nil
+	}
+
+	cmd := exec.CommandContext(ctx, h.command[0], h.command[1:]...)
+	cmd.Env = append(os.Environ(), h.env(e)...)
+	cmd.Stdin = bytes.NewReader(b)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %s", err, strings.TrimSpace(string(out)))
+	}
+
+	return nil
+}
+
+// tunnelHooks runs the hooks configured in `hooks` as events happen. Each hook handles one event at a time, in order,
+// so a slow hook only delays itself. Events are dropped if a hook falls too far behind.
+type tunnelHooks struct {
+	sync.Mutex
+	l      *logrus.Logger
+	events *eventBus
+	hooks  []*tunnelHook
+	subs   []*EventSubscription
+	// cancel kills the hooks that are running when they are stopped
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func newTunnelHooksFromConfig(l *logrus.Logger, c *Config, events *eventBus) (*tunnelHooks, error) {
+	hooks, err := parseTunnelHooks(c)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tunnelHooks{l: l, events: events, hooks: hooks}, nil
+}
+
+// parseTunnelHooks reads every hook from `hooks`
+func parseTunnelHooks(c *Config) ([]*tunnelHook, error) {
+	raw := c.Get("hooks")
+	if raw == nil {
+		return nil, nil
+	}
+
+	rawHooks, ok := raw.([]interface{})
+	if !ok {
+		return nil, errors.New("hooks must be a list")
+	}
+
+	hooks := make([]*tunnelHook, 0, len(rawHooks))
+	for i, rh := range rawHooks {
+		m, ok := rh.(map[interface{}]interface{})
+		if !ok {
+			return nil, fmt.Errorf("hooks #%d must be a map", i)
+		}
+
+		h := &tunnelHook{index: i, timeout: DefaultHookTimeout}
+		on, err := hookStrings(m["on"])
+		if err != nil {
+			return nil, fmt.Errorf("hooks #%d on must be an event or a list of events", i)
+		}
+		for _, name := range on {
+			t, err := parseHookEvent(name)
+			if err != nil {
+				return nil, fmt.Errorf("hooks #%d %s", i, err)
+			}
+			h.on = append(h.on, t)
+		}
+
+		h.command, err = hookStrings(m["command"])
+		if err != nil {
+			return nil, fmt.Errorf("hooks #%d command must be a string or a list of strings", i)
+		}
+
+		if u, ok := m["url"]; ok {
+			h.url = fmt.Sprintf("%v", u)
+			pu, err := url.Parse(h.url)
+			if err != nil || (pu.Scheme != "http" && pu.Scheme != "https") || pu.Host == "" {
+				return nil, fmt.Errorf("hooks #%d url must be an http or https url: %s", i, h.url)
+			}
+		}
+
+		if len(h.command) == 0 && h.url == "" {
+			return nil, fmt.Errorf("hooks #%d needs a command or url", i)
+		}
+		if len(h.command) > 0 && h.url != "" {
+			return nil, fmt.Errorf("hooks #%d can not have both a command and a url", i)
+		}
+
+		if t, ok := m["timeout"]; ok {
+			h.timeout, err = time.ParseDuration(fmt.Sprintf("%v", t))
+			if err != nil || h.timeout <= 0 {
+				return nil, fmt.Errorf("hooks #%d timeout must be a positive duration: %v", i, t)
+			}
+		}
+
+		hooks = append(hooks, h)
+	}
+
+	return hooks, nil
+}
+
+// hookStrings accepts a single string or a list of them
+func hookStrings(v interface{}) ([]string, error) {
+	switch v := v.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []string{v}, nil
+	case []interface{}:
+		s := make([]string, len(v))
+		for i, e := range v {
+			s[i] = fmt.Sprintf("%v", e)
+		}
+		return s, nil
+	default:
+		return nil, fmt.Errorf("%v is not a string or list", v)
+	}
+}
+
+func parseHookEvent(name string) (EventType, error) {
+	for _, t := range hookEvents {
+		if string(t) == name {
+			return t, nil
+		}
+	}
+
+	return "", fmt.Errorf("has an unknown event `%s`. possible events: %s", name, hookEvents)
+}
+
+// start subscribes every hook to its events
+func (h *tunnelHooks) start() {
+	if h == nil {
+		return
+	}
+
+	h.Lock()
+	defer h.Unlock()
+	ctx, cancel := context.WithCancel(context.Background())
+	h.cancel = cancel
+	for _, hook := range h.hooks {
+		sub := h.events.subscribe(hook.on...)
+		h.subs = append(h.subs, sub)
+		h.wg.Add(1)
+		go h.run(ctx, hook, sub)
+	}
+
+	if len(h.hooks) > 0 {
+		h.l.WithField("hooks", len(h.hooks)).Info("Tunnel hooks started")
+	}
+}
+
+// stop unsubscribes every hook, kills any that are running and waits for them to exit. Events that were not handed to
+// a hook yet are dropped.
+func (h *tunnelHooks) stop() {
+	if h == nil {
+		return
+	}
+
+	h.Lock()
+	defer h.Unlock()
+	if h.cancel != nil {
+		h.cancel()
+		h.cancel = nil
+	}
+	for _, sub := range h.subs {
+		sub.Close()
+	}
+	h.subs = nil
+	h.wg.Wait()
+}
+
+// reload replaces the hooks with those in c, the old hooks are kept if c is not valid
+func (h *tunnelHooks) reload(c *Config) error {
+	hooks, err := parseTunnelHooks(c)
+	if err != nil {
+		return err
+	}
+
+	h.stop()
+	h.Lock()
+	h.hooks = hooks
+	h.Unlock()
+	h.start()
+	return nil
+}
+
+func (h *tunnelHooks) run(ctx context.Context, hook *tunnelHook, sub *EventSubscription) {
+	defer h.wg.Done()
+	for e := range sub.C {
+		// The subscription is closed after ctx is canceled, anything still buffered is dropped
+		if ctx.Err() != nil {
+			return
+		}
+
+		l := h.l.WithField("hook", hook.index).WithField("event", e.Type).WithField("vpnIp", e.VpnIP)
+		err := hook.fire(ctx, e)
+		if ctx.Err() != nil {
+			l.Debug("Tunnel hook was stopped")
+			return
+		}
+		if err != nil {
+			l.WithError(err).Warn("Tunnel hook failed")
+			continue
+		}
+		l.Debug("Tunnel hook ran")
+	}
+}
@@ -0,0 +1,208 @@
+package nebula
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTunnelHooks(t *testing.T) {
+	l := NewTestLogger()
+	parse := func(hooks interface{}) ([]*tunnelHook, error) {
+		c := NewConfig(l)
+		c.Settings["hooks"] = hooks
+		return parseTunnelHooks(c)
+	}
+
+	hooks, err := parse([]interface{}{
+		map[interface{}]interface{}{"on": "tunnel_up", "command": "/bin/true"},
+		map[interface{}]interface{}{"on": []interface{}{"tunnel_down", "roam"}, "url": "http://127.0.0.1:8080/hook", "timeout": "1s"},
+		map[interface{}]interface{}{"command": []interface{}{"logger", "-t", "nebula"}},
+	})
+	assert.Nil(t, err)
+	assert.Len(t, hooks, 3)
+	assert.Equal(t, []EventType{EventTunnelUp}, hooks[0].on)
+	assert.Equal(t, []string{"/bin/true"}, hooks[0].command)
+	assert.Equal(t, DefaultHookTimeout, hooks[0].timeout)
+	assert.Equal(t, []EventType{EventTunnelDown, EventRoam}, hooks[1].on)
+	assert.Equal(t, "http://127.0.0.1:8080/hook", hooks[1].url)
+	assert.Equal(t, time.Second, hooks[1].timeout)
+	assert.Nil(t, hooks[2].on, "no events means every event")
+	assert.Equal(t, []string{"logger", "-t", "nebula"}, hooks[2].command)
+
+	hooks, err = parse(nil)
+	assert.Nil(t, err)
+	assert.Empty(t, hooks)
+
+	_, err = parse("nope")
+	assert.EqualError(t, err, "hooks must be a list")
+	_, err = parse([]interface{}{"nope"})
+	assert.EqualError(t, err, "hooks #0 must be a map")
+	_, err = parse([]interface{}{map[interface{}]interface{}{"on": "tunnel_sideways", "command": "x"}})
+	assert.EqualError(t, err, "hooks #0 has an unknown event `tunnel_sideways`. possible events: [tunnel_up tunnel_down handshake_failed roam lighthouse_update]")
+	_, err = parse([]interface{}{map[interface{}]interface{}{"on": "roam"}})
+	assert.EqualError(t, err, "hooks #0 needs a command or url")
+	_, err = parse([]interface{}{map[interface{}]interface{}{"command": "x", "url": "http://127.0.0.1/"}})
+	assert.EqualError(t, err, "hooks #0 can not have both a command and a url")
+	_, err = parse([]interface{}{map[interface{}]interface{}{"url": "/tmp/sock"}})
+	assert.EqualError(t, err, "hooks #0 url must be an http or https url: /tmp/sock")
+	_, err = parse([]interface{}{map[interface{}]interface{}{"command": "x", "timeout": "soon"}})
+	assert.EqualError(t, err, "hooks #0 timeout must be a positive duration: soon")
+	_, err = parse([]interface{}{map[interface{}]interface{}{"command": map[interface{}]interface{}{}}})
+	assert.EqualError(t, err, "hooks #0 command must be a string or a list of strings")
+}
+
+func testHookEvent() Event {
+	return Event{
+		Type:      EventRoam,
+		Time:      time.Now(),
+		VpnIP:     net.IPv4(10, 1, 0, 2).To4(),
+		Name:      "host-2",
+		Groups:    []string{"ops", "web"},
+		Remote:    NewUDPAddrFromString("2.2.2.2:4242"),
+		OldRemote: NewUDPAddrFromString("1.1.1.1:4242"),
+	}
+}
+
+func TestTunnelHooks_command(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs a posix shell")
+	}
+
+	dir, err := ioutil.TempDir("", "hooks-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	out := filepath.Join(dir, "out")
+
+	l := NewTestLogger()
+	c := NewConfig(l)
+	c.Settings["hooks"] = []interface{}{map[interface{}]interface{}{
+		"on":      "roam",
+		"command": []interface{}{"/bin/sh", "-c", `env | grep ^NEBULA_ | sort > "$0"; cat >> "$0"`, out},
+	}}
+
+	events := newEventBus()
+	h, err := newTunnelHooksFromConfig(l, c, events)
+	assert.Nil(t, err)
+	h.start()
+
+	events.publish(Event{Type: EventTunnelUp, VpnIP: net.IPv4(10, 1, 0, 3)})
+	events.publish(testHookEvent())
+
+	// Stopping kills a running hook, wait for it to finish first
+	var b []byte
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		b, err = ioutil.ReadFile(out)
+		if err == nil && strings.HasSuffix(string(b), "}") {
+			break
+		}
+	}
+	h.stop()
+
+	assert.Nil(t, err)
+	assert.Contains(t, string(b), "NEBULA_CERT_NAME=host-2\n"+
+		"NEBULA_EVENT=roam\n"+
+		"NEBULA_GROUPS=ops,web\n"+
+		"NEBULA_OLD_REMOTE=1.1.1.1:4242\n"+
+		"NEBULA_REASON=\n"+
+		"NEBULA_REMOTE=2.2.2.2:4242\n"+
+		"NEBULA_VPN_IP=10.1.0.2\n")
+	assert.Contains(t, string(b), `"type":"roam"`)
+	assert.NotContains(t, string(b), "10.1.0.3", "the hook only runs on roam")
+}
+
+func TestTunnelHooks_stop(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs a posix shell")
+	}
+
+	dir, err := ioutil.TempDir("", "hooks-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	out := filepath.Join(dir, "out")
+
+	l := NewTestLogger()
+	c := NewConfig(l)
+	c.Settings["hooks"] = []interface{}{map[interface{}]interface{}{
+		"on":      "roam",
+		"command": []interface{}{"/bin/sh", "-c", `echo ran >> "$0"; exec sleep 10`, out},
+	}}
+
+	events := newEventBus()
+	h, err := newTunnelHooksFromConfig(l, c, events)
+	assert.Nil(t, err)
+	h.start()
+
+	for i := 0; i < 10; i++ {
+		events.publish(testHookEvent())
+	}
+
+	// Wait for the first hook to be running
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if _, err := os.Stat(out); err == nil {
+			break
+		}
+	}
+
+	// The running hook is killed and the other events are dropped instead of running one after another
+	start := time.Now()
+	h.stop()
+	assert.True(t, time.Since(start) < 5*time.Second, "stop took %s", time.Since(start))
+
+	b, err := ioutil.ReadFile(out)
+	assert.Nil(t, err)
+	assert.Equal(t, "ran\n", string(b))
+}
+
+func TestTunnelHooks_url(t *testing.T) {
+	got := make(chan map[string]interface{}, 2)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPost, r.Method)
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		var e map[string]interface{}
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&e))
+		got <- e
+	}))
+	defer ts.Close()
+
+	l := NewTestLogger()
+	c := NewConfig(l)
+	c.Settings["hooks"] = []interface{}{map[interface{}]interface{}{"url": ts.URL}}
+
+	events := newEventBus()
+	h, err := newTunnelHooksFromConfig(l, c, events)
+	assert.Nil(t, err)
+	h.start()
+
+	events.publish(testHookEvent())
+	e := <-got
+	h.stop()
+
+	assert.Equal(t, "roam", e["type"])
+	assert.Equal(t, "10.1.0.2", e["vpnIp"])
+	assert.Equal(t, "host-2", e["name"])
+	assert.Equal(t, []interface{}{"ops", "web"}, e["groups"])
+	assert.Equal(t, map[string]interface{}{"ip": "2.2.2.2", "port": float64(4242)}, e["remote"])
+
+	// A bad reload keeps the hooks we have
+	c.Settings["hooks"] = "nope"
+	assert.EqualError(t, h.reload(c), "hooks must be a list")
+	assert.Len(t, h.hooks, 1)
+
+	c.Settings["hooks"] = []interface{}{}
+	assert.Nil(t, h.reload(c))
+	assert.Empty(t, h.hooks)
+	events.publish(testHookEvent())
+	h.stop()
+	assert.Len(t, got, 0)
+}
@@ -37,6 +37,9 @@ type HostMap struct {
 }
 
 type HostInfo struct {
+	// stats is first to keep its 64 bit counters aligned on 32 bit platforms
+	stats tunnelStats
+
 	sync.RWMutex
 
 	remote            *udpAddr
@@ -66,6 +69,12 @@ type HostInfo struct {
 
 	lastRoam       time.Time
 	lastRoamRemote *udpAddr
+
+	// pmtu is the state of path mtu discovery for the current remote
+	pmtu pmtuState
+
+	// multipath is the state of every path to this host when multipath is enabled
+	multipath multipathState
 }
 
 type cachedPacket struct {
@@ -96,16 +105,16 @@ func NewHostMap(l *logrus.Logger, name string, vpnCIDR *net.IPNet, preferredRang
 }
 
 // UpdateStats takes a name and reports host and index counts to the stats collection system
-func (hm *HostMap) EmitStats(name string) {
+func (hm *HostMap) EmitStats(r metrics.Registry, name string) {
 	hm.RLock()
 	hostLen := len(hm.Hosts)
 	indexLen := len(hm.Indexes)
 	remoteIndexLen := len(hm.RemoteIndexes)
 	hm.RUnlock()
 
-	metrics.GetOrRegisterGauge("hostmap."+name+".hosts", nil).Update(int64(hostLen))
-	metrics.GetOrRegisterGauge("hostmap."+name+".indexes", nil).Update(int64(indexLen))
-	metrics.GetOrRegisterGauge("hostmap."+name+".remoteIndexes", nil).Update(int64(remoteIndexLen))
+	metrics.GetOrRegisterGauge("hostmap."+name+".hosts", r).Update(int64(hostLen))
+	metrics.GetOrRegisterGauge("hostmap."+name+".indexes", r).Update(int64(indexLen))
+	metrics.GetOrRegisterGauge("hostmap."+name+".remoteIndexes", r).Update(int64(remoteIndexLen))
 }
 
 func (hm *HostMap) GetIndexByVpnIP(vpnIP uint32) (uint32, error) {
@@ -375,6 +384,7 @@ func (hm *HostMap) addHostInfo(hostinfo *HostInfo, f *Interface) {
 	hm.Hosts[hostinfo.hostId] = hostinfo
 	hm.Indexes[hostinfo.localIndexId] = hostinfo
 	hm.RemoteIndexes[hostinfo.remoteIndexId] = hostinfo
+	f.events.publish(newHostEvent(EventTunnelUp, hostinfo))
 
 	if hm.l.Level >= logrus.DebugLevel {
 		hm.l.WithField("hostMap", m{"mapName": hm.name, "vpnIp": IntIp(hostinfo.hostId), "mapTotalSize": len(hm.Hosts),
@@ -415,10 +425,10 @@ func (hm *HostMap) PunchList() []*udpAddr {
 	return list
 }
 
-func (hm *HostMap) Punchy(conn *udpConn) {
+func (hm *HostMap) Punchy(conn *udpConn, r metrics.Registry) {
 	var metricsTxPunchy metrics.Counter
 	if hm.metricsEnabled {
-		metricsTxPunchy = metrics.GetOrRegisterCounter("messages.tx.punchy", nil)
+		metricsTxPunchy = metrics.GetOrRegisterCounter("messages.tx.punchy", r)
 	} else {
 		metricsTxPunchy = metrics.NilCounter{}
 	}
@@ -458,6 +468,9 @@ func (i *HostInfo) MarshalJSON() ([]byte, error) {
 		"receive_errors":     i.recvError,
 		"last_roam":          i.lastRoam,
 		"last_roam_remote":   i.lastRoamRemote,
+		"path_mtu":           i.PathMTU(),
+		"multipath":          &i.multipath,
+		"stats":              &i.stats,
 	})
 }
 
@@ -7,7 +7,9 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
-func (f *Interface) consumeInsidePacket(packet []byte, fwPacket *FirewallPacket, nb, out []byte, q int, localCache ConntrackCache) {
+// consumeInsidePacket processes a single packet read from the tun. If batch is not nil the encrypted packet is queued
+// on it instead of being written immediately and out must be the buffer returned by batch.next().
+func (f *Interface) consumeInsidePacket(packet []byte, fwPacket *FirewallPacket, nb, out []byte, q int, localCache ConntrackCache, batch *sendBatch) {
 	err := newPacket(packet, false, fwPacket)
 	if err != nil {
 		f.l.WithField("packet", packet).Debugf("Error while validating outbound packet: %s", err)
@@ -54,7 +56,12 @@ func (f *Interface) consumeInsidePacket(packet []byte, fwPacket *FirewallPacket,
 
 	dropReason := f.firewall.Drop(packet, *fwPacket, false, hostinfo, f.caPool, localCache)
 	if dropReason == nil {
-		mc := f.sendNoMetrics(message, 0, ci, hostinfo, hostinfo.remote, packet, nb, out, q)
+		if pathMTU := hostinfo.PathMTU(); pathMTU > 0 && len(packet) > pathMTU {
+			f.sendTooBig(hostinfo, packet, pathMTU, nb, q)
+			return
+		}
+
+		mc := f.sendNoMetrics(message, 0, ci, hostinfo, hostinfo.remote, packet, nb, out, q, batch)
 		if f.lightHouse != nil && mc%5000 == 0 {
 			f.lightHouse.Query(fwPacket.RemoteIP, f)
 		}
@@ -104,7 +111,7 @@ func (f *Interface) getOrHandshake(vpnIp uint32) *HostInfo {
 
 	if ci == nil {
 		// if we don't have a connection state, then send a handshake initiation
-		ci = f.newConnectionState(f.l, true, noise.HandshakeIX, []byte{}, 0)
+		ci = f.newConnectionState(f.l, true, noise.HandshakeIX, f.ciphers[0], f.psk.primary, 0)
 		// FIXME: Maybe make XX selectable, but probably not since psk makes it nearly pointless for us.
 		//ci = f.newConnectionState(true, noise.HandshakeXX, []byte{}, 0)
 		hostinfo.ConnectionState = ci
@@ -150,7 +157,7 @@ func (f *Interface) sendMessageNow(t NebulaMessageType, st NebulaMessageSubType,
 		return
 	}
 
-	messageCounter := f.sendNoMetrics(message, st, hostInfo.ConnectionState, hostInfo, hostInfo.remote, p, nb, out, 0)
+	messageCounter := f.sendNoMetrics(message, st, hostInfo.ConnectionState, hostInfo, hostInfo.remote, p, nb, out, 0, nil)
 	if f.lightHouse != nil && messageCounter%5000 == 0 {
 		f.lightHouse.Query(fp.RemoteIP, f)
 	}
@@ -224,10 +231,10 @@ func (f *Interface) sendMessageToAll(t NebulaMessageType, st NebulaMessageSubTyp
 
 func (f *Interface) send(t NebulaMessageType, st NebulaMessageSubType, ci *ConnectionState, hostinfo *HostInfo, remote *udpAddr, p, nb, out []byte) {
 	f.messageMetrics.Tx(t, st, 1)
-	f.sendNoMetrics(t, st, ci, hostinfo, remote, p, nb, out, 0)
+	f.sendNoMetrics(t, st, ci, hostinfo, remote, p, nb, out, 0, nil)
 }
 
-func (f *Interface) sendNoMetrics(t NebulaMessageType, st NebulaMessageSubType, ci *ConnectionState, hostinfo *HostInfo, remote *udpAddr, p, nb, out []byte, q int) uint64 {
+func (f *Interface) sendNoMetrics(t NebulaMessageType, st NebulaMessageSubType, ci *ConnectionState, hostinfo *HostInfo, remote *udpAddr, p, nb, out []byte, q int, batch *sendBatch) uint64 {
 	if ci.eKey == nil {
 		//TODO: log warning
 		return 0
@@ -265,12 +272,46 @@ func (f *Interface) sendNoMetrics(t NebulaMessageType, st NebulaMessageSubType,
 		return c
 	}
 
-	err = f.writers[q].WriteTo(out, remote)
+	// Tunnel traffic may go over any healthy path, everything else goes where the caller asked
+	var mirror []*udpAddr
+	if t == message && f.multipath != nil {
+		remote, mirror = f.multipath.route(hostinfo, remote)
+	}
+
+	if mirror != nil {
+		for range mirror {
+			hostinfo.stats.tx(len(out))
+		}
+	} else {
+		hostinfo.stats.tx(len(out))
+	}
+
+	if batch != nil {
+		if mirror != nil {
+			batch.add(out, mirror...)
+		} else {
+			batch.add(out, remote)
+		}
+		return c
+	}
+
+	if mirror != nil {
+		for _, addr := range mirror {
+			f.writeTo(hostinfo, out, addr, q)
+		}
+		return c
+	}
+
+	f.writeTo(hostinfo, out, remote, q)
+	return c
+}
+
+func (f *Interface) writeTo(hostinfo *HostInfo, out []byte, remote *udpAddr, q int) {
+	err := f.writers[q].WriteTo(out, remote)
 	if err != nil {
 		hostinfo.logger(f.l).WithError(err).
 			WithField("udpAddr", remote).Error("Failed to write outgoing packet")
 	}
-	return c
 }
 
 func isMulticast(ip uint32) bool {
@@ -2,10 +2,12 @@ package nebula
 
 import (
 	"errors"
+	"fmt"
 	"io"
 	"net"
 	"os"
 	"runtime"
+	"sync/atomic"
 	"time"
 
 	"github.com/rcrowley/go-metrics"
@@ -24,12 +26,25 @@ type Inside interface {
 	NewMultiQueueReader() (io.ReadWriteCloser, error)
 }
 
+// batchReader is implemented by inside readers that can return several packets from a single wakeup
+type batchReader interface {
+	// ReadBatch blocks until at least one packet is available and fills bufs with as many as are ready, the size of
+	// each packet is placed in the matching entry of sizes
+	ReadBatch(bufs [][]byte, sizes []int) (int, error)
+}
+
+// batchWriter is implemented by inside writers that can merge packets written together before handing them to the
+// kernel
+type batchWriter interface {
+	WriteBatch(pkts [][]byte) error
+}
+
 type InterfaceConfig struct {
 	HostMap                 *HostMap
 	Outside                 *udpConn
 	Inside                  Inside
 	certState               *CertState
-	Cipher                  string
+	Ciphers                 []string
 	Firewall                *Firewall
 	ServeDns                bool
 	HandshakeManager        *HandshakeManager
@@ -39,10 +54,21 @@ type InterfaceConfig struct {
 	DropLocalBroadcast      bool
 	DropMulticast           bool
 	UDPBatchSize            int
+	UDPGRO                  bool
+	TunBatchSize            int
+	TunOffload              bool
+	pmtud                   *pathMTUDiscovery
+	multipath               *multipath
+	HandshakeHybrid         hybridMode
+	psk                     *Psk
+	handshakeLimiter        *handshakeLimiter
 	routines                int
 	MessageMetrics          *MessageMetrics
 	version                 string
 	caPool                  *cert.NebulaCAPool
+	events                  *eventBus
+	hooks                   *tunnelHooks
+	metrics                 metrics.Registry
 
 	ConntrackCacheTimeout time.Duration
 	l                     *logrus.Logger
@@ -53,7 +79,7 @@ type Interface struct {
 	outside            *udpConn
 	inside             Inside
 	certState          *CertState
-	cipher             string
+	ciphers            []string
 	firewall           *Firewall
 	connectionManager  *connectionManager
 	handshakeManager   *HandshakeManager
@@ -65,9 +91,20 @@ type Interface struct {
 	dropLocalBroadcast bool
 	dropMulticast      bool
 	udpBatchSize       int
+	udpGRO             bool
+	tunBatchSize       int
+	tunOffload         bool
+	pmtud              *pathMTUDiscovery
+	multipath          *multipath
+	handshakeHybrid    hybridMode
+	psk                *Psk
+	handshakeLimiter   *handshakeLimiter
 	routines           int
 	caPool             *cert.NebulaCAPool
 
+	// activated is set once the tun device is up, it is read by ready
+	activated uint32
+
 	// rebindCount is used to decide if an active tunnel should trigger a punch notification through a lighthouse
 	rebindCount int8
 	version     string
@@ -77,9 +114,22 @@ type Interface struct {
 	writers []*udpConn
 	readers []io.ReadWriteCloser
 
+	// tunBatches collects packets destined for the tun from each outside routine when tun offloads are enabled
+	tunBatches []*tunBatch
+
+	// pings are the outstanding probes of Control.Ping and the sshd ping command
+	pings pingTracker
+
+	// events are sent to subscribers of Control.SubscribeEvents
+	events *eventBus
+	// hooks run commands or post to urls for events, as configured in `hooks`
+	hooks *tunnelHooks
+
 	metricHandshakes metrics.Histogram
 	messageMetrics   *MessageMetrics
-	l                *logrus.Logger
+	// metrics is where this network registers its metrics, named networks use a prefixed child of the default registry
+	metrics metrics.Registry
+	l       *logrus.Logger
 }
 
 func NewInterface(c *InterfaceConfig) (*Interface, error) {
@@ -101,7 +151,7 @@ func NewInterface(c *InterfaceConfig) (*Interface, error) {
 		outside:            c.Outside,
 		inside:             c.Inside,
 		certState:          c.certState,
-		cipher:             c.Cipher,
+		ciphers:            c.Ciphers,
 		firewall:           c.Firewall,
 		serveDns:           c.ServeDns,
 		handshakeManager:   c.HandshakeManager,
@@ -111,17 +161,28 @@ func NewInterface(c *InterfaceConfig) (*Interface, error) {
 		dropLocalBroadcast: c.DropLocalBroadcast,
 		dropMulticast:      c.DropMulticast,
 		udpBatchSize:       c.UDPBatchSize,
+		udpGRO:             c.UDPGRO,
+		tunBatchSize:       c.TunBatchSize,
+		tunOffload:         c.TunOffload,
+		pmtud:              c.pmtud,
+		multipath:          c.multipath,
+		handshakeHybrid:    c.HandshakeHybrid,
+		psk:                c.psk,
+		handshakeLimiter:   c.handshakeLimiter,
 		routines:           c.routines,
 		version:            c.version,
 		writers:            make([]*udpConn, c.routines),
 		readers:            make([]io.ReadWriteCloser, c.routines),
 		caPool:             c.caPool,
+		events:             c.events,
+		hooks:              c.hooks,
 		myVpnIp:            ip2int(c.certState.certificate.Details.Ips[0].IP),
 
 		conntrackCacheTimeout: c.ConntrackCacheTimeout,
 
-		metricHandshakes: metrics.GetOrRegisterHistogram("handshakes", nil, metrics.NewExpDecaySample(1028, 0.015)),
+		metricHandshakes: metrics.GetOrRegisterHistogram("handshakes", c.metrics, metrics.NewExpDecaySample(1028, 0.015)),
 		messageMetrics:   c.MessageMetrics,
+		metrics:          c.metrics,
 		l:                c.l,
 	}
 
@@ -142,7 +203,8 @@ func (f *Interface) run() {
 		WithField("build", f.version).WithField("udpAddr", addr).
 		Info("Nebula interface is active")
 
-	metrics.GetOrRegisterGauge("routines", nil).Update(int64(f.routines))
+	metrics.GetOrRegisterGauge("routines", f.metrics).Update(int64(f.routines))
+	f.hooks.start()
 
 	// Prepare n tun queues
 	var reader io.ReadWriteCloser = f.inside
@@ -159,6 +221,16 @@ func (f *Interface) run() {
 	if err := f.inside.Activate(); err != nil {
 		f.l.Fatal(err)
 	}
+	atomic.StoreUint32(&f.activated, 1)
+
+	if f.tunOffload {
+		f.tunBatches = make([]*tunBatch, f.routines)
+		for i, r := range f.readers {
+			if w, ok := r.(batchWriter); ok {
+				f.tunBatches[i] = newTunBatch(f.udpBatchSize, w)
+			}
+		}
+	}
 
 	// Launch n queues to read packets from udp
 	for i := 0; i < f.routines; i++ {
@@ -171,6 +243,29 @@ func (f *Interface) run() {
 	}
 }
 
+// ready returns nil once the tun is up, the udp listener is bound and a tunnel to a lighthouse is established
+func (f *Interface) ready() error {
+	if atomic.LoadUint32(&f.activated) == 0 {
+		return errors.New("tun device is not up")
+	}
+
+	if _, err := f.outside.LocalAddr(); err != nil {
+		return fmt.Errorf("udp listener is not bound: %s", err)
+	}
+
+	if f.lightHouse.amLighthouse || len(f.lightHouse.lighthouses) == 0 {
+		return nil
+	}
+
+	for vpnIp := range f.lightHouse.lighthouses {
+		if _, err := f.hostMap.QueryVpnIP(vpnIp); err == nil {
+			return nil
+		}
+	}
+
+	return errors.New("no lighthouse tunnel is established")
+}
+
 func (f *Interface) listenOut(i int) {
 	runtime.LockOSThread()
 
@@ -187,6 +282,11 @@ func (f *Interface) listenOut(i int) {
 func (f *Interface) listenIn(reader io.ReadWriteCloser, i int) {
 	runtime.LockOSThread()
 
+	if br, ok := reader.(batchReader); ok && f.tunBatchSize > 1 {
+		f.listenInBatch(br, i)
+		return
+	}
+
 	packet := make([]byte, mtu)
 	out := make([]byte, mtu)
 	fwPacket := &FirewallPacket{}
@@ -202,7 +302,49 @@ func (f *Interface) listenIn(reader io.ReadWriteCloser, i int) {
 			os.Exit(2)
 		}
 
-		f.consumeInsidePacket(packet[:n], fwPacket, nb, out, i, conntrackCache.Get(f.l))
+		f.consumeInsidePacket(packet[:n], fwPacket, nb, out, i, conntrackCache.Get(f.l), nil)
+	}
+}
+
+// listenInBatch reads as many packets as are ready from the tun in one pass and sends the results together
+func (f *Interface) listenInBatch(reader batchReader, i int) {
+	packets := make([][]byte, f.tunBatchSize)
+	sizes := make([]int, f.tunBatchSize)
+	for j := range packets {
+		packets[j] = make([]byte, mtu)
+	}
+
+	batch := newSendBatch(f.tunBatchSize)
+	fwPacket := &FirewallPacket{}
+	nb := make([]byte, 12, 12)
+
+	conntrackCache := NewConntrackCacheTicker(f.conntrackCacheTimeout)
+
+	for {
+		n, err := reader.ReadBatch(packets, sizes)
+		if err != nil {
+			f.l.WithError(err).Error("Error while reading outbound packet")
+			// This only seems to happen when something fatal happens to the fd, so exit.
+			os.Exit(2)
+		}
+
+		for j := 0; j < n; j++ {
+			f.consumeInsidePacket(packets[j][:sizes[j]], fwPacket, nb, batch.next(), i, conntrackCache.Get(f.l), batch)
+		}
+
+		// Packets that could not be sent are logged by WriteBatch along with where they were going
+		_ = batch.flush(f.writers[i])
+	}
+}
+
+// flushTunBatch writes any packets collected for the tun by outside routine q
+func (f *Interface) flushTunBatch(q int) {
+	if f.tunBatches == nil || f.tunBatches[q] == nil {
+		return
+	}
+
+	if err := f.tunBatches[q].flush(); err != nil {
+		f.l.WithError(err).Error("Failed to write to tun")
 	}
 }
 
@@ -210,6 +352,9 @@ func (f *Interface) RegisterConfigChangeCallbacks(c *Config) {
 	c.RegisterReloadCallback(f.reloadCA)
 	c.RegisterReloadCallback(f.reloadCertKey)
 	c.RegisterReloadCallback(f.reloadFirewall)
+	c.RegisterReloadCallback(f.reloadPsk)
+	c.RegisterReloadCallback(f.reloadHandshakeLimiter)
+	c.RegisterReloadCallback(f.reloadHooks)
 	for _, udpConn := range f.writers {
 		c.RegisterReloadCallback(udpConn.reloadConfig)
 	}
@@ -255,7 +400,7 @@ func (f *Interface) reloadFirewall(c *Config) {
 		return
 	}
 
-	fw, err := NewFirewallFromConfig(f.l, f.certState.certificate, c)
+	fw, err := NewFirewallFromConfig(f.l, f.certState.certificate, c, f.metrics)
 	if err != nil {
 		f.l.WithError(err).Error("Error while creating firewall during reload")
 		return
@@ -287,14 +432,46 @@ func (f *Interface) reloadFirewall(c *Config) {
 		Info("New firewall has been installed")
 }
 
+func (f *Interface) reloadPsk(c *Config) {
+	if !c.HasChanged("handshakes.psk") {
+		return
+	}
+
+	f.psk = NewPskFromConfig(c, f.metrics)
+	f.l.WithField("keys", len(f.psk.keys)).WithField("required", f.psk.Required()).
+		Info("Handshake pre-shared keys reloaded")
+}
+
+func (f *Interface) reloadHandshakeLimiter(c *Config) {
+	if !c.HasChanged("handshakes.rate_limit") {
+		return
+	}
+
+	f.handshakeLimiter.reload(c)
+	f.l.Info("Handshake rate limits reloaded")
+}
+
+func (f *Interface) reloadHooks(c *Config) {
+	if !c.HasChanged("hooks") {
+		return
+	}
+
+	err := f.hooks.reload(c)
+	if err != nil {
+		f.l.WithError(err).Error("Failed to reload hooks, keeping the old ones")
+		return
+	}
+	f.l.Info("Tunnel hooks reloaded")
+}
+
 func (f *Interface) emitStats(i time.Duration) {
 	ticker := time.NewTicker(i)
 
-	udpStats := NewUDPStatsEmitter(f.writers)
+	udpStats := NewUDPStatsEmitter(f.writers, f.metrics)
 
 	for range ticker.C {
-		f.firewall.EmitStats()
-		f.handshakeManager.EmitStats()
+		f.firewall.EmitStats(f.metrics)
+		f.handshakeManager.EmitStats(f.metrics)
 
 		udpStats()
 	}
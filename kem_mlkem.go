@@ -0,0 +1,46 @@
+// +build go1.24
+
+package nebula
+
+import "crypto/mlkem"
+
+const hybridKEMName = "ML-KEM-768"
+
+// hybridKEMSupported is false when nebula was built with a go release that does not have crypto/mlkem
+const hybridKEMSupported = true
+
+// hybridKEM is the initiator's half of the post quantum key exchange in a hybrid handshake
+type hybridKEM struct {
+	dk *mlkem.DecapsulationKey768
+}
+
+func newHybridKEM() (*hybridKEM, error) {
+	dk, err := mlkem.GenerateKey768()
+	if err != nil {
+		return nil, err
+	}
+
+	return &hybridKEM{dk: dk}, nil
+}
+
+// PublicKey returns the encapsulation key to send to the responder
+func (k *hybridKEM) PublicKey() []byte {
+	return k.dk.EncapsulationKey().Bytes()
+}
+
+// Decapsulate returns the shared secret for the ciphertext the responder sent back
+func (k *hybridKEM) Decapsulate(ciphertext []byte) ([]byte, error) {
+	return k.dk.Decapsulate(ciphertext)
+}
+
+// hybridEncapsulate is the responder's half of the post quantum key exchange, it returns the shared secret and the
+// ciphertext to send back to the initiator
+func hybridEncapsulate(publicKey []byte) ([]byte, []byte, error) {
+	ek, err := mlkem.NewEncapsulationKey768(publicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ss, ct := ek.Encapsulate()
+	return ss, ct, nil
+}
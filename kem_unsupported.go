@@ -0,0 +1,26 @@
+// +build !go1.24
+
+package nebula
+
+const hybridKEMName = "ML-KEM-768"
+
+// hybridKEMSupported is false when nebula was built with a go release that does not have crypto/mlkem
+const hybridKEMSupported = false
+
+type hybridKEM struct{}
+
+func newHybridKEM() (*hybridKEM, error) {
+	return nil, errHybridUnsupported
+}
+
+func (k *hybridKEM) PublicKey() []byte {
+	return nil
+}
+
+func (k *hybridKEM) Decapsulate([]byte) ([]byte, error) {
+	return nil, errHybridUnsupported
+}
+
+func hybridEncapsulate([]byte) ([]byte, []byte, error) {
+	return nil, nil, errHybridUnsupported
+}
@@ -68,6 +68,7 @@ type LightHouse struct {
 
 	metrics           *MessageMetrics
 	metricHolepunchTx metrics.Counter
+	events            *eventBus
 	l                 *logrus.Logger
 }
 
@@ -75,7 +76,7 @@ type EncWriter interface {
 	SendMessageToVpnIp(t NebulaMessageType, st NebulaMessageSubType, vpnIp uint32, p, nb, out []byte)
 }
 
-func NewLightHouse(l *logrus.Logger, amLighthouse bool, myVpnIpNet *net.IPNet, ips []uint32, interval int, nebulaPort uint32, pc *udpConn, punchBack bool, punchDelay time.Duration, metricsEnabled bool) *LightHouse {
+func NewLightHouse(l *logrus.Logger, amLighthouse bool, myVpnIpNet *net.IPNet, ips []uint32, interval int, nebulaPort uint32, pc *udpConn, punchBack bool, punchDelay time.Duration, metricsEnabled bool, r metrics.Registry) *LightHouse {
 	ones, _ := myVpnIpNet.Mask.Size()
 	h := LightHouse{
 		amLighthouse: amLighthouse,
@@ -93,9 +94,9 @@ func NewLightHouse(l *logrus.Logger, amLighthouse bool, myVpnIpNet *net.IPNet, i
 	}
 
 	if metricsEnabled {
-		h.metrics = newLighthouseMetrics()
+		h.metrics = newLighthouseMetrics(r)
 
-		h.metricHolepunchTx = metrics.GetOrRegisterCounter("messages.tx.holepunch", nil)
+		h.metricHolepunchTx = metrics.GetOrRegisterCounter("messages.tx.holepunch", r)
 	} else {
 		h.metricHolepunchTx = metrics.NilCounter{}
 	}
@@ -613,6 +614,8 @@ func (lhh *LightHouseHandler) handleHostQueryReply(n *NebulaMeta, vpnIp uint32)
 		lhh.lh.addRemoteV6(n.Details.VpnIp, to, false, false)
 	}
 
+	lhh.lh.publishUpdate(n.Details.VpnIp, lhh.lh.QueryCache(n.Details.VpnIp))
+
 	// Non-blocking attempt to trigger, skip if it would block
 	select {
 	case lhh.lh.handshakeTrigger <- n.Details.VpnIp:
@@ -666,6 +669,17 @@ func (lhh *LightHouseHandler) handleHostUpdateNotification(n *NebulaMeta, vpnIp
 	if len(am.v6) > MaxRemotes {
 		am.v6 = am.v6[:MaxRemotes]
 	}
+
+	lhh.lh.publishUpdate(vpnIp, TransformLHReplyToUdpAddrs(am))
+}
+
+// publishUpdate tells event subscribers every remote we now know for vpnIp
+func (lh *LightHouse) publishUpdate(vpnIp uint32, remotes []*udpAddr) {
+	if lh.events == nil {
+		return
+	}
+
+	lh.events.publish(Event{Type: EventLighthouseUpdate, Time: time.Now(), VpnIP: int2ip(vpnIp), Remotes: remotes})
 }
 
 func (lhh *LightHouseHandler) handleHostPunchNotification(n *NebulaMeta, vpnIp uint32, w EncWriter) {
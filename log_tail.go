@@ -0,0 +1,143 @@
+package nebula
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+)
+
+// logTailBufferSize is how many entries a tail can fall behind before entries are dropped
+const logTailBufferSize = 1024
+
+// LogTailOptions picks which log entries a LogTail receives and how they are formatted
+type LogTailOptions struct {
+	// Level is the least severe level to send, empty sends everything the logger logs. Entries below the level of the
+	// logger itself are never logged and can not be tailed.
+	Level string
+	// Format is text or json, empty is text
+	Format string
+	// Fields only sends entries that have every field with the value, ie vpnIp: 10.1.0.2
+	Fields map[string]string
+}
+
+// LogTail receives formatted log entries until it is closed
+type LogTail struct {
+	// dropped is first to keep it 64 bit aligned for atomic access on 32 bit platforms
+	dropped uint64
+
+	// C receives one formatted entry at a time, it is closed by Close
+	C <-chan []byte
+
+	c         chan []byte
+	level     logrus.Level
+	formatter logrus.Formatter
+	fields    map[string]string
+	hook      *logTailHook
+}
+
+// Close stops the tail and closes C
+func (t *LogTail) Close() {
+	t.hook.unsubscribe(t)
+}
+
+// Dropped returns how many entries were not delivered because C was full
+func (t *LogTail) Dropped() uint64 {
+	return atomic.LoadUint64(&t.dropped)
+}
+
+func (t *LogTail) match(e *logrus.Entry) bool {
+	if e.Level > t.level {
+		return false
+	}
+
+	for k, v := range t.fields {
+		f, ok := e.Data[k]
+		if !ok || fmt.Sprint(f) != v {
+			return false
+		}
+	}
+
+	return true
+}
+
+// logTailHook is a logrus hook that copies entries to every LogTail
+type logTailHook struct {
+	sync.RWMutex
+	tails map[*LogTail]struct{}
+}
+
+func newLogTailHook() *logTailHook {
+	return &logTailHook{tails: make(map[*LogTail]struct{})}
+}
+
+func (h *logTailHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+// Fire is called with the logger locked, it must not block or log
+func (h *logTailHook) Fire(e *logrus.Entry) error {
+	h.RLock()
+	defer h.RUnlock()
+	for t := range h.tails {
+		if !t.match(e) {
+			continue
+		}
+
+		b, err := t.formatter.Format(e)
+		if err != nil {
+			continue
+		}
+
+		select {
+		case t.c <- b:
+		default:
+			atomic.AddUint64(&t.dropped, 1)
+		}
+	}
+
+	return nil
+}
+
+func (h *logTailHook) subscribe(opts LogTailOptions) (*LogTail, error) {
+	level := logrus.TraceLevel
+	if opts.Level != "" {
+		var err error
+		level, err = logrus.ParseLevel(strings.ToLower(opts.Level))
+		if err != nil {
+			return nil, fmt.Errorf("%s; possible levels: %s", err, logrus.AllLevels)
+		}
+	}
+
+	var formatter logrus.Formatter
+	switch strings.ToLower(opts.Format) {
+	case "", "text":
+		formatter = &logrus.TextFormatter{FullTimestamp: true, DisableColors: true}
+	case "json":
+		formatter = &logrus.JSONFormatter{}
+	default:
+		return nil, fmt.Errorf("unknown log format `%s`. possible formats: %s", opts.Format, []string{"text", "json"})
+	}
+
+	c := make(chan []byte, logTailBufferSize)
+	t := &LogTail{C: c, c: c, level: level, formatter: formatter, fields: make(map[string]string), hook: h}
+	for k, v := range opts.Fields {
+		t.fields[k] = v
+	}
+
+	h.Lock()
+	h.tails[t] = struct{}{}
+	h.Unlock()
+	return t, nil
+}
+
+func (h *logTailHook) unsubscribe(t *LogTail) {
+	h.Lock()
+	defer h.Unlock()
+	if _, ok := h.tails[t]; ok {
+		delete(h.tails, t)
+		close(t.c)
+	}
+}
@@ -0,0 +1,100 @@
+package nebula
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/sshd"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogTailHook(t *testing.T) {
+	l := logrus.New()
+	l.Out = ioutil.Discard
+	l.SetLevel(logrus.DebugLevel)
+	h := newLogTailHook()
+	l.AddHook(h)
+
+	all, err := h.subscribe(LogTailOptions{})
+	assert.Nil(t, err)
+	filtered, err := h.subscribe(LogTailOptions{Level: "info", Format: "json", Fields: map[string]string{"vpnIp": "10.1.0.2"}})
+	assert.Nil(t, err)
+
+	l.WithField("vpnIp", IntIp(ip2int([]byte{10, 1, 0, 2}))).Debug("too quiet")
+	l.WithField("vpnIp", IntIp(ip2int([]byte{10, 1, 0, 3}))).Info("wrong host")
+	l.WithField("vpnIp", IntIp(ip2int([]byte{10, 1, 0, 2}))).Warn("just right")
+
+	assert.Len(t, all.C, 3)
+	assert.Contains(t, string(<-all.C), `msg="too quiet" vpnIp=10.1.0.2`)
+
+	assert.Len(t, filtered.C, 1)
+	var e map[string]interface{}
+	assert.Nil(t, json.Unmarshal(<-filtered.C, &e))
+	assert.Equal(t, "just right", e["msg"])
+	assert.Equal(t, "warning", e["level"])
+	assert.Equal(t, "10.1.0.2", e["vpnIp"])
+
+	// Closed tails stop getting entries
+	filtered.Close()
+	filtered.Close()
+	_, ok := <-filtered.C
+	assert.False(t, ok)
+	l.WithField("vpnIp", IntIp(ip2int([]byte{10, 1, 0, 2}))).Warn("after close")
+	assert.Len(t, h.tails, 1)
+
+	// Slow readers miss entries instead of blocking the logger, 3 entries are still waiting to be read
+	for i := 0; i < logTailBufferSize+5; i++ {
+		l.Info("flood")
+	}
+	assert.Equal(t, uint64(8), all.Dropped())
+
+	_, err = h.subscribe(LogTailOptions{Level: "loud"})
+	assert.EqualError(t, err, "not a valid logrus Level: \"loud\"; possible levels: [panic fatal error warning info debug trace]")
+	_, err = h.subscribe(LogTailOptions{Format: "xml"})
+	assert.EqualError(t, err, "unknown log format `xml`. possible formats: [text json]")
+}
+
+func TestSSHLogTail(t *testing.T) {
+	l := logrus.New()
+	l.Out = ioutil.Discard
+	h := newLogTailHook()
+	l.AddHook(h)
+
+	flags := &sshLogTailFlags{Fields: sshFieldFilter{"subsystem": "test"}, Json: true}
+	w := &testStringWriter{done: make(chan struct{})}
+	errs := make(chan error)
+	go func() {
+		errs <- sshLogTail(h, flags, nil, w)
+	}()
+
+	// Wait for the command to subscribe before logging
+	for {
+		h.RLock()
+		n := len(h.tails)
+		h.RUnlock()
+		if n > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	l.WithField("subsystem", "test").Info("hello")
+	l.WithField("subsystem", "other").Info("nope")
+	l.WithField("subsystem", "test").Info("goodbye")
+	close(w.done)
+	assert.Nil(t, <-errs)
+	assert.Len(t, h.tails, 0)
+
+	assert.Contains(t, w.String(), `"msg":"hello"`)
+	assert.Contains(t, w.String(), `"msg":"goodbye"`)
+	assert.NotContains(t, w.String(), "nope")
+
+	assert.EqualError(t, sshFieldFilter{}.Set("vpnIp"), "field filters must look like key=value: vpnIp")
+	_, err := runSSHCommand(t, nil, func(fs interface{}, a []string, w sshd.StringWriter) error {
+		return sshLogTail(h, &sshLogTailFlags{Level: "loud"}, a, w)
+	})
+	assert.Error(t, err)
+}
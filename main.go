@@ -1,11 +1,12 @@
 package nebula
 
 import (
-	"encoding/binary"
 	"fmt"
 	"net"
+	"sort"
 	"time"
 
+	"github.com/rcrowley/go-metrics"
 	"github.com/sirupsen/logrus"
 	"github.com/slackhq/nebula/sshd"
 	"gopkg.in/yaml.v2"
@@ -35,6 +36,10 @@ func Main(config *Config, configTest bool, buildVersion string, logger *logrus.L
 		return nil, NewContextualError("Failed to configure the logger", nil, err)
 	}
 
+	// Copies log entries to Control.TailLog and the sshd log-tail command
+	logTail := newLogTailHook()
+	l.AddHook(logTail)
+
 	config.RegisterReloadCallback(func(c *Config) {
 		err := configLogger(c)
 		if err != nil {
@@ -42,6 +47,122 @@ func Main(config *Config, configTest bool, buildVersion string, logger *logrus.L
 		}
 	})
 
+	ssh, err := sshd.NewSSHServer(l.WithField("subsystem", "sshd"))
+	sshAuth := &sshCertAuth{}
+	wireSSHReload(l, ssh, sshAuth, config)
+	if config.GetBool("sshd.enabled", false) {
+		err = configSSH(l, ssh, sshAuth, config)
+		if err != nil {
+			return nil, NewContextualError("Error while configuring the sshd", nil, err)
+		}
+	}
+
+	networks, err := config.Networks()
+	if err != nil {
+		ssh.Stop()
+		return nil, NewContextualError("Failed to load networks", nil, err)
+	}
+
+	if !configTest {
+		config.CatchHUP()
+	}
+
+	// Handshake spans from every network are collected here for the otlp exporter, if traces are enabled
+	traces := newTraceBufferFromConfig(config)
+
+	ifce, err := newNetwork(l, "", config, configTest, buildVersion, tunFd, traces)
+	if err != nil {
+		ssh.Stop()
+		return nil, err
+	}
+
+	names := make([]string, 0, len(networks))
+	for name := range networks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	children := make(map[string]*Control, len(networks))
+	// The sshd and networks that already started are closed if a later step fails
+	cleanup := func() {
+		ssh.Stop()
+		if ifce != nil {
+			closeNetwork(l, ifce.inside, ifce.writers)
+		}
+		for _, child := range children {
+			if child.f != nil {
+				closeNetwork(l, child.f.inside, child.f.writers)
+			}
+		}
+	}
+
+	hostMaps := make(map[string]*HostMap, len(networks)+1)
+	for _, name := range names {
+		l.WithField("networkName", name).Info("Starting network")
+		nifce, err := newNetwork(l, name, networks[name], configTest, buildVersion, nil, traces)
+		if err != nil {
+			cleanup()
+			return nil, NewContextualError("Failed to start network", m{"networkName": name}, err)
+		}
+		children[name] = &Control{f: nifce, l: l, logTail: logTail}
+		if nifce != nil {
+			hostMaps[name] = nifce.hostMap
+		}
+	}
+
+	// Networks are not built when testing the config
+	if ifce != nil {
+		hostMaps[""] = ifce.hostMap
+	}
+
+	// The prometheus server only serves /readyz once Control.Start has run, by which time ctrl is set
+	var ctrl *Control
+	stats, err := startStats(l, config, buildVersion, configTest, hostMaps, traces, func() error { return ctrl.Ready() })
+	if err != nil {
+		cleanup()
+		return nil, NewContextualError("Failed to start stats emitter", nil, err)
+	}
+
+	if configTest {
+		return nil, nil
+	}
+
+	attachCommands(l, ssh, ifce.hostMap, ifce.handshakeManager.pendingHostMap, ifce.lightHouse, ifce, logTail)
+	sshAuth.setHostMap(ifce.hostMap, ifce.myVpnIp)
+	if config.GetBool("sshd.enabled", false) {
+		// A typo in sshd.roles would otherwise quietly deny the command
+		err = ssh.CheckRoles()
+		if err != nil {
+			if stats != nil {
+				stats.Stop()
+			}
+			cleanup()
+			return nil, NewContextualError("Error while configuring the sshd", nil, fmt.Errorf("sshd.roles: %s", err))
+		}
+	}
+
+	ctrl = &Control{f: ifce, l: l, networks: children, stats: stats, logTail: logTail}
+	ctrl.admin, err = newAdminServerFromConfig(l, config, ctrl)
+	if err != nil {
+		if stats != nil {
+			stats.Stop()
+		}
+		cleanup()
+		return nil, NewContextualError("Failed to start the admin socket", m{"socket": config.GetString("admin.listen", "")}, err)
+	}
+
+	return ctrl, nil
+}
+
+// newNetwork builds a single nebula network from config. The base network has an empty name, entries from `networks`
+// are named after their key.
+func newNetwork(l *logrus.Logger, name string, config *Config, configTest bool, buildVersion string, tunFd *int, traces *traceBuffer) (_ *Interface, err error) {
+	// Named networks prefix their metrics so they are not merged with the base network's
+	var metricsRegistry metrics.Registry = metrics.DefaultRegistry
+	if name != "" {
+		metricsRegistry = metrics.NewPrefixedChildRegistry(metrics.DefaultRegistry, "networks."+name+".")
+	}
+
 	caPool, err := loadCAFromConfig(l, config)
 	if err != nil {
 		//The errors coming out of loadCA are already nicely formatted
@@ -56,7 +177,11 @@ func Main(config *Config, configTest bool, buildVersion string, logger *logrus.L
 	}
 	l.WithField("cert", cs.certificate).Debug("Client nebula certificate")
 
-	fw, err := NewFirewallFromConfig(l, cs.certificate, config)
+	if caPool.IsDeprecated(cs.certificate, time.Now()) {
+		l.WithField("issuer", cs.certificate.Details.Issuer).Warn("Client nebula certificate was issued by a deprecated CA")
+	}
+
+	fw, err := NewFirewallFromConfig(l, cs.certificate, config, metricsRegistry)
 	if err != nil {
 		return nil, NewContextualError("Error while loading firewall rules", nil, err)
 	}
@@ -73,15 +198,6 @@ func Main(config *Config, configTest bool, buildVersion string, logger *logrus.L
 		return nil, NewContextualError("Could not parse tun.unsafe_routes", nil, err)
 	}
 
-	ssh, err := sshd.NewSSHServer(l.WithField("subsystem", "sshd"))
-	wireSSHReload(l, ssh, config)
-	if config.GetBool("sshd.enabled", false) {
-		err = configSSH(l, ssh, config)
-		if err != nil {
-			return nil, NewContextualError("Error while configuring the sshd", nil, err)
-		}
-	}
-
 	////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
 	// All non system modifying configuration consumption should live above this line
 	// tun config, listeners, anything modifying the computer should be below
@@ -125,11 +241,9 @@ func Main(config *Config, configTest bool, buildVersion string, logger *logrus.L
 
 	var tun Inside
 	if !configTest {
-		config.CatchHUP()
-
 		switch {
 		case config.GetBool("tun.disabled", false):
-			tun = newDisabledTun(tunCidr, config.GetInt("tun.tx_queue", 500), config.GetBool("stats.message_metrics", false), l)
+			tun = newDisabledTun(tunCidr, config.GetInt("tun.tx_queue", 500), config.GetBool("stats.message_metrics", false), metricsRegistry, l)
 		case tunFd != nil:
 			tun, err = newTunFromFd(
 				l,
@@ -150,6 +264,7 @@ func Main(config *Config, configTest bool, buildVersion string, logger *logrus.L
 				unsafeRoutes,
 				config.GetInt("tun.tx_queue", 500),
 				routines > 1,
+				config.GetBool("tun.offload", false),
 			)
 		}
 
@@ -162,6 +277,13 @@ func Main(config *Config, configTest bool, buildVersion string, logger *logrus.L
 	udpConns := make([]*udpConn, routines)
 	port := config.GetInt("listen.port", 0)
 
+	// Give back the tun and listeners if anything below fails
+	defer func() {
+		if err != nil {
+			closeNetwork(l, tun, udpConns)
+		}
+	}()
+
 	if !configTest {
 		for i := 0; i < routines; i++ {
 			udpServer, err := NewListener(l, config.GetString("listen.host", "0.0.0.0"), port, routines > 1)
@@ -182,6 +304,30 @@ func Main(config *Config, configTest bool, buildVersion string, logger *logrus.L
 		}
 	}
 
+	// Probe for anything up to the largest mtu we may hand to the tun
+	maxMTU := config.GetInt("tun.mtu", DEFAULT_MTU)
+	for _, r := range routes {
+		if r.mtu > maxMTU {
+			maxMTU = r.mtu
+		}
+	}
+
+	pmtud := NewPathMTUDiscoveryFromConfig(l, config, maxMTU)
+	if pmtud != nil && !configTest {
+		for _, u := range udpConns {
+			if err := u.SetDontFragment(); err != nil {
+				l.WithError(err).Warn("Disabling path MTU discovery, the udp listener does not support it")
+				pmtud = nil
+				break
+			}
+		}
+	}
+
+	mp, err := NewMultipathFromConfig(l, config)
+	if err != nil {
+		return nil, NewContextualError("Failed to configure multipath", nil, err)
+	}
+
 	// Set up my internal host map
 	var preferredRanges []*net.IPNet
 	rawPreferredRanges := config.GetStringSlice("preferred_ranges", []string{})
@@ -220,7 +366,12 @@ func Main(config *Config, configTest bool, buildVersion string, logger *logrus.L
 		}
 	}
 
-	hostMap := NewHostMap(l, "main", tunCidr, preferredRanges)
+	hostMapName := "main"
+	if name != "" {
+		hostMapName = name
+	}
+
+	hostMap := NewHostMap(l, hostMapName, tunCidr, preferredRanges)
 	hostMap.SetDefaultRoute(ip2int(net.ParseIP(config.GetString("default_route", "0.0.0.0"))))
 	hostMap.addUnsafeRoutes(&unsafeRoutes)
 	hostMap.metricsEnabled = config.GetBool("stats.message_metrics", false)
@@ -235,7 +386,7 @@ func Main(config *Config, configTest bool, buildVersion string, logger *logrus.L
 	punchy := NewPunchyFromConfig(config)
 	if punchy.Punch && !configTest {
 		l.Info("UDP hole punching enabled")
-		go hostMap.Punchy(udpConns[0])
+		go hostMap.Punchy(udpConns[0], metricsRegistry)
 	}
 
 	amLighthouse := config.GetBool("lighthouse.am_lighthouse", false)
@@ -275,6 +426,7 @@ func Main(config *Config, configTest bool, buildVersion string, logger *logrus.L
 		punchy.Respond,
 		punchy.Delay,
 		config.GetBool("stats.lighthouse_metrics", false),
+		metricsRegistry,
 	)
 
 	remoteAllowList, err := config.GetAllowList("lighthouse.remote_allow_list", false)
@@ -320,9 +472,9 @@ func Main(config *Config, configTest bool, buildVersion string, logger *logrus.L
 
 	var messageMetrics *MessageMetrics
 	if config.GetBool("stats.message_metrics", false) {
-		messageMetrics = newMessageMetrics()
+		messageMetrics = newMessageMetrics(metricsRegistry)
 	} else {
-		messageMetrics = newMessageMetricsOnlyRecvError()
+		messageMetrics = newMessageMetricsOnlyRecvError(metricsRegistry)
 	}
 
 	handshakeConfig := HandshakeConfig{
@@ -337,6 +489,39 @@ func Main(config *Config, configTest bool, buildVersion string, logger *logrus.L
 	handshakeManager := NewHandshakeManager(l, tunCidr, preferredRanges, hostMap, lightHouse, udpConns[0], handshakeConfig)
 	lightHouse.handshakeTrigger = handshakeManager.trigger
 
+	// Every part of the network that has something to say shares one event bus
+	events := newEventBus()
+	lightHouse.events = events
+	handshakeManager.events = events
+	handshakeManager.tracer = newHandshakeTracer(name, traces)
+
+	hooks, err := newTunnelHooksFromConfig(l, config, events)
+	if err != nil {
+		return nil, NewContextualError("Failed to load hooks", nil, err)
+	}
+
+	handshakeHybrid, err := newHybridModeFromConfig(config)
+	if err != nil {
+		return nil, NewContextualError("Failed to configure handshakes.hybrid", nil, err)
+	}
+	if handshakeHybrid != hybridOff {
+		l.WithField("mode", handshakeHybrid).WithField("kem", hybridKEMName).Info("Hybrid handshakes enabled")
+	}
+
+	ciphers, err := newCiphersFromConfig(config)
+	if err != nil {
+		return nil, NewContextualError("Failed to load ciphers", nil, err)
+	}
+	if len(ciphers) > 1 {
+		l.WithField("ciphers", ciphers).Info("Negotiating ciphers per tunnel")
+	}
+
+	handshakeLimiter := newHandshakeLimiterFromConfig(config, metricsRegistry)
+	if handshakeLimiter.Enabled() {
+		l.WithField("perSource", handshakeLimiter.perSource).WithField("burst", handshakeLimiter.burst).
+			WithField("cookieThreshold", handshakeLimiter.cookieThreshold).Info("Handshake rate limiting enabled")
+	}
+
 	//TODO: These will be reused for psk
 	//handshakeMACKey := config.GetString("handshake_mac.key", "")
 	//handshakeAcceptedMACKeys := config.GetStringSlice("handshake_mac.accepted_keys", []string{})
@@ -349,7 +534,7 @@ func Main(config *Config, configTest bool, buildVersion string, logger *logrus.L
 		Inside:                  tun,
 		Outside:                 udpConns[0],
 		certState:               cs,
-		Cipher:                  config.GetString("cipher", "aes"),
+		Ciphers:                 ciphers,
 		Firewall:                fw,
 		ServeDns:                serveDns,
 		HandshakeManager:        handshakeManager,
@@ -359,24 +544,26 @@ func Main(config *Config, configTest bool, buildVersion string, logger *logrus.L
 		DropLocalBroadcast:      config.GetBool("tun.drop_local_broadcast", false),
 		DropMulticast:           config.GetBool("tun.drop_multicast", false),
 		UDPBatchSize:            config.GetInt("listen.batch", 64),
+		UDPGRO:                  config.GetBool("listen.gro", true),
+		TunBatchSize:            config.GetInt("tun.batch", 64),
+		TunOffload:              config.GetBool("tun.offload", false),
+		pmtud:                   pmtud,
+		multipath:               mp,
+		HandshakeHybrid:         handshakeHybrid,
+		psk:                     NewPskFromConfig(config, metricsRegistry),
+		handshakeLimiter:        handshakeLimiter,
 		routines:                routines,
 		MessageMetrics:          messageMetrics,
 		version:                 buildVersion,
 		caPool:                  caPool,
+		events:                  events,
+		hooks:                   hooks,
+		metrics:                 metricsRegistry,
 
 		ConntrackCacheTimeout: conntrackCacheTimeout,
 		l:                     l,
 	}
 
-	switch ifConfig.Cipher {
-	case "aes":
-		noiseEndianness = binary.BigEndian
-	case "chachapoly":
-		noiseEndianness = binary.LittleEndian
-	default:
-		return nil, fmt.Errorf("unknown cipher: %v", ifConfig.Cipher)
-	}
-
 	var ifce *Interface
 	if !configTest {
 		ifce, err = NewInterface(ifConfig)
@@ -392,11 +579,14 @@ func Main(config *Config, configTest bool, buildVersion string, logger *logrus.L
 
 		go handshakeManager.Run(ifce)
 		go lightHouse.LhUpdateWorker(ifce)
-	}
 
-	err = startStats(l, config, buildVersion, configTest)
-	if err != nil {
-		return nil, NewContextualError("Failed to start stats emitter", nil, err)
+		if ifce.pmtud != nil {
+			go ifce.pmtud.Run(ifce)
+		}
+
+		if ifce.multipath != nil {
+			go ifce.multipath.Run(ifce)
+		}
 	}
 
 	if configTest {
@@ -406,13 +596,33 @@ func Main(config *Config, configTest bool, buildVersion string, logger *logrus.L
 	//TODO: check if we _should_ be emitting stats
 	go ifce.emitStats(config.GetDuration("stats.interval", time.Second*10))
 
-	attachCommands(l, ssh, hostMap, handshakeManager.pendingHostMap, lightHouse, ifce)
-
 	// Start DNS server last to allow using the nebula IP as lighthouse.dns.host
 	if amLighthouse && serveDns {
-		l.Debugln("Starting dns server")
-		go dnsMain(l, hostMap, config)
+		if name != "" {
+			l.WithField("networkName", name).Warn("lighthouse.serve_dns is only supported by the base network")
+		} else {
+			l.Debugln("Starting dns server")
+			go dnsMain(l, hostMap, config)
+		}
+	}
+
+	return ifce, nil
+}
+
+// closeNetwork gives back the tun device and udp listeners of a network that will not be started
+func closeNetwork(l *logrus.Logger, tun Inside, udpConns []*udpConn) {
+	if tun != nil {
+		if err := tun.Close(); err != nil {
+			l.WithError(err).Warn("Failed to close the tun device")
+		}
 	}
 
-	return &Control{ifce, l}, nil
+	for _, u := range udpConns {
+		if u == nil {
+			continue
+		}
+		if err := u.Close(); err != nil {
+			l.WithError(err).Warn("Failed to close the udp listener")
+		}
+	}
 }
@@ -33,38 +33,38 @@ func (m *MessageMetrics) Tx(t NebulaMessageType, s NebulaMessageSubType, i int64
 	}
 }
 
-func newMessageMetrics() *MessageMetrics {
+func newMessageMetrics(r metrics.Registry) *MessageMetrics {
 	gen := func(t string) [][]metrics.Counter {
 		return [][]metrics.Counter{
 			{
-				metrics.GetOrRegisterCounter(fmt.Sprintf("messages.%s.handshake_ixpsk0", t), nil),
+				metrics.GetOrRegisterCounter(fmt.Sprintf("messages.%s.handshake_ixpsk0", t), r),
 			},
 			nil,
-			{metrics.GetOrRegisterCounter(fmt.Sprintf("messages.%s.recv_error", t), nil)},
-			{metrics.GetOrRegisterCounter(fmt.Sprintf("messages.%s.lighthouse", t), nil)},
+			{metrics.GetOrRegisterCounter(fmt.Sprintf("messages.%s.recv_error", t), r)},
+			{metrics.GetOrRegisterCounter(fmt.Sprintf("messages.%s.lighthouse", t), r)},
 			{
-				metrics.GetOrRegisterCounter(fmt.Sprintf("messages.%s.test_request", t), nil),
-				metrics.GetOrRegisterCounter(fmt.Sprintf("messages.%s.test_response", t), nil),
+				metrics.GetOrRegisterCounter(fmt.Sprintf("messages.%s.test_request", t), r),
+				metrics.GetOrRegisterCounter(fmt.Sprintf("messages.%s.test_response", t), r),
 			},
-			{metrics.GetOrRegisterCounter(fmt.Sprintf("messages.%s.close_tunnel", t), nil)},
+			{metrics.GetOrRegisterCounter(fmt.Sprintf("messages.%s.close_tunnel", t), r)},
 		}
 	}
 	return &MessageMetrics{
 		rx: gen("rx"),
 		tx: gen("tx"),
 
-		rxUnknown: metrics.GetOrRegisterCounter("messages.rx.other", nil),
-		txUnknown: metrics.GetOrRegisterCounter("messages.tx.other", nil),
+		rxUnknown: metrics.GetOrRegisterCounter("messages.rx.other", r),
+		txUnknown: metrics.GetOrRegisterCounter("messages.tx.other", r),
 	}
 }
 
 // Historically we only recorded recv_error, so this is backwards compat
-func newMessageMetricsOnlyRecvError() *MessageMetrics {
+func newMessageMetricsOnlyRecvError(r metrics.Registry) *MessageMetrics {
 	gen := func(t string) [][]metrics.Counter {
 		return [][]metrics.Counter{
 			nil,
 			nil,
-			{metrics.GetOrRegisterCounter(fmt.Sprintf("messages.%s.recv_error", t), nil)},
+			{metrics.GetOrRegisterCounter(fmt.Sprintf("messages.%s.recv_error", t), r)},
 		}
 	}
 	return &MessageMetrics{
@@ -73,7 +73,7 @@ func newMessageMetricsOnlyRecvError() *MessageMetrics {
 	}
 }
 
-func newLighthouseMetrics() *MessageMetrics {
+func newLighthouseMetrics(r metrics.Registry) *MessageMetrics {
 	gen := func(t string) [][]metrics.Counter {
 		h := make([][]metrics.Counter, len(NebulaMeta_MessageType_name))
 		used := []NebulaMeta_MessageType{
@@ -83,7 +83,7 @@ func newLighthouseMetrics() *MessageMetrics {
 			NebulaMeta_HostPunchNotification,
 		}
 		for _, i := range used {
-			h[i] = []metrics.Counter{metrics.GetOrRegisterCounter(fmt.Sprintf("lighthouse.%s.%s", t, i.String()), nil)}
+			h[i] = []metrics.Counter{metrics.GetOrRegisterCounter(fmt.Sprintf("lighthouse.%s.%s", t, i.String()), r)}
 		}
 		return h
 	}
@@ -91,7 +91,7 @@ func newLighthouseMetrics() *MessageMetrics {
 		rx: gen("rx"),
 		tx: gen("tx"),
 
-		rxUnknown: metrics.GetOrRegisterCounter("lighthouse.rx.other", nil),
-		txUnknown: metrics.GetOrRegisterCounter("lighthouse.tx.other", nil),
+		rxUnknown: metrics.GetOrRegisterCounter("lighthouse.rx.other", r),
+		txUnknown: metrics.GetOrRegisterCounter("lighthouse.tx.other", r),
 	}
 }
@@ -0,0 +1,411 @@
+package nebula
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// multipathProbeLen is the length of a path probe, the magic, the probe id and a flag byte
+	multipathProbeLen = 9
+
+	// multipathProbeAck is set in the flag byte of replies from hosts that understand path probes
+	multipathProbeAck = 1
+
+	// multipathLossWeight is how much a single probe moves the loss estimate of a path
+	multipathLossWeight = 0.1
+
+	// multipathMaxLoss is the loss estimate at which a path is no longer used
+	multipathMaxLoss = 0.5
+
+	// multipathMinRTO is the shortest time we wait for a probe reply before the path is considered down
+	multipathMinRTO = time.Millisecond * 10
+)
+
+var multipathProbeMagic = []byte("MPTH")
+
+type multipathMode int
+
+const (
+	// multipathSpread sends each packet over one healthy path, taking turns
+	multipathSpread multipathMode = iota
+	// multipathMirror sends every packet over every healthy path, the receiver drops the copies
+	multipathMirror
+)
+
+func (m multipathMode) String() string {
+	if m == multipathMirror {
+		return "mirror"
+	}
+	return "spread"
+}
+
+// multipath sends tunnel traffic over every remote of a host that answers our probes, instead of only the current
+// remote. Each remote is probed with test requests to measure its latency and loss and a path that stops answering
+// is dropped as soon as a probe is overdue, rather than waiting for the connection manager to notice.
+type multipath struct {
+	mode     multipathMode
+	interval time.Duration
+	maxPaths int
+	l        *logrus.Logger
+}
+
+// multipathState is the state of every path to a single host
+type multipathState struct {
+	sync.RWMutex
+
+	// supported is true once the host answered a probe in a way that shows it understands them. Until then we only
+	// probe the current remote, older hosts roam to any address a test request comes from
+	supported bool
+	paths     []*pathState
+	probeId   uint32
+
+	// active are the paths tunnel traffic is sent over, it is replaced and never modified so senders can hold on to it
+	active []*udpAddr
+	// atomicNext picks the path of the next packet in spread mode
+	atomicNext uint32
+}
+
+type pathState struct {
+	addr   *udpAddr
+	srtt   time.Duration
+	rttvar time.Duration
+	loss   float64
+	up     bool
+
+	// probeId is the id of the outstanding probe, sent is zero if there is none
+	probeId uint32
+	sent    time.Time
+	// lastProbe is when the last probe was sent
+	lastProbe time.Time
+}
+
+// NewMultipathFromConfig returns nil if multipath is disabled
+func NewMultipathFromConfig(l *logrus.Logger, c *Config) (*multipath, error) {
+	if !c.GetBool("multipath.enabled", false) {
+		return nil, nil
+	}
+
+	mp := &multipath{
+		interval: c.GetDuration("multipath.probe_interval", time.Millisecond*500),
+		maxPaths: c.GetInt("multipath.max_paths", 4),
+		l:        l,
+	}
+
+	switch strings.ToLower(c.GetString("multipath.mode", "spread")) {
+	case "spread":
+		mp.mode = multipathSpread
+	case "mirror":
+		mp.mode = multipathMirror
+	default:
+		return nil, fmt.Errorf("unknown multipath.mode: %s, expected spread or mirror", c.GetString("multipath.mode", ""))
+	}
+
+	if mp.interval < time.Millisecond*10 {
+		mp.interval = time.Millisecond * 10
+	}
+
+	if mp.maxPaths < 2 {
+		mp.maxPaths = 2
+	}
+
+	l.WithField("mode", mp.mode).WithField("probeInterval", mp.interval).WithField("maxPaths", mp.maxPaths).
+		Info("Multipath enabled")
+
+	return mp, nil
+}
+
+// Run probes the paths of every established tunnel until the process exits
+func (mp *multipath) Run(f *Interface) {
+	// Tick often enough to notice an overdue probe well before the next one is due
+	ticker := time.NewTicker(mp.interval / 10)
+	defer ticker.Stop()
+
+	var hosts []*HostInfo
+	for now := range ticker.C {
+		hosts = hosts[:0]
+		f.hostMap.RLock()
+		for _, h := range f.hostMap.Hosts {
+			hosts = append(hosts, h)
+		}
+		f.hostMap.RUnlock()
+
+		for _, h := range hosts {
+			mp.tick(f, h, now)
+		}
+	}
+}
+
+func (mp *multipath) tick(f *Interface, h *HostInfo, now time.Time) {
+	ci := h.ConnectionState
+	if ci == nil || !ci.ready {
+		return
+	}
+
+	h.RLock()
+	remote := h.remote
+	h.RUnlock()
+	if remote == nil {
+		return
+	}
+
+	s := &h.multipath
+	s.Lock()
+	defer s.Unlock()
+
+	s.sync(remote, h.CopyRemotes(), mp.maxPaths)
+
+	for _, p := range s.paths {
+		if !p.sent.IsZero() && now.Sub(p.sent) >= p.rto(mp.interval) {
+			// Overdue, this path is not usable until it answers again
+			p.sent = time.Time{}
+			p.loss += (1 - p.loss) * multipathLossWeight
+			if p.up {
+				p.up = false
+				h.logger(mp.l).WithField("udpAddr", p.addr).Info("Multipath path is down")
+			}
+		}
+
+		if p.sent.IsZero() && now.Sub(p.lastProbe) >= mp.interval && (s.supported || p.addr.Equals(remote)) {
+			s.probeId++
+			p.probeId = s.probeId
+			p.sent = now
+			p.lastProbe = now
+			f.sendMultipathProbe(h, p.addr, p.probeId)
+		}
+	}
+
+	s.update()
+
+	// Move the tunnel off a dead remote as soon as we know of a better one, all other traffic follows the remote
+	if len(s.active) > 0 && !s.isUp(remote) {
+		best := s.active[0]
+		h.logger(mp.l).WithField("udpAddr", remote).WithField("newAddr", best).Info("Multipath failover")
+		h.Lock()
+		h.SetRemote(best)
+		h.Unlock()
+	}
+}
+
+// handleReply is called with the decrypted payload of every test reply
+func (mp *multipath) handleReply(h *HostInfo, d []byte, now time.Time) {
+	id, flags, ok := parseMultipathProbe(d)
+	if !ok {
+		return
+	}
+
+	s := &h.multipath
+	s.Lock()
+	defer s.Unlock()
+
+	if flags&multipathProbeAck != 0 {
+		s.supported = true
+	}
+
+	// Replies are matched by id only, a host with more than one address may not answer from the one we probed
+	for _, p := range s.paths {
+		if p.sent.IsZero() || p.probeId != id {
+			continue
+		}
+
+		p.sample(now.Sub(p.sent))
+		p.sent = time.Time{}
+		p.loss -= p.loss * multipathLossWeight
+		if !p.up && p.loss < multipathMaxLoss {
+			p.up = true
+			h.logger(mp.l).WithField("udpAddr", p.addr).WithField("rtt", p.srtt).Info("Multipath path is up")
+		}
+		s.update()
+		return
+	}
+}
+
+// route returns where a tunnel packet should be sent. Either a single remote or, when mirroring, every path.
+func (mp *multipath) route(h *HostInfo, remote *udpAddr) (*udpAddr, []*udpAddr) {
+	s := &h.multipath
+	s.RLock()
+	active := s.active
+	supported := s.supported
+	s.RUnlock()
+
+	// Only a host that acked a probe has multipath enabled, any other host would roam to each of our addresses in turn
+	if !supported || len(active) < 2 {
+		return remote, nil
+	}
+
+	if mp.mode == multipathMirror {
+		return remote, active
+	}
+
+	return active[atomic.AddUint32(&s.atomicNext, 1)%uint32(len(active))], nil
+}
+
+// isPath returns true if addr is one of the paths we keep for h, whether or not it answered a probe yet. Traffic over
+// it is not a roam, a spreading host sends from all of them and the remote only moves to a path on failover.
+func (mp *multipath) isPath(h *HostInfo, addr *udpAddr) bool {
+	s := &h.multipath
+	s.RLock()
+	defer s.RUnlock()
+	return s.path(addr) != nil
+}
+
+// sync keeps a path for the current remote and the first other remotes up to max. s must be locked
+func (s *multipathState) sync(remote *udpAddr, remotes []*udpAddr, max int) {
+	want := []*udpAddr{remote}
+	for _, r := range remotes {
+		if len(want) >= max {
+			break
+		}
+		if !r.Equals(remote) {
+			want = append(want, r)
+		}
+	}
+
+	paths := make([]*pathState, 0, len(want))
+	for _, addr := range want {
+		var found *pathState
+		for _, p := range s.paths {
+			if p.addr.Equals(addr) {
+				found = p
+				break
+			}
+		}
+
+		if found == nil {
+			found = &pathState{addr: addr.Copy()}
+		}
+		paths = append(paths, found)
+	}
+
+	s.paths = paths
+}
+
+// update rebuilds the list of paths tunnel traffic is sent over, fastest first. Paths that are much slower than the
+// fastest one are kept as a standby, spreading packets over them would only reorder them. s must be locked
+func (s *multipathState) update() {
+	var fastest time.Duration
+	for _, p := range s.paths {
+		if p.up && (fastest == 0 || p.srtt < fastest) {
+			fastest = p.srtt
+		}
+	}
+
+	active := make([]*udpAddr, 0, len(s.paths))
+	for _, p := range s.paths {
+		if p.up && p.srtt <= fastest*2+time.Millisecond*10 {
+			active = append(active, p.addr)
+		}
+	}
+
+	// Keep the fastest path first
+	for i := 1; i < len(active); i++ {
+		for j := i; j > 0 && s.path(active[j]).srtt < s.path(active[j-1]).srtt; j-- {
+			active[j], active[j-1] = active[j-1], active[j]
+		}
+	}
+
+	s.active = active
+}
+
+func (s *multipathState) path(addr *udpAddr) *pathState {
+	for _, p := range s.paths {
+		if p.addr.Equals(addr) {
+			return p
+		}
+	}
+	return nil
+}
+
+// isUp returns true if addr is a path that answers our probes. s must be locked
+func (s *multipathState) isUp(addr *udpAddr) bool {
+	p := s.path(addr)
+	return p != nil && p.up
+}
+
+// sample updates the smoothed rtt like tcp does, rfc6298
+func (p *pathState) sample(rtt time.Duration) {
+	if p.srtt == 0 {
+		p.srtt = rtt
+		p.rttvar = rtt / 2
+		return
+	}
+
+	delta := p.srtt - rtt
+	if delta < 0 {
+		delta = -delta
+	}
+	p.rttvar = (3*p.rttvar + delta) / 4
+	p.srtt = (7*p.srtt + rtt) / 8
+}
+
+// rto is how long we wait for a probe reply before the path is considered down
+func (p *pathState) rto(interval time.Duration) time.Duration {
+	if p.srtt == 0 {
+		return interval
+	}
+
+	rto := p.srtt + 4*p.rttvar
+	if rto < multipathMinRTO {
+		rto = multipathMinRTO
+	}
+	if rto > interval {
+		rto = interval
+	}
+	return rto
+}
+
+func (s *multipathState) MarshalJSON() ([]byte, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	paths := make([]m, len(s.paths))
+	for i, p := range s.paths {
+		paths[i] = m{
+			"remote": p.addr,
+			"up":     p.up,
+			"rtt":    p.srtt.String(),
+			"loss":   p.loss,
+		}
+	}
+
+	return json.Marshal(paths)
+}
+
+// sendMultipathProbe sends a test request to a single path of a tunnel
+func (f *Interface) sendMultipathProbe(hostinfo *HostInfo, remote *udpAddr, id uint32) {
+	p := make([]byte, multipathProbeLen)
+	copy(p, multipathProbeMagic)
+	binary.BigEndian.PutUint32(p[4:8], id)
+
+	f.send(test, testRequest, hostinfo.ConnectionState, hostinfo, remote, p, make([]byte, 12, 12), make([]byte, mtu))
+}
+
+// parseMultipathProbe returns the probe id and flags if the test payload is a path probe
+func parseMultipathProbe(d []byte) (uint32, byte, bool) {
+	if len(d) != multipathProbeLen || !bytes.Equal(d[:4], multipathProbeMagic) {
+		return 0, 0, false
+	}
+
+	return binary.BigEndian.Uint32(d[4:8]), d[8], true
+}
+
+func isMultipathProbe(d []byte) bool {
+	_, _, ok := parseMultipathProbe(d)
+	return ok
+}
+
+// multipathReply returns the reply to a path probe, the ack flag tells the sender we understand probes
+func multipathReply(d []byte) []byte {
+	r := make([]byte, multipathProbeLen)
+	copy(r, d)
+	r[8] |= multipathProbeAck
+	return r
+}
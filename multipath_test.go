@@ -0,0 +1,169 @@
+package nebula
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewMultipathFromConfig(t *testing.T) {
+	l := NewTestLogger()
+	c := NewConfig(l)
+
+	mp, err := NewMultipathFromConfig(l, c)
+	assert.Nil(t, err)
+	assert.Nil(t, mp)
+
+	c.Settings["multipath"] = map[interface{}]interface{}{"enabled": true}
+	mp, err = NewMultipathFromConfig(l, c)
+	assert.Nil(t, err)
+	assert.Equal(t, multipathSpread, mp.mode)
+	assert.Equal(t, time.Millisecond*500, mp.interval)
+	assert.Equal(t, 4, mp.maxPaths)
+
+	c.Settings["multipath"] = map[interface{}]interface{}{"enabled": true, "mode": "Mirror", "probe_interval": "1s", "max_paths": 1}
+	mp, err = NewMultipathFromConfig(l, c)
+	assert.Nil(t, err)
+	assert.Equal(t, multipathMirror, mp.mode)
+	assert.Equal(t, time.Second, mp.interval)
+	assert.Equal(t, 2, mp.maxPaths)
+
+	c.Settings["multipath"] = map[interface{}]interface{}{"enabled": true, "mode": "fastest"}
+	_, err = NewMultipathFromConfig(l, c)
+	assert.EqualError(t, err, "unknown multipath.mode: fastest, expected spread or mirror")
+}
+
+func TestMultipathProbe(t *testing.T) {
+	p := make([]byte, multipathProbeLen)
+	copy(p, multipathProbeMagic)
+	p[7] = 5
+
+	id, flags, ok := parseMultipathProbe(p)
+	assert.True(t, ok)
+	assert.Equal(t, uint32(5), id)
+	assert.Equal(t, byte(0), flags)
+
+	id, flags, ok = parseMultipathProbe(multipathReply(p))
+	assert.True(t, ok)
+	assert.Equal(t, uint32(5), id)
+	assert.Equal(t, byte(multipathProbeAck), flags)
+
+	// The request is left alone
+	assert.Equal(t, byte(0), p[8])
+
+	_, _, ok = parseMultipathProbe(p[:8])
+	assert.False(t, ok)
+	_, _, ok = parseMultipathProbe([]byte("PMTU12345"))
+	assert.False(t, ok)
+}
+
+func TestPathState_rto(t *testing.T) {
+	p := &pathState{}
+	assert.Equal(t, time.Second, p.rto(time.Second))
+
+	p.sample(time.Millisecond * 20)
+	assert.Equal(t, time.Millisecond*20, p.srtt)
+	assert.Equal(t, time.Millisecond*10, p.rttvar)
+	assert.Equal(t, time.Millisecond*60, p.rto(time.Second))
+
+	// Never longer than the probe interval
+	assert.Equal(t, time.Millisecond*50, p.rto(time.Millisecond*50))
+
+	// And never too short to answer at all
+	p = &pathState{}
+	p.sample(time.Microsecond)
+	assert.Equal(t, multipathMinRTO, p.rto(time.Second))
+}
+
+func TestMultipathState(t *testing.T) {
+	a := NewUDPAddr(net.ParseIP("1.1.1.1"), 4242)
+	b := NewUDPAddr(net.ParseIP("1.1.1.2"), 4242)
+	c := NewUDPAddr(net.ParseIP("1.1.1.3"), 4242)
+
+	s := &multipathState{}
+	s.sync(a, []*udpAddr{a, b, c}, 2)
+	assert.Len(t, s.paths, 2)
+	assert.True(t, s.paths[0].addr.Equals(a))
+	assert.True(t, s.paths[1].addr.Equals(b))
+
+	// Nothing answered yet
+	s.update()
+	assert.Empty(t, s.active)
+	assert.False(t, s.isUp(a))
+
+	// The fastest path is first
+	s.paths[0].up, s.paths[0].srtt = true, time.Millisecond*30
+	s.paths[1].up, s.paths[1].srtt = true, time.Millisecond*20
+	s.update()
+	assert.Equal(t, []*udpAddr{s.paths[1].addr, s.paths[0].addr}, s.active)
+
+	// Much slower paths are not used
+	s.paths[0].srtt = time.Millisecond * 100
+	s.update()
+	assert.Equal(t, []*udpAddr{s.paths[1].addr}, s.active)
+
+	// Path state survives a change of the remote
+	p := s.paths[1]
+	s.sync(b, []*udpAddr{c, b}, 4)
+	assert.Len(t, s.paths, 2)
+	assert.Equal(t, p, s.paths[0])
+	assert.True(t, s.paths[1].addr.Equals(c))
+}
+
+func TestMultipath_handleReply(t *testing.T) {
+	l := NewTestLogger()
+	mp := &multipath{mode: multipathSpread, interval: time.Second, maxPaths: 4, l: l}
+	a := NewUDPAddr(net.ParseIP("1.1.1.1"), 4242)
+	b := NewUDPAddr(net.ParseIP("1.1.1.2"), 4242)
+
+	h := &HostInfo{}
+	now := time.Now()
+	h.multipath.sync(a, []*udpAddr{a, b}, 4)
+	for i, p := range h.multipath.paths {
+		p.probeId = uint32(i + 1)
+		p.sent = now
+	}
+
+	reply := func(id uint32) []byte {
+		p := make([]byte, multipathProbeLen)
+		copy(p, multipathProbeMagic)
+		p[7] = byte(id)
+		return multipathReply(p)
+	}
+
+	// Traffic from a path we have not heard back from yet is still not a roam
+	assert.True(t, mp.isPath(h, a))
+	assert.True(t, mp.isPath(h, b))
+	assert.False(t, mp.isPath(h, NewUDPAddr(net.ParseIP("1.1.1.3"), 4242)))
+
+	// A reply to a probe we did not send is ignored
+	mp.handleReply(h, reply(3), now.Add(time.Millisecond*10))
+	assert.False(t, h.multipath.isUp(a))
+	assert.False(t, h.multipath.isUp(b))
+	assert.True(t, h.multipath.supported)
+
+	mp.handleReply(h, reply(1), now.Add(time.Millisecond*10))
+	mp.handleReply(h, reply(2), now.Add(time.Millisecond*12))
+	assert.True(t, h.multipath.isUp(a))
+	assert.True(t, h.multipath.isUp(b))
+
+	// Nothing is spread to a host that never acked a probe, it would roam between our addresses
+	h.multipath.supported = false
+	remote, mirror := mp.route(h, a)
+	assert.Equal(t, a, remote)
+	assert.Nil(t, mirror)
+	h.multipath.supported = true
+
+	// Spread takes turns, mirror sends to every path
+	first, mirror := mp.route(h, a)
+	assert.Nil(t, mirror)
+	second, _ := mp.route(h, a)
+	assert.False(t, first.Equals(second))
+
+	mp.mode = multipathMirror
+	remote, mirror = mp.route(h, a)
+	assert.Equal(t, a, remote)
+	assert.Len(t, mirror, 2)
+}
@@ -433,11 +433,15 @@ func (m *NebulaHandshake) GetHmac() []byte {
 }
 
 type NebulaHandshakeDetails struct {
-	Cert           []byte `protobuf:"bytes,1,opt,name=Cert,proto3" json:"Cert,omitempty"`
-	InitiatorIndex uint32 `protobuf:"varint,2,opt,name=InitiatorIndex,proto3" json:"InitiatorIndex,omitempty"`
-	ResponderIndex uint32 `protobuf:"varint,3,opt,name=ResponderIndex,proto3" json:"ResponderIndex,omitempty"`
-	Cookie         uint64 `protobuf:"varint,4,opt,name=Cookie,proto3" json:"Cookie,omitempty"`
-	Time           uint64 `protobuf:"varint,5,opt,name=Time,proto3" json:"Time,omitempty"`
+	Cert           []byte   `protobuf:"bytes,1,opt,name=Cert,proto3" json:"Cert,omitempty"`
+	InitiatorIndex uint32   `protobuf:"varint,2,opt,name=InitiatorIndex,proto3" json:"InitiatorIndex,omitempty"`
+	ResponderIndex uint32   `protobuf:"varint,3,opt,name=ResponderIndex,proto3" json:"ResponderIndex,omitempty"`
+	Cookie         uint64   `protobuf:"varint,4,opt,name=Cookie,proto3" json:"Cookie,omitempty"`
+	Time           uint64   `protobuf:"varint,5,opt,name=Time,proto3" json:"Time,omitempty"`
+	KemPublicKey   []byte   `protobuf:"bytes,6,opt,name=KemPublicKey,proto3" json:"KemPublicKey,omitempty"`
+	KemCiphertext  []byte   `protobuf:"bytes,7,opt,name=KemCiphertext,proto3" json:"KemCiphertext,omitempty"`
+	Ciphers        []string `protobuf:"bytes,8,rep,name=Ciphers,proto3" json:"Ciphers,omitempty"`
+	Cipher         string   `protobuf:"bytes,9,opt,name=Cipher,proto3" json:"Cipher,omitempty"`
 }
 
 func (m *NebulaHandshakeDetails) Reset()         { *m = NebulaHandshakeDetails{} }
@@ -508,6 +512,34 @@ func (m *NebulaHandshakeDetails) GetTime() uint64 {
 	return 0
 }
 
+func (m *NebulaHandshakeDetails) GetKemPublicKey() []byte {
+	if m != nil {
+		return m.KemPublicKey
+	}
+	return nil
+}
+
+func (m *NebulaHandshakeDetails) GetKemCiphertext() []byte {
+	if m != nil {
+		return m.KemCiphertext
+	}
+	return nil
+}
+
+func (m *NebulaHandshakeDetails) GetCiphers() []string {
+	if m != nil {
+		return m.Ciphers
+	}
+	return nil
+}
+
+func (m *NebulaHandshakeDetails) GetCipher() string {
+	if m != nil {
+		return m.Cipher
+	}
+	return ""
+}
+
 func init() {
 	proto.RegisterEnum("nebula.NebulaMeta_MessageType", NebulaMeta_MessageType_name, NebulaMeta_MessageType_value)
 	proto.RegisterEnum("nebula.NebulaPing_MessageType", NebulaPing_MessageType_name, NebulaPing_MessageType_value)
@@ -523,43 +555,47 @@ func init() {
 func init() { proto.RegisterFile("nebula.proto", fileDescriptor_2d65afa7693df5ef) }
 
 var fileDescriptor_2d65afa7693df5ef = []byte{
-	// 570 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x7c, 0x54, 0x41, 0x6f, 0xda, 0x4c,
-	0x10, 0x65, 0x8d, 0x21, 0xc9, 0x90, 0x10, 0x7f, 0xfb, 0xb5, 0x08, 0x7a, 0xb0, 0x22, 0x1f, 0x2a,
-	0x4e, 0xa4, 0x82, 0x08, 0xf5, 0xd8, 0x96, 0x1e, 0x40, 0x0a, 0x88, 0x5a, 0x69, 0x2b, 0xf5, 0x52,
-	0x2d, 0xf6, 0x16, 0xaf, 0x80, 0x5d, 0xd7, 0x5e, 0xaa, 0xf0, 0x2f, 0xfa, 0x33, 0x7a, 0xeb, 0xdf,
-	0xe8, 0xa1, 0x87, 0x1c, 0x7a, 0xe8, 0xb1, 0x82, 0x3f, 0x52, 0xed, 0xda, 0xd8, 0x04, 0xa2, 0xde,
-	0xe6, 0xcd, 0xbc, 0x37, 0x3b, 0x3c, 0x3f, 0x01, 0xa7, 0x9c, 0x4e, 0x96, 0x73, 0xd2, 0x0a, 0x23,
-	0x21, 0x05, 0x2e, 0x27, 0xc8, 0xf9, 0x69, 0x00, 0x8c, 0x74, 0x39, 0xa4, 0x92, 0xe0, 0x36, 0x98,
-	0x37, 0xab, 0x90, 0xd6, 0xd1, 0x05, 0x6a, 0x56, 0xdb, 0x76, 0x2b, 0xd5, 0xe4, 0x8c, 0xd6, 0x90,
-	0xc6, 0x31, 0x99, 0x52, 0xc5, 0x72, 0x35, 0x17, 0x77, 0xe0, 0xe8, 0x35, 0x95, 0x84, 0xcd, 0xe3,
-	0xba, 0x71, 0x81, 0x9a, 0x95, 0x76, 0xe3, 0x50, 0x96, 0x12, 0xdc, 0x2d, 0xd3, 0xf9, 0x85, 0xa0,
-	0xb2, 0xb3, 0x0a, 0x1f, 0x83, 0x39, 0x12, 0x9c, 0x5a, 0x05, 0x7c, 0x06, 0x27, 0x7d, 0x11, 0xcb,
-	0x37, 0x4b, 0x1a, 0xad, 0x2c, 0x84, 0x31, 0x54, 0x33, 0xe8, 0xd2, 0x70, 0xbe, 0xb2, 0x0c, 0xfc,
-	0x04, 0x6a, 0xaa, 0xf7, 0x36, 0xf4, 0x89, 0xa4, 0x23, 0x21, 0xd9, 0x27, 0xe6, 0x11, 0xc9, 0x04,
-	0xb7, 0x8a, 0xb8, 0x01, 0x8f, 0xd5, 0x6c, 0x28, 0xbe, 0x50, 0xff, 0xde, 0xc8, 0xdc, 0x8e, 0xc6,
-	0x4b, 0xee, 0x05, 0xf7, 0x46, 0x25, 0x5c, 0x05, 0x50, 0xa3, 0xf7, 0x81, 0x20, 0x0b, 0x66, 0x95,
-	0xf1, 0xff, 0x70, 0x9e, 0xe3, 0xe4, 0xd9, 0x23, 0x75, 0xd9, 0x98, 0xc8, 0xa0, 0x17, 0x50, 0x6f,
-	0x66, 0x1d, 0xab, 0xcb, 0x32, 0x98, 0x50, 0x4e, 0x9c, 0xef, 0x08, 0xfe, 0x3b, 0xf8, 0xd5, 0xf8,
-	0x11, 0x94, 0xde, 0x85, 0x7c, 0x10, 0x6a, 0x5b, 0xcf, 0xdc, 0x04, 0xe0, 0x2b, 0xa8, 0x0c, 0xc2,
-	0xab, 0x97, 0xdc, 0x1f, 0x8b, 0x48, 0x2a, 0xef, 0x8a, 0xcd, 0x4a, 0x1b, 0x6f, 0xbd, 0xcb, 0x47,
-	0xee, 0x2e, 0x2d, 0x51, 0x75, 0x33, 0x95, 0xb9, 0xaf, 0xea, 0xee, 0xa8, 0x32, 0x1a, 0xae, 0xc3,
-	0x91, 0x27, 0x96, 0x5c, 0xd2, 0xa8, 0x5e, 0xd4, 0x37, 0x6c, 0xa1, 0xf3, 0x0c, 0x20, 0x5f, 0x8f,
-	0xab, 0x60, 0x64, 0x67, 0x1a, 0x83, 0x10, 0x63, 0x30, 0x55, 0x5f, 0x7f, 0xd8, 0x33, 0x57, 0xd7,
-	0xce, 0x0b, 0xa5, 0xe8, 0xee, 0x28, 0xfa, 0x4c, 0x2b, 0x4c, 0xd7, 0xe8, 0x33, 0x85, 0xaf, 0x85,
-	0xe6, 0x9b, 0xae, 0x71, 0x2d, 0xb2, 0x0d, 0xc5, 0x9d, 0x0d, 0xb7, 0xdb, 0xcc, 0x8d, 0x19, 0x9f,
-	0xfe, 0x3b, 0x73, 0x8a, 0xf1, 0x40, 0xe6, 0x30, 0x98, 0x37, 0x6c, 0x41, 0xd3, 0x77, 0x74, 0xed,
-	0x38, 0x07, 0x89, 0x52, 0x62, 0xab, 0x80, 0x4f, 0xa0, 0x94, 0x7c, 0x1f, 0xe4, 0x7c, 0x84, 0xf3,
-	0x64, 0x6f, 0x9f, 0x70, 0x3f, 0x0e, 0xc8, 0x8c, 0xe2, 0xe7, 0x79, 0x7c, 0x91, 0x8e, 0xef, 0xde,
-	0x05, 0x19, 0x73, 0x3f, 0xc3, 0xea, 0x88, 0xfe, 0x82, 0x78, 0xfa, 0x88, 0x53, 0x57, 0xd7, 0xce,
-	0x37, 0x04, 0xb5, 0x87, 0x75, 0x8a, 0xde, 0xa3, 0x91, 0xd4, 0xaf, 0x9c, 0xba, 0xba, 0xc6, 0x4f,
-	0xa1, 0x3a, 0xe0, 0x4c, 0x32, 0x22, 0x45, 0x34, 0xe0, 0x3e, 0xbd, 0x4d, 0x9d, 0xde, 0xeb, 0x2a,
-	0x9e, 0x4b, 0xe3, 0x50, 0x70, 0x9f, 0xa6, 0xbc, 0xc4, 0xcf, 0xbd, 0x2e, 0xae, 0x41, 0xb9, 0x27,
-	0xc4, 0x8c, 0xd1, 0xba, 0xa9, 0x9d, 0x49, 0x51, 0xe6, 0x57, 0x29, 0xf7, 0xeb, 0x55, 0xe7, 0xc7,
-	0xda, 0x46, 0x77, 0x6b, 0x1b, 0xfd, 0x59, 0xdb, 0xe8, 0xeb, 0xc6, 0x2e, 0xdc, 0x6d, 0xec, 0xc2,
-	0xef, 0x8d, 0x5d, 0xf8, 0xd0, 0x98, 0x32, 0x19, 0x2c, 0x27, 0x2d, 0x4f, 0x2c, 0x2e, 0xe3, 0x39,
-	0xf1, 0x66, 0xc1, 0xe7, 0xcb, 0xc4, 0x93, 0x49, 0x59, 0xff, 0x7d, 0x74, 0xfe, 0x06, 0x00, 0x00,
-	0xff, 0xff, 0x20, 0x00, 0x2b, 0x46, 0x4e, 0x04, 0x00, 0x00,
+	// 625 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x7c, 0x54, 0x4d, 0x6f, 0xd3, 0x40,
+	0x10, 0x8d, 0x1d, 0x27, 0x69, 0x26, 0x1f, 0x0d, 0x0b, 0x54, 0x2e, 0x07, 0x2b, 0xb2, 0x10, 0xca,
+	0x29, 0x45, 0x69, 0x55, 0x71, 0x04, 0xc2, 0x21, 0x51, 0x3f, 0x14, 0x56, 0x05, 0x24, 0x2e, 0x68,
+	0xe3, 0x0c, 0xf5, 0x2a, 0x89, 0xd7, 0xd8, 0x1b, 0xd4, 0xfc, 0x0b, 0x7e, 0x04, 0x77, 0xfe, 0x06,
+	0x07, 0x0e, 0x3d, 0x70, 0xe0, 0x88, 0xda, 0x3f, 0x82, 0x76, 0xed, 0xd8, 0x49, 0x5a, 0x71, 0x9b,
+	0x37, 0xf3, 0xde, 0xf8, 0x65, 0xf6, 0x29, 0x50, 0x0f, 0x70, 0xbc, 0x98, 0xb1, 0x6e, 0x18, 0x09,
+	0x29, 0x48, 0x39, 0x41, 0xee, 0x2f, 0x13, 0xe0, 0x5c, 0x97, 0x67, 0x28, 0x19, 0xe9, 0x81, 0x75,
+	0xb1, 0x0c, 0xd1, 0x36, 0xda, 0x46, 0xa7, 0xd9, 0x73, 0xba, 0xa9, 0x26, 0x67, 0x74, 0xcf, 0x30,
+	0x8e, 0xd9, 0x25, 0x2a, 0x16, 0xd5, 0x5c, 0x72, 0x08, 0x95, 0x37, 0x28, 0x19, 0x9f, 0xc5, 0xb6,
+	0xd9, 0x36, 0x3a, 0xb5, 0xde, 0xfe, 0x5d, 0x59, 0x4a, 0xa0, 0x2b, 0xa6, 0xfb, 0xdb, 0x80, 0xda,
+	0xda, 0x2a, 0xb2, 0x03, 0xd6, 0xb9, 0x08, 0xb0, 0x55, 0x20, 0x0d, 0xa8, 0x0e, 0x44, 0x2c, 0xdf,
+	0x2e, 0x30, 0x5a, 0xb6, 0x0c, 0x42, 0xa0, 0x99, 0x41, 0x8a, 0xe1, 0x6c, 0xd9, 0x32, 0xc9, 0x13,
+	0xd8, 0x53, 0xbd, 0x77, 0xe1, 0x84, 0x49, 0x3c, 0x17, 0x92, 0x7f, 0xe6, 0x1e, 0x93, 0x5c, 0x04,
+	0xad, 0x22, 0xd9, 0x87, 0xc7, 0x6a, 0x76, 0x26, 0xbe, 0xe2, 0x64, 0x63, 0x64, 0xad, 0x46, 0xa3,
+	0x45, 0xe0, 0xf9, 0x1b, 0xa3, 0x12, 0x69, 0x02, 0xa8, 0xd1, 0x07, 0x5f, 0xb0, 0x39, 0x6f, 0x95,
+	0xc9, 0x43, 0xd8, 0xcd, 0x71, 0xf2, 0xd9, 0x8a, 0x72, 0x36, 0x62, 0xd2, 0xef, 0xfb, 0xe8, 0x4d,
+	0x5b, 0x3b, 0xca, 0x59, 0x06, 0x13, 0x4a, 0xd5, 0xfd, 0x61, 0xc0, 0x83, 0x3b, 0xbf, 0x9a, 0x3c,
+	0x82, 0xd2, 0xfb, 0x30, 0x18, 0x86, 0xfa, 0xac, 0x0d, 0x9a, 0x00, 0x72, 0x04, 0xb5, 0x61, 0x78,
+	0xf4, 0x2a, 0x98, 0x8c, 0x44, 0x24, 0xd5, 0xed, 0x8a, 0x9d, 0x5a, 0x8f, 0xac, 0x6e, 0x97, 0x8f,
+	0xe8, 0x3a, 0x2d, 0x51, 0x1d, 0x67, 0x2a, 0x6b, 0x5b, 0x75, 0xbc, 0xa6, 0xca, 0x68, 0xc4, 0x86,
+	0x8a, 0x27, 0x16, 0x81, 0xc4, 0xc8, 0x2e, 0x6a, 0x0f, 0x2b, 0xe8, 0x3e, 0x07, 0xc8, 0xd7, 0x93,
+	0x26, 0x98, 0x99, 0x4d, 0x73, 0x18, 0x12, 0x02, 0x96, 0xea, 0xeb, 0x87, 0x6d, 0x50, 0x5d, 0xbb,
+	0x2f, 0x01, 0xf2, 0xd5, 0x4a, 0x31, 0xe0, 0x5a, 0x61, 0x51, 0x73, 0xc0, 0x15, 0x3e, 0x15, 0x9a,
+	0x6f, 0x51, 0xf3, 0x54, 0x64, 0x1b, 0x8a, 0x6b, 0x1b, 0xae, 0x56, 0x99, 0x1b, 0xf1, 0xe0, 0xf2,
+	0xff, 0x99, 0x53, 0x8c, 0x7b, 0x32, 0x47, 0xc0, 0xba, 0xe0, 0x73, 0x4c, 0xbf, 0xa3, 0x6b, 0xd7,
+	0xbd, 0x93, 0x28, 0x25, 0x6e, 0x15, 0x48, 0x15, 0x4a, 0xc9, 0xfb, 0x18, 0xee, 0x27, 0xd8, 0x4d,
+	0xf6, 0x0e, 0x58, 0x30, 0x89, 0x7d, 0x36, 0x45, 0xf2, 0x22, 0x8f, 0xaf, 0xa1, 0xe3, 0xbb, 0xe5,
+	0x20, 0x63, 0x6e, 0x67, 0x58, 0x99, 0x18, 0xcc, 0x99, 0xa7, 0x4d, 0xd4, 0xa9, 0xae, 0xdd, 0xef,
+	0x26, 0xec, 0xdd, 0xaf, 0x53, 0xf4, 0x3e, 0x46, 0x52, 0x7f, 0xa5, 0x4e, 0x75, 0x4d, 0x9e, 0x41,
+	0x73, 0x18, 0x70, 0xc9, 0x99, 0x14, 0xd1, 0x30, 0x98, 0xe0, 0x55, 0x7a, 0xe9, 0xad, 0xae, 0xe2,
+	0x51, 0x8c, 0x43, 0x11, 0x4c, 0x30, 0xe5, 0x25, 0xf7, 0xdc, 0xea, 0x92, 0x3d, 0x28, 0xf7, 0x85,
+	0x98, 0x72, 0xb4, 0x2d, 0x7d, 0x99, 0x14, 0x65, 0xf7, 0x2a, 0xe5, 0xf7, 0x22, 0x2e, 0xd4, 0x4f,
+	0x70, 0x3e, 0x5a, 0x8c, 0x67, 0xdc, 0x3b, 0xc1, 0xa5, 0x5d, 0xd6, 0xbe, 0x36, 0x7a, 0xe4, 0x29,
+	0x34, 0x4e, 0x70, 0xde, 0xe7, 0xa1, 0x8f, 0x91, 0xc4, 0x2b, 0x69, 0x57, 0x34, 0x69, 0xb3, 0xa9,
+	0xd2, 0x95, 0xa0, 0xd8, 0xde, 0x69, 0x17, 0x3b, 0x55, 0xba, 0x82, 0xda, 0x8f, 0x2e, 0xed, 0x6a,
+	0xdb, 0xe8, 0x54, 0x69, 0x8a, 0x5e, 0x1f, 0xfe, 0xbc, 0x71, 0x8c, 0xeb, 0x1b, 0xc7, 0xf8, 0x7b,
+	0xe3, 0x18, 0xdf, 0x6e, 0x9d, 0xc2, 0xf5, 0xad, 0x53, 0xf8, 0x73, 0xeb, 0x14, 0x3e, 0xee, 0x5f,
+	0x72, 0xe9, 0x2f, 0xc6, 0x5d, 0x4f, 0xcc, 0x0f, 0xe2, 0x19, 0xf3, 0xa6, 0xfe, 0x97, 0x83, 0xe4,
+	0x3d, 0xc6, 0x65, 0xfd, 0xd7, 0x75, 0xf8, 0x6f, 0x00, 0x17, 0xc0, 0xb3, 0xe1, 0xca, 0x04, 0x00,
+	0x00,
 }
 
 func (m *NebulaMeta) Marshal() (dAtA []byte, err error) {
@@ -829,6 +865,36 @@ func (m *NebulaHandshakeDetails) MarshalToSizedBuffer(dAtA []byte) (int, error)
 	_ = i
 	var l int
 	_ = l
+	if len(m.Cipher) > 0 {
+		i -= len(m.Cipher)
+		copy(dAtA[i:], m.Cipher)
+		i = encodeVarintNebula(dAtA, i, uint64(len(m.Cipher)))
+		i--
+		dAtA[i] = 0x4a
+	}
+	if len(m.Ciphers) > 0 {
+		for iNdEx := len(m.Ciphers) - 1; iNdEx >= 0; iNdEx-- {
+			i -= len(m.Ciphers[iNdEx])
+			copy(dAtA[i:], m.Ciphers[iNdEx])
+			i = encodeVarintNebula(dAtA, i, uint64(len(m.Ciphers[iNdEx])))
+			i--
+			dAtA[i] = 0x42
+		}
+	}
+	if len(m.KemCiphertext) > 0 {
+		i -= len(m.KemCiphertext)
+		copy(dAtA[i:], m.KemCiphertext)
+		i = encodeVarintNebula(dAtA, i, uint64(len(m.KemCiphertext)))
+		i--
+		dAtA[i] = 0x3a
+	}
+	if len(m.KemPublicKey) > 0 {
+		i -= len(m.KemPublicKey)
+		copy(dAtA[i:], m.KemPublicKey)
+		i = encodeVarintNebula(dAtA, i, uint64(len(m.KemPublicKey)))
+		i--
+		dAtA[i] = 0x32
+	}
 	if m.Time != 0 {
 		i = encodeVarintNebula(dAtA, i, uint64(m.Time))
 		i--
@@ -1000,6 +1066,24 @@ func (m *NebulaHandshakeDetails) Size() (n int) {
 	if m.Time != 0 {
 		n += 1 + sovNebula(uint64(m.Time))
 	}
+	l = len(m.KemPublicKey)
+	if l > 0 {
+		n += 1 + l + sovNebula(uint64(l))
+	}
+	l = len(m.KemCiphertext)
+	if l > 0 {
+		n += 1 + l + sovNebula(uint64(l))
+	}
+	if len(m.Ciphers) > 0 {
+		for _, s := range m.Ciphers {
+			l = len(s)
+			n += 1 + l + sovNebula(uint64(l))
+		}
+	}
+	l = len(m.Cipher)
+	if l > 0 {
+		n += 1 + l + sovNebula(uint64(l))
+	}
 	return n
 }
 
@@ -1812,6 +1896,138 @@ func (m *NebulaHandshakeDetails) Unmarshal(dAtA []byte) error {
 					break
 				}
 			}
+		case 6:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field KemPublicKey", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				byteLen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if byteLen < 0 {
+				return ErrInvalidLengthNebula
+			}
+			postIndex := iNdEx + byteLen
+			if postIndex < 0 {
+				return ErrInvalidLengthNebula
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.KemPublicKey = append(m.KemPublicKey[:0], dAtA[iNdEx:postIndex]...)
+			if m.KemPublicKey == nil {
+				m.KemPublicKey = []byte{}
+			}
+			iNdEx = postIndex
+		case 7:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field KemCiphertext", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				byteLen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if byteLen < 0 {
+				return ErrInvalidLengthNebula
+			}
+			postIndex := iNdEx + byteLen
+			if postIndex < 0 {
+				return ErrInvalidLengthNebula
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.KemCiphertext = append(m.KemCiphertext[:0], dAtA[iNdEx:postIndex]...)
+			if m.KemCiphertext == nil {
+				m.KemCiphertext = []byte{}
+			}
+			iNdEx = postIndex
+		case 8:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Ciphers", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthNebula
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex < 0 {
+				return ErrInvalidLengthNebula
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Ciphers = append(m.Ciphers, string(dAtA[iNdEx:postIndex]))
+			iNdEx = postIndex
+		case 9:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Cipher", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthNebula
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex < 0 {
+				return ErrInvalidLengthNebula
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Cipher = string(dAtA[iNdEx:postIndex])
+			iNdEx = postIndex
 		default:
 			iNdEx = preIndex
 			skippy, err := skipNebula(dAtA[iNdEx:])
@@ -12,17 +12,25 @@ type endianness interface {
 	PutUint64(b []byte, v uint64)
 }
 
-var noiseEndianness endianness = binary.BigEndian
-
 type NebulaCipherState struct {
 	c noise.Cipher
+	// endianness of the counter in the nonce, it matches what noise does for the cipher
+	endianness endianness
 	//k [32]byte
 	//n uint64
 }
 
-func NewNebulaCipherState(s *noise.CipherState) *NebulaCipherState {
-	return &NebulaCipherState{c: s.Cipher()}
+func NewNebulaCipherState(s *noise.CipherState, cipher string) *NebulaCipherState {
+	return &NebulaCipherState{c: s.Cipher(), endianness: cipherEndianness(cipher)}
+
+}
 
+// cipherEndianness returns the byte order noise uses for the nonce of a cipher
+func cipherEndianness(cipher string) endianness {
+	if cipher == "chachapoly" {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
 }
 
 func (s *NebulaCipherState) EncryptDanger(out, ad, plaintext []byte, n uint64, nb []byte) ([]byte, error) {
@@ -37,7 +45,7 @@ func (s *NebulaCipherState) EncryptDanger(out, ad, plaintext []byte, n uint64, n
 		nb[1] = 0
 		nb[2] = 0
 		nb[3] = 0
-		noiseEndianness.PutUint64(nb[4:], n)
+		s.endianness.PutUint64(nb[4:], n)
 		out = s.c.(cipher.AEAD).Seal(out, nb, plaintext, ad)
 		//l.Debugf("Encryption: outlen: %d, nonce: %d, ad: %s, plainlen %d", len(out), n, ad, len(plaintext))
 		return out, nil
@@ -52,7 +60,7 @@ func (s *NebulaCipherState) DecryptDanger(out, ad, ciphertext []byte, n uint64,
 		nb[1] = 0
 		nb[2] = 0
 		nb[3] = 0
-		noiseEndianness.PutUint64(nb[4:], n)
+		s.endianness.PutUint64(nb[4:], n)
 		return s.c.(cipher.AEAD).Open(out, nb, ciphertext, ad)
 	} else {
 		return []byte{}, nil
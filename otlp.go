@@ -0,0 +1,377 @@
+package nebula
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// The OTLP services, http posts to the paths and grpc calls the methods
+const (
+	otlpMetricsPath   = "/v1/metrics"
+	otlpTracesPath    = "/v1/traces"
+	otlpMetricsMethod = "/opentelemetry.proto.collector.metrics.v1.MetricsService/Export"
+	otlpTracesMethod  = "/opentelemetry.proto.collector.trace.v1.TraceService/Export"
+	otlpScopeName     = "github.com/slackhq/nebula"
+)
+
+// otlpPercentiles are sent as the quantiles of histograms and timers
+var otlpPercentiles = []float64{0.5, 0.75, 0.95, 0.99, 0.999}
+
+// otlpExporter pushes the go-metrics registry, and handshake spans if tracing is enabled, to an OTLP collector.
+// Messages are encoded by hand to avoid pulling in the OpenTelemetry sdk and grpc.
+type otlpExporter struct {
+	l        *logrus.Logger
+	registry metrics.Registry
+	traces   *traceBuffer
+	client   *http.Client
+
+	grpc       bool
+	metricsURL string
+	tracesURL  string
+	headers    map[string]string
+
+	prefix  string
+	version string
+	started time.Time
+}
+
+func startOTLPStats(l *logrus.Logger, i time.Duration, c *Config, buildVersion string, configTest bool, traces *traceBuffer) error {
+	e, err := newOTLPExporterFromConfig(l, i, c, buildVersion, traces)
+	if err != nil {
+		return err
+	}
+
+	l.WithField("endpoint", c.GetString("stats.endpoint", "")).WithField("interval", i).
+		WithField("traces", traces != nil).Info("Starting otlp stats")
+	if !configTest {
+		go e.run(i)
+	}
+	return nil
+}
+
+func newOTLPExporterFromConfig(l *logrus.Logger, i time.Duration, c *Config, buildVersion string, traces *traceBuffer) (*otlpExporter, error) {
+	endpoint := c.GetString("stats.endpoint", "")
+	if endpoint == "" {
+		return nil, errors.New("stats.endpoint can not be empty")
+	}
+
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("stats.endpoint must be an http or https url: %s", endpoint)
+	}
+
+	e := &otlpExporter{
+		l:        l,
+		registry: metrics.DefaultRegistry,
+		traces:   traces,
+		headers:  make(map[string]string),
+		prefix:   c.GetString("stats.prefix", "nebula"),
+		version:  buildVersion,
+		started:  time.Now(),
+	}
+
+	for k, v := range c.GetMap("stats.headers", map[interface{}]interface{}{}) {
+		e.headers[fmt.Sprintf("%v", k)] = fmt.Sprintf("%v", v)
+	}
+
+	base := strings.TrimSuffix(u.String(), "/")
+	switch protocol := c.GetString("stats.protocol", "http"); protocol {
+	case "http":
+		e.client = &http.Client{Timeout: i}
+		e.metricsURL = base + otlpMetricsPath
+		e.tracesURL = base + otlpTracesPath
+
+	case "grpc":
+		var rt http.RoundTripper
+		if u.Scheme == "https" {
+			rt = &http.Transport{ForceAttemptHTTP2: true}
+		} else {
+			rt, err = newH2CTransport()
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		e.grpc = true
+		e.client = &http.Client{Timeout: i, Transport: rt}
+		e.metricsURL = u.Scheme + "://" + u.Host + otlpMetricsMethod
+		e.tracesURL = u.Scheme + "://" + u.Host + otlpTracesMethod
+
+	default:
+		return nil, fmt.Errorf("stats.protocol must be http or grpc for otlp: %s", protocol)
+	}
+
+	return e, nil
+}
+
+func (e *otlpExporter) run(i time.Duration) {
+	for range time.Tick(i) {
+		e.flush(time.Now())
+	}
+}
+
+// flush sends the current value of every metric and any finished spans
+func (e *otlpExporter) flush(now time.Time) {
+	err := e.send(e.metricsURL, e.metricsRequest(now))
+	if err != nil {
+		e.l.WithError(err).Warn("Failed to send otlp metrics")
+	}
+
+	spans := e.traces.drain()
+	if len(spans) == 0 {
+		return
+	}
+
+	err = e.send(e.tracesURL, e.tracesRequest(spans))
+	if err != nil {
+		e.l.WithError(err).WithField("spans", len(spans)).Warn("Failed to send otlp traces")
+	}
+}
+
+func (e *otlpExporter) send(u string, msg []byte) error {
+	body := msg
+	contentType := "application/x-protobuf"
+	if e.grpc {
+		// A grpc message is prefixed with an uncompressed flag and its length
+		body = make([]byte, 5, 5+len(msg))
+		binary.BigEndian.PutUint32(body[1:], uint32(len(msg)))
+		body = append(body, msg...)
+		contentType = "application/grpc"
+	}
+
+	req, err := http.NewRequest(http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", contentType)
+	if e.grpc {
+		req.Header.Set("TE", "trailers")
+	}
+	for k, v := range e.headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// The body has to be read for the grpc status to show up in the trailers
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s returned %s", u, resp.Status)
+	}
+
+	if e.grpc {
+		// A response without a message has the status in the headers instead of the trailers
+		status, message := resp.Trailer.Get("Grpc-Status"), resp.Trailer.Get("Grpc-Message")
+		if status == "" {
+			status, message = resp.Header.Get("Grpc-Status"), resp.Header.Get("Grpc-Message")
+		}
+		if status != "0" {
+			return fmt.Errorf("%s returned grpc status %s: %s", u, status, message)
+		}
+	}
+
+	return nil
+}
+
+// metricsRequest encodes every metric in the registry as an ExportMetricsServiceRequest
+func (e *otlpExporter) metricsRequest(now time.Time) []byte {
+	all := make(map[string]interface{})
+	e.registry.Each(func(name string, i interface{}) {
+		all[name] = i
+	})
+
+	names := make([]string, 0, len(all))
+	for name := range all {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	start, ts := uint64(e.started.UnixNano()), uint64(now.UnixNano())
+	var scope []byte
+	scope = pbMessage(scope, 1, e.scope())
+	for _, name := range names {
+		var m []byte
+		m = pbString(m, 1, e.prefix+"."+name)
+
+		switch v := all[name].(type) {
+		case metrics.Counter:
+			m = pbMessage(m, 7, otlpSum(start, ts, v.Count()))
+		case metrics.Gauge:
+			m = pbMessage(m, 5, pbMessage(nil, 1, otlpIntPoint(start, ts, v.Value())))
+		case metrics.GaugeFloat64:
+			m = pbMessage(m, 5, pbMessage(nil, 1, otlpDoublePoint(start, ts, v.Value())))
+		case metrics.Meter:
+			m = pbMessage(m, 7, otlpSum(start, ts, v.Snapshot().Count()))
+		case metrics.Histogram:
+			s := v.Snapshot()
+			m = pbMessage(m, 11, otlpSummary(start, ts, s.Count(), float64(s.Sum()), s.Percentiles(otlpPercentiles)))
+		case metrics.Timer:
+			s := v.Snapshot()
+			m = pbString(m, 3, "ns")
+			m = pbMessage(m, 11, otlpSummary(start, ts, s.Count(), float64(s.Sum()), s.Percentiles(otlpPercentiles)))
+		default:
+			continue
+		}
+
+		scope = pbMessage(scope, 2, m)
+	}
+
+	var rm []byte
+	rm = pbMessage(rm, 1, e.resource())
+	rm = pbMessage(rm, 2, scope)
+	return pbMessage(nil, 1, rm)
+}
+
+// tracesRequest encodes spans as an ExportTraceServiceRequest
+func (e *otlpExporter) tracesRequest(spans []*traceSpan) []byte {
+	var scope []byte
+	scope = pbMessage(scope, 1, e.scope())
+	for _, s := range spans {
+		var b []byte
+		b = pbBytes(b, 1, s.traceID[:])
+		b = pbBytes(b, 2, s.spanID[:])
+		if s.parentID != nil {
+			b = pbBytes(b, 4, s.parentID)
+		}
+		b = pbString(b, 5, s.name)
+		// SPAN_KIND_INTERNAL
+		b = pbVarint(b, 6, 1)
+		b = pbFixed64(b, 7, uint64(s.start.UnixNano()))
+		b = pbFixed64(b, 8, uint64(s.end.UnixNano()))
+		for _, a := range s.attrs {
+			b = pbMessage(b, 9, a)
+		}
+
+		var status []byte
+		if s.err != "" {
+			status = pbString(status, 2, s.err)
+			// STATUS_CODE_ERROR
+			status = pbVarint(status, 3, 2)
+		} else {
+			// STATUS_CODE_OK
+			status = pbVarint(status, 3, 1)
+		}
+		b = pbMessage(b, 15, status)
+
+		scope = pbMessage(scope, 2, b)
+	}
+
+	var rs []byte
+	rs = pbMessage(rs, 1, e.resource())
+	rs = pbMessage(rs, 2, scope)
+	return pbMessage(nil, 1, rs)
+}
+
+func (e *otlpExporter) resource() []byte {
+	var b []byte
+	b = pbMessage(b, 1, pbAttr("service.name", "nebula"))
+	return pbMessage(b, 1, pbAttr("service.version", e.version))
+}
+
+func (e *otlpExporter) scope() []byte {
+	var b []byte
+	b = pbString(b, 1, otlpScopeName)
+	return pbString(b, 2, e.version)
+}
+
+// otlpSum is a cumulative, monotonic Sum
+func otlpSum(start, ts uint64, v int64) []byte {
+	var b []byte
+	b = pbMessage(b, 1, otlpIntPoint(start, ts, v))
+	// AGGREGATION_TEMPORALITY_CUMULATIVE
+	b = pbVarint(b, 2, 2)
+	return pbVarint(b, 3, 1)
+}
+
+func otlpIntPoint(start, ts uint64, v int64) []byte {
+	var b []byte
+	b = pbFixed64(b, 2, start)
+	b = pbFixed64(b, 3, ts)
+	// as_int is an sfixed64
+	return pbFixed64(b, 6, uint64(v))
+}
+
+func otlpDoublePoint(start, ts uint64, v float64) []byte {
+	var b []byte
+	b = pbFixed64(b, 2, start)
+	b = pbFixed64(b, 3, ts)
+	return pbFixed64(b, 4, math.Float64bits(v))
+}
+
+func otlpSummary(start, ts uint64, count int64, sum float64, quantiles []float64) []byte {
+	var p []byte
+	p = pbFixed64(p, 2, start)
+	p = pbFixed64(p, 3, ts)
+	p = pbFixed64(p, 4, uint64(count))
+	p = pbFixed64(p, 5, math.Float64bits(sum))
+	for i, q := range otlpPercentiles {
+		var vq []byte
+		vq = pbFixed64(vq, 1, math.Float64bits(q))
+		vq = pbFixed64(vq, 2, math.Float64bits(quantiles[i]))
+		p = pbMessage(p, 6, vq)
+	}
+
+	return pbMessage(nil, 1, p)
+}
+
+// pbAttr encodes a KeyValue, v must be a string, bool, int64 or float64
+func pbAttr(k string, v interface{}) []byte {
+	var value []byte
+	switch v := v.(type) {
+	case string:
+		value = pbString(value, 1, v)
+	case bool:
+		value = pbVarint(value, 2, protowire.EncodeBool(v))
+	case int64:
+		value = pbVarint(value, 3, uint64(v))
+	case float64:
+		value = pbFixed64(value, 4, math.Float64bits(v))
+	}
+
+	var b []byte
+	b = pbString(b, 1, k)
+	return pbMessage(b, 2, value)
+}
+
+func pbMessage(b []byte, num protowire.Number, m []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, m)
+}
+
+func pbBytes(b []byte, num protowire.Number, v []byte) []byte {
+	return pbMessage(b, num, v)
+}
+
+func pbString(b []byte, num protowire.Number, s string) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+func pbVarint(b []byte, num protowire.Number, v uint64) []byte {
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+func pbFixed64(b []byte, num protowire.Number, v uint64) []byte {
+	b = protowire.AppendTag(b, num, protowire.Fixed64Type)
+	return protowire.AppendFixed64(b, v)
+}
@@ -0,0 +1,12 @@
+// +build go1.24
+
+package nebula
+
+import "net/http"
+
+// newH2CTransport speaks http/2 without tls, which grpc collectors expect on plain http endpoints
+func newH2CTransport() (http.RoundTripper, error) {
+	var p http.Protocols
+	p.SetUnencryptedHTTP2(true)
+	return &http.Transport{Protocols: &p}, nil
+}
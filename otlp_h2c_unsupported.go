@@ -0,0 +1,13 @@
+// +build !go1.24
+
+package nebula
+
+import (
+	"errors"
+	"net/http"
+)
+
+// newH2CTransport is not possible before go 1.24 without pulling in golang.org/x/net/http2
+func newH2CTransport() (http.RoundTripper, error) {
+	return nil, errors.New("stats.protocol grpc needs an https stats.endpoint unless nebula is built with go 1.24 or newer")
+}
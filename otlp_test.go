@@ -0,0 +1,319 @@
+package nebula
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// pbField is one decoded protobuf field, v holds varint and fixed64 values and b holds bytes
+type pbField struct {
+	num protowire.Number
+	v   uint64
+	b   []byte
+}
+
+// pbDecode splits a message into its fields
+func pbDecode(t *testing.T, b []byte) []pbField {
+	var fields []pbField
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		assert.True(t, n > 0)
+		b = b[n:]
+
+		f := pbField{num: num}
+		switch typ {
+		case protowire.VarintType:
+			f.v, n = protowire.ConsumeVarint(b)
+		case protowire.Fixed64Type:
+			f.v, n = protowire.ConsumeFixed64(b)
+		case protowire.BytesType:
+			f.b, n = protowire.ConsumeBytes(b)
+		default:
+			t.Fatalf("unexpected wire type %v", typ)
+		}
+		assert.True(t, n > 0)
+		b = b[n:]
+		fields = append(fields, f)
+	}
+	return fields
+}
+
+// pbGet returns every field numbered num
+func pbGet(t *testing.T, b []byte, num protowire.Number) []pbField {
+	var fields []pbField
+	for _, f := range pbDecode(t, b) {
+		if f.num == num {
+			fields = append(fields, f)
+		}
+	}
+	return fields
+}
+
+// pbPath follows the first field of each number in path and returns the last one
+func pbPath(t *testing.T, b []byte, path ...protowire.Number) pbField {
+	var f pbField
+	for _, num := range path {
+		fields := pbGet(t, b, num)
+		if !assert.NotEmpty(t, fields, "field %v of %v", num, path) {
+			t.FailNow()
+		}
+		f = fields[0]
+		b = f.b
+	}
+	return f
+}
+
+// pbAttrs decodes the KeyValues numbered num into strings, ints and bools as a map
+func pbAttrs(t *testing.T, b []byte, num protowire.Number) map[string]interface{} {
+	attrs := make(map[string]interface{})
+	for _, kv := range pbGet(t, b, num) {
+		k := string(pbPath(t, kv.b, 1).b)
+		value := pbDecode(t, pbPath(t, kv.b, 2).b)[0]
+		switch value.num {
+		case 1:
+			attrs[k] = string(value.b)
+		case 2:
+			attrs[k] = value.v == 1
+		case 3:
+			attrs[k] = int64(value.v)
+		}
+	}
+	return attrs
+}
+
+// otlpCollector is a stand in for an OpenTelemetry collector that keeps every request it receives
+type otlpCollector struct {
+	grpc     bool
+	status   string
+	requests chan *otlpRequest
+}
+
+type otlpRequest struct {
+	path        string
+	contentType string
+	header      http.Header
+	body        []byte
+}
+
+func newOTLPCollector(grpc bool) *otlpCollector {
+	return &otlpCollector{grpc: grpc, status: "0", requests: make(chan *otlpRequest, 10)}
+}
+
+func (c *otlpCollector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b, _ := ioutil.ReadAll(r.Body)
+	req := &otlpRequest{path: r.URL.Path, contentType: r.Header.Get("Content-Type"), header: r.Header, body: b}
+
+	if !c.grpc {
+		c.requests <- req
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		return
+	}
+
+	// Unwrap the grpc frame and reply with an empty message and the status in the trailers
+	if len(b) < 5 || b[0] != 0 || int(binary.BigEndian.Uint32(b[1:5])) != len(b)-5 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	req.body = b[5:]
+	c.requests <- req
+
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+	_, _ = w.Write(make([]byte, 5))
+	w.Header().Set("Grpc-Status", c.status)
+	if c.status != "0" {
+		w.Header().Set("Grpc-Message", "collector said no")
+	}
+}
+
+func (c *otlpCollector) next(t *testing.T) *otlpRequest {
+	select {
+	case r := <-c.requests:
+		return r
+	case <-time.After(5 * time.Second):
+		t.Fatal("the collector did not receive a request")
+		return nil
+	}
+}
+
+func testOTLPExporter(t *testing.T, endpoint, protocol string, traces *traceBuffer) *otlpExporter {
+	c := NewConfig(NewTestLogger())
+	c.Settings["stats"] = map[interface{}]interface{}{
+		"type":     "otlp",
+		"endpoint": endpoint,
+		"protocol": protocol,
+		"headers":  map[interface{}]interface{}{"x-api-key": "secret"},
+	}
+
+	e, err := newOTLPExporterFromConfig(NewTestLogger(), time.Second, c, "1.2.3", traces)
+	assert.Nil(t, err)
+
+	r := metrics.NewRegistry()
+	metrics.NewRegisteredCounter("handshakes", r).Inc(3)
+	metrics.NewRegisteredGauge("hosts", r).Update(7)
+	metrics.NewRegisteredGaugeFloat64("ratio", r).Update(0.5)
+	h := metrics.NewRegisteredHistogram("latency", r, metrics.NewUniformSample(10))
+	h.Update(10)
+	h.Update(20)
+	e.registry = r
+
+	return e
+}
+
+func TestNewOTLPExporterFromConfig(t *testing.T) {
+	l := NewTestLogger()
+	newExporter := func(stats map[interface{}]interface{}) error {
+		c := NewConfig(l)
+		c.Settings["stats"] = stats
+		_, err := newOTLPExporterFromConfig(l, time.Second, c, "", nil)
+		return err
+	}
+
+	assert.EqualError(t, newExporter(map[interface{}]interface{}{}), "stats.endpoint can not be empty")
+	assert.EqualError(t, newExporter(map[interface{}]interface{}{"endpoint": "127.0.0.1:4317"}),
+		"stats.endpoint must be an http or https url: 127.0.0.1:4317")
+	assert.EqualError(t, newExporter(map[interface{}]interface{}{"endpoint": "http://127.0.0.1:4318", "protocol": "udp"}),
+		"stats.protocol must be http or grpc for otlp: udp")
+	assert.Nil(t, newExporter(map[interface{}]interface{}{"endpoint": "https://127.0.0.1:4317", "protocol": "grpc"}))
+
+	c := NewConfig(l)
+	c.Settings["stats"] = map[interface{}]interface{}{"endpoint": "http://127.0.0.1:4318/otlp/"}
+	e, err := newOTLPExporterFromConfig(l, time.Second, c, "", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "http://127.0.0.1:4318/otlp/v1/metrics", e.metricsURL)
+	assert.Equal(t, "http://127.0.0.1:4318/otlp/v1/traces", e.tracesURL)
+	assert.Equal(t, "nebula", e.prefix)
+}
+
+func TestOTLPExporter_http(t *testing.T) {
+	collector := newOTLPCollector(false)
+	ts := httptest.NewServer(collector)
+	defer ts.Close()
+
+	traces := &traceBuffer{}
+	e := testOTLPExporter(t, ts.URL, "http", traces)
+
+	// No spans means no trace request
+	now := time.Now()
+	e.flush(now)
+	r := collector.next(t)
+	assert.Equal(t, otlpMetricsPath, r.path)
+	assert.Equal(t, "application/x-protobuf", r.contentType)
+	assert.Equal(t, "secret", r.header.Get("X-Api-Key"))
+	assert.Len(t, collector.requests, 0)
+
+	rm := pbPath(t, r.body, 1)
+	resource := pbPath(t, rm.b, 1)
+	assert.Equal(t, map[string]interface{}{"service.name": "nebula", "service.version": "1.2.3"}, pbAttrs(t, resource.b, 1))
+
+	scope := pbPath(t, rm.b, 2)
+	assert.Equal(t, otlpScopeName, string(pbPath(t, scope.b, 1, 1).b))
+
+	got := make(map[string][]byte)
+	for _, m := range pbGet(t, scope.b, 2) {
+		got[string(pbPath(t, m.b, 1).b)] = m.b
+	}
+	assert.Len(t, got, 4)
+
+	// Counters are cumulative monotonic sums
+	sum := pbPath(t, got["nebula.handshakes"], 7)
+	assert.Equal(t, uint64(2), pbPath(t, sum.b, 2).v)
+	assert.Equal(t, uint64(1), pbPath(t, sum.b, 3).v)
+	assert.Equal(t, uint64(3), pbPath(t, sum.b, 1, 6).v)
+	assert.Equal(t, uint64(e.started.UnixNano()), pbPath(t, sum.b, 1, 2).v)
+	assert.Equal(t, uint64(now.UnixNano()), pbPath(t, sum.b, 1, 3).v)
+
+	assert.Equal(t, uint64(7), pbPath(t, got["nebula.hosts"], 5, 1, 6).v)
+	assert.Equal(t, 0.5, math.Float64frombits(pbPath(t, got["nebula.ratio"], 5, 1, 4).v))
+
+	summary := pbPath(t, got["nebula.latency"], 11, 1)
+	assert.Equal(t, uint64(2), pbPath(t, summary.b, 4).v)
+	assert.Equal(t, float64(30), math.Float64frombits(pbPath(t, summary.b, 5).v))
+	quantiles := pbGet(t, summary.b, 6)
+	assert.Len(t, quantiles, len(otlpPercentiles))
+	assert.Equal(t, 0.5, math.Float64frombits(pbPath(t, quantiles[0].b, 1).v))
+	assert.Equal(t, float64(15), math.Float64frombits(pbPath(t, quantiles[0].b, 2).v))
+
+	// A handshake that went through the lighthouse is a root span with a lighthouse child
+	tracer := newHandshakeTracer("", traces)
+	vpnIp := ip2int(net.ParseIP("10.1.0.2"))
+	tracer.start(vpnIp)
+	tracer.lighthouseQuery(vpnIp)
+	tracer.lighthouseReply(vpnIp)
+	tracer.finish(&HostInfo{hostId: vpnIp, HandshakeCounter: 2, remote: NewUDPAddrFromString("1.1.1.1:4242")}, "")
+
+	e.flush(time.Now())
+	assert.Equal(t, otlpMetricsPath, collector.next(t).path)
+	r = collector.next(t)
+	assert.Equal(t, otlpTracesPath, r.path)
+	assert.Len(t, traces.drain(), 0, "the exporter drains the spans it sends")
+
+	spans := pbGet(t, pbPath(t, r.body, 1, 2).b, 2)
+	assert.Len(t, spans, 2)
+	lh, root := spans[0].b, spans[1].b
+	assert.Equal(t, "nebula.lighthouse.query", string(pbPath(t, lh, 5).b))
+	assert.Equal(t, "nebula.handshake", string(pbPath(t, root, 5).b))
+	assert.Equal(t, pbPath(t, root, 1).b, pbPath(t, lh, 1).b, "both spans are in one trace")
+	assert.Equal(t, pbPath(t, root, 2).b, pbPath(t, lh, 4).b, "the lighthouse span is a child of the handshake")
+	assert.Empty(t, pbGet(t, root, 4))
+	assert.Equal(t, uint64(1), pbPath(t, root, 15, 3).v)
+	assert.True(t, pbPath(t, root, 8).v >= pbPath(t, root, 7).v)
+	assert.Equal(t, map[string]interface{}{
+		"nebula.network":            "",
+		"nebula.vpn_ip":             "10.1.0.2",
+		"nebula.handshake.attempts": int64(2),
+		"nebula.lighthouse.queries": int64(1),
+		"nebula.remote":             "1.1.1.1:4242",
+	}, pbAttrs(t, root, 9))
+}
+
+func TestOTLPExporter_grpc(t *testing.T) {
+	collector := newOTLPCollector(true)
+	ts := httptest.NewUnstartedServer(collector)
+	ts.EnableHTTP2 = true
+	ts.StartTLS()
+	defer ts.Close()
+
+	traces := &traceBuffer{}
+	e := testOTLPExporter(t, ts.URL, "grpc", traces)
+	e.client = ts.Client()
+
+	tracer := newHandshakeTracer("ops", traces)
+	vpnIp := ip2int(net.ParseIP("10.1.0.3"))
+	tracer.start(vpnIp)
+	tracer.lighthouseQuery(vpnIp)
+	tracer.finish(&HostInfo{hostId: vpnIp, HandshakeCounter: 10}, "handshake timed out")
+
+	e.flush(time.Now())
+	r := collector.next(t)
+	assert.Equal(t, otlpMetricsMethod, r.path)
+	assert.Equal(t, "application/grpc", r.contentType)
+	assert.Equal(t, "trailers", r.header.Get("Te"))
+	assert.Equal(t, "secret", r.header.Get("X-Api-Key"))
+	assert.Len(t, pbGet(t, pbPath(t, r.body, 1, 2).b, 2), 4)
+
+	r = collector.next(t)
+	assert.Equal(t, otlpTracesMethod, r.path)
+	spans := pbGet(t, pbPath(t, r.body, 1, 2).b, 2)
+	assert.Len(t, spans, 2)
+	for _, s := range spans {
+		assert.Equal(t, uint64(2), pbPath(t, s.b, 15, 3).v)
+		assert.Equal(t, "handshake timed out", string(pbPath(t, s.b, 15, 2).b))
+		assert.Equal(t, "ops", pbAttrs(t, s.b, 9)["nebula.network"])
+	}
+
+	// A grpc error comes back in the trailers of a 200
+	collector.status = "14"
+	err := e.send(e.metricsURL, e.metricsRequest(time.Now()))
+	assert.EqualError(t, err, ts.URL+otlpMetricsMethod+" returned grpc status 14: collector said no")
+}
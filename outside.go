@@ -41,7 +41,7 @@ func (f *Interface) readOutsidePackets(addr *udpAddr, out []byte, packet []byte,
 
 	switch header.Type {
 	case message:
-		if !f.handleEncrypted(ci, addr, header) {
+		if !f.handleEncrypted(ci, hostinfo, addr, header) {
 			return
 		}
 
@@ -51,7 +51,7 @@ func (f *Interface) readOutsidePackets(addr *udpAddr, out []byte, packet []byte,
 
 	case lightHouse:
 		f.messageMetrics.Rx(header.Type, header.Subtype, 1)
-		if !f.handleEncrypted(ci, addr, header) {
+		if !f.handleEncrypted(ci, hostinfo, addr, header) {
 			return
 		}
 
@@ -72,7 +72,7 @@ func (f *Interface) readOutsidePackets(addr *udpAddr, out []byte, packet []byte,
 
 	case test:
 		f.messageMetrics.Rx(header.Type, header.Subtype, 1)
-		if !f.handleEncrypted(ci, addr, header) {
+		if !f.handleEncrypted(ci, hostinfo, addr, header) {
 			return
 		}
 
@@ -87,11 +87,28 @@ func (f *Interface) readOutsidePackets(addr *udpAddr, out []byte, packet []byte,
 			return
 		}
 
-		if header.Subtype == testRequest {
+		if header.Subtype == testRequest && f.multipath != nil && isMultipathProbe(d) {
+			// Path probes are answered over the path they came in on and are never a reason to roam
+			f.send(test, testReply, ci, hostinfo, addr, multipathReply(d), nb, out)
+			f.connectionManager.In(hostinfo.hostId)
+			return
+		} else if header.Subtype == testRequest {
 			// This testRequest might be from TryPromoteBest, so we should roam
 			// to the new IP address before responding
 			f.handleHostRoaming(hostinfo, addr)
-			f.send(test, testReply, ci, hostinfo, hostinfo.remote, d, nb, out)
+			// d was decrypted into out and the reply is encrypted into out, the echoed payload has to be copied first
+			reply := append([]byte(nil), pmtuReply(d)...)
+			f.send(test, testReply, ci, hostinfo, hostinfo.remote, reply, nb, out)
+		} else if header.Subtype == testReply && f.multipath != nil && isMultipathProbe(d) {
+			f.multipath.handleReply(hostinfo, d, time.Now())
+			f.connectionManager.In(hostinfo.hostId)
+			return
+		} else if header.Subtype == testReply {
+			hostinfo.stats.handleTestTimestamp(d, time.Now())
+			f.pings.handleReply(d, time.Now())
+			if f.pmtud != nil {
+				f.pmtud.handleReply(f, hostinfo, d)
+			}
 		}
 
 		// Fallthrough to the bottom to record incoming traffic
@@ -111,14 +128,14 @@ func (f *Interface) readOutsidePackets(addr *udpAddr, out []byte, packet []byte,
 
 	case closeTunnel:
 		f.messageMetrics.Rx(header.Type, header.Subtype, 1)
-		if !f.handleEncrypted(ci, addr, header) {
+		if !f.handleEncrypted(ci, hostinfo, addr, header) {
 			return
 		}
 
 		hostinfo.logger(f.l).WithField("udpAddr", addr).
 			Info("Close tunnel received, tearing down.")
 
-		f.closeTunnel(hostinfo)
+		f.closeTunnel(hostinfo, TunnelDownCloseReceived)
 		return
 
 	default:
@@ -127,17 +144,25 @@ func (f *Interface) readOutsidePackets(addr *udpAddr, out []byte, packet []byte,
 		return
 	}
 
-	f.handleHostRoaming(hostinfo, addr)
+	// Traffic over any of our multipath paths is expected, only an unknown address is a roam
+	if f.multipath == nil || !f.multipath.isPath(hostinfo, addr) {
+		f.handleHostRoaming(hostinfo, addr)
+	}
 
 	f.connectionManager.In(hostinfo.hostId)
 }
 
-func (f *Interface) closeTunnel(hostInfo *HostInfo) {
+// closeTunnel removes the tunnel, reason is one of the TunnelDown constants
+func (f *Interface) closeTunnel(hostInfo *HostInfo, reason string) {
 	//TODO: this would be better as a single function in ConnectionManager that handled locks appropriately
 	f.connectionManager.ClearIP(hostInfo.hostId)
 	f.connectionManager.ClearPendingDeletion(hostInfo.hostId)
 	f.lightHouse.DeleteVpnIP(hostInfo.hostId)
 	f.hostMap.DeleteHostInfo(hostInfo)
+
+	e := newHostEvent(EventTunnelDown, hostInfo)
+	e.Reason = reason
+	f.events.publish(e)
 }
 
 func (f *Interface) handleHostRoaming(hostinfo *HostInfo, addr *udpAddr) {
@@ -163,18 +188,31 @@ func (f *Interface) handleHostRoaming(hostinfo *HostInfo, addr *udpAddr) {
 		if f.lightHouse.amLighthouse {
 			f.lightHouse.AddRemote(hostinfo.hostId, addr, false)
 		}
+
+		e := newHostEvent(EventRoam, hostinfo)
+		e.OldRemote = &remoteCopy
+		f.events.publish(e)
 	}
 
 }
 
-func (f *Interface) handleEncrypted(ci *ConnectionState, addr *udpAddr, header *Header) bool {
+func (f *Interface) handleEncrypted(ci *ConnectionState, hostinfo *HostInfo, addr *udpAddr, header *Header) bool {
 	// If connectionstate exists and the replay protector allows, process packet
 	// Else, send recv errors for 300 seconds after a restart to allow fast reconnection.
-	if ci == nil || !ci.window.Check(f.l, header.MessageCounter) {
+	if ci == nil {
 		f.sendRecvError(addr, header.RemoteIndex)
 		return false
 	}
 
+	if !ci.window.Check(f.l, header.MessageCounter) {
+		hostinfo.stats.replayed()
+		// Copies of mirrored packets arrive all the time with multipath, they are dropped quietly
+		if f.multipath == nil {
+			f.sendRecvError(addr, header.RemoteIndex)
+		}
+		return false
+	}
+
 	return true
 }
 
@@ -244,15 +282,18 @@ func (f *Interface) decrypt(hostinfo *HostInfo, mc uint64, out []byte, packet []
 	var err error
 	out, err = hostinfo.ConnectionState.dKey.DecryptDanger(out, packet[:HeaderLen], packet[HeaderLen:], mc, nb)
 	if err != nil {
+		hostinfo.stats.decryptFailed()
 		return nil, err
 	}
 
 	if !hostinfo.ConnectionState.window.Update(f.l, mc) {
+		hostinfo.stats.replayed()
 		hostinfo.logger(f.l).WithField("header", header).
 			Debugln("dropping out of window packet")
 		return nil, errors.New("out of window packet")
 	}
 
+	hostinfo.stats.rx(len(packet))
 	return out, nil
 }
 
@@ -261,6 +302,7 @@ func (f *Interface) decryptToTun(hostinfo *HostInfo, messageCounter uint64, out
 
 	out, err = hostinfo.ConnectionState.dKey.DecryptDanger(out, packet[:HeaderLen], packet[HeaderLen:], messageCounter, nb)
 	if err != nil {
+		hostinfo.stats.decryptFailed()
 		hostinfo.logger(f.l).WithError(err).Error("Failed to decrypt packet")
 		//TODO: maybe after build 64 is out? 06/14/2018 - NB
 		//f.sendRecvError(hostinfo.remote, header.RemoteIndex)
@@ -275,11 +317,14 @@ func (f *Interface) decryptToTun(hostinfo *HostInfo, messageCounter uint64, out
 	}
 
 	if !hostinfo.ConnectionState.window.Update(f.l, messageCounter) {
+		hostinfo.stats.replayed()
 		hostinfo.logger(f.l).WithField("fwPacket", fwPacket).
 			Debugln("dropping out of window packet")
 		return
 	}
 
+	hostinfo.stats.rx(len(packet))
+
 	dropReason := f.firewall.Drop(out, *fwPacket, true, hostinfo, f.caPool, localCache)
 	if dropReason != nil {
 		if f.l.Level >= logrus.DebugLevel {
@@ -291,6 +336,14 @@ func (f *Interface) decryptToTun(hostinfo *HostInfo, messageCounter uint64, out
 	}
 
 	f.connectionManager.In(hostinfo.hostId)
+	if f.tunBatches != nil && f.tunBatches[q] != nil {
+		err = f.tunBatches[q].add(out)
+		if err != nil {
+			f.l.WithError(err).Error("Failed to write to tun")
+		}
+		return
+	}
+
 	_, err = f.readers[q].Write(out)
 	if err != nil {
 		f.l.WithError(err).Error("Failed to write to tun")
@@ -0,0 +1,288 @@
+package nebula
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// pingPayloadLen is the length of a ping test request, the magic, the ping id and the sequence number
+	pingPayloadLen = 12
+
+	PingStepRoute      = "route"
+	PingStepLighthouse = "lighthouse lookup"
+	PingStepHandshake  = "handshake"
+	PingStepFirewall   = "firewall"
+)
+
+var pingMagic = []byte("PING")
+
+// PingOptions control Control.Ping, zero values get the defaults of the ping command
+type PingOptions struct {
+	// Count is how many probes to send to every remote, default is 4
+	Count int
+	// Interval is the time between probes, default is 1 second
+	Interval time.Duration
+	// Timeout is how long to wait for each reply, default is 1 second
+	Timeout time.Duration
+}
+
+// PingReply is the outcome of a single probe, Lost is true if no reply arrived within the timeout
+type PingReply struct {
+	Seq    int           `json:"seq"`
+	Remote *udpAddr      `json:"remote"`
+	RTT    time.Duration `json:"rtt"`
+	Lost   bool          `json:"lost"`
+}
+
+// PingRemoteStats summarizes every probe sent to a single remote
+type PingRemoteStats struct {
+	Remote      *udpAddr      `json:"remote"`
+	Transmitted int           `json:"transmitted"`
+	Received    int           `json:"received"`
+	Min         time.Duration `json:"min"`
+	Avg         time.Duration `json:"avg"`
+	Max         time.Duration `json:"max"`
+}
+
+// PingError is returned by Control.Ping when no tunnel could be used to reach the host, Step says which step failed
+type PingError struct {
+	Step string
+	Err  error
+}
+
+func (e *PingError) Error() string {
+	return fmt.Sprintf("%s failed: %s", e.Step, e.Err)
+}
+
+// pingTracker matches test replies to outstanding pings, the zero value is ready to use
+type pingTracker struct {
+	sync.Mutex
+	nextId  uint32
+	waiting map[uint32]chan time.Time
+}
+
+// add registers a new outstanding probe and returns its id and the channel its reply time is delivered on
+func (p *pingTracker) add() (uint32, chan time.Time) {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.waiting == nil {
+		p.waiting = make(map[uint32]chan time.Time)
+	}
+
+	p.nextId++
+	c := make(chan time.Time, 1)
+	p.waiting[p.nextId] = c
+	return p.nextId, c
+}
+
+func (p *pingTracker) remove(id uint32) {
+	p.Lock()
+	delete(p.waiting, id)
+	p.Unlock()
+}
+
+// handleReply delivers the arrival time of a ping reply to whoever is waiting for it
+func (p *pingTracker) handleReply(d []byte, now time.Time) {
+	id, _, ok := parsePingPayload(d)
+	if !ok {
+		return
+	}
+
+	p.Lock()
+	c := p.waiting[id]
+	delete(p.waiting, id)
+	p.Unlock()
+
+	if c != nil {
+		c <- now
+	}
+}
+
+func newPingPayload(id uint32, seq int) []byte {
+	p := make([]byte, pingPayloadLen)
+	copy(p, pingMagic)
+	binary.BigEndian.PutUint32(p[4:8], id)
+	binary.BigEndian.PutUint32(p[8:12], uint32(seq))
+	return p
+}
+
+func parsePingPayload(d []byte) (uint32, int, bool) {
+	if len(d) != pingPayloadLen || !bytes.Equal(d[:4], pingMagic) {
+		return 0, 0, false
+	}
+
+	return binary.BigEndian.Uint32(d[4:8]), int(binary.BigEndian.Uint32(d[8:12])), true
+}
+
+// handshakeTimeout is how long an outbound handshake is retried before it is given up on
+func (c *HandshakeManager) handshakeTimeout() time.Duration {
+	// Each retry waits one tryInterval longer than the one before it
+	n := time.Duration(c.config.retries)
+	return c.config.tryInterval * n * (n + 1) / 2
+}
+
+// pingTunnel returns an established tunnel to vpnIp, starting a handshake if needed
+func (f *Interface) pingTunnel(vpnIp uint32) (*HostInfo, error) {
+	hostinfo := f.getOrHandshake(vpnIp)
+	if hostinfo == nil {
+		return nil, &PingError{Step: PingStepRoute, Err: errors.New("vpn ip is not in our network or unsafe routes")}
+	}
+
+	// getOrHandshake may have resolved an unsafe route to the host that serves it
+	vpnIp = hostinfo.hostId
+	deadline := time.Now().Add(f.handshakeManager.handshakeTimeout() + time.Second)
+	hadRemote := false
+	for {
+		if h, err := f.hostMap.QueryVpnIP(vpnIp); err == nil && h.ConnectionState != nil && h.ConnectionState.ready {
+			return h, nil
+		}
+
+		pending, err := f.handshakeManager.pendingHostMap.QueryVpnIP(vpnIp)
+		if err == nil {
+			pending.RLock()
+			hadRemote = hadRemote || pending.remote != nil
+			pending.RUnlock()
+		} else if h, herr := f.hostMap.QueryVpnIP(vpnIp); herr == nil && h.ConnectionState != nil && h.ConnectionState.ready {
+			// The handshake completed since we last looked
+			return h, nil
+		}
+
+		if err != nil || time.Now().After(deadline) {
+			// The handshake manager gave up on the host, say why
+			if !hadRemote {
+				return nil, &PingError{Step: PingStepLighthouse, Err: errors.New("no remote address is known for the vpn ip")}
+			}
+			return nil, &PingError{Step: PingStepHandshake, Err: errors.New("handshake timed out")}
+		}
+
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+// ping sends opts.Count authenticated test messages over every remote of the tunnel to vpnIp. onReply is called with
+// each reply or lost probe as it happens, if it is not nil.
+func (f *Interface) ping(vpnIp uint32, opts PingOptions, onReply func(PingReply)) ([]PingRemoteStats, error) {
+	if opts.Count < 1 {
+		opts.Count = 4
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = time.Second
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = time.Second
+	}
+
+	hostinfo, err := f.pingTunnel(vpnIp)
+	if err != nil {
+		return nil, err
+	}
+
+	// Tun traffic to the host would be dropped by our own firewall before it ever reached the tunnel
+	fp := FirewallPacket{LocalIP: f.myVpnIp, RemoteIP: vpnIp, Protocol: fwProtoICMP}
+	if err := f.firewall.allowNew(fp, false, hostinfo, f.caPool); err != nil {
+		return nil, &PingError{Step: PingStepFirewall, Err: err}
+	}
+
+	remotes := hostinfo.CopyRemotes()
+	if len(remotes) == 0 {
+		hostinfo.RLock()
+		if hostinfo.remote != nil {
+			remotes = append(remotes, hostinfo.remote.Copy())
+		}
+		hostinfo.RUnlock()
+	}
+	if len(remotes) == 0 {
+		return nil, &PingError{Step: PingStepLighthouse, Err: errors.New("no remote address is known for the vpn ip")}
+	}
+
+	stats := make([]PingRemoteStats, len(remotes))
+	totals := make([]time.Duration, len(remotes))
+	for i, r := range remotes {
+		stats[i].Remote = r
+	}
+
+	type probe struct {
+		id   uint32
+		sent time.Time
+		c    chan time.Time
+	}
+
+	nb := make([]byte, 12, 12)
+	out := make([]byte, mtu)
+	for seq := 0; seq < opts.Count; seq++ {
+		start := time.Now()
+		probes := make([]probe, len(remotes))
+		for i, r := range remotes {
+			id, c := f.pings.add()
+			probes[i] = probe{id: id, sent: time.Now(), c: c}
+			f.send(test, testRequest, hostinfo.ConnectionState, hostinfo, r, newPingPayload(id, seq), nb, out)
+			stats[i].Transmitted++
+		}
+
+		// Every probe of this round shares the timeout
+		deadline := time.Now().Add(opts.Timeout)
+		for i, p := range probes {
+			reply := PingReply{Seq: seq, Remote: remotes[i]}
+			at, ok := waitPingReply(p.c, deadline)
+			if ok {
+				reply.RTT = at.Sub(p.sent)
+				s := &stats[i]
+				s.Received++
+				totals[i] += reply.RTT
+				if s.Min == 0 || reply.RTT < s.Min {
+					s.Min = reply.RTT
+				}
+				if reply.RTT > s.Max {
+					s.Max = reply.RTT
+				}
+				s.Avg = totals[i] / time.Duration(s.Received)
+			} else {
+				reply.Lost = true
+				f.pings.remove(p.id)
+			}
+
+			if onReply != nil {
+				onReply(reply)
+			}
+		}
+
+		if seq < opts.Count-1 {
+			time.Sleep(opts.Interval - time.Since(start))
+		}
+	}
+
+	return stats, nil
+}
+
+// waitPingReply returns the arrival time of a reply on c, or false if none arrived before deadline. Replies that
+// already arrived are picked up even if the deadline has passed.
+func waitPingReply(c chan time.Time, deadline time.Time) (time.Time, bool) {
+	select {
+	case at := <-c:
+		return at, true
+	default:
+	}
+
+	t := time.NewTimer(time.Until(deadline))
+	defer t.Stop()
+
+	select {
+	case at := <-c:
+		return at, true
+	case <-t.C:
+		return time.Time{}, false
+	}
+}
+
+// Ping sends authenticated test messages to vpnIp over every known remote of its tunnel and reports the round trip
+// time per remote, without sending any tun traffic. A tunnel is handshaked first if there is none. If the host can not
+// be reached a *PingError says which step failed.
+func (c *Control) Ping(vpnIp uint32, opts PingOptions, onReply func(PingReply)) ([]PingRemoteStats, error) {
+	return c.f.ping(vpnIp, opts, onReply)
+}
@@ -0,0 +1,54 @@
+package nebula
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPingPayload(t *testing.T) {
+	id, seq, ok := parsePingPayload(newPingPayload(7, 3))
+	assert.True(t, ok)
+	assert.Equal(t, uint32(7), id)
+	assert.Equal(t, 3, seq)
+
+	_, _, ok = parsePingPayload([]byte(""))
+	assert.False(t, ok)
+	_, _, ok = parsePingPayload(newPingPayload(7, 3)[:8])
+	assert.False(t, ok)
+	_, _, ok = parsePingPayload(append([]byte("MPTH"), make([]byte, 8)...))
+	assert.False(t, ok)
+}
+
+func TestPingTracker(t *testing.T) {
+	var p pingTracker
+	now := time.Now()
+
+	id1, c1 := p.add()
+	id2, c2 := p.add()
+	assert.NotEqual(t, id1, id2)
+
+	// Replies to probes we are not waiting for are ignored
+	p.handleReply(newPingPayload(id2+1, 0), now)
+	p.handleReply([]byte(""), now)
+
+	p.handleReply(newPingPayload(id2, 0), now)
+	at, ok := waitPingReply(c2, now)
+	assert.True(t, ok)
+	assert.Equal(t, now, at)
+
+	// A duplicate reply is dropped rather than blocking
+	p.handleReply(newPingPayload(id2, 0), now)
+
+	// Nothing arrived for the first probe
+	_, ok = waitPingReply(c1, time.Now().Add(time.Millisecond*10))
+	assert.False(t, ok)
+	p.remove(id1)
+	assert.Empty(t, p.waiting)
+}
+
+func TestHandshakeManager_handshakeTimeout(t *testing.T) {
+	hm := &HandshakeManager{config: HandshakeConfig{tryInterval: time.Millisecond * 100, retries: 20}}
+	assert.Equal(t, time.Millisecond*21000, hm.handshakeTimeout())
+}
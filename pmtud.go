@@ -0,0 +1,392 @@
+package nebula
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// pmtuProbeTries is how many times a probe size is sent before the path is considered too small for it
+	pmtuProbeTries = 3
+
+	// pmtuProbeHeaderLen is the length of the magic and probe id at the start of every probe payload
+	pmtuProbeHeaderLen = 8
+
+	// pmtuMaxProbe is the largest probe that fits in our receive buffers once the nebula header and aead tag are added
+	pmtuMaxProbe = mtu - HeaderLen - 16
+
+	icmpDestinationUnreachable = 3
+	icmpFragmentationNeeded    = 4
+)
+
+var pmtuProbeMagic = []byte("PMTU")
+
+// pathMTUDiscovery probes the underlay path of every established tunnel with padded test messages. Probes are sent
+// with the DF bit set so a probe only arrives if the whole path can carry it unfragmented.
+type pathMTUDiscovery struct {
+	interval time.Duration
+	timeout  time.Duration
+	min      int
+	max      int
+	l        *logrus.Logger
+}
+
+// pmtuState tracks the search for the path mtu of a single tunnel. All sizes are inner packet sizes, the largest
+// packet read from the tun that can be sent to the current remote without being fragmented on the underlay.
+type pmtuState struct {
+	sync.Mutex
+
+	// atomicMTU is the discovered mtu for the current remote, 0 if it is not known yet
+	atomicMTU int32
+
+	remote  *udpAddr
+	lo      int
+	hi      int
+	probe   int
+	probeId uint32
+	tries   int
+	sent    time.Time
+	next    time.Time
+}
+
+// NewPathMTUDiscoveryFromConfig returns nil if path mtu discovery is disabled. maxMTU is the largest mtu configured
+// for the tun, there is no point in probing for anything bigger
+func NewPathMTUDiscoveryFromConfig(l *logrus.Logger, c *Config, maxMTU int) *pathMTUDiscovery {
+	if !c.GetBool("pmtud.enabled", false) {
+		return nil
+	}
+
+	p := &pathMTUDiscovery{
+		interval: c.GetDuration("pmtud.interval", time.Minute*10),
+		timeout:  c.GetDuration("pmtud.timeout", time.Second),
+		min:      c.GetInt("pmtud.min", 1200),
+		max:      c.GetInt("pmtud.max", maxMTU),
+		l:        l,
+	}
+
+	if p.max > pmtuMaxProbe {
+		p.max = pmtuMaxProbe
+	}
+
+	if p.min < 68 {
+		p.min = 68
+	}
+
+	if p.min > p.max {
+		p.min = p.max
+	}
+
+	if p.timeout <= 0 {
+		p.timeout = time.Second
+	}
+
+	l.WithField("min", p.min).WithField("max", p.max).WithField("interval", p.interval).
+		Info("Path MTU discovery enabled")
+
+	return p
+}
+
+// Run probes every established tunnel until the process exits
+func (p *pathMTUDiscovery) Run(f *Interface) {
+	ticker := time.NewTicker(p.timeout)
+	defer ticker.Stop()
+
+	var hosts []*HostInfo
+	for now := range ticker.C {
+		hosts = hosts[:0]
+		f.hostMap.RLock()
+		for _, h := range f.hostMap.Hosts {
+			hosts = append(hosts, h)
+		}
+		f.hostMap.RUnlock()
+
+		for _, h := range hosts {
+			p.tick(f, h, now)
+		}
+	}
+}
+
+func (p *pathMTUDiscovery) tick(f *Interface, h *HostInfo, now time.Time) {
+	ci := h.ConnectionState
+	if ci == nil || !ci.ready {
+		return
+	}
+
+	h.RLock()
+	remote := h.remote
+	h.RUnlock()
+	if remote == nil {
+		return
+	}
+
+	s := &h.pmtu
+	s.Lock()
+	defer s.Unlock()
+
+	if !s.remote.Equals(remote) {
+		// Whatever we learned before does not apply to this path
+		s.remote = remote.Copy()
+		s.probe = 0
+		s.next = now
+		atomic.StoreInt32(&s.atomicMTU, 0)
+	}
+
+	if s.probe == 0 {
+		if now.Before(s.next) {
+			return
+		}
+
+		s.begin(p.min, p.max)
+
+	} else if now.Sub(s.sent) >= p.timeout {
+		s.tries++
+		if s.tries >= pmtuProbeTries {
+			s.failure()
+		}
+
+	} else {
+		// Still waiting for a reply
+		return
+	}
+
+	p.sendOrFinish(f, h, s, now)
+}
+
+// handleReply is called with the decrypted payload of every test reply
+func (p *pathMTUDiscovery) handleReply(f *Interface, h *HostInfo, d []byte) {
+	id, ok := parsePMTUProbe(d)
+	if !ok {
+		return
+	}
+
+	s := &h.pmtu
+	s.Lock()
+	defer s.Unlock()
+
+	if s.probe == 0 || id != s.probeId {
+		// A late reply for a probe we already gave up on
+		return
+	}
+
+	s.success()
+	p.sendOrFinish(f, h, s, time.Now())
+}
+
+// sendOrFinish sends the current probe or records the result if the search is over. s must be locked
+func (p *pathMTUDiscovery) sendOrFinish(f *Interface, h *HostInfo, s *pmtuState, now time.Time) {
+	if s.probe == 0 {
+		old := atomic.SwapInt32(&s.atomicMTU, int32(s.lo))
+		s.next = now.Add(p.interval)
+		if old != int32(s.lo) {
+			h.logger(p.l).WithField("udpAddr", s.remote).WithField("pathMtu", s.lo).
+				Info("Discovered path MTU")
+		}
+		return
+	}
+
+	s.sent = now
+	err := f.sendPMTUProbe(h, s.remote, s.probe, s.probeId)
+	if err != nil && p.l.Level >= logrus.DebugLevel {
+		h.logger(p.l).WithError(err).WithField("udpAddr", s.remote).WithField("size", s.probe).
+			Debug("Failed to send path MTU probe")
+	}
+}
+
+// begin starts a new search between min and max, the first probe is the largest size since most paths can carry it
+func (s *pmtuState) begin(min, max int) {
+	s.lo = min
+	s.hi = max
+	s.probe = max
+	s.probeId++
+	s.tries = 0
+
+	if s.lo >= s.hi {
+		s.probe = 0
+	}
+}
+
+// success records that the current probe size made it through
+func (s *pmtuState) success() {
+	s.lo = s.probe
+	s.advance()
+}
+
+// failure records that the current probe size never made it through
+func (s *pmtuState) failure() {
+	s.hi = s.probe - 1
+	s.advance()
+}
+
+// advance picks the next probe size, probe is 0 and lo is the result once the search is over
+func (s *pmtuState) advance() {
+	s.tries = 0
+	s.probeId++
+	if s.lo >= s.hi {
+		s.probe = 0
+		return
+	}
+
+	s.probe = (s.lo + s.hi + 1) / 2
+}
+
+// PathMTU returns the discovered path mtu for the current remote, or 0 if it is not known
+func (i *HostInfo) PathMTU() int {
+	return int(atomic.LoadInt32(&i.pmtu.atomicMTU))
+}
+
+// sendPMTUProbe sends a test request padded out to size bytes of plaintext, which results in an underlay packet of
+// the same size as a tunneled packet of size bytes
+func (f *Interface) sendPMTUProbe(hostinfo *HostInfo, remote *udpAddr, size int, id uint32) error {
+	ci := hostinfo.ConnectionState
+	if ci.eKey == nil {
+		return nil
+	}
+
+	p := make([]byte, size)
+	copy(p, pmtuProbeMagic)
+	binary.BigEndian.PutUint32(p[4:8], id)
+
+	c := atomic.AddUint64(&ci.atomicMessageCounter, 1)
+	out := HeaderEncode(make([]byte, mtu), Version, uint8(test), uint8(testRequest), hostinfo.remoteIndexId, c)
+	out, err := ci.eKey.EncryptDanger(out, out, p, c, make([]byte, 12, 12))
+	if err != nil {
+		return err
+	}
+
+	f.messageMetrics.Tx(test, testRequest, 1)
+	// Probes are expected to fail, do not log them like a normal send
+	return f.writers[0].WriteToDontFragment(out, remote)
+}
+
+// parsePMTUProbe returns the probe id if the test payload is a path mtu probe
+func parsePMTUProbe(d []byte) (uint32, bool) {
+	if len(d) < pmtuProbeHeaderLen || !bytes.Equal(d[:4], pmtuProbeMagic) {
+		return 0, false
+	}
+
+	return binary.BigEndian.Uint32(d[4:8]), true
+}
+
+// pmtuReply returns the payload to send back for a test request. Path mtu probes only need their header echoed, the
+// return path may not be able to carry the full probe
+func pmtuReply(d []byte) []byte {
+	if _, ok := parsePMTUProbe(d); ok {
+		return d[:pmtuProbeHeaderLen]
+	}
+
+	return d
+}
+
+// sendTooBig handles a packet read from the tun that is larger than the path mtu of the tunnel it is destined for.
+// If the packet has DF set we tell the sender to use a smaller mtu, otherwise it is fragmented like a router would.
+func (f *Interface) sendTooBig(hostinfo *HostInfo, packet []byte, pathMTU int, nb []byte, q int) {
+	flags := binary.BigEndian.Uint16(packet[6:8])
+	if flags&0x4000 != 0 {
+		icmp := newFragmentationNeeded(packet, pathMTU)
+		if icmp == nil {
+			return
+		}
+
+		if _, err := f.readers[q].Write(icmp); err != nil {
+			f.l.WithError(err).Error("Failed to write to tun")
+		}
+		return
+	}
+
+	out := make([]byte, mtu)
+	fragmentIPv4(packet, pathMTU, make([]byte, pathMTU), func(frag []byte) {
+		f.sendNoMetrics(message, 0, hostinfo.ConnectionState, hostinfo, hostinfo.remote, frag, nb, out, q, nil)
+	})
+}
+
+// newFragmentationNeeded builds an icmp fragmentation needed message for packet, as if it was sent by the remote
+// host. nil is returned for packets that must not generate an icmp error.
+func newFragmentationNeeded(packet []byte, pathMTU int) []byte {
+	ihl := int(packet[0]&0x0f) << 2
+	if ihl < 20 || len(packet) < ihl {
+		return nil
+	}
+
+	// Only the first fragment gets an error
+	if binary.BigEndian.Uint16(packet[6:8])&0x1fff != 0 {
+		return nil
+	}
+
+	// Never respond to an icmp error with another one
+	if packet[9] == fwProtoICMP && len(packet) > ihl && packet[ihl] != 0 && packet[ihl] != 8 {
+		return nil
+	}
+
+	quote := ihl + 8
+	if quote > len(packet) {
+		quote = len(packet)
+	}
+
+	b := make([]byte, 28+quote)
+	b[0] = 0x45
+	binary.BigEndian.PutUint16(b[2:4], uint16(len(b)))
+	b[8] = 64
+	b[9] = fwProtoICMP
+	copy(b[12:16], packet[16:20])
+	copy(b[16:20], packet[12:16])
+	setIPv4Checksum(b, 20)
+
+	icmp := b[20:]
+	icmp[0] = icmpDestinationUnreachable
+	icmp[1] = icmpFragmentationNeeded
+	binary.BigEndian.PutUint16(icmp[6:8], uint16(pathMTU))
+	copy(icmp[8:], packet[:quote])
+	binary.BigEndian.PutUint16(icmp[2:4], ^checksumFold(checksumAdd(0, icmp)))
+
+	return b
+}
+
+// fragmentIPv4 splits packet into fragments no larger than pathMTU and calls fn with each one. buf must be at least
+// pathMTU bytes and is reused for every fragment.
+func fragmentIPv4(packet []byte, pathMTU int, buf []byte, fn func([]byte)) {
+	ihl := int(packet[0]&0x0f) << 2
+	if ihl < 20 || len(packet) < ihl {
+		return
+	}
+
+	size := (pathMTU - ihl) &^ 7
+	if size <= 0 {
+		return
+	}
+
+	field := binary.BigEndian.Uint16(packet[6:8])
+	offset := int(field & 0x1fff)
+	moreFragments := field&0x2000 != 0
+
+	payload := packet[ihl:]
+	for len(payload) > 0 {
+		n := size
+		last := false
+		if n >= len(payload) {
+			n = len(payload)
+			last = true
+		}
+
+		frag := buf[:ihl+n]
+		copy(frag, packet[:ihl])
+		copy(frag[ihl:], payload[:n])
+		binary.BigEndian.PutUint16(frag[2:4], uint16(len(frag)))
+
+		field = uint16(offset) & 0x1fff
+		if !last || moreFragments {
+			field |= 0x2000
+		}
+		binary.BigEndian.PutUint16(frag[6:8], field)
+		setIPv4Checksum(frag, ihl)
+
+		fn(frag)
+
+		payload = payload[n:]
+		offset += n / 8
+	}
+}
@@ -0,0 +1,149 @@
+package nebula
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_pmtuState_search(t *testing.T) {
+	search := func(min, max, path int) (int, int) {
+		s := pmtuState{}
+		s.begin(min, max)
+		probes := 0
+		for s.probe != 0 {
+			probes++
+			if s.probe <= path {
+				s.success()
+			} else {
+				s.failure()
+			}
+		}
+		return s.lo, probes
+	}
+
+	// A path that carries everything is found with a single probe
+	found, probes := search(1200, 1300, 9000)
+	assert.Equal(t, 1300, found)
+	assert.Equal(t, 1, probes)
+
+	found, _ = search(1200, 9000, 1472)
+	assert.Equal(t, 1472, found)
+
+	found, _ = search(1200, 9000, 1201)
+	assert.Equal(t, 1201, found)
+
+	// min is assumed to work even if the path is smaller
+	found, _ = search(1200, 9000, 500)
+	assert.Equal(t, 1200, found)
+
+	found, probes = search(1300, 1300, 500)
+	assert.Equal(t, 1300, found)
+	assert.Equal(t, 0, probes)
+}
+
+func Test_pmtuState_probeId(t *testing.T) {
+	s := pmtuState{}
+	s.begin(1200, 1400)
+	first := s.probeId
+
+	s.failure()
+	assert.NotEqual(t, first, s.probeId)
+	assert.Equal(t, 1300, s.probe)
+}
+
+func Test_parsePMTUProbe(t *testing.T) {
+	p := make([]byte, 1300)
+	copy(p, pmtuProbeMagic)
+	binary.BigEndian.PutUint32(p[4:8], 77)
+
+	id, ok := parsePMTUProbe(p)
+	assert.True(t, ok)
+	assert.Equal(t, uint32(77), id)
+	assert.Len(t, pmtuReply(p), pmtuProbeHeaderLen)
+
+	// Regular test messages are echoed as is
+	_, ok = parsePMTUProbe([]byte("hi"))
+	assert.False(t, ok)
+	assert.Equal(t, []byte("hi"), pmtuReply([]byte("hi")))
+	assert.Equal(t, []byte{}, pmtuReply([]byte{}))
+}
+
+func Test_newFragmentationNeeded(t *testing.T) {
+	pkt := newTestTCPPacket(1, tcpFlagACK, make([]byte, 1400))
+
+	b := newFragmentationNeeded(pkt, 1300)
+	assert.Len(t, b, 20+8+28)
+	assert.Equal(t, uint16(0xffff), checksumFold(checksumAdd(0, b[:20])))
+	assert.Equal(t, uint16(0xffff), checksumFold(checksumAdd(0, b[20:])))
+	assert.Equal(t, pkt[16:20], b[12:16])
+	assert.Equal(t, pkt[12:16], b[16:20])
+	assert.Equal(t, uint8(fwProtoICMP), b[9])
+	assert.Equal(t, uint8(icmpDestinationUnreachable), b[20])
+	assert.Equal(t, uint8(icmpFragmentationNeeded), b[21])
+	assert.Equal(t, uint16(1300), binary.BigEndian.Uint16(b[26:28]))
+	assert.Equal(t, pkt[:28], b[28:])
+
+	// Never for a later fragment
+	binary.BigEndian.PutUint16(pkt[6:8], 0x4000|10)
+	assert.Nil(t, newFragmentationNeeded(pkt, 1300))
+
+	// Never for an icmp error
+	assert.Nil(t, newFragmentationNeeded(b, 1300))
+
+	// But for an echo request
+	b[20] = 8
+	assert.NotNil(t, newFragmentationNeeded(b, 1300))
+}
+
+func Test_fragmentIPv4(t *testing.T) {
+	payload := make([]byte, 3000)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+	pkt := newTestTCPPacket(1, tcpFlagACK, payload[:2980])
+	// No DF
+	binary.BigEndian.PutUint16(pkt[6:8], 0)
+
+	var frags [][]byte
+	fragmentIPv4(pkt, 1300, make([]byte, 1300), func(b []byte) {
+		frags = append(frags, append([]byte{}, b...))
+	})
+
+	assert.Len(t, frags, 3)
+	var got []byte
+	for i, f := range frags {
+		assert.True(t, len(f) <= 1300)
+		assert.Equal(t, uint16(0xffff), checksumFold(checksumAdd(0, f[:20])))
+		assert.Equal(t, len(f), int(binary.BigEndian.Uint16(f[2:4])))
+
+		field := binary.BigEndian.Uint16(f[6:8])
+		assert.Equal(t, len(got)/8, int(field&0x1fff))
+		assert.Equal(t, i < 2, field&0x2000 != 0)
+		got = append(got, f[20:]...)
+	}
+	assert.Equal(t, pkt[20:], got)
+	assert.Equal(t, 1300, len(frags[0]))
+}
+
+func TestNewPathMTUDiscoveryFromConfig(t *testing.T) {
+	l := NewTestLogger()
+	c := NewConfig(l)
+
+	assert.Nil(t, NewPathMTUDiscoveryFromConfig(l, c, 1300))
+
+	c.Settings["pmtud"] = map[interface{}]interface{}{"enabled": true}
+	p := NewPathMTUDiscoveryFromConfig(l, c, 1300)
+	assert.Equal(t, 1200, p.min)
+	assert.Equal(t, 1300, p.max)
+	assert.Equal(t, time.Minute*10, p.interval)
+	assert.Equal(t, time.Second, p.timeout)
+
+	c.Settings["pmtud"] = map[interface{}]interface{}{"enabled": true, "min": 1400, "max": 20000, "interval": "1m"}
+	p = NewPathMTUDiscoveryFromConfig(l, c, 1300)
+	assert.Equal(t, pmtuMaxProbe, p.max)
+	assert.Equal(t, 1400, p.min)
+	assert.Equal(t, time.Minute, p.interval)
+}
@@ -0,0 +1,54 @@
+package nebula
+
+import (
+	"crypto/sha256"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+// Psk holds the pre-shared keys mixed into every handshake. A host without one of our keys can not complete the first
+// handshake message, which is rejected before their certificate is parsed.
+type Psk struct {
+	// primary is the key used when we initiate a handshake, nil means no key is used
+	primary []byte
+	// keys are every key accepted from an initiator in the order they are tried, nil accepts handshakes without a key
+	keys [][]byte
+
+	metricRejected metrics.Counter
+}
+
+// NewPskFromConfig reads handshakes.psk.keys. The first key is used when initiating and all keys are accepted, which
+// allows keys to be rotated without downtime. An empty string stands for no key, to introduce a key to a network that
+// does not have one yet.
+func NewPskFromConfig(c *Config, r metrics.Registry) *Psk {
+	p := &Psk{
+		metricRejected: metrics.GetOrRegisterCounter("handshakes.psk.rejected", r),
+	}
+
+	for _, k := range c.GetStringSlice("handshakes.psk.keys", []string{}) {
+		var key []byte
+		if k != "" {
+			// Noise wants exactly 32 bytes, let people configure a string of any length
+			sum := sha256.Sum256([]byte(k))
+			key = sum[:]
+		}
+		p.keys = append(p.keys, key)
+	}
+
+	if len(p.keys) == 0 {
+		p.keys = [][]byte{nil}
+	}
+
+	p.primary = p.keys[0]
+	return p
+}
+
+// Required is true if handshakes without a key are refused
+func (p *Psk) Required() bool {
+	for _, k := range p.keys {
+		if k == nil {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,35 @@
+package nebula
+
+import (
+	"crypto/sha256"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewPskFromConfig(t *testing.T) {
+	l := NewTestLogger()
+	c := NewConfig(l)
+
+	// Nothing configured means no psk
+	p := NewPskFromConfig(c, nil)
+	assert.Nil(t, p.primary)
+	assert.Equal(t, [][]byte{nil}, p.keys)
+	assert.False(t, p.Required())
+
+	a := sha256.Sum256([]byte("a"))
+	b := sha256.Sum256([]byte("b"))
+
+	c.Settings["handshakes"] = map[interface{}]interface{}{"psk": map[interface{}]interface{}{"keys": []interface{}{"a", "b"}}}
+	p = NewPskFromConfig(c, nil)
+	assert.Equal(t, a[:], p.primary)
+	assert.Equal(t, [][]byte{a[:], b[:]}, p.keys)
+	assert.True(t, p.Required())
+
+	// An empty key allows handshakes without a psk while rolling one out
+	c.Settings["handshakes"] = map[interface{}]interface{}{"psk": map[interface{}]interface{}{"keys": []interface{}{"", "b"}}}
+	p = NewPskFromConfig(c, nil)
+	assert.Nil(t, p.primary)
+	assert.Equal(t, [][]byte{nil, b[:]}, p.keys)
+	assert.False(t, p.Required())
+}
@@ -0,0 +1,100 @@
+package nebula
+
+// sendBatch collects encrypted packets produced from a single read of the tun so they can be written to the udp
+// socket together
+type sendBatch struct {
+	bufs  [][]byte
+	out   [][]byte
+	addrs []*udpAddr
+	// used is the number of bufs holding a queued packet, a packet sent to more than one address is queued once per
+	// address but only uses one buffer
+	used int
+}
+
+func newSendBatch(n int) *sendBatch {
+	b := &sendBatch{
+		bufs:  make([][]byte, n),
+		out:   make([][]byte, 0, n),
+		addrs: make([]*udpAddr, 0, n),
+	}
+
+	for i := range b.bufs {
+		b.bufs[i] = make([]byte, mtu)
+	}
+
+	return b
+}
+
+// next returns the buffer the next packet should be encrypted into
+func (b *sendBatch) next() []byte {
+	return b.bufs[b.used]
+}
+
+// add queues an encrypted packet to every addr, out must have been built in the buffer returned by next
+func (b *sendBatch) add(out []byte, addrs ...*udpAddr) {
+	for _, addr := range addrs {
+		b.out = append(b.out, out)
+		b.addrs = append(b.addrs, addr)
+	}
+	b.used++
+}
+
+// flush writes every queued packet and empties the batch
+func (b *sendBatch) flush(w *udpConn) error {
+	if len(b.out) == 0 {
+		return nil
+	}
+
+	err := w.WriteBatch(b.out, b.addrs)
+	b.out = b.out[:0]
+	b.used = 0
+	for i := range b.addrs {
+		b.addrs[i] = nil
+	}
+	b.addrs = b.addrs[:0]
+	return err
+}
+
+// tunBatch collects decrypted packets from a single read of the udp socket so they can be written to the tun together
+type tunBatch struct {
+	bufs [][]byte
+	pkts [][]byte
+	w    batchWriter
+}
+
+func newTunBatch(n int, w batchWriter) *tunBatch {
+	b := &tunBatch{
+		bufs: make([][]byte, n),
+		pkts: make([][]byte, 0, n),
+		w:    w,
+	}
+
+	for i := range b.bufs {
+		b.bufs[i] = make([]byte, mtu)
+	}
+
+	return b
+}
+
+// add copies p into the batch, the batch is flushed first if it is full
+func (b *tunBatch) add(p []byte) error {
+	var err error
+	if len(b.pkts) == len(b.bufs) {
+		err = b.flush()
+	}
+
+	i := len(b.pkts)
+	b.pkts = append(b.pkts, b.bufs[i][:copy(b.bufs[i], p)])
+	return err
+}
+
+// flush writes every queued packet and empties the batch
+func (b *tunBatch) flush() error {
+	if len(b.pkts) == 0 {
+		return nil
+	}
+
+	err := b.w.WriteBatch(b.pkts)
+	b.pkts = b.pkts[:0]
+	return err
+}
@@ -1,8 +1,8 @@
 package nebula
 
 import (
-	"bytes"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
@@ -13,44 +13,154 @@ import (
 	"strings"
 	"sync/atomic"
 	"syscall"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/slackhq/nebula/sshd"
 )
 
-type sshListHostMapFlags struct {
+// sshJsonFlags are the flags every command supports to output json instead of text
+type sshJsonFlags struct {
 	Json   bool
 	Pretty bool
 }
 
+func (f *sshJsonFlags) register(fl *flag.FlagSet, usage string) {
+	fl.BoolVar(&f.Json, "json", false, usage)
+	fl.BoolVar(&f.Pretty, "pretty", false, "pretty prints json, assumes -json")
+}
+
+func (f *sshJsonFlags) asJson() bool {
+	return f.Json || f.Pretty
+}
+
+// write outputs v as json if asked for, otherwise the text line
+func (f *sshJsonFlags) write(w sshd.StringWriter, v interface{}, text string) error {
+	if f.asJson() {
+		return sshWriteJson(w, f.Pretty, v)
+	}
+	return w.WriteLine(text)
+}
+
+// fail tells the user why the command failed, as {"error": msg} if json was asked for. The returned error makes a non
+// interactive command exit non zero.
+func (f *sshJsonFlags) fail(w sshd.StringWriter, msg string) error {
+	var err error
+	if f.asJson() {
+		err = sshWriteJson(w, f.Pretty, m{"error": msg})
+	} else {
+		err = w.WriteLine(msg)
+	}
+
+	if err != nil {
+		return err
+	}
+	return errors.New(msg)
+}
+
+// vpnIp parses the vpn ip given as the first argument of a command
+func (f *sshJsonFlags) vpnIp(w sshd.StringWriter, a []string) (uint32, error) {
+	if len(a) == 0 {
+		return 0, f.fail(w, "No vpn ip was provided")
+	}
+
+	parsedIp := net.ParseIP(a[0])
+	if parsedIp == nil {
+		return 0, f.fail(w, fmt.Sprintf("The provided vpn ip could not be parsed: %s", a[0]))
+	}
+
+	vpnIp := ip2int(parsedIp)
+	if vpnIp == 0 {
+		return 0, f.fail(w, fmt.Sprintf("The provided vpn ip could not be parsed: %s", a[0]))
+	}
+
+	return vpnIp, nil
+}
+
+func sshWriteJson(w sshd.StringWriter, pretty bool, v interface{}) error {
+	js := json.NewEncoder(w.GetWriter())
+	if pretty {
+		js.SetIndent("", "    ")
+	}
+	return js.Encode(v)
+}
+
+func sshJsonFlagSet() (*flag.FlagSet, interface{}) {
+	fl := flag.NewFlagSet("", flag.ContinueOnError)
+	s := sshJsonFlags{}
+	s.register(fl, "outputs as json")
+	return fl, &s
+}
+
+type sshListHostMapFlags struct {
+	sshJsonFlags
+}
+
 type sshPrintCertFlags struct {
-	Json   bool
-	Pretty bool
+	sshJsonFlags
 }
 
 type sshPrintTunnelFlags struct {
-	Pretty bool
+	sshJsonFlags
 }
 
 type sshChangeRemoteFlags struct {
+	sshJsonFlags
 	Address string
 }
 
 type sshCloseTunnelFlags struct {
+	sshJsonFlags
 	LocalOnly bool
 }
 
 type sshCreateTunnelFlags struct {
+	sshJsonFlags
 	Address string
 }
 
-func wireSSHReload(l *logrus.Logger, ssh *sshd.SSHServer, c *Config) {
+type sshPingFlags struct {
+	Count    int
+	Interval time.Duration
+	Timeout  time.Duration
+	Json     bool
+}
+
+type sshLogTailFlags struct {
+	Level  string
+	Fields sshFieldFilter
+	Json   bool
+}
+
+// sshFieldFilter collects repeated -field key=value flags
+type sshFieldFilter map[string]string
+
+func (f sshFieldFilter) String() string {
+	return fmt.Sprint(map[string]string(f))
+}
+
+func (f sshFieldFilter) Set(v string) error {
+	kv := strings.SplitN(v, "=", 2)
+	if len(kv) != 2 || kv[0] == "" {
+		return fmt.Errorf("field filters must look like key=value: %s", v)
+	}
+	f[kv[0]] = kv[1]
+	return nil
+}
+
+func wireSSHReload(l *logrus.Logger, ssh *sshd.SSHServer, certAuth *sshCertAuth, c *Config) {
 	c.RegisterReloadCallback(func(c *Config) {
 		if c.GetBool("sshd.enabled", false) {
-			err := configSSH(l, ssh, c)
+			err := configSSH(l, ssh, certAuth, c)
 			if err != nil {
+				// Whatever was running before keeps running, a typo in the config should not lock everyone out
 				l.WithError(err).Error("Failed to reconfigure the sshd")
-				ssh.Stop()
+				return
+			}
+
+			err = ssh.CheckRoles()
+			if err != nil {
+				l.WithError(err).Error("sshd.roles names a command that does not exist")
 			}
 		} else {
 			ssh.Stop()
@@ -58,7 +168,7 @@ func wireSSHReload(l *logrus.Logger, ssh *sshd.SSHServer, c *Config) {
 	})
 }
 
-func configSSH(l *logrus.Logger, ssh *sshd.SSHServer, c *Config) error {
+func configSSH(l *logrus.Logger, ssh *sshd.SSHServer, certAuth *sshCertAuth, c *Config) error {
 	//TODO conntrack list
 	//TODO print firewall rules or hash?
 
@@ -75,7 +185,6 @@ func configSSH(l *logrus.Logger, ssh *sshd.SSHServer, c *Config) error {
 		return fmt.Errorf("sshd.listen can not use port 22")
 	}
 
-	//TODO: no good way to reload this right now
 	hostKeyFile := c.GetString("sshd.host_key", "")
 	if hostKeyFile == "" {
 		return fmt.Errorf("sshd.host_key must be provided")
@@ -86,9 +195,24 @@ func configSSH(l *logrus.Logger, ssh *sshd.SSHServer, c *Config) error {
 		return fmt.Errorf("error while loading sshd.host_key file: %s", err)
 	}
 
-	err = ssh.SetHostKey(hostKeyBytes)
-	if err != nil {
-		return fmt.Errorf("error while adding sshd.host_key: %s", err)
+	// Everything is loaded into a new auth so a bad config leaves the keys and roles in use alone
+	auth := sshd.NewAuth()
+	for name, v := range c.GetMap("sshd.roles", map[interface{}]interface{}{}) {
+		rName := fmt.Sprintf("%v", name)
+		rCmds, ok := v.([]interface{})
+		if !ok {
+			return fmt.Errorf("sshd.roles.%s must be a list of commands", rName)
+		}
+
+		cmds := make([]string, len(rCmds))
+		for i, cmd := range rCmds {
+			cmds[i] = fmt.Sprintf("%v", cmd)
+		}
+
+		err := auth.AddRole(rName, cmds)
+		if err != nil {
+			return fmt.Errorf("error while adding sshd.roles.%s: %s", rName, err)
+		}
 	}
 
 	rawKeys := c.Get("sshd.authorized_users")
@@ -107,14 +231,24 @@ func configSSH(l *logrus.Logger, ssh *sshd.SSHServer, c *Config) error {
 				continue
 			}
 
+			if role, ok := kDef["role"]; ok {
+				// Leave the user out entirely rather than letting them in as an admin
+				err := auth.SetUserRole(user, fmt.Sprintf("%v", role))
+				if err != nil {
+					l.WithError(err).WithField("sshKeyConfig", rk).Warn("Authorized user had an error, ignoring")
+					continue
+				}
+			}
+
 			k := kDef["keys"]
 			switch v := k.(type) {
 			case string:
-				err := ssh.AddAuthorizedKey(user, v)
+				err := auth.AddAuthorizedKey(user, v)
 				if err != nil {
 					l.WithError(err).WithField("sshKeyConfig", rk).WithField("sshKey", v).Warn("Failed to authorize key")
 					continue
 				}
+				l.WithField("sshKey", v).WithField("sshUser", user).Info("Authorized ssh key")
 
 			case []interface{}:
 				for _, subK := range v {
@@ -124,11 +258,12 @@ func configSSH(l *logrus.Logger, ssh *sshd.SSHServer, c *Config) error {
 						continue
 					}
 
-					err := ssh.AddAuthorizedKey(user, sk)
+					err := auth.AddAuthorizedKey(user, sk)
 					if err != nil {
 						l.WithError(err).WithField("sshKeyConfig", sk).Warn("Failed to authorize key")
 						continue
 					}
+					l.WithField("sshKey", sk).WithField("sshUser", user).Info("Authorized ssh key")
 				}
 
 			default:
@@ -139,9 +274,35 @@ func configSSH(l *logrus.Logger, ssh *sshd.SSHServer, c *Config) error {
 		l.Info("no ssh users to authorize")
 	}
 
+	rules, err := parseSSHCertAuthRules(auth, c)
+	if err != nil {
+		return err
+	}
+	if len(rules) > 0 {
+		auth.SetPeerAuth(certAuth.authenticate)
+	}
+
+	// The host key is the last thing that can fail, nothing has changed until it is set
+	err = ssh.SetHostKey(hostKeyBytes)
+	if err != nil {
+		return fmt.Errorf("error while adding sshd.host_key: %s", err)
+	}
+
+	certAuth.setRules(rules)
+	ssh.SetAuth(auth)
+
+	if c.GetBool("sshd.overlay_only", false) {
+		ssh.SetRemoteFilter(certAuth.fromOverlay)
+	} else {
+		ssh.SetRemoteFilter(nil)
+	}
+
 	if c.GetBool("sshd.enabled", false) {
-		ssh.Stop()
-		go ssh.Run(listen)
+		// Open sessions are left alone, only new connections see the changes
+		err = ssh.Listen(listen)
+		if err != nil {
+			return fmt.Errorf("failed to listen on sshd.listen: %s", err)
+		}
 	} else {
 		ssh.Stop()
 	}
@@ -149,15 +310,15 @@ func configSSH(l *logrus.Logger, ssh *sshd.SSHServer, c *Config) error {
 	return nil
 }
 
-func attachCommands(l *logrus.Logger, ssh *sshd.SSHServer, hostMap *HostMap, pendingHostMap *HostMap, lightHouse *LightHouse, ifce *Interface) {
+func attachCommands(l *logrus.Logger, ssh *sshd.SSHServer, hostMap *HostMap, pendingHostMap *HostMap, lightHouse *LightHouse, ifce *Interface, logTail *logTailHook) {
 	ssh.RegisterCommand(&sshd.Command{
 		Name:             "list-hostmap",
 		ShortDescription: "List all known previously connected hosts",
+		ReadOnly:         true,
 		Flags: func() (*flag.FlagSet, interface{}) {
 			fl := flag.NewFlagSet("", flag.ContinueOnError)
 			s := sshListHostMapFlags{}
-			fl.BoolVar(&s.Json, "json", false, "outputs as json with more information")
-			fl.BoolVar(&s.Pretty, "pretty", false, "pretty prints json, assumes -json")
+			s.register(fl, "outputs as json with more information")
 			return fl, &s
 		},
 		Callback: func(fs interface{}, a []string, w sshd.StringWriter) error {
@@ -168,11 +329,11 @@ func attachCommands(l *logrus.Logger, ssh *sshd.SSHServer, hostMap *HostMap, pen
 	ssh.RegisterCommand(&sshd.Command{
 		Name:             "list-pending-hostmap",
 		ShortDescription: "List all handshaking hosts",
+		ReadOnly:         true,
 		Flags: func() (*flag.FlagSet, interface{}) {
 			fl := flag.NewFlagSet("", flag.ContinueOnError)
 			s := sshListHostMapFlags{}
-			fl.BoolVar(&s.Json, "json", false, "outputs as json with more information")
-			fl.BoolVar(&s.Pretty, "pretty", false, "pretty prints json, assumes -json")
+			s.register(fl, "outputs as json with more information")
 			return fl, &s
 		},
 		Callback: func(fs interface{}, a []string, w sshd.StringWriter) error {
@@ -183,11 +344,11 @@ func attachCommands(l *logrus.Logger, ssh *sshd.SSHServer, hostMap *HostMap, pen
 	ssh.RegisterCommand(&sshd.Command{
 		Name:             "list-lighthouse-addrmap",
 		ShortDescription: "List all lighthouse map entries",
+		ReadOnly:         true,
 		Flags: func() (*flag.FlagSet, interface{}) {
 			fl := flag.NewFlagSet("", flag.ContinueOnError)
 			s := sshListHostMapFlags{}
-			fl.BoolVar(&s.Json, "json", false, "outputs as json with more information")
-			fl.BoolVar(&s.Pretty, "pretty", false, "pretty prints json, assumes -json")
+			s.register(fl, "outputs as json with more information")
 			return fl, &s
 		},
 		Callback: func(fs interface{}, a []string, w sshd.StringWriter) error {
@@ -198,33 +359,35 @@ func attachCommands(l *logrus.Logger, ssh *sshd.SSHServer, hostMap *HostMap, pen
 	ssh.RegisterCommand(&sshd.Command{
 		Name:             "reload",
 		ShortDescription: "Reloads configuration from disk, same as sending HUP to the process",
+		Flags:            sshJsonFlagSet,
 		Callback:         sshReload,
 	})
 
 	ssh.RegisterCommand(&sshd.Command{
 		Name:             "start-cpu-profile",
 		ShortDescription: "Starts a cpu profile and write output to the provided file",
+		Flags:            sshJsonFlagSet,
 		Callback:         sshStartCpuProfile,
 	})
 
 	ssh.RegisterCommand(&sshd.Command{
 		Name:             "stop-cpu-profile",
 		ShortDescription: "Stops a cpu profile and writes output to the previously provided file",
-		Callback: func(fs interface{}, a []string, w sshd.StringWriter) error {
-			pprof.StopCPUProfile()
-			return w.WriteLine("If a CPU profile was running it is now stopped")
-		},
+		Flags:            sshJsonFlagSet,
+		Callback:         sshStopCpuProfile,
 	})
 
 	ssh.RegisterCommand(&sshd.Command{
 		Name:             "save-heap-profile",
 		ShortDescription: "Saves a heap profile to the provided path",
+		Flags:            sshJsonFlagSet,
 		Callback:         sshGetHeapProfile,
 	})
 
 	ssh.RegisterCommand(&sshd.Command{
 		Name:             "log-level",
 		ShortDescription: "Gets or sets the current log level",
+		Flags:            sshJsonFlagSet,
 		Callback: func(fs interface{}, a []string, w sshd.StringWriter) error {
 			return sshLogLevel(l, fs, a, w)
 		},
@@ -233,14 +396,35 @@ func attachCommands(l *logrus.Logger, ssh *sshd.SSHServer, hostMap *HostMap, pen
 	ssh.RegisterCommand(&sshd.Command{
 		Name:             "log-format",
 		ShortDescription: "Gets or sets the current log format",
+		Flags:            sshJsonFlagSet,
 		Callback: func(fs interface{}, a []string, w sshd.StringWriter) error {
 			return sshLogFormat(l, fs, a, w)
 		},
 	})
 
+	ssh.RegisterCommand(&sshd.Command{
+		Name:             "log-tail",
+		ShortDescription: "Streams log entries until ctrl-c is pressed or the session ends",
+		ReadOnly:         true,
+		Help:             "Entries below the current log-level are never logged, raise it to see them.",
+		Flags: func() (*flag.FlagSet, interface{}) {
+			fl := flag.NewFlagSet("", flag.ContinueOnError)
+			s := sshLogTailFlags{Fields: make(sshFieldFilter)}
+			fl.StringVar(&s.Level, "level", "", "Least severe level to show, default is every level that is logged")
+			fl.Var(s.Fields, "field", "Only show entries with this key=value field, ie vpnIp=10.1.0.2. Can be repeated")
+			fl.BoolVar(&s.Json, "json", false, "outputs every entry as json")
+			return fl, &s
+		},
+		Callback: func(fs interface{}, a []string, w sshd.StringWriter) error {
+			return sshLogTail(logTail, fs, a, w)
+		},
+	})
+
 	ssh.RegisterCommand(&sshd.Command{
 		Name:             "version",
 		ShortDescription: "Prints the currently running version of nebula",
+		ReadOnly:         true,
+		Flags:            sshJsonFlagSet,
 		Callback: func(fs interface{}, a []string, w sshd.StringWriter) error {
 			return sshVersion(ifce, fs, a, w)
 		},
@@ -249,11 +433,11 @@ func attachCommands(l *logrus.Logger, ssh *sshd.SSHServer, hostMap *HostMap, pen
 	ssh.RegisterCommand(&sshd.Command{
 		Name:             "print-cert",
 		ShortDescription: "Prints the current certificate being used or the certificate for the provided vpn ip",
+		ReadOnly:         true,
 		Flags: func() (*flag.FlagSet, interface{}) {
 			fl := flag.NewFlagSet("", flag.ContinueOnError)
 			s := sshPrintCertFlags{}
-			fl.BoolVar(&s.Json, "json", false, "outputs as json")
-			fl.BoolVar(&s.Pretty, "pretty", false, "pretty prints json, assumes -json")
+			s.register(fl, "outputs as json")
 			return fl, &s
 		},
 		Callback: func(fs interface{}, a []string, w sshd.StringWriter) error {
@@ -264,10 +448,11 @@ func attachCommands(l *logrus.Logger, ssh *sshd.SSHServer, hostMap *HostMap, pen
 	ssh.RegisterCommand(&sshd.Command{
 		Name:             "print-tunnel",
 		ShortDescription: "Prints json details about a tunnel for the provided vpn ip",
+		ReadOnly:         true,
 		Flags: func() (*flag.FlagSet, interface{}) {
 			fl := flag.NewFlagSet("", flag.ContinueOnError)
 			s := sshPrintTunnelFlags{}
-			fl.BoolVar(&s.Pretty, "pretty", false, "pretty prints json")
+			s.register(fl, "outputs as json, this is the default")
 			return fl, &s
 		},
 		Callback: func(fs interface{}, a []string, w sshd.StringWriter) error {
@@ -281,6 +466,7 @@ func attachCommands(l *logrus.Logger, ssh *sshd.SSHServer, hostMap *HostMap, pen
 		Flags: func() (*flag.FlagSet, interface{}) {
 			fl := flag.NewFlagSet("", flag.ContinueOnError)
 			s := sshChangeRemoteFlags{}
+			s.register(fl, "outputs as json")
 			fl.StringVar(&s.Address, "address", "", "The new remote address, ip:port")
 			return fl, &s
 		},
@@ -295,6 +481,7 @@ func attachCommands(l *logrus.Logger, ssh *sshd.SSHServer, hostMap *HostMap, pen
 		Flags: func() (*flag.FlagSet, interface{}) {
 			fl := flag.NewFlagSet("", flag.ContinueOnError)
 			s := sshCloseTunnelFlags{}
+			s.register(fl, "outputs as json")
 			fl.BoolVar(&s.LocalOnly, "local-only", false, "Disables notifying the remote that the tunnel is shutting down")
 			return fl, &s
 		},
@@ -310,6 +497,7 @@ func attachCommands(l *logrus.Logger, ssh *sshd.SSHServer, hostMap *HostMap, pen
 		Flags: func() (*flag.FlagSet, interface{}) {
 			fl := flag.NewFlagSet("", flag.ContinueOnError)
 			s := sshCreateTunnelFlags{}
+			s.register(fl, "outputs as json")
 			fl.StringVar(&s.Address, "address", "", "Optionally provide a real remote address, ip:port ")
 			return fl, &s
 		},
@@ -321,11 +509,31 @@ func attachCommands(l *logrus.Logger, ssh *sshd.SSHServer, hostMap *HostMap, pen
 	ssh.RegisterCommand(&sshd.Command{
 		Name:             "query-lighthouse",
 		ShortDescription: "Query the lighthouses for the provided vpn ip",
+		ReadOnly:         true,
 		Help:             "This command is asynchronous. Only currently known udp ips will be printed.",
+		Flags:            sshJsonFlagSet,
 		Callback: func(fs interface{}, a []string, w sshd.StringWriter) error {
 			return sshQueryLighthouse(ifce, fs, a, w)
 		},
 	})
+
+	ssh.RegisterCommand(&sshd.Command{
+		Name:             "ping",
+		ShortDescription: "Sends test messages to the provided vpn ip and reports the round trip time per remote",
+		Help:             "A tunnel is created first if there is none, so like create-tunnel this is not a read only command. No tun traffic is sent, the host is probed with nebula test messages.",
+		Flags: func() (*flag.FlagSet, interface{}) {
+			fl := flag.NewFlagSet("", flag.ContinueOnError)
+			s := sshPingFlags{}
+			fl.IntVar(&s.Count, "c", 4, "Number of probes to send to each remote")
+			fl.DurationVar(&s.Interval, "i", time.Second, "Time to wait between probes")
+			fl.DurationVar(&s.Timeout, "W", time.Second, "Time to wait for each reply")
+			fl.BoolVar(&s.Json, "json", false, "outputs every reply and the summary as json")
+			return fl, &s
+		},
+		Callback: func(fs interface{}, a []string, w sshd.StringWriter) error {
+			return sshPing(ifce, fs, a, w)
+		},
+	})
 }
 
 func sshListHostMap(hostMap *HostMap, a interface{}, w sshd.StringWriter) error {
@@ -338,12 +546,7 @@ func sshListHostMap(hostMap *HostMap, a interface{}, w sshd.StringWriter) error
 	hostMap.RLock()
 	defer hostMap.RUnlock()
 
-	if fs.Json || fs.Pretty {
-		js := json.NewEncoder(w.GetWriter())
-		if fs.Pretty {
-			js.SetIndent("", "    ")
-		}
-
+	if fs.asJson() {
 		d := make([]m, len(hostMap.Hosts))
 		x := 0
 		var h m
@@ -355,6 +558,7 @@ func sshListHostMap(hostMap *HostMap, a interface{}, w sshd.StringWriter) error
 				"remoteAddrs":   v.CopyRemotes(),
 				"cachedPackets": len(v.packetStore),
 				"cert":          v.GetCert(),
+				"stats":         &v.stats,
 			}
 
 			if v.ConnectionState != nil {
@@ -365,17 +569,13 @@ func sshListHostMap(hostMap *HostMap, a interface{}, w sshd.StringWriter) error
 			x++
 		}
 
-		err := js.Encode(d)
+		return sshWriteJson(w, fs.Pretty, d)
+	}
+
+	for i, v := range hostMap.Hosts {
+		err := w.WriteLine(fmt.Sprintf("%s: %s", int2ip(i), v.CopyRemotes()))
 		if err != nil {
-			//TODO
-			return nil
-		}
-	} else {
-		for i, v := range hostMap.Hosts {
-			err := w.WriteLine(fmt.Sprintf("%s: %s", int2ip(i), v.CopyRemotes()))
-			if err != nil {
-				return err
-			}
+			return err
 		}
 	}
 
@@ -392,12 +592,7 @@ func sshListLighthouseMap(lightHouse *LightHouse, a interface{}, w sshd.StringWr
 	lightHouse.RLock()
 	defer lightHouse.RUnlock()
 
-	if fs.Json || fs.Pretty {
-		js := json.NewEncoder(w.GetWriter())
-		if fs.Pretty {
-			js.SetIndent("", "    ")
-		}
-
+	if fs.asJson() {
 		d := make([]m, len(lightHouse.addrMap))
 		x := 0
 		var h m
@@ -411,17 +606,13 @@ func sshListLighthouseMap(lightHouse *LightHouse, a interface{}, w sshd.StringWr
 			x++
 		}
 
-		err := js.Encode(d)
+		return sshWriteJson(w, fs.Pretty, d)
+	}
+
+	for vpnIp, v := range lightHouse.addrMap {
+		err := w.WriteLine(fmt.Sprintf("%s: %s", int2ip(vpnIp), TransformLHReplyToUdpAddrs(v)))
 		if err != nil {
-			//TODO
-			return nil
-		}
-	} else {
-		for vpnIp, v := range lightHouse.addrMap {
-			err := w.WriteLine(fmt.Sprintf("%s: %s", int2ip(vpnIp), TransformLHReplyToUdpAddrs(v)))
-			if err != nil {
-				return err
-			}
+			return err
 		}
 	}
 
@@ -429,74 +620,166 @@ func sshListLighthouseMap(lightHouse *LightHouse, a interface{}, w sshd.StringWr
 }
 
 func sshStartCpuProfile(fs interface{}, a []string, w sshd.StringWriter) error {
+	flags, ok := fs.(*sshJsonFlags)
+	if !ok {
+		//TODO: error
+		return nil
+	}
+
 	if len(a) == 0 {
-		err := w.WriteLine("No path to write profile provided")
-		return err
+		return flags.fail(w, "No path to write profile provided")
 	}
 
 	file, err := os.Create(a[0])
 	if err != nil {
-		err = w.WriteLine(fmt.Sprintf("Unable to create profile file: %s", err))
-		return err
+		return flags.fail(w, fmt.Sprintf("Unable to create profile file: %s", err))
 	}
 
 	err = pprof.StartCPUProfile(file)
 	if err != nil {
-		err = w.WriteLine(fmt.Sprintf("Unable to start cpu profile: %s", err))
-		return err
+		return flags.fail(w, fmt.Sprintf("Unable to start cpu profile: %s", err))
 	}
 
-	err = w.WriteLine(fmt.Sprintf("Started cpu profile, issue stop-cpu-profile to write the output to %s", a))
-	return err
+	return flags.write(w, m{"path": a[0]}, fmt.Sprintf("Started cpu profile, issue stop-cpu-profile to write the output to %s", a[0]))
 }
 
-func sshVersion(ifce *Interface, fs interface{}, a []string, w sshd.StringWriter) error {
-	return w.WriteLine(fmt.Sprintf("%s", ifce.version))
+func sshStopCpuProfile(fs interface{}, a []string, w sshd.StringWriter) error {
+	flags, ok := fs.(*sshJsonFlags)
+	if !ok {
+		//TODO: error
+		return nil
+	}
+
+	pprof.StopCPUProfile()
+	return flags.write(w, m{"stopped": true}, "If a CPU profile was running it is now stopped")
 }
 
-func sshQueryLighthouse(ifce *Interface, fs interface{}, a []string, w sshd.StringWriter) error {
-	if len(a) == 0 {
-		return w.WriteLine("No vpn ip was provided")
+func sshVersion(ifce *Interface, fs interface{}, a []string, w sshd.StringWriter) error {
+	flags, ok := fs.(*sshJsonFlags)
+	if !ok {
+		//TODO: error
+		return nil
 	}
 
-	parsedIp := net.ParseIP(a[0])
-	if parsedIp == nil {
-		return w.WriteLine(fmt.Sprintf("The provided vpn ip could not be parsed: %s", a[0]))
+	return flags.write(w, m{"version": ifce.version}, ifce.version)
+}
+
+func sshQueryLighthouse(ifce *Interface, fs interface{}, a []string, w sshd.StringWriter) error {
+	flags, ok := fs.(*sshJsonFlags)
+	if !ok {
+		//TODO: error
+		return nil
 	}
 
-	vpnIp := ip2int(parsedIp)
-	if vpnIp == 0 {
-		return w.WriteLine(fmt.Sprintf("The provided vpn ip could not be parsed: %s", a[0]))
+	vpnIp, err := flags.vpnIp(w, a)
+	if err != nil {
+		return err
 	}
 
 	ips, _ := ifce.lightHouse.Query(vpnIp, ifce)
-	return json.NewEncoder(w.GetWriter()).Encode(ips)
+	if ips == nil {
+		ips = []*udpAddr{}
+	}
+	return flags.write(w, m{"vpnIp": int2ip(vpnIp), "addrs": ips}, fmt.Sprintf("%s: %s", int2ip(vpnIp), ips))
 }
 
-func sshCloseTunnel(ifce *Interface, fs interface{}, a []string, w sshd.StringWriter) error {
-	flags, ok := fs.(*sshCloseTunnelFlags)
+func sshPing(ifce *Interface, fs interface{}, a []string, w sshd.StringWriter) error {
+	flags, ok := fs.(*sshPingFlags)
 	if !ok {
 		//TODO: error
 		return nil
 	}
 
-	if len(a) == 0 {
-		return w.WriteLine("No vpn ip was provided")
+	jf := &sshJsonFlags{Json: flags.Json}
+	vpnIp, err := jf.vpnIp(w, a)
+	if err != nil {
+		return err
 	}
+	parsedIp := int2ip(vpnIp)
 
-	parsedIp := net.ParseIP(a[0])
-	if parsedIp == nil {
-		return w.WriteLine(fmt.Sprintf("The provided vpn ip could not be parsed: %s", a[0]))
+	opts := PingOptions{Count: flags.Count, Interval: flags.Interval, Timeout: flags.Timeout}
+	enc := json.NewEncoder(w.GetWriter())
+
+	if !flags.Json {
+		w.WriteLine(fmt.Sprintf("PING %s", parsedIp))
 	}
 
-	vpnIp := ip2int(parsedIp)
-	if vpnIp == 0 {
-		return w.WriteLine(fmt.Sprintf("The provided vpn ip could not be parsed: %s", a[0]))
+	var werr error
+	stats, err := ifce.ping(vpnIp, opts, func(r PingReply) {
+		if flags.Json {
+			werr = enc.Encode(m{"reply": r})
+		} else if r.Lost {
+			werr = w.WriteLine(fmt.Sprintf("Request timeout for %s via %s: seq=%d", parsedIp, r.Remote, r.Seq))
+		} else {
+			werr = w.WriteLine(fmt.Sprintf("Reply from %s via %s: seq=%d time=%s", parsedIp, r.Remote, r.Seq, r.RTT))
+		}
+	})
+	if werr != nil {
+		return werr
+	}
+
+	if err != nil {
+		if flags.Json {
+			step := ""
+			if perr, ok := err.(*PingError); ok {
+				step = perr.Step
+			}
+			if werr = enc.Encode(m{"error": err.Error(), "step": step}); werr != nil {
+				return werr
+			}
+			return err
+		}
+		return jf.fail(w, fmt.Sprintf("Ping %s failed, %s", parsedIp, err))
+	}
+
+	received := 0
+	for _, s := range stats {
+		received += s.Received
+	}
+
+	if flags.Json {
+		err = enc.Encode(m{"stats": stats})
+	} else {
+		err = w.WriteLine(fmt.Sprintf("--- %s ping statistics ---", parsedIp))
+		for _, s := range stats {
+			loss := 100 - s.Received*100/s.Transmitted
+			line := fmt.Sprintf("%s: %d packets transmitted, %d received, %d%% packet loss", s.Remote, s.Transmitted, s.Received, loss)
+			if s.Received > 0 {
+				line += fmt.Sprintf(", rtt min/avg/max = %s/%s/%s", s.Min, s.Avg, s.Max)
+			}
+
+			if err == nil {
+				err = w.WriteLine(line)
+			}
+		}
+	}
+
+	if err != nil {
+		return err
+	}
+
+	// Like ping, exit non zero if the host never answered
+	if received == 0 {
+		return errors.New("no replies were received")
+	}
+	return nil
+}
+
+func sshCloseTunnel(ifce *Interface, fs interface{}, a []string, w sshd.StringWriter) error {
+	flags, ok := fs.(*sshCloseTunnelFlags)
+	if !ok {
+		//TODO: error
+		return nil
+	}
+
+	vpnIp, err := flags.vpnIp(w, a)
+	if err != nil {
+		return err
 	}
 
 	hostInfo, err := ifce.hostMap.QueryVpnIP(uint32(vpnIp))
 	if err != nil {
-		return w.WriteLine(fmt.Sprintf("Could not find tunnel for vpn ip: %v", a[0]))
+		return flags.fail(w, fmt.Sprintf("Could not find tunnel for vpn ip: %v", a[0]))
 	}
 
 	if !flags.LocalOnly {
@@ -512,8 +795,8 @@ func sshCloseTunnel(ifce *Interface, fs interface{}, a []string, w sshd.StringWr
 		)
 	}
 
-	ifce.closeTunnel(hostInfo)
-	return w.WriteLine("Closed")
+	ifce.closeTunnel(hostInfo, TunnelDownClosed)
+	return flags.write(w, m{"vpnIp": int2ip(vpnIp), "closed": true}, "Closed")
 }
 
 func sshCreateTunnel(ifce *Interface, fs interface{}, a []string, w sshd.StringWriter) error {
@@ -523,35 +806,26 @@ func sshCreateTunnel(ifce *Interface, fs interface{}, a []string, w sshd.StringW
 		return nil
 	}
 
-	if len(a) == 0 {
-		return w.WriteLine("No vpn ip was provided")
-	}
-
-	parsedIp := net.ParseIP(a[0])
-	if parsedIp == nil {
-		return w.WriteLine(fmt.Sprintf("The provided vpn ip could not be parsed: %s", a[0]))
-	}
-
-	vpnIp := ip2int(parsedIp)
-	if vpnIp == 0 {
-		return w.WriteLine(fmt.Sprintf("The provided vpn ip could not be parsed: %s", a[0]))
+	vpnIp, err := flags.vpnIp(w, a)
+	if err != nil {
+		return err
 	}
 
 	hostInfo, _ := ifce.hostMap.QueryVpnIP(uint32(vpnIp))
 	if hostInfo != nil {
-		return w.WriteLine(fmt.Sprintf("Tunnel already exists"))
+		return flags.fail(w, "Tunnel already exists")
 	}
 
 	hostInfo, _ = ifce.handshakeManager.pendingHostMap.QueryVpnIP(uint32(vpnIp))
 	if hostInfo != nil {
-		return w.WriteLine(fmt.Sprintf("Tunnel already handshaking"))
+		return flags.fail(w, "Tunnel already handshaking")
 	}
 
 	var addr *udpAddr
 	if flags.Address != "" {
 		addr = NewUDPAddrFromString(flags.Address)
 		if addr == nil {
-			return w.WriteLine("Address could not be parsed")
+			return flags.fail(w, "Address could not be parsed")
 		}
 	}
 
@@ -561,7 +835,7 @@ func sshCreateTunnel(ifce *Interface, fs interface{}, a []string, w sshd.StringW
 	}
 	ifce.getOrHandshake(vpnIp)
 
-	return w.WriteLine("Created")
+	return flags.write(w, m{"vpnIp": int2ip(vpnIp), "created": true, "remote": addr}, "Created")
 }
 
 func sshChangeRemote(ifce *Interface, fs interface{}, a []string, w sshd.StringWriter) error {
@@ -572,88 +846,145 @@ func sshChangeRemote(ifce *Interface, fs interface{}, a []string, w sshd.StringW
 	}
 
 	if len(a) == 0 {
-		return w.WriteLine("No vpn ip was provided")
+		return flags.fail(w, "No vpn ip was provided")
 	}
 
 	if flags.Address == "" {
-		return w.WriteLine("No address was provided")
+		return flags.fail(w, "No address was provided")
 	}
 
 	addr := NewUDPAddrFromString(flags.Address)
 	if addr == nil {
-		return w.WriteLine("Address could not be parsed")
-	}
-
-	parsedIp := net.ParseIP(a[0])
-	if parsedIp == nil {
-		return w.WriteLine(fmt.Sprintf("The provided vpn ip could not be parsed: %s", a[0]))
+		return flags.fail(w, "Address could not be parsed")
 	}
 
-	vpnIp := ip2int(parsedIp)
-	if vpnIp == 0 {
-		return w.WriteLine(fmt.Sprintf("The provided vpn ip could not be parsed: %s", a[0]))
+	vpnIp, err := flags.vpnIp(w, a)
+	if err != nil {
+		return err
 	}
 
 	hostInfo, err := ifce.hostMap.QueryVpnIP(uint32(vpnIp))
 	if err != nil {
-		return w.WriteLine(fmt.Sprintf("Could not find tunnel for vpn ip: %v", a[0]))
+		return flags.fail(w, fmt.Sprintf("Could not find tunnel for vpn ip: %v", a[0]))
 	}
 
 	hostInfo.SetRemote(addr)
-	return w.WriteLine("Changed")
+	return flags.write(w, m{"vpnIp": int2ip(vpnIp), "remote": addr}, "Changed")
 }
 
 func sshGetHeapProfile(fs interface{}, a []string, w sshd.StringWriter) error {
+	flags, ok := fs.(*sshJsonFlags)
+	if !ok {
+		//TODO: error
+		return nil
+	}
+
 	if len(a) == 0 {
-		return w.WriteLine("No path to write profile provided")
+		return flags.fail(w, "No path to write profile provided")
 	}
 
 	file, err := os.Create(a[0])
 	if err != nil {
-		err = w.WriteLine(fmt.Sprintf("Unable to create profile file: %s", err))
-		return err
+		return flags.fail(w, fmt.Sprintf("Unable to create profile file: %s", err))
 	}
 
 	err = pprof.WriteHeapProfile(file)
 	if err != nil {
-		err = w.WriteLine(fmt.Sprintf("Unable to write profile: %s", err))
-		return err
+		return flags.fail(w, fmt.Sprintf("Unable to write profile: %s", err))
 	}
 
-	err = w.WriteLine(fmt.Sprintf("Mem profile created at %s", a))
-	return err
+	return flags.write(w, m{"path": a[0]}, fmt.Sprintf("Mem profile created at %s", a[0]))
 }
 
 func sshLogLevel(l *logrus.Logger, fs interface{}, a []string, w sshd.StringWriter) error {
-	if len(a) == 0 {
-		return w.WriteLine(fmt.Sprintf("Log level is: %s", l.Level))
+	flags, ok := fs.(*sshJsonFlags)
+	if !ok {
+		//TODO: error
+		return nil
 	}
 
-	level, err := logrus.ParseLevel(a[0])
-	if err != nil {
-		return w.WriteLine(fmt.Sprintf("Unknown log level %s. Possible log levels: %s", a, logrus.AllLevels))
+	if len(a) > 0 {
+		level, err := logrus.ParseLevel(a[0])
+		if err != nil {
+			return flags.fail(w, fmt.Sprintf("Unknown log level %s. Possible log levels: %s", a, logrus.AllLevels))
+		}
+
+		l.SetLevel(level)
 	}
 
-	l.SetLevel(level)
-	return w.WriteLine(fmt.Sprintf("Log level is: %s", l.Level))
+	return flags.write(w, m{"level": l.Level.String()}, fmt.Sprintf("Log level is: %s", l.Level))
 }
 
 func sshLogFormat(l *logrus.Logger, fs interface{}, a []string, w sshd.StringWriter) error {
-	if len(a) == 0 {
-		return w.WriteLine(fmt.Sprintf("Log format is: %s", reflect.TypeOf(l.Formatter)))
+	flags, ok := fs.(*sshJsonFlags)
+	if !ok {
+		//TODO: error
+		return nil
 	}
 
-	logFormat := strings.ToLower(a[0])
-	switch logFormat {
-	case "text":
-		l.Formatter = &logrus.TextFormatter{}
-	case "json":
-		l.Formatter = &logrus.JSONFormatter{}
-	default:
-		return fmt.Errorf("unknown log format `%s`. possible formats: %s", logFormat, []string{"text", "json"})
+	if len(a) > 0 {
+		logFormat := strings.ToLower(a[0])
+		switch logFormat {
+		case "text":
+			l.Formatter = &logrus.TextFormatter{}
+		case "json":
+			l.Formatter = &logrus.JSONFormatter{}
+		default:
+			return flags.fail(w, fmt.Sprintf("unknown log format `%s`. possible formats: %s", logFormat, []string{"text", "json"}))
+		}
+	}
+
+	format := reflect.TypeOf(l.Formatter).String()
+	switch l.Formatter.(type) {
+	case *logrus.TextFormatter:
+		format = "text"
+	case *logrus.JSONFormatter:
+		format = "json"
+	}
+
+	return flags.write(w, m{"format": format}, fmt.Sprintf("Log format is: %s", reflect.TypeOf(l.Formatter)))
+}
+
+func sshLogTail(logTail *logTailHook, fs interface{}, a []string, w sshd.StringWriter) error {
+	flags, ok := fs.(*sshLogTailFlags)
+	if !ok {
+		//TODO: error
+		return nil
+	}
+
+	opts := LogTailOptions{Level: flags.Level, Fields: flags.Fields}
+	if flags.Json {
+		opts.Format = "json"
 	}
 
-	return w.WriteLine(fmt.Sprintf("Log format is: %s", reflect.TypeOf(l.Formatter)))
+	t, err := logTail.subscribe(opts)
+	if err != nil {
+		_ = w.WriteLine(err.Error())
+		return err
+	}
+	defer t.Close()
+
+	for {
+		select {
+		case b := <-t.C:
+			err := w.WriteBytes(b)
+			if err != nil {
+				return nil
+			}
+		case <-w.Done():
+			// Flush what was logged before we were stopped
+			for {
+				select {
+				case b := <-t.C:
+					if w.WriteBytes(b) != nil {
+						return nil
+					}
+				default:
+					return nil
+				}
+			}
+		}
+	}
 }
 
 func sshPrintCert(ifce *Interface, fs interface{}, a []string, w sshd.StringWriter) error {
@@ -665,42 +996,24 @@ func sshPrintCert(ifce *Interface, fs interface{}, a []string, w sshd.StringWrit
 
 	cert := ifce.certState.certificate
 	if len(a) > 0 {
-		parsedIp := net.ParseIP(a[0])
-		if parsedIp == nil {
-			return w.WriteLine(fmt.Sprintf("The provided vpn ip could not be parsed: %s", a[0]))
-		}
-
-		vpnIp := ip2int(parsedIp)
-		if vpnIp == 0 {
-			return w.WriteLine(fmt.Sprintf("The provided vpn ip could not be parsed: %s", a[0]))
+		vpnIp, err := args.vpnIp(w, a)
+		if err != nil {
+			return err
 		}
 
 		hostInfo, err := ifce.hostMap.QueryVpnIP(uint32(vpnIp))
 		if err != nil {
-			return w.WriteLine(fmt.Sprintf("Could not find tunnel for vpn ip: %v", a[0]))
+			return args.fail(w, fmt.Sprintf("Could not find tunnel for vpn ip: %v", a[0]))
 		}
 
 		cert = hostInfo.GetCert()
-	}
-
-	if args.Json || args.Pretty {
-		b, err := cert.MarshalJSON()
-		if err != nil {
-			//TODO: handle it
-			return nil
-		}
-
-		if args.Pretty {
-			buf := new(bytes.Buffer)
-			err := json.Indent(buf, b, "", "    ")
-			b = buf.Bytes()
-			if err != nil {
-				//TODO: handle it
-				return nil
-			}
+		if cert == nil {
+			return args.fail(w, fmt.Sprintf("No certificate is known for vpn ip: %v", a[0]))
 		}
+	}
 
-		return w.WriteBytes(b)
+	if args.asJson() {
+		return sshWriteJson(w, args.Pretty, cert)
 	}
 
 	return w.WriteLine(cert.String())
@@ -713,43 +1026,33 @@ func sshPrintTunnel(ifce *Interface, fs interface{}, a []string, w sshd.StringWr
 		return nil
 	}
 
-	if len(a) == 0 {
-		return w.WriteLine("No vpn ip was provided")
-	}
-
-	parsedIp := net.ParseIP(a[0])
-	if parsedIp == nil {
-		return w.WriteLine(fmt.Sprintf("The provided vpn ip could not be parsed: %s", a[0]))
-	}
-
-	vpnIp := ip2int(parsedIp)
-	if vpnIp == 0 {
-		return w.WriteLine(fmt.Sprintf("The provided vpn ip could not be parsed: %s", a[0]))
+	vpnIp, err := args.vpnIp(w, a)
+	if err != nil {
+		return err
 	}
 
 	hostInfo, err := ifce.hostMap.QueryVpnIP(uint32(vpnIp))
 	if err != nil {
-		return w.WriteLine(fmt.Sprintf("Could not find tunnel for vpn ip: %v", a[0]))
+		return args.fail(w, fmt.Sprintf("Could not find tunnel for vpn ip: %v", a[0]))
 	}
 
-	enc := json.NewEncoder(w.GetWriter())
-	if args.Pretty {
-		enc.SetIndent("", "    ")
-	}
-
-	return enc.Encode(hostInfo)
+	return sshWriteJson(w, args.Pretty, hostInfo)
 }
 
 func sshReload(fs interface{}, a []string, w sshd.StringWriter) error {
+	flags, ok := fs.(*sshJsonFlags)
+	if !ok {
+		//TODO: error
+		return nil
+	}
+
 	p, err := os.FindProcess(os.Getpid())
 	if err != nil {
-		return w.WriteLine(err.Error())
-		//TODO
+		return flags.fail(w, err.Error())
 	}
 	err = p.Signal(syscall.SIGHUP)
 	if err != nil {
-		return w.WriteLine(err.Error())
-		//TODO
+		return flags.fail(w, err.Error())
 	}
-	return w.WriteLine("HUP sent")
+	return flags.write(w, m{"signal": "HUP"}, "HUP sent")
 }
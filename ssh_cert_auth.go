@@ -0,0 +1,191 @@
+package nebula
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/sshd"
+)
+
+// sshCertAuthRule gives role to certificates with the name, if set, and every one of the groups
+type sshCertAuthRule struct {
+	name   string
+	groups []string
+	role   string
+}
+
+func (r *sshCertAuthRule) match(c *cert.NebulaCertificate) bool {
+	if r.name != "" {
+		found := false
+		for _, n := range c.Details.Names {
+			if n == r.name {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	for _, g := range r.groups {
+		if _, ok := c.Details.InvertedGroups[g]; !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+// sshCertAuth authenticates sshd users by the nebula certificate of the vpn ip they connect from
+type sshCertAuth struct {
+	sync.RWMutex
+	hostMap *HostMap
+	// vpnIP is the address of this host, connections made to any other address did not come over the tun
+	vpnIP uint32
+	rules []sshCertAuthRule
+}
+
+// setHostMap sets where tunnels are looked up and the vpn ip of this host, every connection is refused until it is set
+func (a *sshCertAuth) setHostMap(hm *HostMap, vpnIP uint32) {
+	a.Lock()
+	a.hostMap = hm
+	a.vpnIP = vpnIP
+	a.Unlock()
+}
+
+// setRules replaces the rules, certificates that match none of them are refused
+func (a *sshCertAuth) setRules(rules []sshCertAuthRule) {
+	a.Lock()
+	a.rules = rules
+	a.Unlock()
+}
+
+// parseSSHCertAuthRules reads `sshd.nebula_auth`, the roles must already be in auth
+func parseSSHCertAuthRules(auth *sshd.Auth, c *Config) ([]sshCertAuthRule, error) {
+	rawRules, ok := c.Get("sshd.nebula_auth").([]interface{})
+	if !ok && c.Get("sshd.nebula_auth") != nil {
+		return nil, errors.New("sshd.nebula_auth must be a list of rules")
+	}
+
+	toString := func(k string, m map[interface{}]interface{}) string {
+		v, ok := m[k]
+		if !ok {
+			return ""
+		}
+		return fmt.Sprintf("%v", v)
+	}
+
+	rules := make([]sshCertAuthRule, 0, len(rawRules))
+	for i, rr := range rawRules {
+		m, ok := rr.(map[interface{}]interface{})
+		if !ok {
+			return nil, fmt.Errorf("sshd.nebula_auth rule #%d must be a map", i)
+		}
+
+		r := sshCertAuthRule{role: toString("role", m)}
+		if r.role == "" {
+			return nil, fmt.Errorf("sshd.nebula_auth rule #%d is missing a role", i)
+		}
+		if !auth.HasRole(r.role) {
+			return nil, fmt.Errorf("sshd.nebula_auth rule #%d has an unknown role: %s", i, r.role)
+		}
+
+		r.name = toString("name", m)
+		if g := toString("group", m); g != "" {
+			r.groups = append(r.groups, g)
+		}
+
+		if rg, ok := m["groups"]; ok {
+			groups, ok := rg.([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("sshd.nebula_auth rule #%d groups must be a list", i)
+			}
+			for _, g := range groups {
+				r.groups = append(r.groups, fmt.Sprintf("%v", g))
+			}
+		}
+
+		if r.name == "" && len(r.groups) == 0 {
+			return nil, fmt.Errorf("sshd.nebula_auth rule #%d must have a name, group or groups", i)
+		}
+
+		rules = append(rules, r)
+	}
+
+	return rules, nil
+}
+
+// peerCert returns the certificate of the tunnel remote is connecting over. The connection must be made to our vpn ip,
+// an underlay host could otherwise pass for a vpn ip it shares with a tunnel.
+func (a *sshCertAuth) peerCert(local, remote net.Addr) (*cert.NebulaCertificate, error) {
+	addr, ok := remote.(*net.TCPAddr)
+	if !ok || addr.IP.To4() == nil {
+		return nil, fmt.Errorf("%s is not a vpn ip", remote)
+	}
+
+	a.RLock()
+	hm, vpnIP := a.hostMap, a.vpnIP
+	a.RUnlock()
+
+	if hm == nil {
+		return nil, errors.New("nebula is not running yet")
+	}
+
+	localAddr, ok := local.(*net.TCPAddr)
+	if !ok || localAddr.IP.To4() == nil || ip2int(localAddr.IP.To4()) != vpnIP {
+		return nil, fmt.Errorf("%s did not connect over the tun, %s is not our vpn ip", remote, local)
+	}
+
+	h, err := hm.QueryVpnIP(ip2int(addr.IP.To4()))
+	if err != nil {
+		return nil, fmt.Errorf("no tunnel to %s", addr.IP)
+	}
+
+	c := h.GetCert()
+	if c == nil {
+		return nil, fmt.Errorf("no certificate is known for %s", addr.IP)
+	}
+
+	return c, nil
+}
+
+// fromOverlay refuses connections that do not come over a nebula tunnel
+func (a *sshCertAuth) fromOverlay(local, remote net.Addr) error {
+	_, err := a.peerCert(local, remote)
+	return err
+}
+
+// authenticate picks the role of the first rule matching the certificate of the connecting vpn ip
+func (a *sshCertAuth) authenticate(local, remote net.Addr) (*sshd.PeerIdentity, error) {
+	c, err := a.peerCert(local, remote)
+	if err != nil {
+		return nil, err
+	}
+
+	a.RLock()
+	defer a.RUnlock()
+	for _, r := range a.rules {
+		if !r.match(c) {
+			continue
+		}
+
+		fp, err := c.Sha256Sum()
+		if err != nil {
+			return nil, err
+		}
+
+		return &sshd.PeerIdentity{
+			Name:        strings.Join(c.Details.Names, ","),
+			Fingerprint: "nebula:" + fp,
+			Role:        r.role,
+		}, nil
+	}
+
+	return nil, fmt.Errorf("no sshd.nebula_auth rule matches the certificate of %s", strings.Join(c.Details.Names, ","))
+}
@@ -0,0 +1,114 @@
+package nebula
+
+import (
+	"net"
+	"testing"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/sshd"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSSHCertAuth(t *testing.T) {
+	l := NewTestLogger()
+	hm := NewHostMap(l, "test", &net.IPNet{}, make([]*net.IPNet, 0))
+	addHost := func(ip net.IP, name string, groups ...string) {
+		c := &cert.NebulaCertificate{Details: cert.NebulaCertificateDetails{
+			Names:          []string{name},
+			Groups:         groups,
+			InvertedGroups: make(map[string]struct{}),
+		}}
+		for _, g := range groups {
+			c.Details.InvertedGroups[g] = struct{}{}
+		}
+		hm.Add(ip2int(ip), &HostInfo{hostId: ip2int(ip), ConnectionState: &ConnectionState{peerCert: c}})
+	}
+	addHost(net.IPv4(10, 1, 0, 2), "ops-1", "ops", "oncall")
+	addHost(net.IPv4(10, 1, 0, 3), "dev-1", "dev")
+	addHost(net.IPv4(10, 1, 0, 4), "alice", "dev")
+	addHost(net.IPv4(10, 1, 0, 5), "ops-2", "ops")
+
+	c := NewConfig(l)
+	c.Settings["sshd"] = map[interface{}]interface{}{"nebula_auth": []interface{}{
+		map[interface{}]interface{}{"name": "alice", "role": "admin"},
+		map[interface{}]interface{}{"groups": []interface{}{"ops", "oncall"}, "role": "admin"},
+		map[interface{}]interface{}{"group": "dev", "role": "readonly"},
+	}}
+
+	a := &sshCertAuth{}
+	rules, err := parseSSHCertAuthRules(sshd.NewAuth(), c)
+	assert.Nil(t, err)
+	assert.Len(t, rules, 3)
+	a.setRules(rules)
+
+	remote := func(ip net.IP) net.Addr {
+		return &net.TCPAddr{IP: ip, Port: 50000}
+	}
+	// Connections over the tun are made to our vpn ip
+	local := &net.TCPAddr{IP: net.IPv4(10, 1, 0, 1), Port: 2222}
+
+	// Nothing gets in before we know about any tunnels
+	_, err = a.authenticate(local, remote(net.IPv4(10, 1, 0, 2)))
+	assert.EqualError(t, err, "nebula is not running yet")
+	a.setHostMap(hm, ip2int(net.IPv4(10, 1, 0, 1)))
+
+	id, err := a.authenticate(local, remote(net.IPv4(10, 1, 0, 2)))
+	assert.Nil(t, err)
+	assert.Equal(t, "ops-1", id.Name)
+	assert.Equal(t, "admin", id.Role)
+	assert.Contains(t, id.Fingerprint, "nebula:")
+
+	id, err = a.authenticate(local, remote(net.IPv4(10, 1, 0, 3)))
+	assert.Nil(t, err)
+	assert.Equal(t, "readonly", id.Role)
+
+	// The first matching rule wins
+	id, err = a.authenticate(local, remote(net.IPv4(10, 1, 0, 4)))
+	assert.Nil(t, err)
+	assert.Equal(t, "admin", id.Role)
+
+	// Every group of a rule must match
+	_, err = a.authenticate(local, remote(net.IPv4(10, 1, 0, 5)))
+	assert.EqualError(t, err, "no sshd.nebula_auth rule matches the certificate of ops-2")
+
+	_, err = a.authenticate(local, remote(net.IPv4(10, 1, 0, 9)))
+	assert.EqualError(t, err, "no tunnel to 10.1.0.9")
+	_, err = a.authenticate(local, remote(net.IPv4(127, 0, 0, 1)))
+	assert.EqualError(t, err, "no tunnel to 127.0.0.1")
+	assert.EqualError(t, a.fromOverlay(local, remote(net.IPv4(127, 0, 0, 1))), "no tunnel to 127.0.0.1")
+	assert.Nil(t, a.fromOverlay(local, remote(net.IPv4(10, 1, 0, 5))))
+
+	// An underlay host with the same address as a tunnel does not connect to our vpn ip
+	underlay := &net.TCPAddr{IP: net.IPv4(192, 168, 0, 1), Port: 2222}
+	_, err = a.authenticate(underlay, remote(net.IPv4(10, 1, 0, 2)))
+	assert.EqualError(t, err, "10.1.0.2:50000 did not connect over the tun, 192.168.0.1:2222 is not our vpn ip")
+	assert.Error(t, a.fromOverlay(underlay, remote(net.IPv4(10, 1, 0, 5))))
+
+	// No rules disables it
+	c.Settings["sshd"] = map[interface{}]interface{}{}
+	rules, err = parseSSHCertAuthRules(sshd.NewAuth(), c)
+	assert.Nil(t, err)
+	assert.Empty(t, rules)
+}
+
+func TestSSHCertAuth_loadRules(t *testing.T) {
+	l := NewTestLogger()
+	auth := sshd.NewAuth()
+
+	load := func(rules interface{}) error {
+		c := NewConfig(l)
+		c.Settings["sshd"] = map[interface{}]interface{}{"nebula_auth": rules}
+		_, err := parseSSHCertAuthRules(auth, c)
+		return err
+	}
+
+	assert.EqualError(t, load("ops"), "sshd.nebula_auth must be a list of rules")
+	assert.EqualError(t, load([]interface{}{"ops"}), "sshd.nebula_auth rule #0 must be a map")
+	assert.EqualError(t, load([]interface{}{map[interface{}]interface{}{"group": "ops"}}), "sshd.nebula_auth rule #0 is missing a role")
+	assert.EqualError(t, load([]interface{}{map[interface{}]interface{}{"group": "ops", "role": "boss"}}), "sshd.nebula_auth rule #0 has an unknown role: boss")
+	assert.EqualError(t, load([]interface{}{map[interface{}]interface{}{"role": "admin"}}), "sshd.nebula_auth rule #0 must have a name, group or groups")
+	assert.EqualError(t, load([]interface{}{map[interface{}]interface{}{"groups": "ops", "role": "admin"}}), "sshd.nebula_auth rule #0 groups must be a list")
+
+	assert.Nil(t, auth.AddRole("operator", []string{"close-tunnel"}))
+	assert.Nil(t, load([]interface{}{map[interface{}]interface{}{"group": "ops", "role": "operator"}}))
+}
@@ -0,0 +1,258 @@
+package nebula
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"flag"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/sshd"
+	"github.com/stretchr/testify/assert"
+	xssh "golang.org/x/crypto/ssh"
+)
+
+type testStringWriter struct {
+	bytes.Buffer
+	done chan struct{}
+}
+
+func (w *testStringWriter) WriteLine(s string) error {
+	return w.Write(s + "\n")
+}
+
+func (w *testStringWriter) Write(s string) error {
+	_, err := w.WriteString(s)
+	return err
+}
+
+func (w *testStringWriter) WriteBytes(b []byte) error {
+	_, err := w.Buffer.Write(b)
+	return err
+}
+
+func (w *testStringWriter) GetWriter() io.Writer {
+	return &w.Buffer
+}
+
+func (w *testStringWriter) Done() <-chan struct{} {
+	return w.done
+}
+
+// runSSHCommand parses args with the flags of the command and runs it, like the sshd would
+func runSSHCommand(t *testing.T, flags sshd.CommandFlags, cb sshd.CommandCallback, args ...string) (string, error) {
+	var fs interface{}
+	if flags != nil {
+		var fl *flag.FlagSet
+		fl, fs = flags()
+		assert.Nil(t, fl.Parse(args))
+		args = fl.Args()
+	}
+
+	w := &testStringWriter{}
+	err := cb(fs, args, w)
+	return w.String(), err
+}
+
+func TestSSHCommands_json(t *testing.T) {
+	l := NewTestLogger()
+	l.SetLevel(logrus.InfoLevel)
+
+	hm := NewHostMap(l, "test", &net.IPNet{}, make([]*net.IPNet, 0))
+	vpnIp := ip2int(net.IPv4(10, 1, 0, 2))
+	hm.Add(vpnIp, &HostInfo{hostId: vpnIp, ConnectionState: &ConnectionState{}})
+
+	ifce := &Interface{
+		hostMap:   hm,
+		version:   "1.2.3",
+		certState: &CertState{certificate: &cert.NebulaCertificate{Details: cert.NebulaCertificateDetails{Names: []string{"me"}}}},
+	}
+
+	logLevel := func(fs interface{}, a []string, w sshd.StringWriter) error {
+		return sshLogLevel(l, fs, a, w)
+	}
+	version := func(fs interface{}, a []string, w sshd.StringWriter) error {
+		return sshVersion(ifce, fs, a, w)
+	}
+	changeRemote := func(fs interface{}, a []string, w sshd.StringWriter) error {
+		return sshChangeRemote(ifce, fs, a, w)
+	}
+	changeRemoteFlags := func() (*flag.FlagSet, interface{}) {
+		fl := flag.NewFlagSet("", flag.ContinueOnError)
+		s := sshChangeRemoteFlags{}
+		s.register(fl, "")
+		fl.StringVar(&s.Address, "address", "", "")
+		return fl, &s
+	}
+
+	out, err := runSSHCommand(t, sshJsonFlagSet, version)
+	assert.Nil(t, err)
+	assert.Equal(t, "1.2.3\n", out)
+	out, err = runSSHCommand(t, sshJsonFlagSet, version, "-json")
+	assert.Nil(t, err)
+	assert.Equal(t, "{\"version\":\"1.2.3\"}\n", out)
+
+	out, err = runSSHCommand(t, sshJsonFlagSet, logLevel, "-json", "debug")
+	assert.Nil(t, err)
+	assert.Equal(t, "{\"level\":\"debug\"}\n", out)
+	assert.Equal(t, logrus.DebugLevel, l.Level)
+
+	// Failures are returned so exec requests exit non zero, and are json if asked for
+	out, err = runSSHCommand(t, sshJsonFlagSet, logLevel, "-json", "loud")
+	assert.Error(t, err)
+	assert.Contains(t, out, "{\"error\":\"Unknown log level [loud].")
+	out, err = runSSHCommand(t, sshJsonFlagSet, logLevel, "loud")
+	assert.Error(t, err)
+	assert.Contains(t, out, "Unknown log level [loud].")
+
+	out, err = runSSHCommand(t, changeRemoteFlags, changeRemote, "-json", "-address", "1.1.1.1:4242", "10.1.0.2")
+	assert.Nil(t, err)
+	assert.Equal(t, "{\"remote\":{\"ip\":\"1.1.1.1\",\"port\":4242},\"vpnIp\":\"10.1.0.2\"}\n", out)
+	out, err = runSSHCommand(t, changeRemoteFlags, changeRemote, "-json", "-address", "1.1.1.1:4242", "10.1.0.3")
+	assert.EqualError(t, err, "Could not find tunnel for vpn ip: 10.1.0.3")
+	assert.Equal(t, "{\"error\":\"Could not find tunnel for vpn ip: 10.1.0.3\"}\n", out)
+	out, err = runSSHCommand(t, changeRemoteFlags, changeRemote, "-address", "1.1.1.1:4242")
+	assert.EqualError(t, err, "No vpn ip was provided")
+	assert.Equal(t, "No vpn ip was provided\n", out)
+}
+
+// writeTestSSHHostKey writes a new host key to dir and returns its path
+func writeTestSSHHostKey(t *testing.T, dir string) string {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+	b, err := x509.MarshalPKCS8PrivateKey(key)
+	assert.Nil(t, err)
+	keyFile := filepath.Join(dir, "host_key")
+	assert.Nil(t, ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: b}), 0600))
+	return keyFile
+}
+
+func TestConfigSSH_roles(t *testing.T) {
+	l := NewTestLogger()
+	dir, err := ioutil.TempDir("", "ssh-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	keyFile := writeTestSSHHostKey(t, dir)
+
+	ssh, err := sshd.NewSSHServer(l.WithField("subsystem", "sshd"))
+	assert.Nil(t, err)
+
+	c := NewConfig(l)
+	c.Settings["sshd"] = map[interface{}]interface{}{
+		"listen":   "127.0.0.1:2222",
+		"host_key": keyFile,
+		"roles":    map[interface{}]interface{}{"operator": []interface{}{"close-tunnel"}},
+	}
+	assert.Nil(t, configSSH(l, ssh, &sshCertAuth{}, c))
+
+	c.Settings["sshd"].(map[interface{}]interface{})["roles"] = map[interface{}]interface{}{"admin": []interface{}{}}
+	assert.EqualError(t, configSSH(l, ssh, &sshCertAuth{}, c), "error while adding sshd.roles.admin: role admin is already defined")
+
+	c.Settings["sshd"].(map[interface{}]interface{})["roles"] = map[interface{}]interface{}{"operator": "close-tunnel"}
+	assert.EqualError(t, configSSH(l, ssh, &sshCertAuth{}, c), "sshd.roles.operator must be a list of commands")
+}
+
+func TestWireSSHReload_badConfig(t *testing.T) {
+	l := NewTestLogger()
+	dir, err := ioutil.TempDir("", "ssh-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	keyFile := writeTestSSHHostKey(t, dir)
+
+	ssh, err := sshd.NewSSHServer(l.WithField("subsystem", "sshd"))
+	assert.Nil(t, err)
+	defer ssh.Stop()
+
+	// Find a free port to listen on
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	listen := ln.Addr().String()
+	assert.Nil(t, ln.Close())
+
+	c := NewConfig(l)
+	c.Settings["sshd"] = map[interface{}]interface{}{"enabled": true, "listen": listen, "host_key": keyFile}
+	wireSSHReload(l, ssh, &sshCertAuth{}, c)
+	assert.Nil(t, configSSH(l, ssh, &sshCertAuth{}, c))
+
+	// A reload that can not be applied leaves the sshd running
+	c.reloadSettings(map[interface{}]interface{}{
+		"sshd": map[interface{}]interface{}{"enabled": true, "listen": listen},
+	})
+	conn, err := net.Dial("tcp", listen)
+	if assert.Nil(t, err) {
+		conn.Close()
+	}
+
+	// Turning it off still stops it
+	c.reloadSettings(map[interface{}]interface{}{
+		"sshd": map[interface{}]interface{}{"enabled": false},
+	})
+	_, err = net.Dial("tcp", listen)
+	assert.Error(t, err)
+}
+
+func TestWireSSHReload_badRole(t *testing.T) {
+	l := NewTestLogger()
+	dir, err := ioutil.TempDir("", "ssh-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	keyFile := writeTestSSHHostKey(t, dir)
+
+	_, userKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+	userSigner, err := xssh.NewSignerFromKey(userKey)
+	assert.Nil(t, err)
+
+	ssh, err := sshd.NewSSHServer(l.WithField("subsystem", "sshd"))
+	assert.Nil(t, err)
+	defer ssh.Stop()
+
+	// Find a free port to listen on
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	listen := ln.Addr().String()
+	assert.Nil(t, ln.Close())
+
+	settings := func(roles interface{}) map[interface{}]interface{} {
+		return map[interface{}]interface{}{"sshd": map[interface{}]interface{}{
+			"enabled":  true,
+			"listen":   listen,
+			"host_key": keyFile,
+			"roles":    roles,
+			"authorized_users": []interface{}{map[interface{}]interface{}{
+				"user": "bob",
+				"role": "operator",
+				"keys": string(xssh.MarshalAuthorizedKey(userSigner.PublicKey())),
+			}},
+		}}
+	}
+
+	c := NewConfig(l)
+	c.Settings = settings(map[interface{}]interface{}{"operator": []interface{}{"close-tunnel"}})
+	wireSSHReload(l, ssh, &sshCertAuth{}, c)
+	assert.Nil(t, configSSH(l, ssh, &sshCertAuth{}, c))
+
+	// A typo in a role must not take away the keys and roles that were working
+	c.reloadSettings(settings(map[interface{}]interface{}{"operator": "close-tunnel"}))
+	assert.True(t, ssh.HasRole("operator"))
+
+	client, err := xssh.Dial("tcp", listen, &xssh.ClientConfig{
+		User:            "bob",
+		Auth:            []xssh.AuthMethod{xssh.PublicKeys(userSigner)},
+		HostKeyCallback: xssh.InsecureIgnoreHostKey(),
+	})
+	if assert.Nil(t, err) {
+		client.Close()
+	}
+}
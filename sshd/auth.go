@@ -0,0 +1,94 @@
+package sshd
+
+import (
+	"fmt"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Auth decides who may log in and what they may run. A new one is built from config and swapped in whole with
+// SSHServer.SetAuth, so a config that fails to load leaves the one in use alone. It is not safe for concurrent use
+// until it is handed to the server.
+type Auth struct {
+	// Map of user -> authorized keys
+	trustedKeys map[string]map[string]bool
+
+	// Map of role name -> role and user -> role name, users without a role are admins
+	roles     map[string]*Role
+	userRoles map[string]string
+
+	// peerAuth authenticates connections that do not use an authorized key, if set
+	peerAuth PeerAuthFunc
+}
+
+// NewAuth returns an Auth with only the built in roles, no keys and no peer auth
+func NewAuth() *Auth {
+	return &Auth{
+		trustedKeys: make(map[string]map[string]bool),
+		roles: map[string]*Role{
+			RoleAdmin:    {Name: RoleAdmin, All: true},
+			RoleReadOnly: {Name: RoleReadOnly},
+		},
+		userRoles: make(map[string]string),
+	}
+}
+
+// AddRole defines a role that may run every read only command and the named commands
+func (a *Auth) AddRole(name string, commands []string) error {
+	if _, ok := a.roles[name]; ok {
+		return fmt.Errorf("role %s is already defined", name)
+	}
+
+	r := &Role{Name: name, Commands: make(map[string]bool)}
+	for _, c := range commands {
+		r.Commands[c] = true
+	}
+
+	a.roles[name] = r
+	return nil
+}
+
+// HasRole returns true if the role is built in or was added with AddRole
+func (a *Auth) HasRole(name string) bool {
+	_, ok := a.roles[name]
+	return ok
+}
+
+// SetUserRole limits the commands a user may run to those of the role
+func (a *Auth) SetUserRole(user, role string) error {
+	if _, ok := a.roles[role]; !ok {
+		return fmt.Errorf("unknown role %s", role)
+	}
+
+	a.userRoles[user] = role
+	return nil
+}
+
+func (a *Auth) userRole(user string) *Role {
+	if r, ok := a.roles[a.userRoles[user]]; ok {
+		return r
+	}
+	return a.roles[RoleAdmin]
+}
+
+// AddAuthorizedKey adds an ssh public key for a user
+func (a *Auth) AddAuthorizedKey(user, pubKey string) error {
+	pk, _, _, _, err := ssh.ParseAuthorizedKey([]byte(pubKey))
+	if err != nil {
+		return err
+	}
+
+	tk, ok := a.trustedKeys[user]
+	if !ok {
+		tk = make(map[string]bool)
+		a.trustedKeys[user] = tk
+	}
+
+	tk[string(pk.Marshal())] = true
+	return nil
+}
+
+// SetPeerAuth lets users without an authorized key in if f accepts the connection, nil disables it
+func (a *Auth) SetPeerAuth(f PeerAuthFunc) {
+	a.peerAuth = f
+}
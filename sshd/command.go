@@ -19,8 +19,8 @@ type CommandFlags func() (*flag.FlagSet, interface{})
 // and handled automatically for you.
 // a will be any unconsumed arguments, if no Command.Flags was available this will be all the flags passed in.
 // w is the writer to use when sending messages back to the client.
-// If an error is returned by the callback it is logged locally, the callback should handle messaging errors to the user
-// where appropriate
+// If an error is returned by the callback it is logged locally and a non interactive `ssh host command` exits with a
+// non zero status, the callback should handle messaging errors to the user where appropriate
 type CommandCallback func(fs interface{}, a []string, w StringWriter) error
 
 type Command struct {
@@ -29,6 +29,21 @@ type Command struct {
 	Help             string
 	Flags            CommandFlags
 	Callback         CommandCallback
+	// ReadOnly commands do not change anything and can be run by every role
+	ReadOnly bool
+}
+
+// Role limits which commands a user may run
+type Role struct {
+	Name string
+	// All allows every command, otherwise only read only commands and those in Commands are allowed
+	All      bool
+	Commands map[string]bool
+}
+
+// Allows returns true if the role may run c
+func (r *Role) Allows(c *Command) bool {
+	return r.All || c.ReadOnly || r.Commands[c.Name]
 }
 
 func execCommand(c *Command, args []string, w StringWriter) error {
@@ -40,8 +55,11 @@ func execCommand(c *Command, args []string, w StringWriter) error {
 	if c.Flags != nil {
 		fl, fs = c.Flags()
 		if fl != nil {
-			//TODO: handle the error
-			fl.Parse(args)
+			fl.SetOutput(w.GetWriter())
+			err := fl.Parse(args)
+			if err != nil {
+				return err
+			}
 			args = fl.Args()
 		}
 	}
@@ -1,25 +1,51 @@
 package sshd
 
 import (
+	"errors"
 	"fmt"
 	"net"
+	"sort"
+	"sync"
+	"syscall"
 
 	"github.com/armon/go-radix"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/crypto/ssh"
 )
 
+// The built in roles, admin may run every command and readonly only the read only ones
+const (
+	RoleAdmin    = "admin"
+	RoleReadOnly = "readonly"
+)
+
+// PeerIdentity is who a connection is from, as decided by a PeerAuthFunc
+type PeerIdentity struct {
+	Name        string
+	Fingerprint string
+	Role        string
+}
+
+// PeerAuthFunc authenticates a connection by where it comes from and the local address it was made to instead of an
+// ssh key. It returns nil and an error explaining why if the connection is not allowed.
+type PeerAuthFunc func(local, remote net.Addr) (*PeerIdentity, error)
+
 type SSHServer struct {
+	// lock guards everything that can be changed by a config reload while the server is running
+	lock   sync.RWMutex
 	config *ssh.ServerConfig
 	l      *logrus.Entry
 
-	// Map of user -> authorized keys
-	trustedKeys map[string]map[string]bool
+	// auth decides who may log in and what they may run
+	auth *Auth
+	// remoteFilter drops connections before the ssh handshake, if set
+	remoteFilter func(local, remote net.Addr) error
 
 	// List of available commands
 	helpCommand *Command
 	commands    *radix.Tree
 	listener    net.Listener
+	listenAddr  string
 	conns       map[int]*session
 	counter     int
 }
@@ -27,22 +53,17 @@ type SSHServer struct {
 // NewSSHServer creates a new ssh server rigged with default commands and prepares to listen
 func NewSSHServer(l *logrus.Entry) (*SSHServer, error) {
 	s := &SSHServer{
-		trustedKeys: make(map[string]map[string]bool),
-		l:           l,
-		commands:    radix.New(),
-		conns:       make(map[int]*session),
-	}
-
-	s.config = &ssh.ServerConfig{
-		PublicKeyCallback: s.matchPubKey,
-		//TODO: AuthLogCallback: s.authAttempt,
-		//TODO: version string
-		ServerVersion: fmt.Sprintf("SSH-2.0-Nebula???"),
+		auth:     NewAuth(),
+		l:        l,
+		commands: radix.New(),
+		conns:    make(map[int]*session),
 	}
 
+	s.config = s.newConfig()
 	s.RegisterCommand(&Command{
 		Name:             "help",
 		ShortDescription: "prints available commands or help <command> for specific usage info",
+		ReadOnly:         true,
 		Callback: func(a interface{}, args []string, w StringWriter) error {
 			return helpCallback(s.commands, args, w)
 		},
@@ -51,34 +72,134 @@ func NewSSHServer(l *logrus.Entry) (*SSHServer, error) {
 	return s, nil
 }
 
+func (s *SSHServer) newConfig() *ssh.ServerConfig {
+	return &ssh.ServerConfig{
+		PublicKeyCallback:           s.matchPubKey,
+		KeyboardInteractiveCallback: s.matchPeer,
+		//TODO: AuthLogCallback: s.authAttempt,
+		//TODO: version string
+		ServerVersion: fmt.Sprintf("SSH-2.0-Nebula???"),
+	}
+}
+
+// SetHostKey replaces the host key, only connections made after it is set will see the new key
 func (s *SSHServer) SetHostKey(hostPrivateKey []byte) error {
 	private, err := ssh.ParsePrivateKey(hostPrivateKey)
 	if err != nil {
 		return fmt.Errorf("failed to parse private key: %s", err)
 	}
 
-	s.config.AddHostKey(private)
+	// Build a new config instead of adding to the old one so a key of a different type does not linger
+	config := s.newConfig()
+	config.AddHostKey(private)
+
+	s.lock.Lock()
+	s.config = config
+	s.lock.Unlock()
 	return nil
 }
 
 func (s *SSHServer) ClearAuthorizedKeys() {
-	s.trustedKeys = make(map[string]map[string]bool)
+	s.lock.Lock()
+	s.auth.trustedKeys = make(map[string]map[string]bool)
+	s.lock.Unlock()
+}
+
+// ClearRoles removes every role but the built in ones and the roles assigned to users
+func (s *SSHServer) ClearRoles() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	fresh := NewAuth()
+	s.auth.roles, s.auth.userRoles = fresh.roles, fresh.userRoles
+}
+
+// SetAuth replaces the keys, roles and peer auth all at once, open sessions keep the role they logged in with
+func (s *SSHServer) SetAuth(a *Auth) {
+	s.lock.Lock()
+	s.auth = a
+	s.lock.Unlock()
+}
+
+// AddRole defines a role that may run every read only command and the named commands
+func (s *SSHServer) AddRole(name string, commands []string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.auth.AddRole(name, commands)
+}
+
+// CheckRoles returns an error if a role names a command that is not registered. Roles are usually configured before
+// the commands are registered so AddRole can not do this itself.
+func (s *SSHServer) CheckRoles() error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	roles := s.auth.roles
+	names := make([]string, 0, len(roles))
+	for name := range roles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		cmds := make([]string, 0, len(roles[name].Commands))
+		for c := range roles[name].Commands {
+			cmds = append(cmds, c)
+		}
+		sort.Strings(cmds)
+
+		for _, c := range cmds {
+			if _, ok := s.commands.Get(c); !ok {
+				return fmt.Errorf("role %s allows unknown command %s", name, c)
+			}
+		}
+	}
+
+	return nil
+}
+
+// SetUserRole limits the commands a user may run to those of the role
+func (s *SSHServer) SetUserRole(user, role string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.auth.SetUserRole(user, role)
+}
+
+func (s *SSHServer) userRole(user string) *Role {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.auth.userRole(user)
+}
+
+// HasRole returns true if the role is built in or was added with AddRole
+func (s *SSHServer) HasRole(name string) bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.auth.HasRole(name)
+}
+
+// SetPeerAuth lets users without an authorized key in if f accepts the connection, nil disables it
+func (s *SSHServer) SetPeerAuth(f PeerAuthFunc) {
+	s.lock.Lock()
+	s.auth.SetPeerAuth(f)
+	s.lock.Unlock()
+}
+
+// SetRemoteFilter drops every connection f returns an error for before the ssh handshake, nil accepts all of them
+func (s *SSHServer) SetRemoteFilter(f func(local, remote net.Addr) error) {
+	s.lock.Lock()
+	s.remoteFilter = f
+	s.lock.Unlock()
 }
 
 // AddAuthorizedKey adds an ssh public key for a user
 func (s *SSHServer) AddAuthorizedKey(user, pubKey string) error {
-	pk, _, _, _, err := ssh.ParseAuthorizedKey([]byte(pubKey))
+	s.lock.Lock()
+	err := s.auth.AddAuthorizedKey(user, pubKey)
+	s.lock.Unlock()
 	if err != nil {
 		return err
 	}
 
-	tk, ok := s.trustedKeys[user]
-	if !ok {
-		tk = make(map[string]bool)
-		s.trustedKeys[user] = tk
-	}
-
-	tk[string(pk.Marshal())] = true
 	s.l.WithField("sshKey", pubKey).WithField("sshUser", user).Info("Authorized ssh key")
 	return nil
 }
@@ -88,23 +209,97 @@ func (s *SSHServer) RegisterCommand(c *Command) {
 	s.commands.Insert(c.Name, c)
 }
 
-// Run begins listening and accepting connections
-func (s *SSHServer) Run(addr string) error {
-	var err error
-	s.listener, err = net.Listen("tcp", addr)
+// Listen starts accepting connections on addr, nothing happens if the server is already listening there. If it is
+// listening somewhere else the old listener is closed once addr is bound, sessions that are already open stay up. The
+// old listener is only closed first if addr overlaps it on the same port, any other failure leaves it listening.
+func (s *SSHServer) Listen(addr string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.listener != nil && s.listenAddr == addr {
+		return nil
+	}
+
+	old, oldAddr := s.listener, s.listenAddr
+	listener, err := net.Listen("tcp", addr)
+	if err != nil && old != nil && errors.Is(err, syscall.EADDRINUSE) && samePort(addr, old.Addr()) {
+		// The new address overlaps with the old one, like going from 0.0.0.0:2222 to 127.0.0.1:2222
+		s.closeListener(old, oldAddr)
+		s.listener, s.listenAddr, old = nil, "", nil
+		listener, err = net.Listen("tcp", addr)
+	}
 	if err != nil {
 		return err
 	}
 
+	s.listener, s.listenAddr = listener, addr
+	go s.serve(listener)
 	s.l.WithField("sshListener", addr).Info("SSH server is listening")
+
+	if old != nil {
+		s.closeListener(old, oldAddr)
+	}
+
+	return nil
+}
+
+// samePort returns true if addr uses the port bound is listening on
+func samePort(addr string, bound net.Addr) bool {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+
+	_, boundPort, err := net.SplitHostPort(bound.String())
+	if err != nil {
+		return false
+	}
+
+	return port == boundPort
+}
+
+func (s *SSHServer) closeListener(listener net.Listener, addr string) {
+	err := listener.Close()
+	if err != nil {
+		s.l.WithError(err).WithField("sshListener", addr).Warn("Failed to close the sshd listener")
+		return
+	}
+
+	s.l.WithField("sshListener", addr).Info("SSH server stopped listening")
+}
+
+// serve accepts connections until listener is closed
+func (s *SSHServer) serve(listener net.Listener) {
 	for {
-		c, err := s.listener.Accept()
+		c, err := listener.Accept()
 		if err != nil {
-			s.l.WithError(err).Warn("Error in listener, shutting down")
-			return nil
+			s.lock.Lock()
+			current := s.listener == listener
+			if current {
+				s.listener, s.listenAddr = nil, ""
+			}
+			s.lock.Unlock()
+
+			// Listeners replaced by Listen or closed by Stop are expected to fail
+			if current {
+				s.l.WithError(err).Warn("Error in listener, shutting down")
+			}
+			return
 		}
 
-		conn, chans, reqs, err := ssh.NewServerConn(c, s.config)
+		s.lock.RLock()
+		remoteFilter, config := s.remoteFilter, s.config
+		s.lock.RUnlock()
+
+		if remoteFilter != nil {
+			if err := remoteFilter(c.LocalAddr(), c.RemoteAddr()); err != nil {
+				s.l.WithError(err).WithField("remoteAddress", c.RemoteAddr()).Warn("Refused ssh connection")
+				c.Close()
+				continue
+			}
+		}
+
+		conn, chans, reqs, err := ssh.NewServerConn(c, config)
 		fp := ""
 		if conn != nil {
 			fp = conn.Permissions.Extensions["fp"]
@@ -123,53 +318,87 @@ func (s *SSHServer) Run(addr string) error {
 			continue
 		}
 
+		// The role was picked when the user was authenticated
+		s.lock.RLock()
+		role, ok := s.auth.roles[conn.Permissions.Extensions["role"]]
+		s.lock.RUnlock()
+		if !ok {
+			s.l.WithField("sshUser", conn.User()).WithField("sshRole", conn.Permissions.Extensions["role"]).
+				Warn("ssh role was removed while logging in")
+			conn.Close()
+			continue
+		}
+
 		l := s.l.WithField("sshUser", conn.User())
-		l.WithField("remoteAddress", c.RemoteAddr()).WithField("sshFingerprint", fp).Info("ssh user logged in")
+		if name := conn.Permissions.Extensions["peer"]; name != "" {
+			l = l.WithField("sshPeer", name)
+		}
+		l.WithField("remoteAddress", c.RemoteAddr()).WithField("sshFingerprint", fp).WithField("sshRole", role.Name).
+			Info("ssh user logged in")
 
-		session := NewSession(s.commands, conn, chans, l.WithField("subsystem", "sshd.session"))
+		l = l.WithField("sshFingerprint", fp).WithField("sshRole", role.Name)
+		session := NewSession(s.commands, conn, chans, role, l.WithField("subsystem", "sshd.session"))
+
+		s.lock.Lock()
 		s.counter++
 		counter := s.counter
 		s.conns[counter] = session
+		s.lock.Unlock()
 
 		go ssh.DiscardRequests(reqs)
 		go func() {
 			<-session.exitChan
 			s.l.WithField("id", counter).Debug("closing conn")
+			s.lock.Lock()
 			delete(s.conns, counter)
+			s.lock.Unlock()
 		}()
 	}
 }
 
+// Stop closes the listener and every open session
 func (s *SSHServer) Stop() {
+	s.lock.Lock()
+	conns := make([]*session, 0, len(s.conns))
 	for _, c := range s.conns {
-		c.Close()
+		conns = append(conns, c)
 	}
+	listener, addr := s.listener, s.listenAddr
+	s.listener, s.listenAddr = nil, ""
+	s.lock.Unlock()
 
-	if s.listener == nil {
-		return
+	// Closing a session waits for it to be forgotten, which needs the lock
+	for _, c := range conns {
+		c.Close()
 	}
 
-	err := s.listener.Close()
-	if err != nil {
-		s.l.WithError(err).Warn("Failed to close the sshd listener")
-		return
+	if listener != nil {
+		s.closeListener(listener, addr)
 	}
-
-	s.l.Info("SSH server stopped listening")
-	return
 }
 
 func (s *SSHServer) matchPubKey(c ssh.ConnMetadata, pubKey ssh.PublicKey) (*ssh.Permissions, error) {
 	pk := string(pubKey.Marshal())
 	fp := ssh.FingerprintSHA256(pubKey)
 
-	tk, ok := s.trustedKeys[c.User()]
-	if !ok {
+	s.lock.RLock()
+	tk, userOk := s.auth.trustedKeys[c.User()]
+	keyOk := tk[pk]
+	peerAuth := s.auth.peerAuth
+	role := s.auth.userRole(c.User())
+	s.lock.RUnlock()
+
+	if !userOk {
+		if peerAuth != nil {
+			return s.matchPeer(c, nil)
+		}
 		return nil, fmt.Errorf("unknown user %s", c.User())
 	}
 
-	_, ok = tk[pk]
-	if !ok {
+	if !keyOk {
+		if peerAuth != nil {
+			return s.matchPeer(c, nil)
+		}
 		return nil, fmt.Errorf("unknown public key for %s (%s)", c.User(), fp)
 	}
 
@@ -178,6 +407,32 @@ func (s *SSHServer) matchPubKey(c ssh.ConnMetadata, pubKey ssh.PublicKey) (*ssh.
 		Extensions: map[string]string{
 			"fp":   fp,
 			"user": c.User(),
+			"role": role.Name,
+		},
+	}, nil
+}
+
+// matchPeer authenticates users by where they connect from, the client does not have to answer any questions
+func (s *SSHServer) matchPeer(c ssh.ConnMetadata, _ ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+	s.lock.RLock()
+	peerAuth := s.auth.peerAuth
+	s.lock.RUnlock()
+
+	if peerAuth == nil {
+		return nil, fmt.Errorf("unknown user %s", c.User())
+	}
+
+	id, err := peerAuth(c.LocalAddr(), c.RemoteAddr())
+	if err != nil {
+		return nil, err
+	}
+
+	return &ssh.Permissions{
+		Extensions: map[string]string{
+			"fp":   id.Fingerprint,
+			"user": c.User(),
+			"peer": id.Name,
+			"role": id.Role,
 		},
 	}, nil
 }
@@ -0,0 +1,125 @@
+package sshd
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"net"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+// newTestKey returns a pem encoded private key and its ssh public key
+func newTestKey(t *testing.T) ([]byte, ssh.Signer) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+	b, err := x509.MarshalPKCS8PrivateKey(key)
+	assert.Nil(t, err)
+	signer, err := ssh.NewSignerFromKey(key)
+	assert.Nil(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: b}), signer
+}
+
+func TestSSHServer_reload(t *testing.T) {
+	s, err := NewSSHServer(logrus.NewEntry(logrus.New()))
+	assert.Nil(t, err)
+	defer s.Stop()
+
+	hostKey1, hostSigner1 := newTestKey(t)
+	hostKey2, hostSigner2 := newTestKey(t)
+	_, userSigner := newTestKey(t)
+
+	assert.Nil(t, s.SetHostKey(hostKey1))
+	assert.Nil(t, s.AddAuthorizedKey("bob", string(ssh.MarshalAuthorizedKey(userSigner.PublicKey()))))
+
+	// Find a free port so the second Listen is a different address
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	addr1 := l.Addr().String()
+	assert.Nil(t, l.Close())
+
+	assert.Nil(t, s.Listen(addr1))
+	assert.Nil(t, s.Listen(addr1), "listening on the same address again is a no-op")
+
+	dial := func(addr string) (*ssh.Client, ssh.PublicKey, error) {
+		var hostKey ssh.PublicKey
+		client, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+			User: "bob",
+			Auth: []ssh.AuthMethod{ssh.PublicKeys(userSigner)},
+			HostKeyCallback: func(_ string, _ net.Addr, key ssh.PublicKey) error {
+				hostKey = key
+				return nil
+			},
+		})
+		return client, hostKey, err
+	}
+
+	client, hostKey, err := dial(addr1)
+	assert.Nil(t, err)
+	defer client.Close()
+	assert.Equal(t, hostSigner1.PublicKey().Marshal(), hostKey.Marshal())
+	_, status := testExec(t, client, "help")
+	assert.Equal(t, 0, status)
+
+	// Swap everything out from under the open session
+	assert.Nil(t, s.SetHostKey(hostKey2))
+	s.ClearAuthorizedKeys()
+	assert.Nil(t, s.Listen("127.0.0.1:0"))
+	s.lock.RLock()
+	addr2 := s.listener.Addr().String()
+	s.lock.RUnlock()
+
+	_, _, err = dial(addr1)
+	assert.Error(t, err, "the old listener should be closed")
+
+	_, _, err = dial(addr2)
+	assert.Error(t, err, "bob's key was removed")
+
+	assert.Nil(t, s.AddAuthorizedKey("bob", string(ssh.MarshalAuthorizedKey(userSigner.PublicKey()))))
+	client2, hostKey, err := dial(addr2)
+	assert.Nil(t, err)
+	defer client2.Close()
+	assert.Equal(t, hostSigner2.PublicKey().Marshal(), hostKey.Marshal())
+
+	// The session from before the reload is still up
+	_, status = testExec(t, client, "help")
+	assert.Equal(t, 0, status)
+
+	// Stop closes every session
+	s.Stop()
+	_, err = client.NewSession()
+	assert.Error(t, err)
+}
+
+func TestSSHServer_listenFailure(t *testing.T) {
+	s, err := NewSSHServer(logrus.NewEntry(logrus.New()))
+	assert.Nil(t, err)
+	defer s.Stop()
+
+	assert.Nil(t, s.Listen("127.0.0.1:0"))
+	s.lock.RLock()
+	addr := s.listener.Addr().String()
+	s.lock.RUnlock()
+
+	// Something else has the new port, the old listener must stay up
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer taken.Close()
+
+	assert.Error(t, s.Listen(taken.Addr().String()))
+	c, err := net.Dial("tcp", addr)
+	assert.Nil(t, err, "the old listener should still be up")
+	c.Close()
+
+	// Moving to an address that overlaps the old one on the same port closes the old listener first
+	_, port, err := net.SplitHostPort(addr)
+	assert.Nil(t, err)
+	assert.Nil(t, s.Listen(net.JoinHostPort("0.0.0.0", port)))
+	c, err = net.Dial("tcp", addr)
+	assert.Nil(t, err)
+	c.Close()
+}
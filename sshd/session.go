@@ -12,25 +12,37 @@ import (
 	"golang.org/x/crypto/ssh/terminal"
 )
 
+// Exit statuses of non interactive commands, these follow the shell conventions
+const (
+	exitSuccess          = 0
+	exitFailure          = 1
+	exitPermissionDenied = 126
+	exitUnknownCommand   = 127
+)
+
 type session struct {
 	l        *logrus.Entry
 	c        *ssh.ServerConn
 	term     *terminal.Terminal
 	commands *radix.Tree
+	role     *Role
 	exitChan chan bool
 }
 
-func NewSession(commands *radix.Tree, conn *ssh.ServerConn, chans <-chan ssh.NewChannel, l *logrus.Entry) *session {
+// NewSession serves commands to an authenticated ssh connection, only those role allows can be run
+func NewSession(commands *radix.Tree, conn *ssh.ServerConn, chans <-chan ssh.NewChannel, role *Role, l *logrus.Entry) *session {
 	s := &session{
 		commands: radix.NewFromMap(commands.ToMap()),
 		l:        l,
 		c:        conn,
-		exitChan: make(chan bool),
+		role:     role,
+		exitChan: make(chan bool, 1),
 	}
 
 	s.commands.Insert("logout", &Command{
 		Name:             "logout",
 		ShortDescription: "Ends the current session",
+		ReadOnly:         true,
 		Callback: func(a interface{}, args []string, w StringWriter) error {
 			s.Close()
 			return nil
@@ -81,11 +93,28 @@ func (s *session) handleRequests(in <-chan *ssh.Request, channel ssh.Channel) {
 		case "exec":
 			var payload = struct{ Value string }{}
 			cErr := ssh.Unmarshal(req.Payload, &payload)
-			if cErr == nil {
-				s.dispatchCommand(payload.Value, &stringWriter{channel})
-			} else {
-				//TODO: log it
+			if cErr != nil {
+				s.l.WithError(cErr).Info("Failed to parse ssh exec request")
+				_ = req.Reply(false, nil)
+				channel.Close()
+				return
 			}
+
+			_ = req.Reply(true, nil)
+
+			// Nothing else is expected once the command is running, the requests stop when the channel is closed
+			done := make(chan struct{})
+			go func() {
+				for req := range in {
+					if req.WantReply {
+						_ = req.Reply(false, nil)
+					}
+				}
+				close(done)
+			}()
+
+			status := s.dispatchCommand(payload.Value, &stringWriter{w: channel, done: done})
+			s.sendExitStatus(channel, status)
 			channel.Close()
 			return
 
@@ -126,7 +155,6 @@ func (s *session) createTerm(channel ssh.Channel) *terminal.Terminal {
 
 func (s *session) handleInput(channel ssh.Channel) {
 	defer s.Close()
-	w := &stringWriter{w: s.term}
 	for {
 		line, err := s.term.ReadLine()
 		if err != nil {
@@ -134,50 +162,97 @@ func (s *session) handleInput(channel ssh.Channel) {
 			break
 		}
 
-		s.dispatchCommand(line, w)
+		// The terminal is not reading while a command runs, so ctrl-c can be read straight from the channel
+		s.dispatchCommand(line, &stringWriter{w: s.term, interrupt: func() <-chan struct{} {
+			return readInterrupt(channel)
+		}})
 	}
 }
 
-func (s *session) dispatchCommand(line string, w StringWriter) {
+// dispatchCommand runs the command in line and returns the exit status for non interactive requests
+func (s *session) dispatchCommand(line string, w StringWriter) int {
 	args, err := shlex.Split(line, true)
 	if err != nil {
-		//todo: LOG IT
-		return
+		s.l.WithError(err).WithField("command", line).Debug("Failed to split ssh command")
+		_ = w.WriteLine(fmt.Sprintf("could not parse command: %s", err))
+		return exitFailure
 	}
 
 	if len(args) == 0 {
 		dumpCommands(s.commands, w)
-		return
+		return exitSuccess
 	}
 
 	c, err := lookupCommand(s.commands, args[0])
 	if err != nil {
-		//TODO: handle the error
-		return
+		s.l.WithError(err).WithField("command", args[0]).Error("Failed to look up ssh command")
+		return exitFailure
 	}
 
 	if c == nil {
+		s.audit(args, false).Info("ssh command not found")
 		err := w.WriteLine(fmt.Sprintf("did not understand: %s", line))
 		//TODO: log error
 		_ = err
 
 		dumpCommands(s.commands, w)
-		return
+		return exitUnknownCommand
 	}
 
 	if checkHelpArgs(args) {
-		s.dispatchCommand(fmt.Sprintf("%s %s", "help", c.Name), w)
-		return
+		return s.dispatchCommand(fmt.Sprintf("%s %s", "help", c.Name), w)
+	}
+
+	if !s.role.Allows(c) {
+		s.audit(args, false).Warn("ssh command denied")
+		_ = w.WriteLine(fmt.Sprintf("permission denied: the %s role can not run %s", s.role.Name, c.Name))
+		return exitPermissionDenied
 	}
 
+	s.audit(args, true).Info("ssh command")
 	err = execCommand(c, args[1:], w)
 	if err != nil {
-		//TODO: log the error
+		s.l.WithError(err).WithField("command", c.Name).Debug("ssh command failed")
+		return exitFailure
 	}
-	return
+	return exitSuccess
 }
 
+// audit returns the entry that records a command invocation in the audit log, the user, key fingerprint and role
+// are already fields of the session logger. Audit records are written no matter the log level, they go through a
+// logger that shares everything with the session logger but its level.
+func (s *session) audit(args []string, allowed bool) *logrus.Entry {
+	l := s.l.Logger
+	al := &logrus.Logger{
+		Out:          l.Out,
+		Hooks:        l.Hooks,
+		Formatter:    l.Formatter,
+		ReportCaller: l.ReportCaller,
+		Level:        logrus.InfoLevel,
+		ExitFunc:     l.ExitFunc,
+	}
+
+	return logrus.NewEntry(al).WithFields(s.l.Data).
+		WithField("subsystem", "sshd.audit").
+		WithField("command", args[0]).
+		WithField("args", args[1:]).
+		WithField("allowed", allowed)
+}
+
+// sendExitStatus tells the client how a non interactive command went, like sshd does for a program
+func (s *session) sendExitStatus(channel ssh.Channel, status int) {
+	payload := ssh.Marshal(struct{ Status uint32 }{uint32(status)})
+	_, err := channel.SendRequest("exit-status", false, payload)
+	if err != nil {
+		s.l.WithError(err).Debug("Failed to send ssh exit status")
+	}
+}
+
+// Close closes the connection, it is safe to call more than once
 func (s *session) Close() {
 	s.c.Close()
-	s.exitChan <- true
+	select {
+	case s.exitChan <- true:
+	default:
+	}
 }
@@ -0,0 +1,327 @@
+package sshd
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"flag"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/armon/go-radix"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+// newTestSession connects an ssh client to a session serving commands over a loopback connection
+func newTestSession(t *testing.T, commands *radix.Tree, role *Role, l *logrus.Logger) *ssh.Client {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+	signer, err := ssh.NewSignerFromKey(key)
+	assert.Nil(t, err)
+
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(signer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer listener.Close()
+
+	go func() {
+		c, err := listener.Accept()
+		if err != nil {
+			return
+		}
+
+		conn, chans, reqs, err := ssh.NewServerConn(c, config)
+		if err != nil {
+			return
+		}
+		go ssh.DiscardRequests(reqs)
+		NewSession(commands, conn, chans, role, logrus.NewEntry(l))
+	}()
+
+	client, err := ssh.Dial("tcp", listener.Addr().String(), &ssh.ClientConfig{
+		User:            "test",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	assert.Nil(t, err)
+	return client
+}
+
+// testExec runs cmd non interactively and returns its output and exit status
+func testExec(t *testing.T, client *ssh.Client, cmd string) (string, int) {
+	s, err := client.NewSession()
+	assert.Nil(t, err)
+	defer s.Close()
+
+	out, err := s.Output(cmd)
+	if exitErr, ok := err.(*ssh.ExitError); ok {
+		return string(out), exitErr.ExitStatus()
+	}
+	assert.Nil(t, err)
+	return string(out), 0
+}
+
+func TestSession_exec(t *testing.T) {
+	commands := radix.New()
+	commands.Insert("ok", &Command{
+		Name: "ok",
+		Flags: func() (*flag.FlagSet, interface{}) {
+			fl := flag.NewFlagSet("", flag.ContinueOnError)
+			return fl, fl.Bool("loud", false, "")
+		},
+		Callback: func(fs interface{}, a []string, w StringWriter) error {
+			if *fs.(*bool) {
+				return w.WriteLine("HELLO")
+			}
+			return w.WriteLine("hello")
+		},
+	})
+	commands.Insert("fail", &Command{
+		Name: "fail",
+		Callback: func(fs interface{}, a []string, w StringWriter) error {
+			_ = w.WriteLine("it broke")
+			return errors.New("it broke")
+		},
+	})
+
+	client := newTestSession(t, commands, &Role{Name: RoleAdmin, All: true}, logrus.New())
+	defer client.Close()
+
+	exec := func(cmd string) (string, int) {
+		return testExec(t, client, cmd)
+	}
+
+	out, status := exec("ok -loud")
+	assert.Equal(t, "HELLO\n", out)
+	assert.Equal(t, 0, status)
+
+	out, status = exec("fail")
+	assert.Equal(t, "it broke\n", out)
+	assert.Equal(t, 1, status)
+
+	// Bad flags are reported to the user instead of being ignored
+	out, status = exec("ok -nope")
+	assert.Contains(t, out, "flag provided but not defined: -nope")
+	assert.Equal(t, 1, status)
+
+	out, status = exec("nope")
+	assert.Contains(t, out, "did not understand: nope")
+	assert.Equal(t, 127, status)
+}
+
+func TestSession_roles(t *testing.T) {
+	ran := ""
+	commands := radix.New()
+	for _, c := range []*Command{{Name: "look", ReadOnly: true}, {Name: "poke"}, {Name: "break"}} {
+		name := c.Name
+		c.Callback = func(fs interface{}, a []string, w StringWriter) error {
+			ran = name
+			return nil
+		}
+		commands.Insert(c.Name, c)
+	}
+
+	l, hook := test.NewNullLogger()
+	client := newTestSession(t, commands, &Role{Name: "poker", Commands: map[string]bool{"poke": true}}, l)
+	defer client.Close()
+
+	_, status := testExec(t, client, "look")
+	assert.Equal(t, 0, status)
+	assert.Equal(t, "look", ran)
+
+	_, status = testExec(t, client, "poke -hard")
+	assert.Equal(t, 0, status)
+	assert.Equal(t, "poke", ran)
+
+	out, status := testExec(t, client, "break now")
+	assert.Equal(t, "permission denied: the poker role can not run break\n", out)
+	assert.Equal(t, 126, status)
+	assert.Equal(t, "poke", ran)
+
+	// Every invocation is audited, allowed or not
+	var audit []*logrus.Entry
+	for _, e := range hook.AllEntries() {
+		if e.Data["subsystem"] == "sshd.audit" {
+			audit = append(audit, e)
+		}
+	}
+
+	assert.Len(t, audit, 3)
+	assert.Equal(t, "poke", audit[1].Data["command"])
+	assert.Equal(t, []string{"-hard"}, audit[1].Data["args"])
+	assert.Equal(t, true, audit[1].Data["allowed"])
+	assert.Equal(t, "break", audit[2].Data["command"])
+	assert.Equal(t, []string{"now"}, audit[2].Data["args"])
+	assert.Equal(t, false, audit[2].Data["allowed"])
+}
+
+func TestSession_auditIgnoresLogLevel(t *testing.T) {
+	commands := radix.New()
+	commands.Insert("poke", &Command{Name: "poke", Callback: func(interface{}, []string, StringWriter) error {
+		return nil
+	}})
+
+	// Nothing the session logs on its own gets past the error level, the audit records must
+	l, hook := test.NewNullLogger()
+	l.SetLevel(logrus.ErrorLevel)
+	client := newTestSession(t, commands, &Role{Name: "looker", Commands: map[string]bool{}}, l)
+	defer client.Close()
+
+	_, status := testExec(t, client, "poke")
+	assert.Equal(t, 126, status)
+
+	entries := hook.AllEntries()
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, "sshd.audit", entries[0].Data["subsystem"])
+		assert.Equal(t, "poke", entries[0].Data["command"])
+		assert.Equal(t, logrus.WarnLevel, entries[0].Level)
+	}
+}
+
+func TestSSHServer_roles(t *testing.T) {
+	s, err := NewSSHServer(logrus.NewEntry(logrus.New()))
+	assert.Nil(t, err)
+
+	assert.Nil(t, s.AddRole("operator", []string{"close-tunnel"}))
+	assert.EqualError(t, s.AddRole("admin", nil), "role admin is already defined")
+	assert.EqualError(t, s.SetUserRole("bob", "nope"), "unknown role nope")
+	assert.Nil(t, s.SetUserRole("bob", "operator"))
+	assert.Nil(t, s.SetUserRole("alice", RoleReadOnly))
+
+	assert.Equal(t, "operator", s.userRole("bob").Name)
+	assert.Equal(t, RoleReadOnly, s.userRole("alice").Name)
+	assert.Equal(t, RoleAdmin, s.userRole("carol").Name)
+
+	closeTunnel := &Command{Name: "close-tunnel"}
+	assert.True(t, s.userRole("bob").Allows(closeTunnel))
+	assert.False(t, s.userRole("alice").Allows(closeTunnel))
+	assert.True(t, s.userRole("alice").Allows(&Command{Name: "version", ReadOnly: true}))
+
+	// Roles may only name registered commands
+	assert.EqualError(t, s.CheckRoles(), "role operator allows unknown command close-tunnel")
+	s.RegisterCommand(closeTunnel)
+	assert.Nil(t, s.CheckRoles())
+
+	// Clearing the roles makes everyone an admin again
+	s.ClearRoles()
+	assert.Equal(t, RoleAdmin, s.userRole("bob").Name)
+}
+
+type testConnMetadata struct {
+	user   string
+	local  net.Addr
+	remote net.Addr
+}
+
+func (c *testConnMetadata) User() string          { return c.user }
+func (c *testConnMetadata) SessionID() []byte     { return nil }
+func (c *testConnMetadata) ClientVersion() []byte { return nil }
+func (c *testConnMetadata) ServerVersion() []byte { return nil }
+func (c *testConnMetadata) RemoteAddr() net.Addr  { return c.remote }
+func (c *testConnMetadata) LocalAddr() net.Addr   { return c.local }
+
+func TestSSHServer_peerAuth(t *testing.T) {
+	s, err := NewSSHServer(logrus.NewEntry(logrus.New()))
+	assert.Nil(t, err)
+
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+	key, err := ssh.NewPublicKey(pub)
+	assert.Nil(t, err)
+
+	trusted := &net.TCPAddr{IP: net.IPv4(10, 1, 0, 2), Port: 1234}
+	local := &net.TCPAddr{IP: net.IPv4(10, 1, 0, 1), Port: 2222}
+	conn := &testConnMetadata{user: "bob", local: local, remote: trusted}
+
+	// Without peer auth only authorized keys get in
+	_, err = s.matchPubKey(conn, key)
+	assert.EqualError(t, err, "unknown user bob")
+	_, err = s.matchPeer(conn, nil)
+	assert.EqualError(t, err, "unknown user bob")
+
+	s.SetPeerAuth(func(l, remote net.Addr) (*PeerIdentity, error) {
+		if l.String() != local.String() || remote.String() != trusted.String() {
+			return nil, errors.New("not trusted")
+		}
+		return &PeerIdentity{Name: "bobs-laptop", Fingerprint: "nebula:abc", Role: RoleReadOnly}, nil
+	})
+
+	// Any key or none at all is fine from a trusted peer
+	for _, p := range []func() (*ssh.Permissions, error){
+		func() (*ssh.Permissions, error) { return s.matchPubKey(conn, key) },
+		func() (*ssh.Permissions, error) { return s.matchPeer(conn, nil) },
+	} {
+		perms, err := p()
+		assert.Nil(t, err)
+		assert.Equal(t, map[string]string{"fp": "nebula:abc", "user": "bob", "peer": "bobs-laptop", "role": RoleReadOnly}, perms.Extensions)
+	}
+
+	conn.remote = &net.TCPAddr{IP: net.IPv4(10, 1, 0, 3), Port: 1234}
+	_, err = s.matchPeer(conn, nil)
+	assert.EqualError(t, err, "not trusted")
+
+	// Authorized keys still win and keep the role of their user
+	assert.Nil(t, s.AddAuthorizedKey("bob", string(ssh.MarshalAuthorizedKey(key))))
+	perms, err := s.matchPubKey(conn, key)
+	assert.Nil(t, err)
+	assert.Equal(t, RoleAdmin, perms.Extensions["role"])
+}
+
+func TestSession_done(t *testing.T) {
+	stopped := make(chan struct{})
+	commands := radix.New()
+	commands.Insert("wait", &Command{
+		Name: "wait",
+		Callback: func(fs interface{}, a []string, w StringWriter) error {
+			_ = w.WriteLine("waiting")
+			<-w.Done()
+			close(stopped)
+			return nil
+		},
+	})
+
+	client := newTestSession(t, commands, &Role{Name: RoleAdmin, All: true}, logrus.New())
+	defer client.Close()
+
+	s, err := client.NewSession()
+	assert.Nil(t, err)
+	out, err := s.StdoutPipe()
+	assert.Nil(t, err)
+	assert.Nil(t, s.Start("wait"))
+
+	b := make([]byte, 8)
+	_, err = io.ReadFull(out, b)
+	assert.Nil(t, err)
+	assert.Equal(t, "waiting\n", string(b))
+
+	// Going away stops the command
+	assert.Nil(t, s.Close())
+	<-stopped
+}
+
+func TestReadInterrupt(t *testing.T) {
+	r, w := io.Pipe()
+	done := readInterrupt(r)
+	_, err := w.Write([]byte("q\r"))
+	assert.Nil(t, err)
+
+	select {
+	case <-done:
+		t.Fatal("only ctrl-c should interrupt")
+	default:
+	}
+
+	_, err = w.Write([]byte{ctrlC})
+	assert.Nil(t, err)
+	<-done
+
+	// A closed reader interrupts too
+	done = readInterrupt(strings.NewReader("no ctrl-c here"))
+	<-done
+}
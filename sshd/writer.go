@@ -2,15 +2,26 @@ package sshd
 
 import "io"
 
+// ctrlC is the byte a terminal sends when ctrl-c is pressed
+const ctrlC = 3
+
 type StringWriter interface {
 	WriteLine(string) error
 	Write(string) error
 	WriteBytes([]byte) error
 	GetWriter() io.Writer
+	// Done is closed when the user wants a command to stop, by pressing ctrl-c or disconnecting. Commands that run
+	// until they are stopped must return once it is closed.
+	Done() <-chan struct{}
 }
 
 type stringWriter struct {
 	w io.Writer
+
+	// done is closed when the command should stop
+	done <-chan struct{}
+	// interrupt creates done the first time it is asked for, if set
+	interrupt func() <-chan struct{}
 }
 
 func (w *stringWriter) WriteLine(s string) error {
@@ -30,3 +41,27 @@ func (w *stringWriter) WriteBytes(b []byte) error {
 func (w *stringWriter) GetWriter() io.Writer {
 	return w.w
 }
+
+func (w *stringWriter) Done() <-chan struct{} {
+	if w.done == nil && w.interrupt != nil {
+		w.done = w.interrupt()
+	}
+	return w.done
+}
+
+// readInterrupt returns a channel that is closed once ctrl-c is read from r or r fails. Everything else read is
+// thrown away so it may only be used while nothing else is reading from r.
+func readInterrupt(r io.Reader) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		b := make([]byte, 1)
+		for {
+			_, err := r.Read(b)
+			if err != nil || b[0] == ctrlC {
+				return
+			}
+		}
+	}()
+	return done
+}
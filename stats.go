@@ -3,9 +3,7 @@ package nebula
 import (
 	"errors"
 	"fmt"
-	"log"
 	"net"
-	"net/http"
 	"runtime"
 	"time"
 
@@ -17,24 +15,37 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
-func startStats(l *logrus.Logger, c *Config, buildVersion string, configTest bool) error {
+// startStats starts the configured metrics emitter, hostMaps are the tunnels of every network keyed by network name.
+// traces holds handshake spans for the otlp emitter and may be nil. ready backs the /readyz endpoint of the prometheus
+// server, which is returned so Control can run and stop it.
+func startStats(l *logrus.Logger, c *Config, buildVersion string, configTest bool, hostMaps map[string]*HostMap, traces *traceBuffer, ready func() error) (*statsServer, error) {
 	mType := c.GetString("stats.type", "")
 	if mType == "" || mType == "none" {
-		return nil
+		return nil, nil
 	}
 
 	interval := c.GetDuration("stats.interval", 0)
 	if interval == 0 {
-		return fmt.Errorf("stats.interval was an invalid duration: %s", c.GetString("stats.interval", ""))
+		return nil, fmt.Errorf("stats.interval was an invalid duration: %s", c.GetString("stats.interval", ""))
 	}
 
+	var server *statsServer
 	switch mType {
 	case "graphite":
 		startGraphiteStats(l, interval, c, configTest)
 	case "prometheus":
-		startPrometheusStats(l, interval, c, buildVersion, configTest)
+		var err error
+		server, err = startPrometheusStats(l, interval, c, buildVersion, configTest, hostMaps, ready)
+		if err != nil {
+			return nil, err
+		}
+	case "otlp":
+		err := startOTLPStats(l, interval, c, buildVersion, configTest, traces)
+		if err != nil {
+			return nil, err
+		}
 	default:
-		return fmt.Errorf("stats.type was not understood: %s", mType)
+		return nil, fmt.Errorf("stats.type was not understood: %s", mType)
 	}
 
 	metrics.RegisterDebugGCStats(metrics.DefaultRegistry)
@@ -43,7 +54,7 @@ func startStats(l *logrus.Logger, c *Config, buildVersion string, configTest boo
 	go metrics.CaptureDebugGCStats(metrics.DefaultRegistry, interval)
 	go metrics.CaptureRuntimeMemStats(metrics.DefaultRegistry, interval)
 
-	return nil
+	return server, nil
 }
 
 func startGraphiteStats(l *logrus.Logger, i time.Duration, c *Config, configTest bool) error {
@@ -66,21 +77,16 @@ func startGraphiteStats(l *logrus.Logger, i time.Duration, c *Config, configTest
 	return nil
 }
 
-func startPrometheusStats(l *logrus.Logger, i time.Duration, c *Config, buildVersion string, configTest bool) error {
+func startPrometheusStats(l *logrus.Logger, i time.Duration, c *Config, buildVersion string, configTest bool, hostMaps map[string]*HostMap, ready func() error) (*statsServer, error) {
 	namespace := c.GetString("stats.namespace", "")
 	subsystem := c.GetString("stats.subsystem", "")
 
-	listen := c.GetString("stats.listen", "")
-	if listen == "" {
-		return fmt.Errorf("stats.listen should not be empty")
-	}
-
-	path := c.GetString("stats.path", "")
-	if path == "" {
-		return fmt.Errorf("stats.path should not be empty")
+	pr := prometheus.NewRegistry()
+	server, err := newStatsServerFromConfig(l, c, promhttp.HandlerFor(pr, promhttp.HandlerOpts{ErrorLog: l}), ready, configTest)
+	if err != nil {
+		return nil, err
 	}
 
-	pr := prometheus.NewRegistry()
 	pClient := mp.NewPrometheusProvider(metrics.DefaultRegistry, namespace, subsystem, pr, i)
 	go pClient.UpdatePrometheusMetrics()
 
@@ -98,13 +104,19 @@ func startPrometheusStats(l *logrus.Logger, i time.Duration, c *Config, buildVer
 	pr.MustRegister(g)
 	g.Set(1)
 
-	if !configTest {
-		go func() {
-			l.Infof("Prometheus stats listening on %s at %s", listen, path)
-			http.Handle(path, promhttp.HandlerFor(pr, promhttp.HandlerOpts{ErrorLog: l}))
-			log.Fatal(http.ListenAndServe(listen, nil))
-		}()
+	// Per tunnel metrics get a label for every peer, they are opt in and capped to keep the number of series sane
+	if c.GetBool("stats.tunnels.enabled", false) {
+		max := c.GetInt("stats.tunnels.max", 100)
+		if max < 1 {
+			l.WithField("max", max).Warn("stats.tunnels.max must be greater than 0, using 100")
+			max = 100
+		}
+		pr.MustRegister(newTunnelStatsCollector(namespace, subsystem, hostMaps, max))
 	}
 
-	return nil
+	if configTest {
+		return nil, nil
+	}
+
+	return server, nil
 }
@@ -0,0 +1,203 @@
+package nebula
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// statsShutdownTimeout is how long Stop waits for in flight scrapes to finish
+const statsShutdownTimeout = 5 * time.Second
+
+// statsServer serves the prometheus metrics on stats.path along with /healthz and /readyz. It can use tls and require
+// basic or bearer auth for the metrics, the health endpoints are always open so orchestrators can probe them.
+type statsServer struct {
+	l        *logrus.Logger
+	listen   string
+	listener net.Listener
+	server   *http.Server
+	tls      bool
+}
+
+// newStatsServerFromConfig validates the stats server config and, unless configTest is set, binds stats.listen.
+// ready reports why nebula is not ready to carry traffic, or nil when it is.
+func newStatsServerFromConfig(l *logrus.Logger, c *Config, metrics http.Handler, ready func() error, configTest bool) (*statsServer, error) {
+	listen := c.GetString("stats.listen", "")
+	if listen == "" {
+		return nil, fmt.Errorf("stats.listen should not be empty")
+	}
+
+	path := c.GetString("stats.path", "")
+	if path == "" {
+		return nil, fmt.Errorf("stats.path should not be empty")
+	}
+	if path == "/healthz" || path == "/readyz" {
+		return nil, fmt.Errorf("stats.path can not be %s", path)
+	}
+
+	auth, err := newStatsAuthFromConfig(c)
+	if err != nil {
+		return nil, err
+	}
+
+	certFile := c.GetString("stats.tls.cert", "")
+	keyFile := c.GetString("stats.tls.key", "")
+	if (certFile == "") != (keyFile == "") {
+		return nil, errors.New("stats.tls.cert and stats.tls.key must both be set")
+	}
+
+	var tlsConfig *tls.Config
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load stats.tls: %s", err)
+		}
+		tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(path, auth.wrap(metrics))
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "ok\n")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if err := ready(); err != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = io.WriteString(w, err.Error()+"\n")
+			return
+		}
+		_, _ = io.WriteString(w, "ok\n")
+	})
+
+	s := &statsServer{
+		l:      l,
+		listen: listen,
+		tls:    tlsConfig != nil,
+		server: &http.Server{
+			Handler:           mux,
+			TLSConfig:         tlsConfig,
+			ReadHeaderTimeout: 10 * time.Second,
+			ErrorLog:          log.New(l.WriterLevel(logrus.WarnLevel), "", 0),
+		},
+	}
+
+	if configTest {
+		return s, nil
+	}
+
+	s.listener, err = net.Listen("tcp", listen)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on stats.listen: %s", err)
+	}
+	if tlsConfig != nil {
+		s.listener = tls.NewListener(s.listener, tlsConfig)
+	}
+
+	l.WithField("listen", s.listener.Addr()).WithField("path", path).WithField("tls", s.tls).
+		WithField("auth", auth.kind()).Info("Prometheus stats listening")
+	return s, nil
+}
+
+// Run serves until Stop is called
+func (s *statsServer) Run() {
+	err := s.server.Serve(s.listener)
+	if err != nil && err != http.ErrServerClosed {
+		s.l.WithError(err).WithField("listen", s.listen).Error("Prometheus stats server failed")
+	}
+}
+
+// Stop waits for in flight requests to finish, up to statsShutdownTimeout, and closes the listener
+func (s *statsServer) Stop() {
+	ctx, cancel := context.WithTimeout(context.Background(), statsShutdownTimeout)
+	defer cancel()
+
+	err := s.server.Shutdown(ctx)
+	if err != nil {
+		s.l.WithError(err).Warn("Prometheus stats server did not shut down cleanly")
+	}
+
+	// Shutdown only closes the listener if Run was called
+	_ = s.listener.Close()
+}
+
+// statsAuth protects the metrics with basic auth if username is set or a bearer token if token is set
+type statsAuth struct {
+	username string
+	password string
+	token    string
+}
+
+func newStatsAuthFromConfig(c *Config) (*statsAuth, error) {
+	a := &statsAuth{
+		username: c.GetString("stats.auth.username", ""),
+		password: c.GetString("stats.auth.password", ""),
+		token:    c.GetString("stats.auth.token", ""),
+	}
+
+	if (a.username == "") != (a.password == "") {
+		return nil, errors.New("stats.auth.username and stats.auth.password must both be set")
+	}
+
+	if a.username != "" && a.token != "" {
+		return nil, errors.New("stats.auth can use a username and password or a token, not both")
+	}
+
+	return a, nil
+}
+
+func (a *statsAuth) kind() string {
+	switch {
+	case a.username != "":
+		return "basic"
+	case a.token != "":
+		return "bearer"
+	default:
+		return "none"
+	}
+}
+
+func (a *statsAuth) wrap(h http.Handler) http.Handler {
+	if a.kind() == "none" {
+		return h
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !a.allowed(r) {
+			if a.username != "" {
+				w.Header().Set("WWW-Authenticate", `Basic realm="nebula"`)
+			} else {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="nebula"`)
+			}
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+func (a *statsAuth) allowed(r *http.Request) bool {
+	if a.username != "" {
+		username, password, ok := r.BasicAuth()
+		// Both are compared every time to avoid leaking which one was wrong
+		userOk := subtle.ConstantTimeCompare([]byte(username), []byte(a.username)) == 1
+		passOk := subtle.ConstantTimeCompare([]byte(password), []byte(a.password)) == 1
+		return ok && userOk && passOk
+	}
+
+	const prefix = "Bearer "
+	h := r.Header.Get("Authorization")
+	if len(h) < len(prefix) || h[:len(prefix)] != prefix {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(h[len(prefix):]), []byte(a.token)) == 1
+}
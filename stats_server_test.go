@@ -0,0 +1,222 @@
+package nebula
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestStatsServer(t *testing.T, stats map[interface{}]interface{}, ready func() error) (*statsServer, string) {
+	c := NewConfig(NewTestLogger())
+	stats["listen"] = "127.0.0.1:0"
+	stats["path"] = "/metrics"
+	c.Settings["stats"] = stats
+
+	metrics := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("metrics\n"))
+	})
+
+	s, err := newStatsServerFromConfig(NewTestLogger(), c, metrics, ready, false)
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	go s.Run()
+	return s, s.listener.Addr().String()
+}
+
+func testStatsGet(t *testing.T, client *http.Client, url string, setup func(r *http.Request)) (int, string) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	assert.Nil(t, err)
+	if setup != nil {
+		setup(req)
+	}
+
+	resp, err := client.Do(req)
+	if !assert.Nil(t, err) {
+		return 0, ""
+	}
+	defer resp.Body.Close()
+	b, _ := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, string(b)
+}
+
+func TestNewStatsServerFromConfig(t *testing.T) {
+	l := NewTestLogger()
+	newServer := func(stats map[interface{}]interface{}) error {
+		c := NewConfig(l)
+		c.Settings["stats"] = stats
+		_, err := newStatsServerFromConfig(l, c, http.NotFoundHandler(), func() error { return nil }, true)
+		return err
+	}
+
+	assert.EqualError(t, newServer(map[interface{}]interface{}{"path": "/metrics"}), "stats.listen should not be empty")
+	assert.EqualError(t, newServer(map[interface{}]interface{}{"listen": ":8080"}), "stats.path should not be empty")
+	assert.EqualError(t, newServer(map[interface{}]interface{}{"listen": ":8080", "path": "/readyz"}), "stats.path can not be /readyz")
+	assert.EqualError(t, newServer(map[interface{}]interface{}{"listen": ":8080", "path": "/metrics", "tls": map[interface{}]interface{}{"cert": "x.crt"}}),
+		"stats.tls.cert and stats.tls.key must both be set")
+	assert.EqualError(t, newServer(map[interface{}]interface{}{"listen": ":8080", "path": "/metrics", "auth": map[interface{}]interface{}{"username": "prom"}}),
+		"stats.auth.username and stats.auth.password must both be set")
+	assert.EqualError(t, newServer(map[interface{}]interface{}{"listen": ":8080", "path": "/metrics", "auth": map[interface{}]interface{}{"username": "prom", "password": "pw", "token": "t"}}),
+		"stats.auth can use a username and password or a token, not both")
+
+	err := newServer(map[interface{}]interface{}{"listen": ":8080", "path": "/metrics", "tls": map[interface{}]interface{}{"cert": "/nope.crt", "key": "/nope.key"}})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to load stats.tls: ")
+
+	assert.Nil(t, newServer(map[interface{}]interface{}{"listen": ":8080", "path": "/metrics"}))
+}
+
+func TestStatsServer_auth(t *testing.T) {
+	var notReady error = errors.New("tun device is not up")
+	s, addr := newTestStatsServer(t, map[interface{}]interface{}{
+		"auth": map[interface{}]interface{}{"username": "prom", "password": "secret"},
+	}, func() error { return notReady })
+
+	client := &http.Client{}
+	base := "http://" + addr
+
+	code, body := testStatsGet(t, client, base+"/metrics", nil)
+	assert.Equal(t, http.StatusUnauthorized, code)
+	assert.Equal(t, "unauthorized\n", body)
+
+	code, _ = testStatsGet(t, client, base+"/metrics", func(r *http.Request) { r.SetBasicAuth("prom", "wrong") })
+	assert.Equal(t, http.StatusUnauthorized, code)
+
+	code, body = testStatsGet(t, client, base+"/metrics", func(r *http.Request) { r.SetBasicAuth("prom", "secret") })
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "metrics\n", body)
+
+	// Health checks are not behind auth
+	code, body = testStatsGet(t, client, base+"/healthz", nil)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "ok\n", body)
+
+	code, body = testStatsGet(t, client, base+"/readyz", nil)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "tun device is not up\n", body)
+
+	notReady = nil
+	code, body = testStatsGet(t, client, base+"/readyz", nil)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "ok\n", body)
+
+	// Stop closes the listener
+	s.Stop()
+	_, err := net.DialTimeout("tcp", addr, time.Second)
+	assert.Error(t, err)
+}
+
+func TestStatsServer_tls(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stats-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := filepath.Join(dir, "stats.crt"), filepath.Join(dir, "stats.key")
+	pool := writeTestTLSCert(t, certFile, keyFile)
+
+	s, addr := newTestStatsServer(t, map[interface{}]interface{}{
+		"tls":  map[interface{}]interface{}{"cert": certFile, "key": keyFile},
+		"auth": map[interface{}]interface{}{"token": "s3cret"},
+	}, func() error { return nil })
+	defer s.Stop()
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	base := "https://" + addr
+
+	code, _ := testStatsGet(t, client, base+"/metrics", func(r *http.Request) { r.Header.Set("Authorization", "Bearer nope") })
+	assert.Equal(t, http.StatusUnauthorized, code)
+
+	code, body := testStatsGet(t, client, base+"/metrics", func(r *http.Request) { r.Header.Set("Authorization", "Bearer s3cret") })
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "metrics\n", body)
+
+	// Plain http is refused
+	code, _ = testStatsGet(t, &http.Client{}, "http://"+addr+"/healthz", nil)
+	assert.Equal(t, http.StatusBadRequest, code)
+}
+
+// writeTestTLSCert writes a self signed certificate for 127.0.0.1 and returns a pool that trusts it
+func writeTestTLSCert(t *testing.T, certFile, keyFile string) *x509.CertPool {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "nebula-stats"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	assert.Nil(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	assert.Nil(t, err)
+
+	assert.Nil(t, ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	assert.Nil(t, ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+
+	crt, err := x509.ParseCertificate(der)
+	assert.Nil(t, err)
+	pool := x509.NewCertPool()
+	pool.AddCert(crt)
+	return pool
+}
+
+func TestControl_Ready(t *testing.T) {
+	l := NewTestLogger()
+	outside, err := NewListener(l, "127.0.0.1", 0, false)
+	assert.Nil(t, err)
+
+	_, vpnNet, _ := net.ParseCIDR("10.1.0.0/24")
+	lhIp := ip2int(net.IPv4(10, 1, 0, 1))
+	newInterface := func(amLighthouse bool, lighthouses []uint32) *Interface {
+		return &Interface{
+			outside:    outside,
+			hostMap:    NewHostMap(l, "main", vpnNet, nil),
+			lightHouse: NewLightHouse(l, amLighthouse, vpnNet, lighthouses, 10, 4242, outside, false, time.Second, false, nil),
+		}
+	}
+
+	ctrl := &Control{
+		f: newInterface(false, []uint32{lhIp}),
+		l: l,
+		networks: map[string]*Control{
+			"ops": {f: newInterface(false, nil), l: l},
+		},
+	}
+
+	assert.EqualError(t, ctrl.Ready(), "tun device is not up")
+	ctrl.f.activated = 1
+	assert.EqualError(t, ctrl.Ready(), "no lighthouse tunnel is established")
+
+	ctrl.f.hostMap.Add(lhIp, &HostInfo{hostId: lhIp})
+	assert.EqualError(t, ctrl.Ready(), "network ops: tun device is not up")
+
+	// Networks without lighthouses, or that are lighthouses, do not wait on one
+	ctrl.networks["ops"].f.activated = 1
+	assert.Nil(t, ctrl.Ready())
+
+	ctrl.f = newInterface(true, nil)
+	ctrl.f.activated = 1
+	assert.Nil(t, ctrl.Ready())
+}
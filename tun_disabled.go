@@ -21,7 +21,7 @@ type disabledTun struct {
 	l  *logrus.Logger
 }
 
-func newDisabledTun(cidr *net.IPNet, queueLen int, metricsEnabled bool, l *logrus.Logger) *disabledTun {
+func newDisabledTun(cidr *net.IPNet, queueLen int, metricsEnabled bool, r metrics.Registry, l *logrus.Logger) *disabledTun {
 	tun := &disabledTun{
 		cidr: cidr,
 		read: make(chan []byte, queueLen),
@@ -29,8 +29,8 @@ func newDisabledTun(cidr *net.IPNet, queueLen int, metricsEnabled bool, l *logru
 	}
 
 	if metricsEnabled {
-		tun.tx = metrics.GetOrRegisterCounter("messages.tx.message", nil)
-		tun.rx = metrics.GetOrRegisterCounter("messages.rx.message", nil)
+		tun.tx = metrics.GetOrRegisterCounter("messages.tx.message", r)
+		tun.rx = metrics.GetOrRegisterCounter("messages.rx.message", r)
 	} else {
 		tun.tx = &metrics.NilCounter{}
 		tun.rx = &metrics.NilCounter{}
@@ -9,6 +9,7 @@ import (
 	"net"
 	"os"
 	"strings"
+	"syscall"
 	"unsafe"
 
 	"github.com/sirupsen/logrus"
@@ -18,6 +19,8 @@ import (
 
 type Tun struct {
 	io.ReadWriteCloser
+	reader       *tunReader
+	offload      bool
 	fd           int
 	Device       string
 	Cidr         *net.IPNet
@@ -61,6 +64,14 @@ const (
 	cIFF_TUN         = 0x0001
 	cIFF_NO_PI       = 0x1000
 	cIFF_MULTI_QUEUE = 0x0100
+	cIFF_VNET_HDR    = 0x4000
+)
+
+// From linux/if_tun.h
+const (
+	cTUN_F_CSUM = 0x01
+	cTUN_F_TSO4 = 0x02
+	cTUN_F_USO4 = 0x20
 )
 
 type ifreqAddr struct {
@@ -99,7 +110,7 @@ func newTunFromFd(l *logrus.Logger, deviceFd int, cidr *net.IPNet, defaultMTU in
 	return
 }
 
-func newTun(l *logrus.Logger, deviceName string, cidr *net.IPNet, defaultMTU int, routes []route, unsafeRoutes []route, txQueueLen int, multiqueue bool) (ifce *Tun, err error) {
+func newTun(l *logrus.Logger, deviceName string, cidr *net.IPNet, defaultMTU int, routes []route, unsafeRoutes []route, txQueueLen int, multiqueue bool, offload bool) (ifce *Tun, err error) {
 	fd, err := unix.Open("/dev/net/tun", os.O_RDWR, 0)
 	if err != nil {
 		return nil, err
@@ -110,13 +121,19 @@ func newTun(l *logrus.Logger, deviceName string, cidr *net.IPNet, defaultMTU int
 	if multiqueue {
 		req.Flags |= cIFF_MULTI_QUEUE
 	}
+	if offload {
+		req.Flags |= cIFF_VNET_HDR
+	}
 	copy(req.Name[:], deviceName)
 	if err = ioctl(uintptr(fd), uintptr(unix.TUNSETIFF), uintptr(unsafe.Pointer(&req))); err != nil {
 		return nil, err
 	}
 	name := strings.Trim(string(req.Name[:]), "\x00")
 
-	file := os.NewFile(uintptr(fd), "/dev/net/tun")
+	reader, err := newTunReader(l, fd, offload)
+	if err != nil {
+		return nil, err
+	}
 
 	maxMTU := defaultMTU
 	for _, r := range routes {
@@ -126,8 +143,10 @@ func newTun(l *logrus.Logger, deviceName string, cidr *net.IPNet, defaultMTU int
 	}
 
 	ifce = &Tun{
-		ReadWriteCloser: file,
-		fd:              int(file.Fd()),
+		ReadWriteCloser: reader,
+		reader:          reader,
+		offload:         offload,
+		fd:              fd,
 		Device:          name,
 		Cidr:            cidr,
 		MaxMTU:          maxMTU,
@@ -148,17 +167,263 @@ func (c *Tun) NewMultiQueueReader() (io.ReadWriteCloser, error) {
 
 	var req ifReq
 	req.Flags = uint16(cIFF_TUN | cIFF_NO_PI | cIFF_MULTI_QUEUE)
+	if c.offload {
+		req.Flags |= cIFF_VNET_HDR
+	}
 	copy(req.Name[:], c.Device)
 	if err = ioctl(uintptr(fd), uintptr(unix.TUNSETIFF), uintptr(unsafe.Pointer(&req))); err != nil {
 		return nil, err
 	}
 
+	return newTunReader(c.l, fd, c.offload)
+}
+
+// tunReader is a tun queue in non blocking mode, this lets ReadBatch drain every packet that is ready in one wakeup
+type tunReader struct {
+	*os.File
+	rc syscall.RawConn
+	l  *logrus.Logger
+
+	// Only set when offloads are enabled
+	offload   bool
+	scratch   []byte
+	splitter  gsoSplitter
+	coalescer *tcpCoalescer
+	one       [][]byte
+	oneSize   []int
+}
+
+func newTunReader(l *logrus.Logger, fd int, offload bool) (*tunReader, error) {
+	if offload {
+		if err := enableTunOffload(fd); err != nil {
+			unix.Close(fd)
+			return nil, err
+		}
+	}
+
+	// The fd must be non blocking before handing it to os.NewFile so that it uses the runtime poller
+	if err := unix.SetNonblock(fd, true); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+
 	file := os.NewFile(uintptr(fd), "/dev/net/tun")
+	rc, err := file.SyscallConn()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	r := &tunReader{File: file, rc: rc, l: l}
+	if offload {
+		r.offload = true
+		r.scratch = make([]byte, virtioNetHdrLen+maxOffloadPacket)
+		r.coalescer = newTCPCoalescer(r.writeWithHdr)
+		r.one = make([][]byte, 1)
+		r.oneSize = make([]int, 1)
+	}
+
+	return r, nil
+}
+
+// enableTunOffload asks the kernel for checksum and segmentation offloads, udp segmentation offload is used if the
+// kernel supports it
+func enableTunOffload(fd int) error {
+	if err := unix.IoctlSetInt(fd, unix.TUNSETVNETHDRSZ, virtioNetHdrLen); err != nil {
+		return fmt.Errorf("failed to set tun vnet header size: %s", err)
+	}
+
+	if err := unix.IoctlSetInt(fd, unix.TUNSETOFFLOAD, cTUN_F_CSUM|cTUN_F_TSO4|cTUN_F_USO4); err == nil {
+		return nil
+	}
+
+	if err := unix.IoctlSetInt(fd, unix.TUNSETOFFLOAD, cTUN_F_CSUM|cTUN_F_TSO4); err != nil {
+		return fmt.Errorf("failed to enable tun offloads: %s", err)
+	}
+
+	return nil
+}
+
+func (r *tunReader) Read(b []byte) (int, error) {
+	if !r.offload {
+		return r.File.Read(b)
+	}
+
+	r.one[0] = b
+	_, err := r.ReadBatch(r.one, r.oneSize)
+	r.one[0] = nil
+	if err != nil {
+		return 0, err
+	}
+	return r.oneSize[0], nil
+}
+
+func (r *tunReader) Write(b []byte) (int, error) {
+	if !r.offload {
+		return r.File.Write(b)
+	}
+
+	return len(b), r.writeWithHdr(emptyVirtioNetHdr, b)
+}
+
+// WriteBatch writes every packet in pkts, with offloads enabled consecutive tcp segments are merged first
+func (r *tunReader) WriteBatch(pkts [][]byte) error {
+	if !r.offload {
+		var err error
+		for _, p := range pkts {
+			if _, e := r.File.Write(p); e != nil {
+				err = e
+			}
+		}
+		return err
+	}
+
+	return r.coalescer.WriteBatch(pkts)
+}
+
+// writeRaw writes a packet without a virtio header, waiting for room if the tun queue is full
+func (r *tunReader) writeRaw(b []byte) error {
+	var err error
+	werr := r.rc.Write(func(fd uintptr) bool {
+		_, err = unix.Write(int(fd), b)
+		return err != unix.EAGAIN
+	})
+	if werr != nil {
+		return werr
+	}
+	return err
+}
+
+func (r *tunReader) writeWithHdr(hdr, pkt []byte) error {
+	var err error
+	werr := r.rc.Write(func(fd uintptr) bool {
+		_, err = unix.Writev(int(fd), [][]byte{hdr, pkt})
+		return err != unix.EAGAIN
+	})
+	if werr != nil {
+		return werr
+	}
+	return err
+}
+
+func (r *tunReader) ReadBatch(bufs [][]byte, sizes []int) (int, error) {
+	var n int
+	var readErr error
+
+	err := r.rc.Read(func(fd uintptr) bool {
+		for n < len(bufs) {
+			if r.offload {
+				// Hand out anything left over from the last super packet before reading another
+				if !r.splitter.done() {
+					s, err := r.splitter.segment(bufs[n])
+					if err != nil {
+						r.l.WithError(err).Debug("Dropping the rest of an offloaded tun packet")
+						r.splitter = gsoSplitter{}
+						continue
+					}
+					sizes[n] = s
+					n++
+					continue
+				}
+
+				s, err := unix.Read(int(fd), r.scratch)
+				if err == unix.EINTR {
+					continue
+				}
+
+				if err == unix.EAGAIN {
+					return n > 0
+				}
+
+				if err != nil {
+					readErr = err
+					return true
+				}
+
+				var h virtioNetHdr
+				if err := h.decode(r.scratch[:s]); err != nil {
+					r.l.WithError(err).Debug("Dropping offloaded tun packet")
+					continue
+				}
+
+				if err := r.splitter.reset(r.scratch[virtioNetHdrLen:s], h); err != nil {
+					r.l.WithError(err).Debug("Dropping offloaded tun packet")
+					r.splitter = gsoSplitter{}
+				}
+				continue
+			}
+
+			s, err := unix.Read(int(fd), bufs[n])
+			if err == unix.EINTR {
+				continue
+			}
+
+			if err == unix.EAGAIN {
+				// Wait for the poller if we have nothing yet
+				return n > 0
+			}
+
+			if err != nil {
+				readErr = err
+				return true
+			}
+
+			sizes[n] = s
+			n++
+		}
+		return true
+	})
+
+	if n > 0 {
+		// Any error will be seen again on the next read
+		return n, nil
+	}
 
-	return file, nil
+	if err != nil {
+		return 0, err
+	}
+
+	return 0, readErr
+}
+
+// ReadBatch drains ready packets when the tun was opened by us, tuns from a provided fd are read one at a time
+func (c *Tun) ReadBatch(bufs [][]byte, sizes []int) (int, error) {
+	if c.reader != nil {
+		return c.reader.ReadBatch(bufs, sizes)
+	}
+
+	n, err := c.Read(bufs[0])
+	if err != nil {
+		return 0, err
+	}
+	sizes[0] = n
+	return 1, nil
+}
+
+// WriteBatch writes every packet in pkts, with offloads enabled consecutive tcp segments are merged first
+func (c *Tun) WriteBatch(pkts [][]byte) error {
+	if c.reader != nil {
+		return c.reader.WriteBatch(pkts)
+	}
+
+	for _, p := range pkts {
+		if err := c.WriteRaw(p); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (c *Tun) WriteRaw(b []byte) error {
+	if c.offload {
+		return c.reader.writeWithHdr(emptyVirtioNetHdr, b)
+	}
+
+	// The queue is non blocking, a full tun queue has to wait on the poller instead of failing the write
+	if c.reader != nil {
+		return c.reader.writeRaw(b)
+	}
+
 	var nn int
 	for {
 		max := len(b)
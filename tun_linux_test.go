@@ -2,7 +2,15 @@
 
 package nebula
 
-import "testing"
+import (
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
 
 var runAdvMSSTests = []struct {
 	name     string
@@ -31,3 +39,38 @@ func TestTunAdvMSS(t *testing.T) {
 		})
 	}
 }
+
+func TestTun_WriteRawFullQueue(t *testing.T) {
+	// A pipe stands in for the tun queue, it is just as non blocking and fills up the same way
+	fds := make([]int, 2)
+	assert.Nil(t, unix.Pipe(fds))
+	rd := os.NewFile(uintptr(fds[0]), "pipe")
+	defer rd.Close()
+	size, err := unix.FcntlInt(uintptr(fds[1]), unix.F_SETPIPE_SZ, 4096)
+	assert.Nil(t, err)
+
+	r, err := newTunReader(NewTestLogger(), fds[1], false)
+	assert.Nil(t, err)
+	defer r.Close()
+	tun := &Tun{ReadWriteCloser: r, reader: r, fd: fds[1]}
+
+	assert.Nil(t, tun.WriteRaw(make([]byte, size)))
+
+	done := make(chan error, 1)
+	go func() {
+		done <- tun.WriteRaw([]byte("packet"))
+	}()
+
+	select {
+	case err := <-done:
+		t.Fatalf("the write should wait for room in the queue, got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	b := make([]byte, size+6)
+	n, err := io.ReadAtLeast(rd, b, len(b))
+	assert.Nil(t, err)
+	assert.Equal(t, size+6, n)
+	assert.Nil(t, <-done)
+	assert.Equal(t, "packet", string(b[size:]))
+}
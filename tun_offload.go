@@ -0,0 +1,410 @@
+package nebula
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"unsafe"
+)
+
+// virtioNetHdrLen is the size of the header in front of every packet on a tun with IFF_VNET_HDR
+const virtioNetHdrLen = 10
+
+// From linux/virtio_net.h
+const (
+	virtioNetHdrFNeedsCsum = 1
+
+	virtioNetHdrGSONone  = 0
+	virtioNetHdrGSOTCPv4 = 1
+	virtioNetHdrGSOUDPL4 = 5
+	virtioNetHdrGSOECN   = 0x80
+)
+
+const (
+	// maxOffloadPacket is the largest packet a tun with offloads will hand us or accept from us
+	maxOffloadPacket = 65535
+	// maxCoalesceSegments limits how many segments are merged into a single packet written to the tun
+	maxCoalesceSegments = 64
+
+	tcpFlagFIN = 0x01
+	tcpFlagSYN = 0x02
+	tcpFlagRST = 0x04
+	tcpFlagPSH = 0x08
+	tcpFlagACK = 0x10
+	tcpFlagURG = 0x20
+	tcpFlagCWR = 0x80
+)
+
+// nativeEndian is the byte order of the virtio header, tuns use the host byte order unless told otherwise
+var nativeEndian binary.ByteOrder
+
+func init() {
+	i := uint16(1)
+	if *(*byte)(unsafe.Pointer(&i)) == 1 {
+		nativeEndian = binary.LittleEndian
+	} else {
+		nativeEndian = binary.BigEndian
+	}
+}
+
+type virtioNetHdr struct {
+	flags      uint8
+	gsoType    uint8
+	hdrLen     uint16
+	gsoSize    uint16
+	csumStart  uint16
+	csumOffset uint16
+}
+
+func (h *virtioNetHdr) decode(b []byte) error {
+	if len(b) < virtioNetHdrLen {
+		return fmt.Errorf("packet is less than %v bytes", virtioNetHdrLen)
+	}
+
+	h.flags = b[0]
+	h.gsoType = b[1]
+	h.hdrLen = nativeEndian.Uint16(b[2:4])
+	h.gsoSize = nativeEndian.Uint16(b[4:6])
+	h.csumStart = nativeEndian.Uint16(b[6:8])
+	h.csumOffset = nativeEndian.Uint16(b[8:10])
+	return nil
+}
+
+func (h *virtioNetHdr) encode(b []byte) {
+	b[0] = h.flags
+	b[1] = h.gsoType
+	nativeEndian.PutUint16(b[2:4], h.hdrLen)
+	nativeEndian.PutUint16(b[4:6], h.gsoSize)
+	nativeEndian.PutUint16(b[6:8], h.csumStart)
+	nativeEndian.PutUint16(b[8:10], h.csumOffset)
+}
+
+// checksumAdd adds b to a ones complement sum
+func checksumAdd(sum uint64, b []byte) uint64 {
+	for len(b) >= 2 {
+		sum += uint64(b[0])<<8 | uint64(b[1])
+		b = b[2:]
+	}
+	if len(b) == 1 {
+		sum += uint64(b[0]) << 8
+	}
+	return sum
+}
+
+func checksumFold(sum uint64) uint16 {
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return uint16(sum)
+}
+
+// pseudoHeaderSum is the sum of the ipv4 pseudo header used by tcp and udp checksums
+func pseudoHeaderSum(ip []byte, proto uint8, length int) uint64 {
+	return checksumAdd(0, ip[12:20]) + uint64(proto) + uint64(length)
+}
+
+// setIPv4Checksum recomputes the header checksum of an ipv4 packet
+func setIPv4Checksum(ip []byte, ihl int) {
+	ip[10], ip[11] = 0, 0
+	binary.BigEndian.PutUint16(ip[10:12], ^checksumFold(checksumAdd(0, ip[:ihl])))
+}
+
+// gsoSplitter hands out the MTU sized segments of a super packet read from a tun with offloads enabled
+type gsoSplitter struct {
+	pkt     []byte
+	gsoType uint8
+	ihl     int
+	hlen    int
+	mss     int
+	next    int
+	index   int
+}
+
+// reset prepares pkt, which must not include the virtio header, to be split
+func (s *gsoSplitter) reset(pkt []byte, h virtioNetHdr) error {
+	*s = gsoSplitter{}
+
+	gsoType := h.gsoType &^ virtioNetHdrGSOECN
+	if gsoType == virtioNetHdrGSONone {
+		if h.flags&virtioNetHdrFNeedsCsum != 0 {
+			// The kernel left the pseudo header sum in the checksum field, finish the job
+			start, offset := int(h.csumStart), int(h.csumStart)+int(h.csumOffset)
+			if offset+2 > len(pkt) {
+				return errors.New("checksum offset is beyond the end of the packet")
+			}
+			binary.BigEndian.PutUint16(pkt[offset:], ^checksumFold(checksumAdd(0, pkt[start:])))
+		}
+
+		s.pkt = pkt
+		s.gsoType = gsoType
+		s.hlen = len(pkt)
+		return nil
+	}
+
+	if len(pkt) < 20 || pkt[0]>>4 != 4 {
+		return errors.New("super packet is not ipv4")
+	}
+
+	ihl := int(pkt[0]&0x0f) << 2
+	hlen := ihl
+	switch gsoType {
+	case virtioNetHdrGSOTCPv4:
+		if pkt[9] != fwProtoTCP || len(pkt) < ihl+20 {
+			return errors.New("tcp super packet is not tcp")
+		}
+		hlen += int(pkt[ihl+12]>>4) << 2
+	case virtioNetHdrGSOUDPL4:
+		if pkt[9] != fwProtoUDP {
+			return errors.New("udp super packet is not udp")
+		}
+		hlen += 8
+	default:
+		return fmt.Errorf("unsupported gso type: %v", gsoType)
+	}
+
+	if h.gsoSize == 0 || hlen > len(pkt) {
+		return errors.New("invalid super packet")
+	}
+
+	s.pkt = pkt
+	s.gsoType = gsoType
+	s.ihl = ihl
+	s.hlen = hlen
+	s.mss = int(h.gsoSize)
+	return nil
+}
+
+// done returns true once every segment has been handed out
+func (s *gsoSplitter) done() bool {
+	return s.pkt == nil || (s.index > 0 && s.hlen+s.next >= len(s.pkt))
+}
+
+// segment writes the next segment into dst and returns its length
+func (s *gsoSplitter) segment(dst []byte) (int, error) {
+	if s.gsoType == virtioNetHdrGSONone {
+		if len(s.pkt) > len(dst) {
+			return 0, fmt.Errorf("packet of %v bytes is larger than the buffer", len(s.pkt))
+		}
+		s.index++
+		return copy(dst, s.pkt), nil
+	}
+
+	payload := s.pkt[s.hlen+s.next:]
+	if len(payload) > s.mss {
+		payload = payload[:s.mss]
+	}
+	last := s.hlen+s.next+len(payload) >= len(s.pkt)
+
+	n := s.hlen + len(payload)
+	if n > len(dst) {
+		return 0, fmt.Errorf("segment of %v bytes is larger than the buffer", n)
+	}
+
+	copy(dst, s.pkt[:s.hlen])
+	copy(dst[s.hlen:], payload)
+	seg := dst[:n]
+
+	binary.BigEndian.PutUint16(seg[2:4], uint16(n))
+	binary.BigEndian.PutUint16(seg[4:6], binary.BigEndian.Uint16(s.pkt[4:6])+uint16(s.index))
+	setIPv4Checksum(seg, s.ihl)
+
+	l4 := seg[s.ihl:]
+	switch s.gsoType {
+	case virtioNetHdrGSOTCPv4:
+		binary.BigEndian.PutUint32(l4[4:8], binary.BigEndian.Uint32(s.pkt[s.ihl+4:])+uint32(s.next))
+		if !last {
+			l4[13] &^= tcpFlagFIN | tcpFlagPSH
+		}
+		if s.index > 0 {
+			l4[13] &^= tcpFlagCWR
+		}
+		l4[16], l4[17] = 0, 0
+		binary.BigEndian.PutUint16(l4[16:18], ^checksumFold(checksumAdd(pseudoHeaderSum(seg, fwProtoTCP, len(l4)), l4)))
+
+	case virtioNetHdrGSOUDPL4:
+		binary.BigEndian.PutUint16(l4[4:6], uint16(len(l4)))
+		l4[6], l4[7] = 0, 0
+		c := ^checksumFold(checksumAdd(pseudoHeaderSum(seg, fwProtoUDP, len(l4)), l4))
+		if c == 0 {
+			c = 0xffff
+		}
+		binary.BigEndian.PutUint16(l4[6:8], c)
+	}
+
+	s.next += len(payload)
+	s.index++
+	return n, nil
+}
+
+// tcpCoalescer merges consecutive segments of a tcp flow into a single super packet for a tun with offloads enabled.
+// Packets are passed to write with their virtio header.
+type tcpCoalescer struct {
+	buf      []byte
+	n        int
+	ihl      int
+	hlen     int
+	mss      int
+	segments int
+	nextSeq  uint32
+	closed   bool
+	write    func(hdr, pkt []byte) error
+}
+
+var emptyVirtioNetHdr = make([]byte, virtioNetHdrLen)
+
+func newTCPCoalescer(write func(hdr, pkt []byte) error) *tcpCoalescer {
+	return &tcpCoalescer{
+		buf:   make([]byte, virtioNetHdrLen+maxOffloadPacket),
+		write: write,
+	}
+}
+
+// WriteBatch coalesces what it can from pkts and writes everything to the tun
+func (c *tcpCoalescer) WriteBatch(pkts [][]byte) error {
+	var err error
+	for _, p := range pkts {
+		if c.canAppend(p) {
+			c.append(p)
+			continue
+		}
+
+		if e := c.flush(); e != nil {
+			err = e
+		}
+
+		if c.start(p) {
+			continue
+		}
+
+		if e := c.write(emptyVirtioNetHdr, p); e != nil {
+			err = e
+		}
+	}
+
+	if e := c.flush(); e != nil {
+		err = e
+	}
+	return err
+}
+
+// tcpSegmentInfo returns the ip header length, the header length, and the payload length of a tcp packet that may be
+// coalesced. ok is false for anything else.
+func tcpSegmentInfo(p []byte) (ihl int, hlen int, payload int, ok bool) {
+	if len(p) < 40 || p[0]>>4 != 4 || p[9] != fwProtoTCP {
+		return 0, 0, 0, false
+	}
+
+	// Must have DF set and not be a fragment
+	if binary.BigEndian.Uint16(p[6:8]) != 0x4000 || int(binary.BigEndian.Uint16(p[2:4])) != len(p) {
+		return 0, 0, 0, false
+	}
+
+	ihl = int(p[0]&0x0f) << 2
+	if ihl < 20 || len(p) < ihl+20 {
+		return 0, 0, 0, false
+	}
+
+	hlen = ihl + int(p[ihl+12]>>4)<<2
+	if hlen < ihl+20 || hlen >= len(p) {
+		return 0, 0, 0, false
+	}
+
+	// Only plain data segments, anything else goes through as is
+	if p[ihl+13]&^tcpFlagPSH != tcpFlagACK {
+		return 0, 0, 0, false
+	}
+
+	return ihl, hlen, len(p) - hlen, true
+}
+
+func (c *tcpCoalescer) start(p []byte) bool {
+	ihl, hlen, payload, ok := tcpSegmentInfo(p)
+	if !ok || p[ihl+13]&tcpFlagPSH != 0 {
+		return false
+	}
+
+	c.n = copy(c.buf[virtioNetHdrLen:], p)
+	c.ihl = ihl
+	c.hlen = hlen
+	c.mss = payload
+	c.segments = 1
+	c.nextSeq = binary.BigEndian.Uint32(p[ihl+4:]) + uint32(payload)
+	c.closed = false
+	return true
+}
+
+func (c *tcpCoalescer) canAppend(p []byte) bool {
+	if c.segments == 0 || c.closed || c.segments >= maxCoalesceSegments {
+		return false
+	}
+
+	ihl, hlen, payload, ok := tcpSegmentInfo(p)
+	if !ok || ihl != c.ihl || hlen != c.hlen || payload > c.mss || c.n+payload > maxOffloadPacket {
+		return false
+	}
+
+	r := c.buf[virtioNetHdrLen:]
+	// tos, ttl, protocol and addresses
+	if p[1] != r[1] || p[8] != r[8] || string(p[12:20]) != string(r[12:20]) {
+		return false
+	}
+
+	// ports, ack, data offset, window, and options must match. Flags may only differ by PSH
+	if string(p[ihl:ihl+4]) != string(r[ihl:ihl+4]) || string(p[ihl+8:ihl+13]) != string(r[ihl+8:ihl+13]) ||
+		p[ihl+13]&^tcpFlagPSH != r[ihl+13] || string(p[ihl+14:ihl+16]) != string(r[ihl+14:ihl+16]) ||
+		string(p[ihl+20:hlen]) != string(r[ihl+20:hlen]) {
+		return false
+	}
+
+	return binary.BigEndian.Uint32(p[ihl+4:]) == c.nextSeq
+}
+
+func (c *tcpCoalescer) append(p []byte) {
+	payload := p[c.hlen:]
+	copy(c.buf[virtioNetHdrLen+c.n:], payload)
+	c.n += len(payload)
+	c.nextSeq += uint32(len(payload))
+	c.segments++
+
+	if p[c.ihl+13]&tcpFlagPSH != 0 {
+		c.buf[virtioNetHdrLen+c.ihl+13] |= tcpFlagPSH
+		c.closed = true
+	}
+
+	// Only the last segment may be short
+	if len(payload) < c.mss {
+		c.closed = true
+	}
+}
+
+func (c *tcpCoalescer) flush() error {
+	if c.segments == 0 {
+		return nil
+	}
+
+	pkt := c.buf[virtioNetHdrLen : virtioNetHdrLen+c.n]
+	segments := c.segments
+	c.segments = 0
+
+	if segments == 1 {
+		return c.write(emptyVirtioNetHdr, pkt)
+	}
+
+	binary.BigEndian.PutUint16(pkt[2:4], uint16(len(pkt)))
+	setIPv4Checksum(pkt, c.ihl)
+
+	// With NEEDS_CSUM the kernel expects the pseudo header sum in the checksum field
+	binary.BigEndian.PutUint16(pkt[c.ihl+16:], checksumFold(pseudoHeaderSum(pkt, fwProtoTCP, len(pkt)-c.ihl)))
+
+	h := virtioNetHdr{
+		flags:      virtioNetHdrFNeedsCsum,
+		gsoType:    virtioNetHdrGSOTCPv4,
+		hdrLen:     uint16(c.hlen),
+		gsoSize:    uint16(c.mss),
+		csumStart:  uint16(c.ihl),
+		csumOffset: 16,
+	}
+	h.encode(c.buf[:virtioNetHdrLen])
+
+	return c.write(c.buf[:virtioNetHdrLen], pkt)
+}
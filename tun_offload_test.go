@@ -0,0 +1,180 @@
+package nebula
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestTCPPacket builds an ipv4 tcp packet with DF set and valid checksums
+func newTestTCPPacket(seq uint32, flags uint8, payload []byte) []byte {
+	p := make([]byte, 40+len(payload))
+	p[0] = 0x45
+	binary.BigEndian.PutUint16(p[2:4], uint16(len(p)))
+	binary.BigEndian.PutUint16(p[4:6], 100)
+	binary.BigEndian.PutUint16(p[6:8], 0x4000)
+	p[8] = 64
+	p[9] = fwProtoTCP
+	copy(p[12:16], []byte{10, 0, 0, 1})
+	copy(p[16:20], []byte{10, 0, 0, 2})
+	setIPv4Checksum(p, 20)
+
+	tcp := p[20:]
+	binary.BigEndian.PutUint16(tcp[0:2], 5000)
+	binary.BigEndian.PutUint16(tcp[2:4], 80)
+	binary.BigEndian.PutUint32(tcp[4:8], seq)
+	binary.BigEndian.PutUint32(tcp[8:12], 42)
+	tcp[12] = 5 << 4
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:16], 1024)
+	copy(tcp[20:], payload)
+	binary.BigEndian.PutUint16(tcp[16:18], ^checksumFold(checksumAdd(pseudoHeaderSum(p, fwProtoTCP, len(tcp)), tcp)))
+
+	return p
+}
+
+func assertValidTCPPacket(t *testing.T, p []byte) {
+	assert.Equal(t, uint16(0xffff), checksumFold(checksumAdd(0, p[:20])), "ip checksum")
+	assert.Equal(t, uint16(0xffff), checksumFold(checksumAdd(pseudoHeaderSum(p, fwProtoTCP, len(p)-20), p[20:])), "tcp checksum")
+	assert.Equal(t, len(p), int(binary.BigEndian.Uint16(p[2:4])))
+}
+
+func Test_virtioNetHdr(t *testing.T) {
+	h := virtioNetHdr{flags: 1, gsoType: 5, hdrLen: 28, gsoSize: 1200, csumStart: 20, csumOffset: 6}
+	b := make([]byte, virtioNetHdrLen)
+	h.encode(b)
+
+	var d virtioNetHdr
+	assert.Nil(t, d.decode(b))
+	assert.Equal(t, h, d)
+
+	assert.Error(t, d.decode(b[:4]))
+}
+
+func Test_gsoSplitter_tcp(t *testing.T) {
+	payload := make([]byte, 2500)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+
+	pkt := newTestTCPPacket(1000, tcpFlagACK|tcpFlagPSH|tcpFlagCWR, payload)
+	// The kernel leaves the checksum partial on super packets
+	pkt[36], pkt[37] = 0, 0
+
+	s := gsoSplitter{}
+	assert.Nil(t, s.reset(pkt, virtioNetHdr{gsoType: virtioNetHdrGSOTCPv4, gsoSize: 1000, flags: virtioNetHdrFNeedsCsum}))
+
+	var segments [][]byte
+	for !s.done() {
+		dst := make([]byte, mtu)
+		n, err := s.segment(dst)
+		assert.Nil(t, err)
+		segments = append(segments, dst[:n])
+	}
+
+	assert.Len(t, segments, 3)
+	var got []byte
+	for i, seg := range segments {
+		assertValidTCPPacket(t, seg)
+		assert.Equal(t, uint16(100+i), binary.BigEndian.Uint16(seg[4:6]))
+		assert.Equal(t, uint32(1000+i*1000), binary.BigEndian.Uint32(seg[24:28]))
+		got = append(got, seg[40:]...)
+	}
+
+	// PSH only on the last segment, CWR only on the first
+	assert.Equal(t, uint8(tcpFlagACK|tcpFlagCWR), segments[0][33])
+	assert.Equal(t, uint8(tcpFlagACK), segments[1][33])
+	assert.Equal(t, uint8(tcpFlagACK|tcpFlagPSH), segments[2][33])
+	assert.Equal(t, payload, got)
+
+	// Too small of a buffer is an error
+	assert.Nil(t, s.reset(pkt, virtioNetHdr{gsoType: virtioNetHdrGSOTCPv4, gsoSize: 1000}))
+	_, err := s.segment(make([]byte, 100))
+	assert.Error(t, err)
+
+	// ipv6 is not supported
+	assert.Error(t, s.reset(pkt, virtioNetHdr{gsoType: 4, gsoSize: 1000}))
+}
+
+func Test_gsoSplitter_none(t *testing.T) {
+	pkt := newTestTCPPacket(1, tcpFlagACK, []byte("hello"))
+	expected := make([]byte, len(pkt))
+	copy(expected, pkt)
+
+	// Put the pseudo header sum in the checksum field like the kernel does for NEEDS_CSUM
+	binary.BigEndian.PutUint16(pkt[36:38], checksumFold(pseudoHeaderSum(pkt, fwProtoTCP, len(pkt)-20)))
+
+	s := gsoSplitter{}
+	assert.Nil(t, s.reset(pkt, virtioNetHdr{flags: virtioNetHdrFNeedsCsum, csumStart: 20, csumOffset: 16}))
+	assert.False(t, s.done())
+
+	dst := make([]byte, mtu)
+	n, err := s.segment(dst)
+	assert.Nil(t, err)
+	assert.Equal(t, expected, dst[:n])
+	assert.True(t, s.done())
+}
+
+func Test_tcpCoalescer(t *testing.T) {
+	type write struct {
+		hdr virtioNetHdr
+		pkt []byte
+	}
+	var writes []write
+	c := newTCPCoalescer(func(hdr, pkt []byte) error {
+		w := write{pkt: make([]byte, len(pkt))}
+		assert.Nil(t, w.hdr.decode(hdr))
+		copy(w.pkt, pkt)
+		writes = append(writes, w)
+		return nil
+	})
+
+	full := bytes.Repeat([]byte{1}, 1000)
+	pkts := [][]byte{
+		newTestTCPPacket(1000, tcpFlagACK, full),
+		newTestTCPPacket(2000, tcpFlagACK, full),
+		newTestTCPPacket(3000, tcpFlagACK|tcpFlagPSH, full[:500]),
+		// out of order, can not be merged
+		newTestTCPPacket(9000, tcpFlagACK, full),
+		// syn is never merged
+		newTestTCPPacket(0, tcpFlagSYN, nil),
+	}
+
+	assert.Nil(t, c.WriteBatch(pkts))
+	assert.Len(t, writes, 3)
+
+	// The first three became a single super packet
+	w := writes[0]
+	assert.Equal(t, virtioNetHdr{
+		flags:      virtioNetHdrFNeedsCsum,
+		gsoType:    virtioNetHdrGSOTCPv4,
+		hdrLen:     40,
+		gsoSize:    1000,
+		csumStart:  20,
+		csumOffset: 16,
+	}, w.hdr)
+	assert.Len(t, w.pkt, 40+2500)
+	assert.Equal(t, uint8(tcpFlagACK|tcpFlagPSH), w.pkt[33])
+
+	// Splitting it again gives back the original packets
+	s := gsoSplitter{}
+	assert.Nil(t, s.reset(w.pkt, w.hdr))
+	for i := 0; i < 3; i++ {
+		dst := make([]byte, mtu)
+		n, err := s.segment(dst)
+		assert.Nil(t, err)
+		// ip ids are regenerated from the first packet
+		binary.BigEndian.PutUint16(dst[4:6], 100)
+		setIPv4Checksum(dst, 20)
+		assert.Equal(t, pkts[i], dst[:n])
+	}
+	assert.True(t, s.done())
+
+	// The rest go through untouched
+	assert.Equal(t, virtioNetHdr{}, writes[1].hdr)
+	assert.Equal(t, pkts[3], writes[1].pkt)
+	assert.Equal(t, virtioNetHdr{}, writes[2].hdr)
+	assert.Equal(t, pkts[4], writes[2].pkt)
+}
@@ -21,15 +21,16 @@ type Tun struct {
 	txPackets chan []byte // Packets transmitted outside by nebula
 }
 
-func newTun(l *logrus.Logger, deviceName string, cidr *net.IPNet, defaultMTU int, _ []route, unsafeRoutes []route, _ int, _ bool) (ifce *Tun, err error) {
+func newTun(l *logrus.Logger, deviceName string, cidr *net.IPNet, defaultMTU int, _ []route, unsafeRoutes []route, _ int, _ bool, _ bool) (ifce *Tun, err error) {
 	return &Tun{
 		Device:       deviceName,
 		Cidr:         cidr,
 		MTU:          defaultMTU,
 		UnsafeRoutes: unsafeRoutes,
 		l:            l,
-		rxPackets:    make(chan []byte, 1),
 		txPackets:    make(chan []byte, 1),
+		// Room for a burst of packets so ReadBatch returns more than one at a time
+		rxPackets: make(chan []byte, 64),
 	}, nil
 }
 
@@ -101,6 +102,22 @@ func (c *Tun) Read(b []byte) (int, error) {
 	return len(p), nil
 }
 
+// ReadBatch blocks for the first packet and then takes any others that are already queued
+func (c *Tun) ReadBatch(bufs [][]byte, sizes []int) (int, error) {
+	sizes[0], _ = c.Read(bufs[0])
+	n := 1
+	for n < len(bufs) {
+		select {
+		case p := <-c.rxPackets:
+			sizes[n] = copy(bufs[n], p)
+			n++
+		default:
+			return n, nil
+		}
+	}
+	return n, nil
+}
+
 func (c *Tun) NewMultiQueueReader() (io.ReadWriteCloser, error) {
 	return nil, fmt.Errorf("TODO: multiqueue not implemented")
 }
@@ -0,0 +1,211 @@
+package nebula
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// testTimestampLen is the length of a test request payload that carries the time it was sent, the magic followed
+	// by the time in nanoseconds
+	testTimestampLen = 12
+
+	// maxTestRTT is the longest round trip we believe, anything longer is a stale or bogus reply
+	maxTestRTT = time.Minute
+)
+
+var testTimestampMagic = []byte("TIME")
+
+// tunnelStats are the traffic counters of a single tunnel, every field is updated atomically
+type tunnelStats struct {
+	atomicTxBytes       uint64
+	atomicTxPackets     uint64
+	atomicRxBytes       uint64
+	atomicRxPackets     uint64
+	atomicReplayed      uint64
+	atomicDecryptFailed uint64
+	// atomicRTT is the smoothed round trip time in nanoseconds
+	atomicRTT int64
+}
+
+// TunnelStats is a copy of the counters of a tunnel
+type TunnelStats struct {
+	TxBytes       uint64        `json:"txBytes"`
+	TxPackets     uint64        `json:"txPackets"`
+	RxBytes       uint64        `json:"rxBytes"`
+	RxPackets     uint64        `json:"rxPackets"`
+	Replayed      uint64        `json:"replayed"`
+	DecryptFailed uint64        `json:"decryptFailed"`
+	RTT           time.Duration `json:"rtt"`
+}
+
+func (s *tunnelStats) tx(n int) {
+	atomic.AddUint64(&s.atomicTxPackets, 1)
+	atomic.AddUint64(&s.atomicTxBytes, uint64(n))
+}
+
+func (s *tunnelStats) rx(n int) {
+	atomic.AddUint64(&s.atomicRxPackets, 1)
+	atomic.AddUint64(&s.atomicRxBytes, uint64(n))
+}
+
+func (s *tunnelStats) replayed() {
+	atomic.AddUint64(&s.atomicReplayed, 1)
+}
+
+func (s *tunnelStats) decryptFailed() {
+	atomic.AddUint64(&s.atomicDecryptFailed, 1)
+}
+
+// sampleRTT folds a round trip measurement into the smoothed rtt the same way tcp does, rfc6298
+func (s *tunnelStats) sampleRTT(rtt time.Duration) {
+	for {
+		old := atomic.LoadInt64(&s.atomicRTT)
+		srtt := int64(rtt)
+		if old != 0 {
+			srtt = (7*old + int64(rtt)) / 8
+		}
+
+		if atomic.CompareAndSwapInt64(&s.atomicRTT, old, srtt) {
+			return
+		}
+	}
+}
+
+func (s *tunnelStats) Copy() TunnelStats {
+	return TunnelStats{
+		TxBytes:       atomic.LoadUint64(&s.atomicTxBytes),
+		TxPackets:     atomic.LoadUint64(&s.atomicTxPackets),
+		RxBytes:       atomic.LoadUint64(&s.atomicRxBytes),
+		RxPackets:     atomic.LoadUint64(&s.atomicRxPackets),
+		Replayed:      atomic.LoadUint64(&s.atomicReplayed),
+		DecryptFailed: atomic.LoadUint64(&s.atomicDecryptFailed),
+		RTT:           time.Duration(atomic.LoadInt64(&s.atomicRTT)),
+	}
+}
+
+func (s *tunnelStats) MarshalJSON() ([]byte, error) {
+	c := s.Copy()
+	return json.Marshal(m{
+		"txBytes":       c.TxBytes,
+		"txPackets":     c.TxPackets,
+		"rxBytes":       c.RxBytes,
+		"rxPackets":     c.RxPackets,
+		"replayed":      c.Replayed,
+		"decryptFailed": c.DecryptFailed,
+		"rtt":           c.RTT.String(),
+	})
+}
+
+// appendTestTimestamp appends a test request payload holding t to b, peers echo it back in their test reply
+func appendTestTimestamp(b []byte, t time.Time) []byte {
+	var ts [testTimestampLen]byte
+	copy(ts[:], testTimestampMagic)
+	binary.BigEndian.PutUint64(ts[4:], uint64(t.UnixNano()))
+	return append(b, ts[:]...)
+}
+
+// handleTestTimestamp measures the round trip time of a test reply if it carries the time the request was sent
+func (s *tunnelStats) handleTestTimestamp(d []byte, now time.Time) {
+	if len(d) != testTimestampLen || !bytes.Equal(d[:4], testTimestampMagic) {
+		return
+	}
+
+	rtt := now.Sub(time.Unix(0, int64(binary.BigEndian.Uint64(d[4:]))))
+	if rtt < 0 || rtt > maxTestRTT {
+		return
+	}
+
+	s.sampleRTT(rtt)
+}
+
+// tunnelStatsCollector exports the counters of every tunnel to prometheus with a label for each peer. Only the first
+// max tunnels, ordered by vpn ip, are exported to keep the number of series in check on large networks.
+type tunnelStatsCollector struct {
+	hostMaps map[string]*HostMap
+	max      int
+
+	txBytes       *prometheus.Desc
+	txPackets     *prometheus.Desc
+	rxBytes       *prometheus.Desc
+	rxPackets     *prometheus.Desc
+	replayed      *prometheus.Desc
+	decryptFailed *prometheus.Desc
+	rtt           *prometheus.Desc
+	omitted       *prometheus.Desc
+}
+
+func newTunnelStatsCollector(namespace, subsystem string, hostMaps map[string]*HostMap, max int) *tunnelStatsCollector {
+	labels := []string{"network", "vpn_ip", "cert_name"}
+	desc := func(name, help string, labels []string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(namespace, subsystem, name), help, labels, nil)
+	}
+
+	return &tunnelStatsCollector{
+		hostMaps:      hostMaps,
+		max:           max,
+		txBytes:       desc("tunnel_tx_bytes_total", "Bytes sent over the tunnel", labels),
+		txPackets:     desc("tunnel_tx_packets_total", "Packets sent over the tunnel", labels),
+		rxBytes:       desc("tunnel_rx_bytes_total", "Bytes received over the tunnel", labels),
+		rxPackets:     desc("tunnel_rx_packets_total", "Packets received over the tunnel", labels),
+		replayed:      desc("tunnel_replayed_packets_total", "Packets dropped by the replay window", labels),
+		decryptFailed: desc("tunnel_decrypt_failures_total", "Packets that failed to decrypt", labels),
+		rtt:           desc("tunnel_rtt_seconds", "Smoothed round trip time of the tunnel", labels),
+		omitted:       desc("tunnel_stats_omitted", "Tunnels left out because of stats.tunnels.max", []string{"network"}),
+	}
+}
+
+func (c *tunnelStatsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.txBytes
+	ch <- c.txPackets
+	ch <- c.rxBytes
+	ch <- c.rxPackets
+	ch <- c.replayed
+	ch <- c.decryptFailed
+	ch <- c.rtt
+	ch <- c.omitted
+}
+
+func (c *tunnelStatsCollector) Collect(ch chan<- prometheus.Metric) {
+	for network, hm := range c.hostMaps {
+		hm.RLock()
+		hosts := make([]*HostInfo, 0, len(hm.Hosts))
+		for _, h := range hm.Hosts {
+			hosts = append(hosts, h)
+		}
+		hm.RUnlock()
+
+		sort.Slice(hosts, func(i, j int) bool { return hosts[i].hostId < hosts[j].hostId })
+
+		omitted := 0
+		if len(hosts) > c.max {
+			omitted = len(hosts) - c.max
+			hosts = hosts[:c.max]
+		}
+		ch <- prometheus.MustNewConstMetric(c.omitted, prometheus.GaugeValue, float64(omitted), network)
+
+		for _, h := range hosts {
+			var name string
+			if crt := h.GetCert(); crt != nil {
+				name = strings.Join(crt.Details.Names, ",")
+			}
+
+			s := h.stats.Copy()
+			labels := []string{network, IntIp(h.hostId).String(), name}
+			ch <- prometheus.MustNewConstMetric(c.txBytes, prometheus.CounterValue, float64(s.TxBytes), labels...)
+			ch <- prometheus.MustNewConstMetric(c.txPackets, prometheus.CounterValue, float64(s.TxPackets), labels...)
+			ch <- prometheus.MustNewConstMetric(c.rxBytes, prometheus.CounterValue, float64(s.RxBytes), labels...)
+			ch <- prometheus.MustNewConstMetric(c.rxPackets, prometheus.CounterValue, float64(s.RxPackets), labels...)
+			ch <- prometheus.MustNewConstMetric(c.replayed, prometheus.CounterValue, float64(s.Replayed), labels...)
+			ch <- prometheus.MustNewConstMetric(c.decryptFailed, prometheus.CounterValue, float64(s.DecryptFailed), labels...)
+			ch <- prometheus.MustNewConstMetric(c.rtt, prometheus.GaugeValue, s.RTT.Seconds(), labels...)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package nebula
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/slackhq/nebula/cert"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTunnelStats(t *testing.T) {
+	s := &tunnelStats{}
+	s.tx(100)
+	s.tx(50)
+	s.rx(10)
+	s.replayed()
+	s.decryptFailed()
+	s.decryptFailed()
+
+	assert.Equal(t, TunnelStats{TxBytes: 150, TxPackets: 2, RxBytes: 10, RxPackets: 1, Replayed: 1, DecryptFailed: 2}, s.Copy())
+
+	s.sampleRTT(time.Millisecond * 80)
+	assert.Equal(t, time.Millisecond*80, s.Copy().RTT)
+	s.sampleRTT(time.Millisecond * 160)
+	assert.Equal(t, time.Millisecond*90, s.Copy().RTT)
+}
+
+func TestTunnelStats_handleTestTimestamp(t *testing.T) {
+	now := time.Now()
+	s := &tunnelStats{}
+
+	// Payloads without a timestamp are ignored
+	s.handleTestTimestamp([]byte(""), now)
+	s.handleTestTimestamp([]byte("PMTU"), now)
+	assert.Equal(t, time.Duration(0), s.Copy().RTT)
+
+	// Including the 8 byte header a path mtu probe reply echoes and payloads without the timestamp magic
+	probe := make([]byte, 1200)
+	copy(probe, pmtuProbeMagic)
+	binary.BigEndian.PutUint32(probe[4:8], 1)
+	s.handleTestTimestamp(pmtuReply(probe), now)
+	ts := appendTestTimestamp(nil, now.Add(-time.Millisecond*20))
+	s.handleTestTimestamp(ts[4:], now)
+	s.handleTestTimestamp(append([]byte("PING"), ts[4:]...), now)
+	assert.Equal(t, time.Duration(0), s.Copy().RTT)
+
+	// As are timestamps from the future or the distant past
+	s.handleTestTimestamp(appendTestTimestamp(nil, now.Add(time.Second)), now)
+	s.handleTestTimestamp(appendTestTimestamp(nil, now.Add(-time.Hour)), now)
+	assert.Equal(t, time.Duration(0), s.Copy().RTT)
+
+	s.handleTestTimestamp(appendTestTimestamp(nil, now.Add(-time.Millisecond*20)), now)
+	assert.Equal(t, time.Millisecond*20, s.Copy().RTT)
+}
+
+func TestTunnelStatsCollector(t *testing.T) {
+	l := NewTestLogger()
+	_, vpncidr, _ := net.ParseCIDR("172.1.1.1/24")
+	hm := NewHostMap(l, "test", vpncidr, nil)
+
+	for i := 1; i <= 3; i++ {
+		h := &HostInfo{
+			hostId: ip2int(net.IPv4(172, 1, 1, byte(i))),
+			ConnectionState: &ConnectionState{
+				peerCert: &cert.NebulaCertificate{Details: cert.NebulaCertificateDetails{Names: []string{"host"}}},
+			},
+		}
+		h.stats.tx(i * 100)
+		hm.Add(h.hostId, h)
+	}
+
+	c := newTunnelStatsCollector("nebula", "", map[string]*HostMap{"": hm}, 2)
+	pr := prometheus.NewRegistry()
+	pr.MustRegister(c)
+
+	mfs, err := pr.Gather()
+	assert.Nil(t, err)
+	assert.Len(t, mfs, 8)
+
+	// Only the lowest vpn ips fit
+	for _, mf := range mfs {
+		switch mf.GetName() {
+		case "nebula_tunnel_stats_omitted":
+			assert.Equal(t, 1.0, mf.Metric[0].GetGauge().GetValue())
+		case "nebula_tunnel_tx_bytes_total":
+			assert.Len(t, mf.Metric, 2)
+			for _, m := range mf.Metric {
+				assert.NotEqual(t, 300.0, m.GetCounter().GetValue())
+			}
+		}
+	}
+}
@@ -8,9 +8,11 @@ package nebula
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
 
+	"github.com/rcrowley/go-metrics"
 	"github.com/sirupsen/logrus"
 )
 
@@ -36,6 +38,21 @@ func (uc *udpConn) WriteTo(b []byte, addr *udpAddr) error {
 	return err
 }
 
+// WriteBatch writes each packet in bufs to the matching entry in addrs, there is no batched send in the stdlib.
+// A packet that can not be sent is logged and skipped, the first error is returned once every packet has been tried.
+func (uc *udpConn) WriteBatch(bufs [][]byte, addrs []*udpAddr) error {
+	var firstErr error
+	for i, b := range bufs {
+		if err := uc.WriteTo(b, addrs[i]); err != nil {
+			uc.l.WithError(err).WithField("udpAddr", addrs[i]).Error("Failed to write outgoing packet")
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
 func (uc *udpConn) LocalAddr() (*udpAddr, error) {
 	a := uc.UDPConn.LocalAddr()
 
@@ -55,7 +72,7 @@ func (u *udpConn) reloadConfig(c *Config) {
 	// TODO
 }
 
-func NewUDPStatsEmitter(udpConns []*udpConn) func() {
+func NewUDPStatsEmitter(udpConns []*udpConn, _ metrics.Registry) func() {
 	// No UDP stats for non-linux
 	return func() {}
 }
@@ -90,6 +107,15 @@ func (u *udpConn) ListenOut(f *Interface, q int) {
 	}
 }
 
+func (u *udpConn) SetDontFragment() error {
+	return errors.New("setting the don't fragment bit is not supported on this platform")
+}
+
+// WriteToDontFragment is WriteTo, the DF bit is never set on this platform
+func (u *udpConn) WriteToDontFragment(b []byte, addr *udpAddr) error {
+	return u.WriteTo(b, addr)
+}
+
 func hostDidRoam(addr *udpAddr, newaddr *udpAddr) bool {
 	return !addr.Equals(newaddr)
 }
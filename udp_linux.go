@@ -5,8 +5,11 @@ package nebula
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"net"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"unsafe"
 
@@ -20,6 +23,27 @@ import (
 type udpConn struct {
 	sysFd int
 	l     *logrus.Logger
+
+	// gso is 1 when consecutive packets to the same destination are sent as a single UDP_SEGMENT message. It is
+	// changed by reloads and WriteBatch while other routines are sending, use gsoEnabled and setGSO.
+	gso          uint32
+	gsoSupported bool
+	batch        *udpWriteBatch
+
+	// dontFragment is set once SetDontFragment succeeds, mtuDiscover holds the default ipv4 and ipv6 IP_MTU_DISCOVER of
+	// the socket. dfLock is held while WriteToDontFragment has the DF bit set.
+	dontFragment bool
+	mtuDiscover  [2]int
+	dfLock       sync.Mutex
+}
+
+// udpWriteBatch is the scratch space used by WriteBatch to build sendmmsg calls
+type udpWriteBatch struct {
+	msgs     []rawMessage
+	iovs     []iovec
+	names    []unix.RawSockaddrInet6
+	controls [][]byte
+	starts   []int
 }
 
 var x int
@@ -41,6 +65,21 @@ const (
 
 type _SK_MEMINFO [_SK_MEMINFO_VARS]uint32
 
+// From linux/udp.h
+const (
+	_UDP_SEGMENT = 103
+	_UDP_GRO     = 104
+)
+
+const (
+	// maxGSOSegments is the most segments the kernel will accept in a single UDP_SEGMENT message
+	maxGSOSegments = 64
+	// maxGSOBytes is the largest payload allowed in a single UDP_SEGMENT message
+	maxGSOBytes = 65000
+	// groBufferSize is large enough to hold any datagram coalesced by UDP_GRO
+	groBufferSize = 65535
+)
+
 func NewListener(l *logrus.Logger, ip string, port int, multi bool) (*udpConn, error) {
 	syscall.ForkLock.RLock()
 	fd, err := unix.Socket(unix.AF_INET6, unix.SOCK_DGRAM, unix.IPPROTO_UDP)
@@ -73,13 +112,83 @@ func NewListener(l *logrus.Logger, ip string, port int, multi bool) (*udpConn, e
 	//v, err := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_INCOMING_CPU)
 	//l.Println(v, err)
 
-	return &udpConn{sysFd: fd, l: l}, err
+	// UDP_SEGMENT is available as a socket option on kernels that support gso
+	_, gsoErr := unix.GetsockoptInt(fd, unix.IPPROTO_UDP, _UDP_SEGMENT)
+
+	return &udpConn{sysFd: fd, l: l, gsoSupported: gsoErr == nil}, err
 }
 
 func (u *udpConn) Rebind() error {
 	return nil
 }
 
+// Close closes the socket
+func (u *udpConn) Close() error {
+	return unix.Close(u.sysFd)
+}
+
+// SetDontFragment checks that WriteToDontFragment can set the DF bit on this socket and remembers how the kernel
+// treats every other packet, the socket itself is left as it was
+func (u *udpConn) SetDontFragment() error {
+	v4, err := unix.GetsockoptInt(u.sysFd, unix.IPPROTO_IP, unix.IP_MTU_DISCOVER)
+	if err != nil {
+		return err
+	}
+
+	v6, err := unix.GetsockoptInt(u.sysFd, unix.IPPROTO_IPV6, unix.IPV6_MTU_DISCOVER)
+	if err != nil {
+		return err
+	}
+
+	err = u.setMTUDiscover(unix.IP_PMTUDISC_PROBE, unix.IPV6_PMTUDISC_PROBE)
+	if err != nil {
+		return err
+	}
+
+	err = u.setMTUDiscover(v4, v6)
+	if err != nil {
+		return err
+	}
+
+	u.dontFragment = true
+	u.mtuDiscover = [2]int{v4, v6}
+	return nil
+}
+
+func (u *udpConn) setMTUDiscover(v4, v6 int) error {
+	err := unix.SetsockoptInt(u.sysFd, unix.IPPROTO_IP, unix.IP_MTU_DISCOVER, v4)
+	if err != nil {
+		return err
+	}
+
+	return unix.SetsockoptInt(u.sysFd, unix.IPPROTO_IPV6, unix.IPV6_MTU_DISCOVER, v6)
+}
+
+// WriteToDontFragment sends b with the DF bit set and without the kernel fragmenting it based on its own path mtu
+// cache, this is needed for path mtu probes to be accurate. The socket goes back to its default once b is sent, so
+// packets sent by other routines meanwhile may be refused instead of fragmented if they do not fit.
+func (u *udpConn) WriteToDontFragment(b []byte, addr *udpAddr) error {
+	if !u.dontFragment {
+		return &net.OpError{Op: "sendto", Err: errors.New("SetDontFragment was not called")}
+	}
+
+	u.dfLock.Lock()
+	defer u.dfLock.Unlock()
+
+	err := u.setMTUDiscover(unix.IP_PMTUDISC_PROBE, unix.IPV6_PMTUDISC_PROBE)
+	if err != nil {
+		return &net.OpError{Op: "setsockopt", Err: err}
+	}
+
+	err = u.WriteTo(b, addr)
+
+	if rErr := u.setMTUDiscover(u.mtuDiscover[0], u.mtuDiscover[1]); rErr != nil {
+		u.l.WithError(rErr).Error("Failed to clear the DF bit after sending a path mtu probe")
+	}
+
+	return err
+}
+
 func (u *udpConn) SetRecvBuffer(n int) error {
 	return unix.SetsockoptInt(u.sysFd, unix.SOL_SOCKET, unix.SO_RCVBUFFORCE, n)
 }
@@ -114,13 +223,13 @@ func (u *udpConn) LocalAddr() (*udpAddr, error) {
 	addr := &udpAddr{}
 	if rsa.Addr.Family == unix.AF_INET {
 		pp := (*unix.RawSockaddrInet4)(unsafe.Pointer(&rsa))
-		addr.Port = uint16(rsa.Addr.Data[0])<<8 + uint16(rsa.Addr.Data[1])
+		addr.Port = uint16(uint8(rsa.Addr.Data[0]))<<8 + uint16(uint8(rsa.Addr.Data[1]))
 		copy(addr.IP, pp.Addr[:])
 
 	} else if rsa.Addr.Family == unix.AF_INET6 {
 		//TODO: this cast sucks and we can do better
 		pp := (*unix.RawSockaddrInet6)(unsafe.Pointer(&rsa))
-		addr.Port = uint16(rsa.Addr.Data[0])<<8 + uint16(rsa.Addr.Data[1])
+		addr.Port = uint16(uint8(rsa.Addr.Data[0]))<<8 + uint16(uint8(rsa.Addr.Data[1]))
 		copy(addr.IP, pp.Addr[:])
 
 	} else {
@@ -143,9 +252,21 @@ func (u *udpConn) ListenOut(f *Interface, q int) {
 
 	lhh := f.lightHouse.NewRequestHandler()
 
+	// With gro enabled the kernel may hand us several datagrams from the same source in a single buffer
+	bufSize := mtu
+	controlLen := 0
+	if f.udpGRO {
+		if err := unix.SetsockoptInt(u.sysFd, unix.IPPROTO_UDP, _UDP_GRO, 1); err == nil {
+			bufSize = groBufferSize
+			controlLen = unix.CmsgSpace(4)
+		} else if q == 0 {
+			u.l.WithError(err).Info("UDP GRO is not supported, reading one packet per buffer")
+		}
+	}
+
 	//TODO: should we track this?
 	//metric := metrics.GetOrRegisterHistogram("test.batch_read", nil, metrics.NewExpDecaySample(1028, 0.015))
-	msgs, buffers, names := u.PrepareRawMessages(f.udpBatchSize)
+	msgs, buffers, names, controls := u.PrepareRawMessages(f.udpBatchSize, bufSize, controlLen)
 	read := u.ReadMulti
 	if f.udpBatchSize == 1 {
 		read = u.ReadSingle
@@ -154,6 +275,13 @@ func (u *udpConn) ListenOut(f *Interface, q int) {
 	conntrackCache := NewConntrackCacheTicker(f.conntrackCacheTimeout)
 
 	for {
+		if controlLen > 0 {
+			// The kernel shrinks the control length to what it wrote, reset it before every read
+			for i := range msgs {
+				msgs[i].Hdr.setControl(controls[i])
+			}
+		}
+
 		n, err := read(msgs)
 		if err != nil {
 			u.l.WithError(err).Error("Failed to read packets")
@@ -164,9 +292,45 @@ func (u *udpConn) ListenOut(f *Interface, q int) {
 		for i := 0; i < n; i++ {
 			udpAddr.IP = names[i][8:24]
 			udpAddr.Port = binary.BigEndian.Uint16(names[i][2:4])
-			f.readOutsidePackets(udpAddr, plaintext[:0], buffers[i][:msgs[i].Len], header, fwPacket, lhh, nb, q, conntrackCache.Get(u.l))
+
+			b := buffers[i][:msgs[i].Len]
+			segment := len(b)
+			if controlLen > 0 {
+				if s := groSegmentSize(controls[i][:msgs[i].Hdr.Controllen]); s > 0 {
+					segment = s
+				}
+			}
+
+			for len(b) > 0 {
+				end := segment
+				if end > len(b) {
+					end = len(b)
+				}
+				f.readOutsidePackets(udpAddr, plaintext[:0], b[:end], header, fwPacket, lhh, nb, q, conntrackCache.Get(u.l))
+				b = b[end:]
+			}
+		}
+
+		f.flushTunBatch(q)
+	}
+}
+
+// groSegmentSize returns the segment size reported by UDP_GRO in a control message, or 0 if there was none
+func groSegmentSize(control []byte) int {
+	for len(control) >= unix.CmsgLen(0) {
+		h := (*unix.Cmsghdr)(unsafe.Pointer(&control[0]))
+		if h.Len < unix.SizeofCmsghdr || int(h.Len) > len(control) {
+			return 0
+		}
+
+		if h.Level == unix.IPPROTO_UDP && h.Type == _UDP_GRO && int(h.Len) >= unix.CmsgLen(4) {
+			return int(*(*int32)(unsafe.Pointer(&control[unix.CmsgLen(0)])))
 		}
+
+		control = control[unix.CmsgSpace(int(h.Len)-unix.CmsgLen(0)):]
 	}
+
+	return 0
 }
 
 func (u *udpConn) ReadSingle(msgs []rawMessage) (int, error) {
@@ -213,11 +377,7 @@ func (u *udpConn) ReadMulti(msgs []rawMessage) (int, error) {
 func (u *udpConn) WriteTo(b []byte, addr *udpAddr) error {
 
 	var rsa unix.RawSockaddrInet6
-	rsa.Family = unix.AF_INET6
-	p := (*[2]byte)(unsafe.Pointer(&rsa.Port))
-	p[0] = byte(addr.Port >> 8)
-	p[1] = byte(addr.Port)
-	copy(rsa.Addr[:], addr.IP)
+	setSockaddr(&rsa, addr)
 
 	for {
 		_, _, err := unix.Syscall6(
@@ -240,7 +400,160 @@ func (u *udpConn) WriteTo(b []byte, addr *udpAddr) error {
 	}
 }
 
+// WriteBatch sends every packet in bufs to the matching entry in addrs with as few sendmmsg calls as possible. When gso
+// is enabled, runs of packets to the same destination are sent as a single UDP_SEGMENT message.
+// A message that can not be sent is logged and skipped so one unreachable remote does not drop the packets for every
+// other remote in the batch, the first such error is returned once the whole batch has been tried.
+// WriteBatch is not safe for concurrent use, each inside routine writes through its own udpConn.
+func (u *udpConn) WriteBatch(bufs [][]byte, addrs []*udpAddr) error {
+	if len(bufs) == 0 {
+		return nil
+	}
+
+	if u.batch == nil || len(u.batch.msgs) < len(bufs) {
+		u.batch = newUDPWriteBatch(len(bufs))
+	}
+	wb := u.batch
+	gso := u.gsoEnabled()
+
+	n := 0
+	for i := 0; i < len(bufs); n++ {
+		first := i
+		size := len(bufs[i])
+		total := size
+		i++
+
+		if gso {
+			// Every segment but the last must be exactly size bytes, the last may be shorter
+			for i < len(bufs) && i-first < maxGSOSegments && len(bufs[i-1]) == size && len(bufs[i]) <= size &&
+				total+len(bufs[i]) <= maxGSOBytes && addrs[i].Equals(addrs[first]) {
+				total += len(bufs[i])
+				i++
+			}
+		}
+
+		for j := first; j < i; j++ {
+			wb.iovs[j].set(bufs[j])
+		}
+		wb.starts[n] = first
+
+		setSockaddr(&wb.names[n], addrs[first])
+
+		m := &wb.msgs[n]
+		m.Hdr.setIov(wb.iovs[first:i])
+		m.Hdr.Name = (*byte)(unsafe.Pointer(&wb.names[n]))
+		m.Hdr.Namelen = unix.SizeofSockaddrInet6
+
+		if i-first > 1 {
+			setGSOSize(wb.controls[n], size)
+			m.Hdr.setControl(wb.controls[n])
+		} else {
+			m.Hdr.setControl(nil)
+		}
+	}
+
+	var firstErr error
+	for sent := 0; sent < n; {
+		r, _, err := unix.Syscall6(
+			unix.SYS_SENDMMSG,
+			uintptr(u.sysFd),
+			uintptr(unsafe.Pointer(&wb.msgs[sent])),
+			uintptr(n-sent),
+			0,
+			0,
+			0,
+		)
+
+		if err == unix.EINTR {
+			continue
+		}
+
+		if err == unix.EIO && gso {
+			// Some drivers do not support checksum offload which gso requires, fall back to plain messages
+			u.l.WithError(err).Warn("UDP GSO is not supported by the network device, disabling")
+			u.setGSO(false)
+			start := wb.starts[sent]
+			if err := u.WriteBatch(bufs[start:], addrs[start:]); err != nil && firstErr == nil {
+				firstErr = err
+			}
+			return firstErr
+		}
+
+		if err != 0 {
+			// sendmmsg only fails outright when the first message it was given could not be sent
+			start := wb.starts[sent]
+			end := len(bufs)
+			if sent+1 < n {
+				end = wb.starts[sent+1]
+			}
+
+			opErr := &net.OpError{Op: "sendmmsg", Err: err}
+			u.l.WithError(opErr).WithField("udpAddr", addrs[start]).WithField("packets", end-start).
+				Error("Failed to write outgoing packets")
+			if firstErr == nil {
+				firstErr = opErr
+			}
+			sent++
+			continue
+		}
+
+		sent += int(r)
+	}
+
+	return firstErr
+}
+
+func newUDPWriteBatch(n int) *udpWriteBatch {
+	wb := &udpWriteBatch{
+		msgs:     make([]rawMessage, n),
+		iovs:     make([]iovec, n),
+		names:    make([]unix.RawSockaddrInet6, n),
+		controls: make([][]byte, n),
+		starts:   make([]int, n),
+	}
+
+	for i := range wb.controls {
+		wb.controls[i] = make([]byte, unix.CmsgSpace(2))
+	}
+
+	return wb
+}
+
+func setSockaddr(rsa *unix.RawSockaddrInet6, addr *udpAddr) {
+	rsa.Family = unix.AF_INET6
+	p := (*[2]byte)(unsafe.Pointer(&rsa.Port))
+	p[0] = byte(addr.Port >> 8)
+	p[1] = byte(addr.Port)
+	copy(rsa.Addr[:], addr.IP.To16())
+}
+
+func setGSOSize(control []byte, size int) {
+	h := (*unix.Cmsghdr)(unsafe.Pointer(&control[0]))
+	h.Level = unix.IPPROTO_UDP
+	h.Type = _UDP_SEGMENT
+	h.SetLen(unix.CmsgLen(2))
+	*(*uint16)(unsafe.Pointer(&control[unix.CmsgLen(0)])) = uint16(size)
+}
+
+func (u *udpConn) gsoEnabled() bool {
+	return atomic.LoadUint32(&u.gso) == 1
+}
+
+// setGSO turns gso on or off and returns whether it was on before
+func (u *udpConn) setGSO(on bool) bool {
+	var v uint32
+	if on {
+		v = 1
+	}
+	return atomic.SwapUint32(&u.gso, v) == 1
+}
+
 func (u *udpConn) reloadConfig(c *Config) {
+	gso := c.GetBool("listen.gso", true) && u.gsoSupported
+	if u.setGSO(gso) != gso {
+		u.l.WithField("gso", gso).Info("UDP segmentation offload changed")
+	}
+
 	b := c.GetInt("listen.read_buffer", 0)
 	if b > 0 {
 		err := u.SetRecvBuffer(b)
@@ -281,7 +594,7 @@ func (u *udpConn) getMemInfo(meminfo *_SK_MEMINFO) error {
 	return nil
 }
 
-func NewUDPStatsEmitter(udpConns []*udpConn) func() {
+func NewUDPStatsEmitter(udpConns []*udpConn, r metrics.Registry) func() {
 	// Check if our kernel supports SO_MEMINFO before registering the gauges
 	var udpGauges [][_SK_MEMINFO_VARS]metrics.Gauge
 	var meminfo _SK_MEMINFO
@@ -289,15 +602,15 @@ func NewUDPStatsEmitter(udpConns []*udpConn) func() {
 		udpGauges = make([][_SK_MEMINFO_VARS]metrics.Gauge, len(udpConns))
 		for i := range udpConns {
 			udpGauges[i] = [_SK_MEMINFO_VARS]metrics.Gauge{
-				metrics.GetOrRegisterGauge(fmt.Sprintf("udp.%d.rmem_alloc", i), nil),
-				metrics.GetOrRegisterGauge(fmt.Sprintf("udp.%d.rcvbuf", i), nil),
-				metrics.GetOrRegisterGauge(fmt.Sprintf("udp.%d.wmem_alloc", i), nil),
-				metrics.GetOrRegisterGauge(fmt.Sprintf("udp.%d.sndbuf", i), nil),
-				metrics.GetOrRegisterGauge(fmt.Sprintf("udp.%d.fwd_alloc", i), nil),
-				metrics.GetOrRegisterGauge(fmt.Sprintf("udp.%d.wmem_queued", i), nil),
-				metrics.GetOrRegisterGauge(fmt.Sprintf("udp.%d.optmem", i), nil),
-				metrics.GetOrRegisterGauge(fmt.Sprintf("udp.%d.backlog", i), nil),
-				metrics.GetOrRegisterGauge(fmt.Sprintf("udp.%d.drops", i), nil),
+				metrics.GetOrRegisterGauge(fmt.Sprintf("udp.%d.rmem_alloc", i), r),
+				metrics.GetOrRegisterGauge(fmt.Sprintf("udp.%d.rcvbuf", i), r),
+				metrics.GetOrRegisterGauge(fmt.Sprintf("udp.%d.wmem_alloc", i), r),
+				metrics.GetOrRegisterGauge(fmt.Sprintf("udp.%d.sndbuf", i), r),
+				metrics.GetOrRegisterGauge(fmt.Sprintf("udp.%d.fwd_alloc", i), r),
+				metrics.GetOrRegisterGauge(fmt.Sprintf("udp.%d.wmem_queued", i), r),
+				metrics.GetOrRegisterGauge(fmt.Sprintf("udp.%d.optmem", i), r),
+				metrics.GetOrRegisterGauge(fmt.Sprintf("udp.%d.backlog", i), r),
+				metrics.GetOrRegisterGauge(fmt.Sprintf("udp.%d.drops", i), r),
 			}
 		}
 	}
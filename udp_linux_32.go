@@ -29,13 +29,16 @@ type rawMessage struct {
 	Len uint32
 }
 
-func (u *udpConn) PrepareRawMessages(n int) ([]rawMessage, [][]byte, [][]byte) {
+// PrepareRawMessages allocates n messages with buffers of bufSize bytes for recvmmsg. If controlLen is non zero each
+// message is also given a control buffer, these must be reset with setControl before every read.
+func (u *udpConn) PrepareRawMessages(n, bufSize, controlLen int) ([]rawMessage, [][]byte, [][]byte, [][]byte) {
 	msgs := make([]rawMessage, n)
 	buffers := make([][]byte, n)
 	names := make([][]byte, n)
+	controls := make([][]byte, n)
 
 	for i := range msgs {
-		buffers[i] = make([]byte, mtu)
+		buffers[i] = make([]byte, bufSize)
 		names[i] = make([]byte, unix.SizeofSockaddrInet6)
 
 		//TODO: this is still silly, no need for an array
@@ -43,12 +46,37 @@ func (u *udpConn) PrepareRawMessages(n int) ([]rawMessage, [][]byte, [][]byte) {
 			{Base: &buffers[i][0], Len: uint32(len(buffers[i]))},
 		}
 
-		msgs[i].Hdr.Iov = &vs[0]
-		msgs[i].Hdr.Iovlen = uint32(len(vs))
+		msgs[i].Hdr.setIov(vs)
 
 		msgs[i].Hdr.Name = &names[i][0]
 		msgs[i].Hdr.Namelen = uint32(len(names[i]))
+
+		if controlLen > 0 {
+			controls[i] = make([]byte, controlLen)
+			msgs[i].Hdr.setControl(controls[i])
+		}
+	}
+
+	return msgs, buffers, names, controls
+}
+
+func (v *iovec) set(b []byte) {
+	v.Base = &b[0]
+	v.Len = uint32(len(b))
+}
+
+func (m *msghdr) setIov(vs []iovec) {
+	m.Iov = &vs[0]
+	m.Iovlen = uint32(len(vs))
+}
+
+func (m *msghdr) setControl(b []byte) {
+	if len(b) == 0 {
+		m.Control = nil
+		m.Controllen = 0
+		return
 	}
 
-	return msgs, buffers, names
+	m.Control = &b[0]
+	m.Controllen = uint32(len(b))
 }
@@ -0,0 +1,206 @@
+// +build !android
+// +build !e2e_testing
+
+package nebula
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func TestUdpConn_WriteBatch(t *testing.T) {
+	l := NewTestLogger()
+	tx, err := NewListener(l, "127.0.0.1", 0, false)
+	assert.Nil(t, err)
+	rx, err := NewListener(l, "127.0.0.1", 0, false)
+	assert.Nil(t, err)
+
+	rxAddr, err := rx.LocalAddr()
+	assert.Nil(t, err)
+	to := NewUDPAddr(net.ParseIP("127.0.0.1"), rxAddr.Port)
+
+	// 3 full segments and a short one to the same destination can be sent as a single gso message
+	bufs := [][]byte{
+		bytes.Repeat([]byte{1}, 100),
+		bytes.Repeat([]byte{2}, 100),
+		bytes.Repeat([]byte{3}, 100),
+		bytes.Repeat([]byte{4}, 10),
+	}
+	addrs := []*udpAddr{to, to, to, to}
+
+	for _, gso := range []bool{false, tx.gsoSupported} {
+		tx.setGSO(gso)
+		assert.Nil(t, tx.WriteBatch(bufs, addrs))
+
+		msgs, buffers, _, _ := rx.PrepareRawMessages(len(bufs), mtu, 0)
+		got := 0
+		for got < len(bufs) {
+			n, err := rx.ReadMulti(msgs[got:])
+			assert.Nil(t, err)
+			for i := got; i < got+n; i++ {
+				assert.Equal(t, bufs[i], buffers[i][:msgs[i].Len], "gso: %v", gso)
+			}
+			got += n
+		}
+	}
+}
+
+func TestUdpConn_WriteBatchSkipsFailures(t *testing.T) {
+	l := NewTestLogger()
+	tx, err := NewListener(l, "127.0.0.1", 0, false)
+	assert.Nil(t, err)
+	rx, err := NewListener(l, "127.0.0.1", 0, false)
+	assert.Nil(t, err)
+
+	rxAddr, err := rx.LocalAddr()
+	assert.Nil(t, err)
+	to := NewUDPAddr(net.ParseIP("127.0.0.1"), rxAddr.Port)
+	// A socket bound to loopback can not send anywhere else
+	bad := NewUDPAddr(net.ParseIP("192.0.2.1"), 4242)
+
+	// Fail instead of blocking forever if a packet is missing
+	assert.Nil(t, unix.SetsockoptTimeval(rx.sysFd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &unix.Timeval{Sec: 1}))
+
+	bufs := [][]byte{{1}, {2}, {3}, {4}}
+	addrs := []*udpAddr{to, bad, bad, to}
+
+	for _, gso := range []bool{false, tx.gsoSupported} {
+		tx.setGSO(gso)
+		assert.Error(t, tx.WriteBatch(bufs, addrs))
+
+		// The packets around the failing destination are still sent
+		msgs, buffers, _, _ := rx.PrepareRawMessages(2, mtu, 0)
+		got := 0
+		for got < 2 {
+			n, err := rx.ReadMulti(msgs[got:])
+			if !assert.Nil(t, err) {
+				t.FailNow()
+			}
+			got += n
+		}
+		assert.Equal(t, bufs[0], buffers[0][:msgs[0].Len], "gso: %v", gso)
+		assert.Equal(t, bufs[3], buffers[1][:msgs[1].Len], "gso: %v", gso)
+	}
+}
+
+func TestUdpConn_WriteToDontFragment(t *testing.T) {
+	l := NewTestLogger()
+	tx, err := NewListener(l, "127.0.0.1", 0, false)
+	assert.Nil(t, err)
+	rx, err := NewListener(l, "127.0.0.1", 0, false)
+	assert.Nil(t, err)
+
+	rxAddr, err := rx.LocalAddr()
+	assert.Nil(t, err)
+	to := NewUDPAddr(net.ParseIP("127.0.0.1"), rxAddr.Port)
+
+	assertMTUDiscover := func(v4, v6 int) {
+		v, err := unix.GetsockoptInt(tx.sysFd, unix.IPPROTO_IP, unix.IP_MTU_DISCOVER)
+		assert.Nil(t, err)
+		assert.Equal(t, v4, v)
+		v, err = unix.GetsockoptInt(tx.sysFd, unix.IPPROTO_IPV6, unix.IPV6_MTU_DISCOVER)
+		assert.Nil(t, err)
+		assert.Equal(t, v6, v)
+	}
+
+	v4, err := unix.GetsockoptInt(tx.sysFd, unix.IPPROTO_IP, unix.IP_MTU_DISCOVER)
+	assert.Nil(t, err)
+	v6, err := unix.GetsockoptInt(tx.sysFd, unix.IPPROTO_IPV6, unix.IPV6_MTU_DISCOVER)
+	assert.Nil(t, err)
+	assert.NotEqual(t, unix.IP_PMTUDISC_PROBE, v4)
+
+	assert.Error(t, tx.WriteToDontFragment([]byte{1}, to))
+
+	// Every other packet is left to the kernel, only probes set the DF bit
+	assert.Nil(t, tx.SetDontFragment())
+	assertMTUDiscover(v4, v6)
+
+	assert.Nil(t, tx.WriteToDontFragment([]byte{1}, to))
+	assertMTUDiscover(v4, v6)
+
+	msgs, buffers, _, _ := rx.PrepareRawMessages(1, mtu, 0)
+	n, err := rx.ReadMulti(msgs)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, []byte{1}, buffers[0][:msgs[0].Len])
+}
+
+func BenchmarkUdpConn_WriteBatch(b *testing.B) {
+	l := NewTestLogger()
+	tx, err := NewListener(l, "127.0.0.1", 0, false)
+	assert.Nil(b, err)
+	defer tx.Close()
+	rx, err := NewListener(l, "127.0.0.1", 0, false)
+	assert.Nil(b, err)
+
+	rxAddr, err := rx.LocalAddr()
+	assert.Nil(b, err)
+	to := NewUDPAddr(net.ParseIP("127.0.0.1"), rxAddr.Port)
+
+	// A full batch of tunnel sized packets to one host, as listenInBatch builds them
+	bufs := make([][]byte, 64)
+	addrs := make([]*udpAddr, len(bufs))
+	for i := range bufs {
+		bufs[i] = make([]byte, 1200)
+		addrs[i] = to
+	}
+
+	// Keep the receive buffer drained until the benchmark is over, reads time out so the stop is noticed
+	assert.Nil(b, unix.SetsockoptTimeval(rx.sysFd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &unix.Timeval{Usec: 100000}))
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		msgs, _, _, _ := rx.PrepareRawMessages(len(bufs), mtu, 0)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				_, _ = rx.ReadMulti(msgs)
+			}
+		}
+	}()
+
+	for _, gso := range []bool{false, true} {
+		b.Run(fmt.Sprintf("gso=%v", gso), func(b *testing.B) {
+			if gso && !tx.gsoSupported {
+				b.Skip("the kernel does not support gso")
+			}
+			tx.setGSO(gso)
+
+			b.SetBytes(int64(len(bufs) * len(bufs[0])))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := tx.WriteBatch(bufs, addrs); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+
+	close(stop)
+	<-done
+	rx.Close()
+}
+
+func Test_groSegmentSize(t *testing.T) {
+	assert.Equal(t, 0, groSegmentSize(nil))
+
+	control := make([]byte, unix.CmsgSpace(4))
+	setGSOSize(control, 1200)
+	// a UDP_SEGMENT message is not a UDP_GRO message
+	assert.Equal(t, 0, groSegmentSize(control))
+
+	h := (*unix.Cmsghdr)(unsafe.Pointer(&control[0]))
+	h.Type = _UDP_GRO
+	h.SetLen(unix.CmsgLen(4))
+	*(*int32)(unsafe.Pointer(&control[unix.CmsgLen(0)])) = 1200
+	assert.Equal(t, 1200, groSegmentSize(control))
+}
@@ -4,7 +4,9 @@ package nebula
 
 import (
 	"net"
+	"syscall"
 
+	"github.com/rcrowley/go-metrics"
 	"github.com/sirupsen/logrus"
 )
 
@@ -40,6 +42,9 @@ type udpConn struct {
 	l *logrus.Logger
 }
 
+// testPathMTU is the largest udp payload that fits on an ipv6 path with the minimum 1280 byte mtu
+const testPathMTU = 1280 - 40 - 8
+
 func NewListener(l *logrus.Logger, ip string, port int, _ bool) (*udpConn, error) {
 	return &udpConn{
 		addr:      &udpAddr{net.ParseIP(ip), uint16(port)},
@@ -94,6 +99,16 @@ func (u *udpConn) WriteTo(b []byte, addr *udpAddr) error {
 	return nil
 }
 
+func (u *udpConn) WriteBatch(bufs [][]byte, addrs []*udpAddr) error {
+	var firstErr error
+	for i, b := range bufs {
+		if err := u.WriteTo(b, addrs[i]); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
 func (u *udpConn) ListenOut(f *Interface, q int) {
 	plaintext := make([]byte, mtu)
 	header := &Header{}
@@ -114,7 +129,7 @@ func (u *udpConn) ListenOut(f *Interface, q int) {
 
 func (u *udpConn) reloadConfig(*Config) {}
 
-func NewUDPStatsEmitter(_ []*udpConn) func() {
+func NewUDPStatsEmitter(_ []*udpConn, _ metrics.Registry) func() {
 	// No UDP stats for non-linux
 	return func() {}
 }
@@ -123,10 +138,27 @@ func (u *udpConn) LocalAddr() (*udpAddr, error) {
 	return u.addr, nil
 }
 
+func (u *udpConn) Close() error {
+	return nil
+}
+
 func (u *udpConn) Rebind() error {
 	return nil
 }
 
+func (u *udpConn) SetDontFragment() error {
+	return nil
+}
+
+// WriteToDontFragment refuses packets that would not fit in testPathMTU, like the kernel does on a real path
+func (u *udpConn) WriteToDontFragment(b []byte, addr *udpAddr) error {
+	if len(b) > testPathMTU {
+		return &net.OpError{Op: "sendto", Err: syscall.EMSGSIZE}
+	}
+
+	return u.WriteTo(b, addr)
+}
+
 func hostDidRoam(addr *udpAddr, newaddr *udpAddr) bool {
 	return !addr.Equals(newaddr)
 }